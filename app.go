@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+	"tronicscorp/cache"
+	"tronicscorp/changes"
+	"tronicscorp/config"
+	"tronicscorp/correlation"
+	"tronicscorp/dbiface"
+	"tronicscorp/events"
+	"tronicscorp/graph"
+	"tronicscorp/handlers"
+	"tronicscorp/idempotency"
+	"tronicscorp/logging"
+	"tronicscorp/metrics"
+	"tronicscorp/migrations"
+	"tronicscorp/openapi"
+	"tronicscorp/outbox"
+	"tronicscorp/problem"
+	"tronicscorp/rpc"
+	"tronicscorp/tenant"
+	"tronicscorp/tracing"
+	"tronicscorp/webhooks"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/grpc"
+)
+
+// eventHistory is the number of events kept for the streams to resume.
+const eventHistory = 1000
+
+// App owns the HTTP server, the database client and the background workers.
+// Workers are started in registration order and stopped in reverse order,
+// after the server has drained and before the database is disconnected.
+type App struct {
+	cfg     *config.Manager
+	client  *mongo.Client
+	db      *mongo.Database
+	echo    *echo.Echo
+	rules   *handlers.RulesStore
+	tenants *tenant.Registry
+	events  *events.Bus
+	streams chan struct{}
+	api     *openapi.Spec
+	legacy  map[string]string
+	// rateGroups maps "METHOD path" to the rate limit group of the route.
+	rateGroups map[string]string
+	redis      *redis.Client
+	workers    []*worker
+	draining   atomic.Bool
+	started    time.Time
+
+	stopTracing func(context.Context) error
+	logLevel    *slog.LevelVar
+}
+
+type worker struct {
+	name   string
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewApp connects to the database, applies the pending migrations and
+// registers the routes. It does not start serving.
+func NewApp(mgr *config.Manager) (_ *App, err error) {
+	cfg := mgr.Current()
+	a := &App{cfg: mgr, echo: echo.New(), started: time.Now(), logLevel: new(slog.LevelVar), api: newSpec(), events: events.NewBus(eventHistory), streams: make(chan struct{})}
+	a.echo.HideBanner = true
+	a.logLevel.Set(logging.ParseLevel(cfg.LogLevel))
+	slog.SetDefault(logging.New(os.Stdout, logging.Options{
+		Format:           cfg.LogFormat,
+		Level:            a.logLevel,
+		SampleFirst:      10,
+		SampleThereafter: 100,
+		SampleTick:       time.Second,
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.StartupTimeout)
+	defer cancel()
+	stopTracing, err := tracing.Setup(ctx, tracing.Options{
+		ServiceName:    "tronicscorp",
+		ServiceVersion: version,
+		Exporter:       cfg.TracingExporter,
+		OTLPEndpoint:   cfg.OTLPEndpoint,
+		OTLPInsecure:   cfg.OTLPInsecure,
+		SampleRatio:    cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up tracing: %w", err)
+	}
+	a.stopTracing = stopTracing
+	// A later step failing releases the exporter and the database client.
+	defer func() {
+		if err != nil {
+			a.stopTracing(context.Background())
+			a.disconnect(context.Background())
+		}
+	}()
+	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(connectURI))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	a.client = client
+	if err := client.Ping(ctx, nil); err != nil {
+		return nil, fmt.Errorf("unable to reach database: %w", err)
+	}
+	a.db = client.Database(cfg.DBName)
+	if err := migrations.Apply(ctx, a.db, cfg); err != nil {
+		return nil, err
+	}
+	rules, err := handlers.LoadProductRules(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	a.rules = handlers.NewRulesStore(a.collection(cfg.RulesCollection), rules)
+	if err := a.rules.Refresh(ctx); err != nil {
+		return nil, fmt.Errorf("unable to load the product rules: %w", err)
+	}
+	a.tenants, err = tenant.Load(cfg.TenantsFile, cfg.DefaultTenant)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.routes(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *App) routes() error {
+	cfg := a.cfg.Current()
+	e := a.echo
+	e.HTTPErrorHandler = handlers.HTTPErrorHandler
+	tokens := handlers.NewTokenIssuer(cfg.JwtTokenSecret)
+	limits := &reloadableLimits{}
+	origins := &reloadableOrigins{}
+	a.cfg.Subscribe(func(p config.Properties) {
+		applyRuntimeConfig(p, a.logLevel, limits, origins)
+		tokens.SetSecret(p.JwtTokenSecret)
+	})
+	a.Go("config watcher", func(ctx context.Context) error {
+		a.cfg.Watch(ctx, 5*time.Second)
+		return nil
+	})
+
+	e.Pre(middleware.RemoveTrailingSlash())
+	e.Pre(correlation.Middleware)
+	jwtAuth := middleware.JWTWithConfig(middleware.JWTConfig{
+		KeyFunc:     tokens.Keyfunc,
+		TokenLookup: "header:x-auth-token:Bearer ",
+	})
+	jwtMiddleware := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return jwtAuth(withUser(next))
+	}
+	// optionalJWT checks the token of requests sending one.
+	optionalJWT := func(next echo.HandlerFunc) echo.HandlerFunc {
+		authenticated := jwtMiddleware(next)
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("x-auth-token") == "" {
+				return next(c)
+			}
+			return authenticated(c)
+		}
+	}
+	e.Use(tracing.Middleware)
+	e.Use(metrics.Middleware)
+	e.Use(logging.Middleware(slog.Default(), isProbe))
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: origins.allow,
+		ExposeHeaders: []string{"x-auth-token", correlation.Header,
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"},
+	}))
+	e.IPExtractor = ipExtractor(cfg.TrustedProxies)
+	a.rateGroups = map[string]string{}
+	e.Use(tenant.Middleware(tenant.Config{
+		Skipper:  isProbe,
+		Registry: a.tenants,
+		Claims: func(c echo.Context) jwt.MapClaims {
+			return tokenClaims(c, tokens)
+		},
+	}))
+	// After the tenant middleware: the buckets of the users are those of
+	// their tenant.
+	e.Use(a.rateLimiter(cfg, limits, tokens, isProbe))
+	operator := operatorOnly(a.tenants)
+	a.legacy = map[string]string{}
+	deprecated, _ := time.Parse(time.DateOnly, cfg.LegacyDeprecated)
+	sunset, _ := time.Parse(time.DateOnly, cfg.LegacySunset)
+	e.Use(deprecation(a.legacy, deprecated, sunset))
+	e.Use(a.api.Validator(openapi.ValidatorConfig{
+		Skipper:     isProbe,
+		MaxBodySize: 1 << 20,
+		Responses:   cfg.Profile != config.ProfileProd,
+		Error:       handlers.SchemaProblem,
+	}))
+	products := a.collection(cfg.ProductCollection)
+	users := a.collection(cfg.UsersCollection)
+	// The handlers only see the products, users and categories of the
+	// request tenant.
+	tenantProducts, tenantUsers := tenant.Scope(products), tenant.Scope(users)
+	categories := tenant.Scope(a.collection(cfg.CategoriesCollection))
+	a.Go("catalog metrics", func(ctx context.Context) error {
+		return metrics.RefreshCatalog(ctx, products, time.Minute)
+	})
+	a.Go("product rules", func(ctx context.Context) error {
+		return a.rules.Watch(ctx, 30*time.Second)
+	})
+	dispatcher := &webhooks.Dispatcher{
+		Webhooks:    a.collection(cfg.WebhooksCollection),
+		Deliveries:  a.collection(cfg.DeliveriesCollection),
+		Client:      &http.Client{Timeout: cfg.WebhookTimeout},
+		MaxAttempts: cfg.WebhookMaxAttempts,
+	}
+	// The outbox relays the events to the dispatcher, which only sends them.
+	a.Go("webhooks", func(ctx context.Context) error {
+		return dispatcher.Run(ctx, nil)
+	})
+	productCache := a.productCache(cfg)
+	ob := &outbox.Outbox{
+		Col:    a.collection(cfg.OutboxCollection),
+		Sinks:  a.outboxSinks(cfg, dispatcher),
+		Decode: handlers.DecodeEventData,
+	}
+	if cfg.Transactions {
+		ob.Tx = outbox.MongoTransactor{Client: a.client}
+	}
+	a.Go("outbox relay", ob.Relay)
+	listener := &changes.Listener{
+		Sources: []changes.Source{
+			{Name: cfg.ProductCollection, Col: products, Watcher: a.db.Collection(cfg.ProductCollection), Translate: handlers.ProductEvent},
+			{Name: cfg.UsersCollection, Col: users, Watcher: a.db.Collection(cfg.UsersCollection), Translate: handlers.UserEvent},
+		},
+		Tokens: a.collection(cfg.ChangeTokensCollection),
+		Outbox: ob,
+		Poll:   cfg.ChangePoll,
+	}
+	a.Go("change listener", listener.Run)
+	h := &handlers.ProductHandler{Col: tenantProducts, Rules: a.rules, Events: a.events, Outbox: ob, Cache: productCache, MaxAge: cfg.CacheMaxAge,
+		Categories: categories}
+	if productCache != nil {
+		a.Go("product cache", func(ctx context.Context) error {
+			return h.InvalidateOnEvents(ctx, a.events)
+		})
+	}
+	rh := &handlers.RulesHandler{Store: a.rules, Products: products, Tenants: a.tenants, Categories: categories}
+	uh := &handlers.UsersHandler{
+		Col:     tenantUsers,
+		Tokens:  tokens,
+		Lockout: handlers.NewLockout(cfg.LoginMaxFailures, cfg.LoginLockout),
+		Events:  a.events,
+		Outbox:  ob,
+	}
+	wh := &handlers.WebhooksHandler{Dispatcher: dispatcher}
+	oh := &handlers.OutboxHandler{Outbox: ob}
+	readTimeout := middleware.ContextTimeout(cfg.ReadTimeout)
+	idempotent := idempotency.Middleware(idempotency.Config{
+		Col: a.collection(cfg.IdempotencyCollection),
+		TTL: cfg.IdempotencyTTL,
+		// A request holds its key until it times out, and a margin more.
+		Lock:  2 * cfg.WriteTimeout,
+		Scope: keyScope,
+	})
+	writeTimeout := middleware.ContextTimeout(cfg.WriteTimeout)
+	h2 := &handlers.ProductHandler{Col: tenantProducts, Rules: a.rules, Representation: handlers.ProductV2, Events: a.events, Outbox: ob,
+		Cache: productCache, MaxAge: cfg.CacheMaxAge, Categories: categories}
+	ch := &handlers.CategoriesHandler{Col: categories, Products: h}
+	ch2 := &handlers.CategoriesHandler{Col: categories, Products: h2}
+	sh := &handlers.StreamHandler{Events: a.events, AllowOrigin: origins.allow, Done: a.streams}
+	sh2 := &handlers.StreamHandler{Events: a.events, Representation: handlers.ProductV2, AllowOrigin: origins.allow, Done: a.streams}
+	objectID := openapi.ObjectID()
+	slug := &openapi.Schema{Type: "string", Pattern: handlers.SlugPattern}
+	text := &openapi.Schema{Type: "string"}
+	deliveryStatus := &openapi.Schema{Type: "string", Enum: []interface{}{webhooks.StatusPending, webhooks.StatusSucceeded, webhooks.StatusDead}}
+	outboxStatus := &openapi.Schema{Type: "string", Enum: []interface{}{"pending", "dispatched"}}
+	minLimit, maxLimit := float64(1), float64(200)
+	maxKey := idempotency.MaxKeyLength
+	idempotencyKey := &openapi.Schema{Type: "string", MaxLength: &maxKey}
+	idempotencyDoc := "Processes the request once, retries getting the stored response. See docs/idempotency.md."
+	deliveryLimit := &openapi.Schema{Type: "integer", Minimum: &minLimit, Maximum: &maxLimit}
+	a.register([]apiVersion{
+		{prefix: "/v1", product: handlers.Product{}, products: []handlers.Product{}},
+		{prefix: "/v2", suffix: "V2", product: handlers.ProductV2Body{}, products: []handlers.ProductV2Body{}},
+	}, []endpoint{
+		{id: "GetProduct", group: groupProducts, method: http.MethodGet, path: "/products/:id", legacy: "/product/:id",
+			v1: h.GetProduct, v2: h2.GetProduct, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get a product").Tags("products").Param("id", objectID).
+					Returns(http.StatusOK, v.product).Header("Cache-Control", "How long the product may be kept, see docs/caching.md").
+					Errors(http.StatusBadRequest, http.StatusNotFound)
+			}},
+		{id: "DeleteProduct", group: groupProducts, method: http.MethodDelete, path: "/products/:id", legacy: "/product/:id",
+			v1: h.DeleteProduct, v2: h2.DeleteProduct, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Delete a product").Description("Returns the number of deleted products.").Tags("products").
+					Secured().Param("id", objectID).Returns(http.StatusOK, int64(0)).Errors(http.StatusBadRequest, http.StatusForbidden)
+			}},
+		{id: "UpdateProduct", group: groupProducts, method: http.MethodPut, path: "/products/:id", legacy: "/products/:id",
+			v1: h.UpdateProduct, v2: h2.UpdateProduct, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("1M"), jwtMiddleware, idempotent, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Update a product").Tags("products").Secured().Param("id", objectID).
+					HeaderParam(idempotency.Header, idempotencyDoc, idempotencyKey).PartialBody(v.product).
+					Returns(http.StatusOK, v.product).Errors(http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity)
+			}},
+		{id: "CreateProducts", group: groupProducts, method: http.MethodPost, path: "/products", legacy: "/products",
+			v1: h.CreateProducts, v2: h2.CreateProducts, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("1M"), jwtMiddleware, idempotent, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Create products").Description("Returns the ids of the created products.").Tags("products").
+					Secured().HeaderParam(idempotency.Header, idempotencyDoc, idempotencyKey).Body(v.products).
+					Returns(http.StatusCreated, []primitive.ObjectID{}).Errors(http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity)
+			}},
+		{id: "GetProducts", group: groupProducts, method: http.MethodGet, path: "/products", legacy: "/products",
+			v1: h.GetProducts, v2: h2.GetProducts, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List products").Description("Query parameters filter on equality.").Tags("products").
+					Query(v.product).Returns(http.StatusOK, v.products).Header("Cache-Control", "How long the products may be kept, see docs/caching.md").
+					Errors(http.StatusBadRequest)
+			}},
+		{id: "StreamProducts", group: groupProducts, method: http.MethodGet, path: "/products/stream",
+			v1: sh.StreamProducts, v2: sh2.StreamProducts,
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Stream the product changes").
+					Description("Server-Sent Events, or JSON messages over a WebSocket when the request asks for an upgrade. "+
+						"Send the Last-Event-ID header, or last_event_id, to resume. See docs/streaming.md.").Tags("products").
+					QueryParam("vendor", "Only the changes of the products of this vendor", text).
+					QueryParam("id", "Only the changes of this product", objectID).
+					QueryParam("last_event_id", "Resume after this event", text).
+					ReturnsAs(http.StatusOK, "text/event-stream", openapi.Text()).Errors(http.StatusBadRequest)
+			}},
+		{id: "ListCategories", method: http.MethodGet, path: "/categories",
+			v1: ch.ListCategories, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get the category tree").Description("The root categories with their descendants, in order. See docs/categories.md.").
+					Tags("categories").Returns(http.StatusOK, []handlers.Category{})
+			}},
+		{id: "CreateCategory", method: http.MethodPost, path: "/categories",
+			v1: ch.CreateCategory, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Create a category").Description("Under parent, or as a root when it has none.").
+					Tags("categories").Secured().Body(handlers.Category{}).Returns(http.StatusCreated, handlers.Category{}).
+					Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusConflict)
+			}},
+		{id: "GetCategory", method: http.MethodGet, path: "/categories/:slug",
+			v1: ch.GetCategory, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get a category").Description("With its descendants.").Tags("categories").Param("slug", slug).
+					Returns(http.StatusOK, handlers.Category{}).Errors(http.StatusBadRequest, http.StatusNotFound)
+			}},
+		{id: "UpdateCategory", method: http.MethodPut, path: "/categories/:slug",
+			v1: ch.UpdateCategory, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Update a category").Description("Replaces its name, position and attributes; move it to change its parent.").
+					Tags("categories").Secured().Param("slug", slug).Body(handlers.CategoryUpdate{}).
+					Returns(http.StatusOK, handlers.Category{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "DeleteCategory", method: http.MethodDelete, path: "/categories/:slug",
+			v1: ch.DeleteCategory, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Delete a category").Description("Only without subcategories nor products; merge it otherwise.").
+					Tags("categories").Secured().Param("slug", slug).Returns(http.StatusNoContent, nil).
+					Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict)
+			}},
+		{id: "MoveCategory", method: http.MethodPost, path: "/categories/:slug/move",
+			v1: ch.MoveCategory, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Move a category").Description("Moves it with its descendants under parent, or to the roots.").
+					Tags("categories").Secured().Param("slug", slug).Body(handlers.CategoryMove{}).
+					Returns(http.StatusOK, handlers.Category{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict)
+			}},
+		{id: "MergeCategory", method: http.MethodPost, path: "/categories/:slug/merge",
+			v1: ch.MergeCategory, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Merge a category").
+					Description("Moves its products and subcategories to the category into, then deletes it. Returns the category into.").
+					Tags("categories").Secured().Param("slug", slug).Body(handlers.CategoryMerge{}).
+					Returns(http.StatusOK, handlers.Category{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict)
+			}},
+		{id: "GetCategoryProducts", group: groupProducts, method: http.MethodGet, path: "/categories/:slug/products",
+			v1: ch.GetCategoryProducts, v2: ch2.GetCategoryProducts, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List the products of a category").
+					Description("Includes the products of its descendants, with the attributes inherited from their categories.").
+					Tags("categories").Param("slug", slug).Returns(http.StatusOK, v.products).Errors(http.StatusBadRequest, http.StatusNotFound)
+			}},
+		{id: "GetProductRules", method: http.MethodGet, path: "/rules/products", legacy: "/rules/products",
+			v1: rh.GetProductRules, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get the product rules").Tags("rules").Secured().
+					Returns(http.StatusOK, handlers.ProductRules{}).Errors(http.StatusForbidden)
+			}},
+		{id: "UpdateProductRules", method: http.MethodPut, path: "/rules/products", legacy: "/rules/products",
+			v1: rh.UpdateProductRules, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("1M"), jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Replace the product rules").Description("version is the one the rules were read at, 0 before any is saved; a newer stored version gives 409. With dry_run=true, only reports the stored products the rules would reject.").
+					Tags("rules").Secured().QueryParam("dry_run", "Only report, do not save", &openapi.Schema{Type: "boolean"}).
+					Body(handlers.ProductRules{}).Returns(http.StatusOK, handlers.RulesReport{}).
+					Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusConflict)
+			}},
+		{id: "CreateWebhook", method: http.MethodPost, path: "/webhooks",
+			v1: wh.CreateWebhook, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Subscribe to events").Description("The response is the only one holding the signing secret. See docs/webhooks.md.").
+					Tags("webhooks").Secured().Body(webhooks.Subscription{}).Returns(http.StatusCreated, webhooks.Subscription{}).
+					Errors(http.StatusBadRequest, http.StatusForbidden)
+			}},
+		{id: "ListWebhooks", method: http.MethodGet, path: "/webhooks",
+			v1: wh.ListWebhooks, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List the webhooks").Tags("webhooks").Secured().
+					Returns(http.StatusOK, []webhooks.Subscription{}).Errors(http.StatusForbidden)
+			}},
+		{id: "ListAllDeliveries", method: http.MethodGet, path: "/webhooks/deliveries",
+			v1: wh.ListDeliveries, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List the latest deliveries").Description("status=dead lists the dead letters.").
+					Tags("webhooks").Secured().QueryParam("status", "Only the deliveries in this status", deliveryStatus).
+					QueryParam("limit", "Number of deliveries, 50 by default", deliveryLimit).
+					Returns(http.StatusOK, []webhooks.Delivery{}).Errors(http.StatusBadRequest, http.StatusForbidden)
+			}},
+		{id: "Redeliver", method: http.MethodPost, path: "/webhooks/deliveries/:id/redeliver",
+			v1: wh.Redeliver, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Retry a delivery").Description("Queues a delivery, typically a dead letter, for one more attempt.").
+					Tags("webhooks").Secured().Param("id", objectID).Returns(http.StatusAccepted, nil).
+					Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "GetWebhook", method: http.MethodGet, path: "/webhooks/:id",
+			v1: wh.GetWebhook, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get a webhook").Tags("webhooks").Secured().Param("id", objectID).
+					Returns(http.StatusOK, webhooks.Subscription{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "UpdateWebhook", method: http.MethodPut, path: "/webhooks/:id",
+			v1: wh.UpdateWebhook, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Replace a webhook").Description("The secret is only replaced when one is given.").
+					Tags("webhooks").Secured().Param("id", objectID).Body(webhooks.Subscription{}).
+					Returns(http.StatusOK, webhooks.Subscription{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "DeleteWebhook", method: http.MethodDelete, path: "/webhooks/:id",
+			v1: wh.DeleteWebhook, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Delete a webhook").Tags("webhooks").Secured().Param("id", objectID).
+					Returns(http.StatusNoContent, nil).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "PingWebhook", method: http.MethodPost, path: "/webhooks/:id/ping",
+			v1: wh.PingWebhook, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Send a test event").Description("Queues a webhook.ping delivery to the webhook.").
+					Tags("webhooks").Secured().Param("id", objectID).Returns(http.StatusAccepted, webhooks.Delivery{}).
+					Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "ListDeliveries", method: http.MethodGet, path: "/webhooks/:id/deliveries",
+			v1: wh.ListDeliveries, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List the deliveries of a webhook").Description("Latest first, with the log of their attempts.").
+					Tags("webhooks").Secured().Param("id", objectID).
+					QueryParam("status", "Only the deliveries in this status", deliveryStatus).
+					QueryParam("limit", "Number of deliveries, 50 by default", deliveryLimit).
+					Returns(http.StatusOK, []webhooks.Delivery{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "ListOutbox", method: http.MethodGet, path: "/outbox",
+			v1: oh.ListOutbox, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("List the outbox entries").Description("Latest first. See docs/outbox.md.").
+					Tags("outbox").Secured().QueryParam("status", "Only the entries in this status", outboxStatus).
+					QueryParam("type", "Only the events of this type", text).
+					QueryParam("limit", "Number of entries, 50 by default", deliveryLimit).
+					Returns(http.StatusOK, []handlers.OutboxEntry{}).Errors(http.StatusBadRequest, http.StatusForbidden)
+			}},
+		{id: "ReplayOutbox", method: http.MethodPost, path: "/outbox/replay",
+			v1: oh.ReplayOutbox, middleware: []echo.MiddlewareFunc{middleware.BodyLimit("64K"), jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Replay events").Description("Relays again the events of a time range, dispatched or not, with their original ids.").
+					Tags("outbox").Secured().Body(handlers.ReplayRequest{}).Returns(http.StatusAccepted, handlers.ReplayResult{}).
+					Errors(http.StatusBadRequest, http.StatusForbidden)
+			}},
+		{id: "GetOutboxEntry", method: http.MethodGet, path: "/outbox/:id",
+			v1: oh.GetOutboxEntry, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Get an outbox entry").Tags("outbox").Secured().Param("id", objectID).
+					Returns(http.StatusOK, handlers.OutboxEntry{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "ReplayOutboxEntry", method: http.MethodPost, path: "/outbox/:id/replay",
+			v1: oh.ReplayOutboxEntry, middleware: []echo.MiddlewareFunc{jwtMiddleware, adminMiddleware, operator, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Replay an event").Tags("outbox").Secured().Param("id", objectID).
+					QueryParam("sink", "Only to this sink; repeat for several. Every sink by default", text).
+					Returns(http.StatusAccepted, handlers.OutboxEntry{}).Errors(http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound)
+			}},
+		{id: "CreateUser", group: groupAuth, method: http.MethodPost, path: "/users", legacy: "/users",
+			v1: uh.CreateUser, middleware: []echo.MiddlewareFunc{idempotent, writeTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Sign up").Tags("users").HeaderParam(idempotency.Header, idempotencyDoc, idempotencyKey).Body(handlers.User{}).
+					Returns(http.StatusCreated, handlers.User{}).Header("x-auth-token", "Bearer token of the new user").
+					Errors(http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity)
+			}},
+		{id: "AuthnUser", group: groupAuth, method: http.MethodPost, path: "/auth", legacy: "/auth",
+			v1: uh.AuthnUser, middleware: []echo.MiddlewareFunc{readTimeout},
+			doc: func(v apiVersion) *openapi.Doc {
+				return openapi.Describe("Log in").Tags("users").Body(handlers.User{}).
+					Returns(http.StatusOK, handlers.User{}).Header("x-auth-token", "Bearer token to send back in x-auth-token").
+					Errors(http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusTooManyRequests)
+			}},
+	})
+
+	gh, err := graph.New(h)
+	if err != nil {
+		return fmt.Errorf("graphql schema: %w", err)
+	}
+	a.api.Route(e.POST("/graphql", gh.Serve, middleware.BodyLimit("1M"), optionalJWT, writeTimeout),
+		openapi.Describe("Run a GraphQL query").
+			Description("Products, users and product mutations, see docs/graphql.md. Mutations need a token, sent as for the REST API.").
+			Tags("graphql").Body(graph.Request{}).Returns(http.StatusOK, openapi.Object()).Errors(http.StatusBadRequest))
+
+	grpcServer := rpc.NewServer(&rpc.CatalogServer{Products: h, Events: a.events}, tokens.Keyfunc, a.tenants)
+	a.Go("grpc server", func(ctx context.Context) error {
+		return serveGRPC(ctx, grpcServer, net.JoinHostPort(cfg.Host, cfg.GRPCPort), cfg.ShutdownTimeout)
+	})
+
+	hh := &handlers.HealthHandler{
+		Checks:   a.checks(),
+		Draining: a.draining.Load,
+		Version:  version,
+		Started:  a.started,
+		Profile:  func() string { return a.cfg.Current().Profile },
+		Timeout:  2 * time.Second,
+	}
+	api := a.api
+	api.Route(e.GET("/healthz", hh.Liveness),
+		openapi.Describe("Liveness probe").Tags("operations").Returns(http.StatusOK, openapi.Object()))
+	api.Route(e.GET("/readyz", hh.Readiness),
+		openapi.Describe("Readiness probe").Tags("operations").Returns(http.StatusOK, openapi.Object()).
+			Returns(http.StatusServiceUnavailable, openapi.Object()))
+	api.Route(e.GET("/status", hh.Status, jwtMiddleware, adminMiddleware, operator),
+		openapi.Describe("Service status").Tags("operations").Secured().
+			Returns(http.StatusOK, openapi.Object()).Errors(http.StatusForbidden))
+	api.Route(e.GET("/metrics", metrics.Handler()),
+		openapi.Describe("Prometheus metrics").ID("Metrics").Tags("operations").
+			ReturnsAs(http.StatusOK, "text/plain", openapi.Text()))
+	api.Route(e.GET("/openapi.json", api.Handler),
+		openapi.Describe("This document").ID("OpenAPI").Tags("operations").Returns(http.StatusOK, openapi.Object()))
+	api.Route(e.GET("/docs", openapi.UI("Tronics API", "/openapi.json")),
+		openapi.Describe("API documentation page").ID("Docs").Tags("operations").
+			ReturnsAs(http.StatusOK, echo.MIMETextHTML, openapi.Text()))
+	return nil
+}
+
+func newSpec() *openapi.Spec {
+	return openapi.New(openapi.Info{
+		Title:       "Tronics API",
+		Version:     version,
+		Description: "Product catalog of Tronics Corp. Errors are RFC 7807 problem details, see docs/errors.md.",
+	}, problem.Problem{})
+}
+
+// outboxSinks returns the outbox sinks named in cfg. The broker connections
+// are closed by a worker registered before the relay, so stopped after it.
+func (a *App) outboxSinks(cfg config.Properties, dispatcher *webhooks.Dispatcher) map[string]outbox.Sink {
+	sinks := map[string]outbox.Sink{}
+	for _, name := range cfg.OutboxSinks {
+		switch name {
+		case "bus":
+			sinks[name] = outbox.BusSink{Bus: a.events}
+		case "webhooks":
+			sinks[name] = outbox.SinkFunc(dispatcher.Enqueue)
+		case "nats":
+			conn, err := nats.Connect(cfg.NATSURL, nats.Name("tronicscorp"), nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+			if err != nil {
+				// The entries stay pending for this sink until fixed. The
+				// URL is not logged: it can hold credentials.
+				slog.Error("Unable to connect to NATS", "error", err)
+				sinks[name] = outbox.SinkFunc(func(ctx context.Context, e events.Event) error { return err })
+				continue
+			}
+			sinks[name] = outbox.NATSSink{Conn: conn, Prefix: cfg.NATSSubject}
+			a.Go("nats", func(ctx context.Context) error {
+				<-ctx.Done()
+				return conn.Drain()
+			})
+		case "kafka":
+			w := &kafka.Writer{
+				Addr:         kafka.TCP(cfg.KafkaBrokers...),
+				Topic:        cfg.KafkaTopic,
+				Balancer:     &kafka.Hash{},
+				RequiredAcks: kafka.RequireAll,
+				// The relay sends one event at a time: do not wait for a batch.
+				BatchSize: 1,
+			}
+			sinks[name] = outbox.KafkaSink{Writer: w}
+			a.Go("kafka", func(ctx context.Context) error {
+				<-ctx.Done()
+				return w.Close()
+			})
+		}
+	}
+	return sinks
+}
+
+// productCache returns the product cache of cfg, nil when disabled. A Redis
+// cache is shared by the instances; a memory one is invalidated on the writes
+// of this instance and the events it relays, and kept up to the TTL otherwise.
+func (a *App) productCache(cfg config.Properties) *cache.Cache {
+	c := &cache.Cache{Name: "products", TTL: cfg.CacheTTL}
+	switch cfg.CacheStore {
+	case "memory":
+		c.Store = cache.NewLRU(cfg.CacheSize)
+	case "redis":
+		client := a.redisClient(cfg)
+		if client == nil {
+			return nil
+		}
+		c.Store = cache.Redis{Client: client, Prefix: "tronics:"}
+	default:
+		return nil
+	}
+	return c
+}
+
+// redisClient returns the Redis client shared by the caches and the rate
+// limits, nil when the url is invalid. It is closed by a worker registered by
+// the first call, so stopped after the workers using it.
+func (a *App) redisClient(cfg config.Properties) *redis.Client {
+	if a.redis != nil {
+		return a.redis
+	}
+	opts, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		slog.Error("Invalid redis url, redis is not used", "error", err)
+		return nil
+	}
+	a.redis = redis.NewClient(opts)
+	a.Go("redis", func(ctx context.Context) error {
+		<-ctx.Done()
+		return a.redis.Close()
+	})
+	return a.redis
+}
+
+// collection returns the named collection instrumented for metrics and
+// tracing.
+func (a *App) collection(name string) dbiface.CollectionAPI {
+	return tracing.TraceCollection(name, metrics.InstrumentCollection(name, a.db.Collection(name)))
+}
+
+func (a *App) checks() []handlers.Check {
+	return []handlers.Check{
+		{Name: "mongo", Run: func(ctx context.Context) error {
+			return a.client.Ping(ctx, nil)
+		}},
+		{Name: "migrations", Run: func(ctx context.Context) error {
+			return migrations.CheckApplied(ctx, a.db)
+		}},
+		{Name: "indexes", Run: func(ctx context.Context) error {
+			return migrations.CheckIndexes(ctx, a.db, a.cfg.Current())
+		}},
+	}
+}
+
+// serveGRPC serves srv on addr until ctx is done, then stops it gracefully,
+// cutting the calls still running, such as watches, after grace.
+func serveGRPC(ctx context.Context, srv *grpc.Server, addr string, grace time.Duration) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for gRPC: %w", err)
+	}
+	slog.Info("Serving gRPC", "addr", addr)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(lis)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(grace):
+		srv.Stop()
+	}
+	return nil
+}
+
+// isProbe reports whether the request comes from health checks or metric
+// scrapes, which are neither logged nor rate limited.
+func isProbe(c echo.Context) bool {
+	path := c.Request().URL.Path
+	return path == "/healthz" || path == "/readyz" || path == "/metrics"
+}
+
+// Go registers a background worker. Workers registered after Run has started
+// are not run.
+func (a *App) Go(name string, run func(ctx context.Context) error) {
+	a.workers = append(a.workers, &worker{name: name, run: run})
+}
+
+func (a *App) startWorkers() {
+	for _, w := range a.workers {
+		ctx, cancel := context.WithCancel(context.Background())
+		w.cancel = cancel
+		w.done = make(chan struct{})
+		go func(w *worker) {
+			defer close(w.done)
+			if err := w.run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				slog.Error("Worker stopped", "worker", w.name, "error", err)
+			}
+		}(w)
+	}
+}
+
+// stopWorkers cancels the workers in reverse order, waiting for each one to
+// return before stopping the next.
+func (a *App) stopWorkers(ctx context.Context) error {
+	for i := len(a.workers) - 1; i >= 0; i-- {
+		w := a.workers[i]
+		if w.cancel == nil {
+			continue
+		}
+		w.cancel()
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return fmt.Errorf("worker %s did not stop: %w", w.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Run starts the workers and the server and blocks until ctx is done or the
+// server fails, then shuts everything down.
+func (a *App) Run(ctx context.Context) error {
+	cfg := a.cfg.Current()
+	a.startWorkers()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- a.echo.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port))
+	}()
+	var serveErr error
+	drain := cfg.DrainPeriod
+	select {
+	case err := <-errc:
+		if !errors.Is(err, http.ErrServerClosed) {
+			// The server is not serving, no request is in flight.
+			serveErr, drain = err, 0
+		}
+	case <-ctx.Done():
+		slog.Info("Shutting down", "drain_period", cfg.DrainPeriod)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain+cfg.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(serveErr, a.shutdown(shutdownCtx, drain))
+}
+
+// Shutdown stops accepting requests after the drain period, waits for in
+// flight requests, then stops the workers and disconnects from the database.
+func (a *App) Shutdown(ctx context.Context) error {
+	return a.shutdown(ctx, a.cfg.Current().DrainPeriod)
+}
+
+func (a *App) shutdown(ctx context.Context, drain time.Duration) error {
+	if !a.draining.CompareAndSwap(false, true) {
+		return nil
+	}
+	select {
+	case <-time.After(drain):
+	case <-ctx.Done():
+	}
+	var errs []error
+	if a.streams != nil {
+		close(a.streams)
+	}
+	if err := a.echo.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("unable to shutdown the server: %w", err))
+	}
+	if err := a.stopWorkers(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if a.stopTracing != nil {
+		if err := a.stopTracing(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to flush traces: %w", err))
+		}
+	}
+	if err := a.disconnect(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("unable to disconnect from database: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *App) disconnect(ctx context.Context) error {
+	if a.client == nil {
+		return nil
+	}
+	return a.client.Disconnect(ctx)
+}
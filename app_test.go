@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"tronicscorp/config"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppShutdown(t *testing.T) {
+	mgr, err := config.NewManager([]string{"--drain-period", "0s"})
+	assert.Nil(t, err)
+	a := &App{cfg: mgr, echo: echo.New()}
+
+	var stopped []string
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		a.Go(name, func(ctx context.Context) error {
+			<-ctx.Done()
+			stopped = append(stopped, name)
+			return ctx.Err()
+		})
+	}
+	a.startWorkers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, a.Shutdown(ctx))
+	assert.Equal(t, []string{"third", "second", "first"}, stopped)
+	assert.True(t, a.draining.Load())
+	assert.Nil(t, a.Shutdown(ctx))
+}
+
+func TestAppShutdownTimesOutOnStuckWorker(t *testing.T) {
+	mgr, err := config.NewManager([]string{"--drain-period", "0s"})
+	assert.Nil(t, err)
+	a := &App{cfg: mgr, echo: echo.New()}
+	block := make(chan struct{})
+	defer close(block)
+	a.Go("stuck", func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	a.startWorkers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, a.Shutdown(ctx))
+}
+
+func TestAppRunSkipsTheDrainWhenServingFails(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer busy.Close()
+	_, port, _ := net.SplitHostPort(busy.Addr().String())
+	mgr, err := config.NewManager([]string{"--drain-period", "10s", "--host", "127.0.0.1", "--my-app-port", port})
+	assert.Nil(t, err)
+	a := &App{cfg: mgr, echo: echo.New()}
+	a.echo.HideBanner = true
+
+	start := time.Now()
+	assert.NotNil(t, a.Run(context.Background()), "the port is in use")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
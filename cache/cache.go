@@ -0,0 +1,117 @@
+// Package cache keeps encoded values for a while, in process or in Redis, in
+// front of slower reads. Concurrent misses of a key share one read, so that an
+// expiry or an invalidation does not send every waiting request to the
+// database at once.
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+	"tronicscorp/metrics"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Store keeps values for a time to live; a zero TTL keeps them until evicted.
+type Store interface {
+	// Get returns the value of key and whether it was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
+
+// Cache reads through a Store. Its keys are versioned: Invalidate drops them
+// all at once, on every instance sharing the store.
+type Cache struct {
+	// Name prefixes the keys and labels the metrics.
+	Name  string
+	Store Store
+	TTL   time.Duration
+
+	group singleflight.Group
+}
+
+// Load returns the value of key, read with load on a miss and stored. The
+// errors of load are returned and not stored; the errors of the store are
+// logged, the value being read with load.
+func (c *Cache) Load(ctx context.Context, key string, load func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	version, err := c.version(ctx)
+	if err != nil {
+		c.record("error")
+		slog.Warn("Unable to read the cache version", "cache", c.Name, "error", err)
+		return load(ctx)
+	}
+	key = c.Name + ":" + version + ":" + key
+	switch value, ok, err := c.Store.Get(ctx, key); {
+	case err != nil:
+		c.record("error")
+		slog.Warn("Unable to read the cache", "cache", c.Name, "key", key, "error", err)
+	case ok:
+		c.record("hit")
+		return value, nil
+	default:
+		c.record("miss")
+	}
+	res := c.group.DoChan(key, func() (interface{}, error) {
+		// The read is shared: one caller giving up must not fail the others.
+		lctx, cancel := context.WithoutCancel(ctx), func() {}
+		if deadline, ok := ctx.Deadline(); ok {
+			lctx, cancel = context.WithDeadline(lctx, deadline)
+		}
+		defer cancel()
+		value, err := load(lctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Store.Set(lctx, key, value, c.TTL); err != nil {
+			slog.Warn("Unable to fill the cache", "cache", c.Name, "key", key, "error", err)
+		}
+		return value, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-res:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.([]byte), nil
+	}
+}
+
+// Invalidate drops every value of the cache.
+func (c *Cache) Invalidate(ctx context.Context) error {
+	next := strconv.FormatInt(time.Now().UnixNano(), 36)
+	return c.Store.Set(ctx, c.versionKey(), []byte(next), 0)
+}
+
+// version returns the current version of the keys, starting one when there
+// is none, as after an eviction.
+func (c *Cache) version(ctx context.Context) (string, error) {
+	version, ok, err := c.Store.Get(ctx, c.versionKey())
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return string(version), nil
+	}
+	if err := c.Invalidate(ctx); err != nil {
+		return "", err
+	}
+	version, ok, err = c.Store.Get(ctx, c.versionKey())
+	if err == nil && !ok {
+		err = errors.New("cache: the version was evicted as soon as set")
+	}
+	return string(version), err
+}
+
+func (c *Cache) versionKey() string {
+	return c.Name + ":version"
+}
+
+func (c *Cache) record(result string) {
+	metrics.CacheRequests.WithLabelValues(c.Name, result).Inc()
+}
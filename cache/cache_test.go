@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	s := NewLRU(2)
+	s.Set(ctx, "a", []byte("1"), 0)
+	s.Set(ctx, "b", []byte("2"), 0)
+	s.Get(ctx, "a")
+	s.Set(ctx, "c", []byte("3"), 0)
+	_, ok, _ := s.Get(ctx, "b")
+	assert.False(t, ok, "the least recently used value is evicted")
+	v, ok, _ := s.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), v)
+	assert.Equal(t, 2, s.Len())
+
+	s.Set(ctx, "d", []byte("4"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_, ok, _ = s.Get(ctx, "d")
+	assert.False(t, ok, "expired")
+
+	s.Delete(ctx, "a", "missing")
+	_, ok, _ = s.Get(ctx, "a")
+	assert.False(t, ok)
+}
+
+// failingStore fails every operation.
+type failingStore struct{}
+
+func (failingStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	return nil, false, errors.New("store down")
+}
+
+func (failingStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return errors.New("store down")
+}
+
+func (failingStore) Delete(ctx context.Context, keys ...string) error {
+	return errors.New("store down")
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	c := &Cache{Name: "widgets", Store: NewLRU(100), TTL: time.Minute}
+	var loads atomic.Int32
+	release := make(chan struct{})
+	load := func(ctx context.Context) ([]byte, error) {
+		loads.Add(1)
+		<-release
+		return []byte("w1"), nil
+	}
+
+	t.Run("loads the concurrent misses once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err := c.Load(ctx, "w1", load)
+				assert.NoError(t, err)
+				assert.Equal(t, []byte("w1"), v)
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		assert.EqualValues(t, 1, loads.Load())
+
+		_, err := c.Load(ctx, "w1", load)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, loads.Load(), "hit")
+	})
+	t.Run("reloads once invalidated", func(t *testing.T) {
+		assert.NoError(t, c.Invalidate(ctx))
+		_, err := c.Load(ctx, "w1", load)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, loads.Load())
+	})
+	t.Run("does not keep the errors", func(t *testing.T) {
+		_, err := c.Load(ctx, "w2", func(ctx context.Context) ([]byte, error) {
+			return nil, errors.New("not found")
+		})
+		assert.EqualError(t, err, "not found")
+		v, err := c.Load(ctx, "w2", func(ctx context.Context) ([]byte, error) {
+			return []byte("w2"), nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("w2"), v)
+	})
+	t.Run("reads through a failing store", func(t *testing.T) {
+		down := &Cache{Name: "widgets", Store: failingStore{}, TTL: time.Minute}
+		v, err := down.Load(ctx, "w1", func(ctx context.Context) ([]byte, error) {
+			return []byte("w1"), nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("w1"), v)
+	})
+	t.Run("gives up with its context only", func(t *testing.T) {
+		slow := make(chan struct{})
+		cctx, cancel := context.WithCancel(ctx)
+		done := make(chan []byte)
+		go func() {
+			v, _ := c.Load(ctx, "w3", func(ctx context.Context) ([]byte, error) {
+				<-slow
+				return []byte("w3"), ctx.Err()
+			})
+			done <- v
+		}()
+		time.Sleep(10 * time.Millisecond)
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		_, err := c.Load(cctx, "w3", load)
+		assert.ErrorIs(t, err, context.Canceled)
+		close(slow)
+		assert.Equal(t, []byte("w3"), <-done)
+	})
+}
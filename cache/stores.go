@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LRU is an in-process store of at most Size values, evicting the least
+// recently used ones. Each instance has its own: the values it keeps may be
+// stale for up to their TTL after a write through another instance.
+type LRU struct {
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// NewLRU returns an LRU store of size values.
+func NewLRU(size int) *LRU {
+	return &LRU{Size: size, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+func (s *LRU) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := el.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		s.remove(el)
+		return nil, false, nil
+	}
+	s.order.MoveToFront(el)
+	return entry.value, true, nil
+}
+
+func (s *LRU) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &lruEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	if el, ok := s.entries[key]; ok {
+		el.Value = entry
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.entries[key] = s.order.PushFront(entry)
+	for s.order.Len() > s.Size {
+		s.remove(s.order.Back())
+	}
+	return nil
+}
+
+func (s *LRU) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := s.entries[key]; ok {
+			s.remove(el)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of values kept, expired or not.
+func (s *LRU) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+func (s *LRU) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*lruEntry).key)
+}
+
+// Redis stores the values in Redis, shared by the instances.
+type Redis struct {
+	Client redis.UniversalClient
+	// Prefix namespaces the keys, for several applications to share a
+	// server.
+	Prefix string
+}
+
+func (s Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := s.Client.Get(ctx, s.Prefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.Client.Set(ctx, s.Prefix+key, value, ttl).Err()
+}
+
+func (s Redis) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.Prefix + key
+	}
+	return s.Client.Del(ctx, prefixed...).Err()
+}
@@ -0,0 +1,348 @@
+// Package changes notices the changes made to the collections outside of the
+// API, by scripts or by hand, and records them in the outbox as the events
+// the API writes would have produced. It follows the collections with change
+// streams, resuming where it stopped, or polls them when the server does not
+// support change streams.
+package changes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+	"tronicscorp/dbiface"
+	"tronicscorp/events"
+	"tronicscorp/metrics"
+	"tronicscorp/outbox"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Op is the kind of a change.
+type Op string
+
+const (
+	Insert  Op = "insert"
+	Update  Op = "update"
+	Replace Op = "replace"
+	Delete  Op = "delete"
+)
+
+// Error codes of the servers without change streams: standalone servers, and
+// the ones predating them.
+const (
+	codeNotReplicaSet = 40573
+	codeUnknownStage  = 40324
+)
+
+// Error code of the servers predating the pre-images, MongoDB 6.0, which
+// reject fullDocumentBeforeChange.
+const codeUnknownField = 40415
+
+// Error codes of the resume tokens the server cannot resume from anymore.
+const (
+	codeInvalidResumeToken = 260
+	codeHistoryLost        = 286
+)
+
+// Change is a change of a document. Doc is the document once changed, nil for
+// deletions, and for updates of a document deleted since. Before is the
+// document before the change, when known: the pre-image of the change
+// stream, or the document of the previous scan when polling.
+type Change struct {
+	Op     Op
+	ID     bson.RawValue
+	Doc    bson.Raw
+	Before bson.Raw
+	Time   time.Time
+}
+
+// Watcher opens change streams, as *mongo.Collection does.
+type Watcher interface {
+	Watch(ctx context.Context, pipeline interface{}, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+// Source is a collection whose changes are turned into events.
+type Source struct {
+	// Name identifies the source in the resume tokens, the logs and the
+	// metrics.
+	Name string
+	// Col is read when polling.
+	Col dbiface.CollectionAPI
+	// Watcher follows the changes of the collection. Col is polled when nil.
+	Watcher Watcher
+	// Translate returns the event of a change, if it has one.
+	Translate func(c Change) (events.Event, bool)
+}
+
+// Listener records the events of the changes made to Sources in Outbox. The
+// changes made by the API are recognized, their events being already in the
+// outbox, and skipped.
+type Listener struct {
+	Sources []Source
+	// Tokens stores the resume tokens of the change streams.
+	Tokens dbiface.CollectionAPI
+	Outbox *outbox.Outbox
+	// Poll is the interval between the scans of the sources without change
+	// streams, and between the attempts to reopen a failed stream.
+	Poll time.Duration
+	// Settle is how long after a change its event is looked for in the
+	// outbox, for the API writes made without transaction to record it.
+	Settle time.Duration
+}
+
+// token is the resume token of a source.
+type token struct {
+	Source  string    `bson:"_id"`
+	Token   bson.Raw  `bson:"token"`
+	SavedAt time.Time `bson:"saved_at"`
+}
+
+// Run follows the sources until ctx is done.
+func (l *Listener) Run(ctx context.Context) error {
+	if l.Poll <= 0 {
+		l.Poll = 10 * time.Second
+	}
+	if l.Settle <= 0 {
+		l.Settle = 2 * time.Second
+	}
+	var wg sync.WaitGroup
+	for _, s := range l.Sources {
+		wg.Add(1)
+		go func(s Source) {
+			defer wg.Done()
+			l.listen(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (l *Listener) listen(ctx context.Context, s Source) {
+	logger := slog.With("source", s.Name)
+	preImages := true
+	for s.Watcher != nil {
+		err := l.watch(ctx, s, preImages)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case preImages && hasCode(err, codeUnknownField):
+			logger.Warn("Pre-images are unavailable, the deletions are handled without their document", "error", err)
+			preImages = false
+		case hasCode(err, codeNotReplicaSet, codeUnknownStage):
+			logger.Warn("Change streams are unavailable, polling the collection instead", "poll", l.Poll, "error", err)
+			s.Watcher = nil
+		case hasCode(err, codeInvalidResumeToken, codeHistoryLost):
+			logger.Error("Unable to resume the change stream, the changes made meanwhile are missed", "error", err)
+			if _, err := l.Tokens.DeleteOne(ctx, bson.M{"_id": s.Name}); err != nil {
+				logger.Error("Unable to reset the resume token", "error", err)
+				sleep(ctx, l.Poll)
+			}
+		default:
+			logger.Error("The change stream failed, reopening it", "error", err)
+			sleep(ctx, l.Poll)
+		}
+	}
+	var seen map[string]snapshot
+	for {
+		next, err := l.scan(ctx, s, seen)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("Unable to poll the changes", "error", err)
+		} else if err == nil {
+			seen = next
+		}
+		if !sleep(ctx, l.Poll) {
+			return
+		}
+	}
+}
+
+// watch follows the change stream of s from its saved resume token, or from
+// now, until it fails. The token is saved once the change is handled. With
+// preImages, the changes carry the document before them when the collection
+// records it.
+func (l *Listener) watch(ctx context.Context, s Source, preImages bool) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if preImages {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+	resume, err := l.token(ctx, s.Name)
+	if err != nil {
+		return err
+	}
+	if resume != nil {
+		opts.SetResumeAfter(resume)
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{Insert, Update, Replace, Delete}},
+	}}}}
+	cs, err := s.Watcher.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.Background())
+	slog.Info("Following the changes", "source", s.Name, "resumed", resume != nil)
+	for cs.Next(ctx) {
+		var raw struct {
+			Op  Op `bson:"operationType"`
+			Key struct {
+				ID bson.RawValue `bson:"_id"`
+			} `bson:"documentKey"`
+			Doc         bson.Raw            `bson:"fullDocument"`
+			Before      bson.Raw            `bson:"fullDocumentBeforeChange"`
+			ClusterTime primitive.Timestamp `bson:"clusterTime"`
+		}
+		if err := cs.Decode(&raw); err != nil {
+			return err
+		}
+		c := Change{Op: raw.Op, ID: raw.Key.ID, Doc: raw.Doc, Before: raw.Before, Time: time.Unix(int64(raw.ClusterTime.T), 0)}
+		if err := l.handle(ctx, s, c); err != nil {
+			return err
+		}
+		if err := l.saveToken(ctx, s.Name, cs.ResumeToken()); err != nil {
+			return err
+		}
+	}
+	return cs.Err()
+}
+
+// snapshot is a document at the previous scan, kept whole for the changes to
+// carry it as their Before.
+type snapshot struct {
+	id  bson.RawValue
+	doc bson.Raw
+}
+
+// scan reads the documents of s and handles their differences with seen, the
+// documents of the previous scan. The first scan, with a nil seen, only
+// reads them.
+func (l *Listener) scan(ctx context.Context, s Source, seen map[string]snapshot) (map[string]snapshot, error) {
+	cursor, err := s.Col.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	now := time.Now()
+	current := map[string]snapshot{}
+	for cursor.Next(ctx) {
+		id := cursor.Current.Lookup("_id")
+		key := string(id.Type) + string(id.Value)
+		doc := append(bson.Raw(nil), cursor.Current...)
+		snap := snapshot{id: bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)}, doc: doc}
+		current[key] = snap
+		if seen == nil {
+			continue
+		}
+		old, ok := seen[key]
+		switch {
+		case !ok:
+			err = l.handle(ctx, s, Change{Op: Insert, ID: snap.id, Doc: doc, Time: now})
+		case !bytes.Equal(old.doc, doc):
+			err = l.handle(ctx, s, Change{Op: Update, ID: snap.id, Doc: doc, Before: old.doc, Time: now})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	for key, old := range seen {
+		if _, ok := current[key]; !ok {
+			if err := l.handle(ctx, s, Change{Op: Delete, ID: old.id, Before: old.doc, Time: now}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return current, nil
+}
+
+// handle records the event of c, unless it is in the outbox already.
+func (l *Listener) handle(ctx context.Context, s Source, c Change) error {
+	e, ok := s.Translate(c)
+	if !ok {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = c.Time
+	}
+	if wait := time.Until(c.Time.Add(l.Settle)); wait > 0 && !sleep(ctx, wait) {
+		return ctx.Err()
+	}
+	recorded, err := l.recorded(ctx, e)
+	if err != nil || recorded {
+		return err
+	}
+	metrics.OutOfBandChanges.WithLabelValues(s.Name, string(c.Op)).Inc()
+	slog.Info("Out-of-band change", "source", s.Name, "op", c.Op, "type", e.Type, "subject", e.Subject)
+	return l.Outbox.Write(ctx, func(ctx context.Context) ([]events.Event, error) {
+		return []events.Event{e}, nil
+	})
+}
+
+// recorded reports whether e is the latest event of its subject in the
+// outbox, as it is when an API write, or another instance, recorded it.
+func (l *Listener) recorded(ctx context.Context, e events.Event) (bool, error) {
+	entry, err := l.Outbox.Latest(ctx, e.Subject)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil || entry.Type != e.Type {
+		return false, err
+	}
+	if e.Data == nil {
+		return len(entry.Data) == 0, nil
+	}
+	data, err := bson.Marshal(e.Data)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(data, entry.Data), nil
+}
+
+func (l *Listener) token(ctx context.Context, source string) (bson.Raw, error) {
+	var t token
+	err := l.Tokens.FindOne(ctx, bson.M{"_id": source}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return t.Token, err
+}
+
+// saveToken records the resume token of source.
+func (l *Listener) saveToken(ctx context.Context, source string, t bson.Raw) error {
+	_, err := l.Tokens.UpdateOne(ctx, bson.M{"_id": source},
+		bson.M{"$set": bson.M{"token": t, "saved_at": time.Now().UTC()}}, options.Update().SetUpsert(true))
+	return err
+}
+
+// hasCode reports whether err is a server error with one of codes.
+func hasCode(err error, codes ...int32) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, code := range codes {
+		if cmdErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// sleep waits for d, and reports whether ctx is still running.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,128 @@
+package changes
+
+import (
+	"context"
+	"testing"
+	"time"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+	"tronicscorp/outbox"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type widget struct {
+	ID   primitive.ObjectID `bson:"_id"`
+	Name string             `bson:"name"`
+}
+
+func translate(c Change) (events.Event, bool) {
+	id := c.ID.ObjectID()
+	if c.Op == Delete {
+		return events.Event{Type: "widget.deleted", Subject: id.Hex()}, true
+	}
+	var w widget
+	if bson.Unmarshal(c.Doc, &w) != nil {
+		return events.Event{}, false
+	}
+	t := events.Type("widget.updated")
+	if c.Op == Insert {
+		t = "widget.created"
+	}
+	return events.Event{Type: t, Subject: id.Hex(), Data: w}, true
+}
+
+// entries returns the types and subjects of the outbox entries.
+func entries(box *dbtest.Collection) []string {
+	var got []string
+	for _, doc := range box.Docs() {
+		got = append(got, doc["type"].(string)+" "+doc["subject"].(string))
+	}
+	return got
+}
+
+func TestScan(t *testing.T) {
+	ctx := context.Background()
+	widgets, box := &dbtest.Collection{}, &dbtest.Collection{}
+	ob := &outbox.Outbox{Col: box}
+	l := &Listener{Outbox: ob, Settle: time.Millisecond}
+	s := Source{Name: "widgets", Col: widgets, Translate: translate}
+
+	w1 := widget{ID: primitive.NewObjectID(), Name: "w1"}
+	widgets.InsertOne(ctx, w1)
+	seen, err := l.scan(ctx, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, seen, 1)
+	assert.Empty(t, entries(box), "the first scan only reads the documents")
+
+	// Out-of-band: a script inserts w2 and renames w1.
+	w2 := widget{ID: primitive.NewObjectID(), Name: "w2"}
+	widgets.InsertOne(ctx, w2)
+	widgets.UpdateOne(ctx, bson.M{"_id": w1.ID}, bson.M{"$set": bson.M{"name": "w1 renamed"}})
+	seen, err = l.scan(ctx, s, seen)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"widget.updated " + w1.ID.Hex(), "widget.created " + w2.ID.Hex()}, entries(box))
+	var entry outbox.Entry
+	assert.NoError(t, box.FindOne(ctx, bson.M{"subject": w1.ID.Hex()}).Decode(&entry))
+	var data widget
+	assert.NoError(t, bson.Unmarshal(entry.Data, &data))
+	assert.Equal(t, "w1 renamed", data.Name)
+
+	// The API renames w2 and records its event.
+	widgets.UpdateOne(ctx, bson.M{"_id": w2.ID}, bson.M{"$set": bson.M{"name": "w2 renamed"}})
+	assert.NoError(t, ob.Write(ctx, func(ctx context.Context) ([]events.Event, error) {
+		return []events.Event{{Type: "widget.updated", Subject: w2.ID.Hex(), Data: widget{ID: w2.ID, Name: "w2 renamed"}}}, nil
+	}))
+	before := len(entries(box))
+	seen, err = l.scan(ctx, s, seen)
+	assert.NoError(t, err)
+	assert.Len(t, entries(box), before, "API writes are already recorded")
+
+	// Out-of-band deletion, the change carrying the deleted document.
+	var deleted widget
+	s.Translate = func(c Change) (events.Event, bool) {
+		if c.Op == Delete {
+			assert.NoError(t, bson.Unmarshal(c.Before, &deleted))
+		}
+		return translate(c)
+	}
+	widgets.DeleteOne(ctx, bson.M{"_id": w1.ID})
+	stale := seen
+	seen, err = l.scan(ctx, s, seen)
+	assert.NoError(t, err)
+	assert.Len(t, seen, 1)
+	got := entries(box)
+	assert.Equal(t, "widget.deleted "+w1.ID.Hex(), got[len(got)-1])
+	assert.Equal(t, "w1 renamed", deleted.Name)
+
+	// Seeing the deletion again, as after a failed scan, records nothing.
+	_, err = l.scan(ctx, s, stale)
+	assert.NoError(t, err)
+	assert.Len(t, entries(box), len(got))
+}
+
+func TestTokens(t *testing.T) {
+	ctx := context.Background()
+	l := &Listener{Tokens: &dbtest.Collection{}}
+	token, err := l.token(ctx, "widgets")
+	assert.NoError(t, err)
+	assert.Nil(t, token)
+
+	first, _ := bson.Marshal(bson.M{"_data": "8263"})
+	second, _ := bson.Marshal(bson.M{"_data": "8264"})
+	assert.NoError(t, l.saveToken(ctx, "widgets", first))
+	assert.NoError(t, l.saveToken(ctx, "widgets", second))
+	token, err = l.token(ctx, "widgets")
+	assert.NoError(t, err)
+	assert.Equal(t, bson.Raw(second), token)
+}
+
+func TestHasCode(t *testing.T) {
+	err := mongo.CommandError{Code: codeNotReplicaSet, Message: "The $changeStream stage is only supported on replica sets"}
+	assert.True(t, hasCode(err, codeNotReplicaSet, codeUnknownStage))
+	assert.False(t, hasCode(err, codeHistoryLost))
+	assert.False(t, hasCode(context.Canceled, codeNotReplicaSet))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"tronicscorp/config"
+	"tronicscorp/webhooks"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runConfigCommand implements `config print [--redacted] [config flags...]`,
+// which prints the effective configuration as YAML.
+func runConfigCommand(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: config print [--redacted] [config flags...]")
+	}
+	redacted := false
+	var configArgs []string
+	for _, arg := range args[1:] {
+		if arg == "--redacted" || arg == "-redacted" {
+			redacted = true
+			continue
+		}
+		configArgs = append(configArgs, arg)
+	}
+	p, err := config.Load(configArgs)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if redacted {
+		p = p.Redacted()
+	}
+	out, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// runWebhooksCommand implements `webhooks receive [--addr host:port]
+// [--secret secret] [--status code]`, a local endpoint printing the webhook
+// deliveries it receives, to try subscriptions out.
+func runWebhooksCommand(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] != "receive" {
+		return errors.New("usage: webhooks receive [--addr host:port] [--secret secret] [--status code]")
+	}
+	fs := flag.NewFlagSet("webhooks receive", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:9000", "address to listen on")
+	secret := fs.String("secret", "", "secret of the webhook, to verify the signatures")
+	status := fs.Int("status", http.StatusOK, "status to answer with, a failure triggers the retries")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: *addr, Handler: webhookReceiver(*secret, *status, w), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	fmt.Fprintf(w, "Receiving webhooks on http://%s\n", *addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// webhookReceiver prints the deliveries to w and answers with status, or 401
+// when the signature does not match secret.
+func webhookReceiver(secret string, status int, w io.Writer) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		code, verdict := status, "not verified"
+		if secret != "" {
+			verdict = "valid signature"
+			if err := webhooks.Verify(secret, r.Header, body, 5*time.Minute); err != nil {
+				code, verdict = http.StatusUnauthorized, err.Error()
+			}
+		}
+		mu.Lock()
+		fmt.Fprintf(w, "%s %s delivery %s, %s, answered %d\n%s\n\n", time.Now().Format(time.TimeOnly),
+			r.Header.Get(webhooks.EventHeader), r.Header.Get(webhooks.DeliveryHeader), verdict, code, body)
+		mu.Unlock()
+		rw.WriteHeader(code)
+	})
+}
@@ -1,12 +1,395 @@
 package config
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+const (
+	ProfileDev  = "dev"
+	ProfileTest = "test"
+	ProfileProd = "prod"
+
+	// DefaultJwtTokenSecret is only acceptable in the dev profile
+	DefaultJwtTokenSecret = "abrakadabra"
+
+	redactedValue = "********"
+)
+
+// Properties holds the application configuration. Values are layered, in
+// increasing priority: env-default tags, the config file, environment
+// variables and command line flags.
 type Properties struct {
-	Port              string `env:"MY_APP_PORT" env-default:"8080"`
-	Host              string `env:"HOST" env-default:"localhost"`
-	DBHost            string `env:"DB_HOST" env-default:"localhost"`
-	DBPort            string `env:"DB_PORT" env-default:"27017"`
-	DBName            string `env:"DB_NAME" env-default:"tronics"`
-	ProductCollection string `env: "PRODUCT_COL_NAME" env-default:"products"`
-	UsersCollection   string `env:"USERS_COL_NAME" env-default:"users"`
-	JwtTokenSecret    string `env:"JWT_TOKEN_SECRET" env-default:"abrakadabra"`
+	Profile                string        `yaml:"profile" toml:"profile" env:"APP_PROFILE" env-default:"dev"`
+	Port                   string        `yaml:"port" toml:"port" env:"MY_APP_PORT" env-default:"8080"`
+	Host                   string        `yaml:"host" toml:"host" env:"HOST" env-default:"localhost"`
+	GRPCPort               string        `yaml:"grpc_port" toml:"grpc_port" env:"GRPC_PORT" env-default:"9090"`
+	DBHost                 string        `yaml:"db_host" toml:"db_host" env:"DB_HOST" env-default:"localhost"`
+	DBPort                 string        `yaml:"db_port" toml:"db_port" env:"DB_PORT" env-default:"27017"`
+	DBName                 string        `yaml:"db_name" toml:"db_name" env:"DB_NAME" env-default:"tronics"`
+	ProductCollection      string        `yaml:"product_col_name" toml:"product_col_name" env:"PRODUCT_COL_NAME" env-default:"products"`
+	UsersCollection        string        `yaml:"users_col_name" toml:"users_col_name" env:"USERS_COL_NAME" env-default:"users"`
+	CategoriesCollection   string        `yaml:"categories_col_name" toml:"categories_col_name" env:"CATEGORIES_COL_NAME" env-default:"categories"`
+	RulesCollection        string        `yaml:"rules_col_name" toml:"rules_col_name" env:"RULES_COL_NAME" env-default:"rules"`
+	WebhooksCollection     string        `yaml:"webhooks_col_name" toml:"webhooks_col_name" env:"WEBHOOKS_COL_NAME" env-default:"webhooks"`
+	DeliveriesCollection   string        `yaml:"webhook_deliveries_col_name" toml:"webhook_deliveries_col_name" env:"WEBHOOK_DELIVERIES_COL_NAME" env-default:"webhook_deliveries"`
+	WebhookMaxAttempts     int           `yaml:"webhook_max_attempts" toml:"webhook_max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" env-default:"8"`
+	WebhookTimeout         time.Duration `yaml:"webhook_timeout" toml:"webhook_timeout" env:"WEBHOOK_TIMEOUT" env-default:"10s"`
+	OutboxCollection       string        `yaml:"outbox_col_name" toml:"outbox_col_name" env:"OUTBOX_COL_NAME" env-default:"outbox"`
+	Transactions           bool          `yaml:"transactions" toml:"transactions" env:"TRANSACTIONS" env-default:"true"`
+	OutboxSinks            []string      `yaml:"outbox_sinks" toml:"outbox_sinks" env:"OUTBOX_SINKS" env-default:"bus,webhooks"`
+	NATSURL                string        `yaml:"nats_url" toml:"nats_url" env:"NATS_URL" secret:"true"`
+	NATSSubject            string        `yaml:"nats_subject" toml:"nats_subject" env:"NATS_SUBJECT" env-default:"tronics"`
+	KafkaBrokers           []string      `yaml:"kafka_brokers" toml:"kafka_brokers" env:"KAFKA_BROKERS"`
+	KafkaTopic             string        `yaml:"kafka_topic" toml:"kafka_topic" env:"KAFKA_TOPIC" env-default:"tronics.events"`
+	ChangeTokensCollection string        `yaml:"change_tokens_col_name" toml:"change_tokens_col_name" env:"CHANGE_TOKENS_COL_NAME" env-default:"change_tokens"`
+	ChangePoll             time.Duration `yaml:"change_poll" toml:"change_poll" env:"CHANGE_POLL" env-default:"10s"`
+	IdempotencyCollection  string        `yaml:"idempotency_col_name" toml:"idempotency_col_name" env:"IDEMPOTENCY_COL_NAME" env-default:"idempotency_keys"`
+	IdempotencyTTL         time.Duration `yaml:"idempotency_ttl" toml:"idempotency_ttl" env:"IDEMPOTENCY_TTL" env-default:"24h"`
+	CacheStore             string        `yaml:"cache_store" toml:"cache_store" env:"CACHE_STORE" env-default:"memory"`
+	CacheSize              int           `yaml:"cache_size" toml:"cache_size" env:"CACHE_SIZE" env-default:"10000"`
+	CacheTTL               time.Duration `yaml:"cache_ttl" toml:"cache_ttl" env:"CACHE_TTL" env-default:"5m"`
+	CacheMaxAge            time.Duration `yaml:"cache_max_age" toml:"cache_max_age" env:"CACHE_MAX_AGE" env-default:"30s"`
+	RedisURL               string        `yaml:"redis_url" toml:"redis_url" env:"REDIS_URL" secret:"true"`
+	RulesFile              string        `yaml:"rules_file" toml:"rules_file" env:"RULES_FILE" env-default:"config/product_rules.yaml"`
+	TenantsFile            string        `yaml:"tenants_file" toml:"tenants_file" env:"TENANTS_FILE" env-default:"config/tenants.yaml"`
+	DefaultTenant          string        `yaml:"default_tenant" toml:"default_tenant" env:"DEFAULT_TENANT" env-default:"default"`
+	JwtTokenSecret         string        `yaml:"jwt_token_secret" toml:"jwt_token_secret" env:"JWT_TOKEN_SECRET" env-default:"abrakadabra" secret:"true" reload:"true"`
+	ReadTimeout            time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"READ_TIMEOUT" env-default:"5s"`
+	WriteTimeout           time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"WRITE_TIMEOUT" env-default:"10s"`
+	StartupTimeout         time.Duration `yaml:"startup_timeout" toml:"startup_timeout" env:"STARTUP_TIMEOUT" env-default:"10s"`
+	DrainPeriod            time.Duration `yaml:"drain_period" toml:"drain_period" env:"DRAIN_PERIOD" env-default:"5s"`
+	ShutdownTimeout        time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" env-default:"15s"`
+	LoginMaxFailures       int           `yaml:"login_max_failures" toml:"login_max_failures" env:"LOGIN_MAX_FAILURES" env-default:"5"`
+	LoginLockout           time.Duration `yaml:"login_lockout" toml:"login_lockout" env:"LOGIN_LOCKOUT" env-default:"15m"`
+	TracingExporter        string        `yaml:"tracing_exporter" toml:"tracing_exporter" env:"TRACING_EXPORTER" env-default:"none"`
+	OTLPEndpoint           string        `yaml:"otlp_endpoint" toml:"otlp_endpoint" env:"OTLP_ENDPOINT" env-default:"localhost:4318"`
+	OTLPInsecure           bool          `yaml:"otlp_insecure" toml:"otlp_insecure" env:"OTLP_INSECURE" env-default:"true"`
+	TraceSampleRatio       float64       `yaml:"trace_sample_ratio" toml:"trace_sample_ratio" env:"TRACE_SAMPLE_RATIO" env-default:"1"`
+	LogFormat              string        `yaml:"log_format" toml:"log_format" env:"LOG_FORMAT" env-default:"text"`
+	LogLevel               string        `yaml:"log_level" toml:"log_level" env:"LOG_LEVEL" env-default:"debug" reload:"true"`
+	RateLimit              float64       `yaml:"rate_limit" toml:"rate_limit" env:"RATE_LIMIT" env-default:"0" reload:"true"`
+	RateBurst              int           `yaml:"rate_burst" toml:"rate_burst" env:"RATE_BURST" env-default:"0" reload:"true"`
+	ProductsRateLimit      float64       `yaml:"products_rate_limit" toml:"products_rate_limit" env:"PRODUCTS_RATE_LIMIT" env-default:"50" reload:"true"`
+	ProductsRateBurst      int           `yaml:"products_rate_burst" toml:"products_rate_burst" env:"PRODUCTS_RATE_BURST" env-default:"100" reload:"true"`
+	AuthRateLimit          float64       `yaml:"auth_rate_limit" toml:"auth_rate_limit" env:"AUTH_RATE_LIMIT" env-default:"0.2" reload:"true"`
+	AuthRateBurst          int           `yaml:"auth_rate_burst" toml:"auth_rate_burst" env:"AUTH_RATE_BURST" env-default:"10" reload:"true"`
+	RateLimitStore         string        `yaml:"rate_limit_store" toml:"rate_limit_store" env:"RATE_LIMIT_STORE" env-default:"memory"`
+	APIKeys                []string      `yaml:"api_keys" toml:"api_keys" env:"API_KEYS" secret:"true" reload:"true"`
+	TrustedProxies         []string      `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES" env-default:"loopback,linklocal,private"`
+	CORSOrigins            []string      `yaml:"cors_origins" toml:"cors_origins" env:"CORS_ORIGINS" reload:"true"`
+	LegacyDeprecated       string        `yaml:"legacy_deprecated" toml:"legacy_deprecated" env:"LEGACY_DEPRECATED" env-default:"2026-10-19"`
+	LegacySunset           string        `yaml:"legacy_sunset" toml:"legacy_sunset" env:"LEGACY_SUNSET" env-default:"2027-04-30"`
+}
+
+// Load builds the configuration from args (without the program name). The
+// config file is taken from --config, CONFIG_FILE or config/<profile>.yaml
+// (or .toml) when present.
+func Load(args []string) (Properties, error) {
+	cfg, _, err := load(args)
+	return cfg, err
+}
+
+// load is Load that also returns the config file that was read, if any.
+func load(args []string) (Properties, string, error) {
+	var cfg Properties
+	fs, path, profile, overrides := newFlagSet()
+	if err := fs.Parse(args); err != nil {
+		return cfg, "", err
+	}
+	if *profile != "" {
+		cfg.Profile = *profile
+	} else if env, ok := os.LookupEnv("APP_PROFILE"); ok {
+		cfg.Profile = env
+	} else {
+		cfg.Profile = ProfileDev
+	}
+	file := *path
+	if file == "" {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	if file == "" {
+		file = profileFile(cfg.Profile)
+	}
+	if err := read(file, &cfg); err != nil {
+		return cfg, file, err
+	}
+	if *profile != "" {
+		cfg.Profile = *profile
+	}
+	if err := overrides.apply(&cfg); err != nil {
+		return cfg, file, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, file, err
+	}
+	return cfg, file, nil
+}
+
+func read(file string, cfg *Properties) error {
+	if file == "" {
+		return cleanenv.ReadEnv(cfg)
+	}
+	if err := cleanenv.ReadConfig(file, cfg); err != nil {
+		return fmt.Errorf("unable to read config file %s: %w", file, err)
+	}
+	return nil
+}
+
+// profileFile returns the default config file of a profile, if it exists.
+func profileFile(profile string) string {
+	for _, ext := range []string{".yaml", ".yml", ".toml"} {
+		file := filepath.Join("config", profile+ext)
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
+
+// Validate reports configuration values the application must not start with.
+func (p Properties) Validate() error {
+	var errs []error
+	switch p.Profile {
+	case ProfileDev, ProfileTest, ProfileProd:
+	default:
+		errs = append(errs, fmt.Errorf("profile %q is not one of dev, test, prod", p.Profile))
+	}
+	if _, err := strconv.ParseUint(p.Port, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("port %q is not a valid port", p.Port))
+	}
+	if _, err := strconv.ParseUint(p.GRPCPort, 10, 16); err != nil || p.GRPCPort == p.Port {
+		errs = append(errs, fmt.Errorf("grpc port %q is not a valid port distinct from the http one", p.GRPCPort))
+	}
+	if _, err := strconv.ParseUint(p.DBPort, 10, 16); err != nil {
+		errs = append(errs, fmt.Errorf("db port %q is not a valid port", p.DBPort))
+	}
+	if p.DBName == "" || p.ProductCollection == "" || p.UsersCollection == "" || p.CategoriesCollection == "" || p.RulesCollection == "" ||
+		p.WebhooksCollection == "" || p.DeliveriesCollection == "" || p.OutboxCollection == "" || p.ChangeTokensCollection == "" ||
+		p.IdempotencyCollection == "" {
+		errs = append(errs, errors.New("database and collection names must be set"))
+	}
+	if p.DefaultTenant == "" {
+		errs = append(errs, errors.New("default tenant must be set"))
+	}
+	if p.JwtTokenSecret == "" {
+		errs = append(errs, errors.New("jwt token secret must be set"))
+	}
+	if p.Profile != ProfileDev && p.JwtTokenSecret == DefaultJwtTokenSecret {
+		errs = append(errs, fmt.Errorf("the default jwt token secret is not allowed in the %s profile", p.Profile))
+	}
+	if p.ReadTimeout <= 0 || p.WriteTimeout <= 0 {
+		errs = append(errs, errors.New("read and write timeouts must be positive"))
+	}
+	if p.StartupTimeout <= 0 || p.ShutdownTimeout <= 0 || p.DrainPeriod < 0 {
+		errs = append(errs, errors.New("startup and shutdown timeouts must be positive and the drain period not negative"))
+	}
+	if p.WebhookMaxAttempts <= 0 || p.WebhookTimeout <= 0 {
+		errs = append(errs, errors.New("webhook max attempts and timeout must be positive"))
+	}
+	for _, sink := range p.OutboxSinks {
+		switch sink {
+		case "bus", "webhooks":
+		case "nats":
+			if p.NATSURL == "" || p.NATSSubject == "" {
+				errs = append(errs, errors.New("the nats outbox sink needs a nats url and subject"))
+			}
+		case "kafka":
+			if len(p.KafkaBrokers) == 0 || p.KafkaTopic == "" {
+				errs = append(errs, errors.New("the kafka outbox sink needs kafka brokers and a topic"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("outbox sink %q is not one of bus, webhooks, nats, kafka", sink))
+		}
+	}
+	if p.ChangePoll <= 0 {
+		errs = append(errs, errors.New("change poll must be positive"))
+	}
+	if p.IdempotencyTTL <= 0 {
+		errs = append(errs, errors.New("idempotency ttl must be positive"))
+	}
+	switch p.CacheStore {
+	case "none":
+	case "memory":
+		if p.CacheSize <= 0 {
+			errs = append(errs, errors.New("the memory cache needs a positive size"))
+		}
+	case "redis":
+		if p.RedisURL == "" {
+			errs = append(errs, errors.New("the redis cache needs a redis url"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("cache store %q is not one of none, memory, redis", p.CacheStore))
+	}
+	if p.CacheTTL <= 0 || p.CacheMaxAge < 0 {
+		errs = append(errs, errors.New("cache ttl must be positive and the cache max age not negative"))
+	}
+	if p.LoginMaxFailures <= 0 || p.LoginLockout <= 0 {
+		errs = append(errs, errors.New("login max failures and lockout must be positive"))
+	}
+	switch p.TracingExporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracing exporter %q is not one of none, stdout, otlp", p.TracingExporter))
+	}
+	if p.TraceSampleRatio < 0 || p.TraceSampleRatio > 1 {
+		errs = append(errs, errors.New("trace sample ratio must be between 0 and 1"))
+	}
+	if p.LogFormat != "text" && p.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log format %q is not one of text, json", p.LogFormat))
+	}
+	switch p.LogLevel {
+	case "debug", "info", "warn", "error", "off":
+	default:
+		errs = append(errs, fmt.Errorf("log level %q is not one of debug, info, warn, error, off", p.LogLevel))
+	}
+	if p.RateLimit < 0 || p.RateBurst < 0 || p.ProductsRateLimit < 0 || p.ProductsRateBurst < 0 || p.AuthRateLimit < 0 || p.AuthRateBurst < 0 {
+		errs = append(errs, errors.New("rate limits and bursts must not be negative"))
+	}
+	switch p.RateLimitStore {
+	case "memory":
+	case "redis":
+		if p.RedisURL == "" {
+			errs = append(errs, errors.New("the redis rate limit store needs a redis url"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rate limit store %q is not one of memory, redis", p.RateLimitStore))
+	}
+	for _, key := range p.APIKeys {
+		if name, secret, _ := strings.Cut(key, ":"); name == "" || secret == "" {
+			errs = append(errs, errors.New("api keys must be like name:key"))
+			break
+		}
+	}
+	for _, proxy := range p.TrustedProxies {
+		switch proxy {
+		case "loopback", "linklocal", "private":
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("trusted proxy %q is not an address, a CIDR or one of loopback, linklocal, private", proxy))
+		}
+	}
+	deprecated, err1 := time.Parse(time.DateOnly, p.LegacyDeprecated)
+	sunset, err2 := time.Parse(time.DateOnly, p.LegacySunset)
+	if err1 != nil || err2 != nil {
+		errs = append(errs, errors.New("legacy deprecated and sunset must be dates like 2006-01-02"))
+	} else if sunset.Before(deprecated) {
+		errs = append(errs, errors.New("legacy sunset must not be before the deprecation"))
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of p with the fields tagged secret masked.
+func (p Properties) Redacted() Properties {
+	v := reflect.ValueOf(&p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if v.Type().Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		switch {
+		case f.Kind() == reflect.String && f.String() != "":
+			f.SetString(redactedValue)
+		case f.Kind() == reflect.Slice && f.Len() > 0:
+			f.Set(reflect.ValueOf([]string{redactedValue}))
+		}
+	}
+	return p
+}
+
+// overrides collects the flag values given on the command line, keyed by
+// field index.
+type overrides map[int]string
+
+func newFlagSet() (*flag.FlagSet, *string, *string, overrides) {
+	fs := flag.NewFlagSet("tronicscorp", flag.ContinueOnError)
+	path := fs.String("config", "", "path to a YAML or TOML config file")
+	profile := fs.String("profile", "", "configuration profile: dev, test or prod")
+	values := overrides{}
+	t := reflect.TypeOf(Properties{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.ReplaceAll(strings.ToLower(field.Tag.Get("env")), "_", "-")
+		if name == "" || fs.Lookup(name) != nil {
+			continue
+		}
+		index := i
+		fs.Func(name, fmt.Sprintf("overrides %s", field.Tag.Get("env")), func(s string) error {
+			values[index] = s
+			return nil
+		})
+	}
+	return fs, path, profile, values
+}
+
+func (o overrides) apply(p *Properties) error {
+	v := reflect.ValueOf(p).Elem()
+	for i, raw := range o {
+		if err := setField(v.Field(i), raw); err != nil {
+			return fmt.Errorf("flag %s: %w", v.Type().Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, raw string) error {
+	switch f.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		parts := strings.Split(raw, ",")
+		f.Set(reflect.ValueOf(parts))
+	case reflect.Map:
+		toggles := map[string]bool{}
+		for _, part := range strings.Split(raw, ",") {
+			name, value, _ := strings.Cut(part, ":")
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			toggles[name] = b
+		}
+		f.Set(reflect.ValueOf(toggles))
+	default:
+		return fmt.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
 }
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Manager holds the current configuration snapshot and reloads it when the
+// config file changes or the process receives SIGHUP. Only fields tagged
+// reload:"true" may change at runtime; reloads that fail validation or touch
+// other fields are rejected and the previous snapshot is kept.
+type Manager struct {
+	args    []string
+	file    string
+	current atomic.Pointer[Properties]
+
+	mu          sync.Mutex
+	subscribers []func(Properties)
+}
+
+// NewManager loads the initial configuration from args.
+func NewManager(args []string) (*Manager, error) {
+	cfg, file, err := load(args)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manager{args: args, file: file}
+	m.current.Store(&cfg)
+	return m, nil
+}
+
+// Current returns the active configuration snapshot.
+func (m *Manager) Current() Properties {
+	return *m.current.Load()
+}
+
+// Subscribe registers fn to be called with every new snapshot. fn is called
+// once with the current snapshot before Subscribe returns.
+func (m *Manager) Subscribe(fn func(Properties)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, fn)
+	fn(m.Current())
+}
+
+// Reload re-reads the configuration and swaps it in if it is valid.
+func (m *Manager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next, _, err := load(m.args)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	old := m.Current()
+	if err := checkReloadable(old, next); err != nil {
+		return err
+	}
+	m.current.Store(&next)
+	for _, fn := range m.subscribers {
+		fn(next)
+	}
+	return nil
+}
+
+// Watch reloads the configuration on SIGHUP and whenever the config file
+// modification time changes, checking every interval, until ctx is done.
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	modTime := m.modTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			m.reload("SIGHUP")
+		case <-ticker.C:
+			if t := m.modTime(); !t.Equal(modTime) {
+				modTime = t
+				m.reload("config file change")
+			}
+		}
+	}
+}
+
+func (m *Manager) reload(reason string) {
+	if err := m.Reload(); err != nil {
+		slog.Error("Configuration reload rejected, keeping the current one", "reason", reason, "error", err)
+		return
+	}
+	slog.Info("Configuration reloaded", "reason", reason)
+}
+
+func (m *Manager) modTime() time.Time {
+	if m.file == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// checkReloadable returns an error if next changes a field that needs a
+// restart to take effect.
+func checkReloadable(old, next Properties) error {
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(next)
+	for i := 0; i < ov.NumField(); i++ {
+		field := ov.Type().Field(i)
+		if field.Tag.Get("reload") == "true" {
+			continue
+		}
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			return fmt.Errorf("%s cannot be changed without a restart", field.Name)
+		}
+	}
+	return nil
+}
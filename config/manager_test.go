@@ -0,0 +1,39 @@
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagerReload(t *testing.T) {
+	path := writeFile(t, "app.yaml", "log_level: info\ncors_origins: [\"https://a.example\"]\n")
+	m, err := NewManager([]string{"--config", path})
+	assert.Nil(t, err)
+
+	var seen []Properties
+	m.Subscribe(func(p Properties) { seen = append(seen, p) })
+	assert.Len(t, seen, 1)
+	assert.Equal(t, "info", seen[0].LogLevel)
+
+	t.Run("valid reload is applied", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(path, []byte("log_level: warn\ncors_origins: [\"https://b.example\"]\n"), 0o600))
+		assert.Nil(t, m.Reload())
+		assert.Equal(t, "warn", m.Current().LogLevel)
+		assert.Equal(t, []string{"https://b.example"}, m.Current().CORSOrigins)
+		assert.Len(t, seen, 2)
+	})
+	t.Run("invalid reload keeps the old config", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(path, []byte("log_level: verbose\n"), 0o600))
+		assert.NotNil(t, m.Reload())
+		assert.Equal(t, "warn", m.Current().LogLevel)
+		assert.Len(t, seen, 2)
+	})
+	t.Run("static fields cannot be reloaded", func(t *testing.T) {
+		assert.Nil(t, os.WriteFile(path, []byte("log_level: error\ndb_name: other\n"), 0o600))
+		assert.NotNil(t, m.Reload())
+		assert.Equal(t, "tronics", m.Current().DBName)
+		assert.Equal(t, "warn", m.Current().LogLevel)
+	})
+}
@@ -0,0 +1,38 @@
+package correlation
+
+import (
+	"context"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/random"
+)
+
+const Header = "X-Correlation-ID"
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the correlation ID id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the correlation ID carried by ctx, or "".
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Middleware reuses the caller's correlation ID or generates one, echoes it
+// in the response and stores it in the request context.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(Header)
+		if id == "" {
+			id = random.String(12)
+		}
+		c.Request().Header.Set(Header, id)
+		c.Response().Header().Set(Header, id)
+		c.SetRequest(c.Request().WithContext(NewContext(c.Request().Context(), id)))
+		return next(c)
+	}
+}
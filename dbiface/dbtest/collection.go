@@ -0,0 +1,306 @@
+// Package dbtest provides an in-memory dbiface.CollectionAPI for the tests
+// that do not need a database.
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection stores documents in memory, in insertion order, with a unique
+// _id. Filters match top level fields on equality, array fields when they
+// hold the value, $in, $lt, $lte, $gt, $gte and $and. Find and FindOne
+// honor the sort, Find the limit. Updates support $set, $unset, $push and
+// upserts. Aggregate returns no documents. Its zero value is an empty
+// collection.
+type Collection struct {
+	mu   sync.Mutex
+	docs []bson.M
+}
+
+// Docs returns the documents, in insertion order.
+func (c *Collection) Docs() []bson.M {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bson.M(nil), c.docs...)
+}
+
+// document gives v the shape of a document read from the database. The
+// embedded documents keep their field order, as a bson.D.
+func document(v interface{}) bson.M {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(raw, &fields); err != nil {
+		panic(err)
+	}
+	doc := bson.M{}
+	for _, f := range fields {
+		doc[f.Key] = f.Value
+	}
+	return doc
+}
+
+func (c *Collection) match(doc bson.M, filter interface{}) bool {
+	if filter == nil {
+		return true
+	}
+	for k, want := range document(filter) {
+		if k == "$and" {
+			for _, f := range want.(bson.A) {
+				if !c.match(doc, f) {
+					return false
+				}
+			}
+			continue
+		}
+		ops, ok := operators(want)
+		if !ok {
+			if !equal(doc[k], want) {
+				return false
+			}
+			continue
+		}
+		for _, op := range ops {
+			if !operator(doc[k], op.Key, op.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// operators returns the query operators of a filter value, false when it is
+// a value to compare with.
+func operators(v interface{}) (bson.D, bool) {
+	ops, ok := v.(bson.D)
+	return ops, ok && len(ops) > 0 && strings.HasPrefix(ops[0].Key, "$")
+}
+
+// equal reports whether got is want, or an array holding it.
+func equal(got, want interface{}) bool {
+	if values, ok := got.(bson.A); ok {
+		for _, v := range values {
+			if reflect.DeepEqual(v, want) {
+				return true
+			}
+		}
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+func operator(got interface{}, op string, arg interface{}) bool {
+	if op == "$in" {
+		for _, v := range arg.(bson.A) {
+			if equal(got, v) {
+				return true
+			}
+		}
+		return false
+	}
+	cmp, ok := compare(got, arg)
+	switch op {
+	case "$lt":
+		return ok && cmp < 0
+	case "$lte":
+		return ok && cmp <= 0
+	case "$gt":
+		return ok && cmp > 0
+	case "$gte":
+		return ok && cmp >= 0
+	}
+	panic(fmt.Sprintf("dbtest: unsupported operator %s", op))
+}
+
+// compare orders the numbers, strings, dates and object ids; ok is false
+// when a and b are not comparable.
+func compare(a, b interface{}) (cmp int, ok bool) {
+	switch x := a.(type) {
+	case int32, int64, float64:
+		switch b.(type) {
+		case int32, int64, float64:
+			return compareFloats(number(x), number(b)), true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return compareFloats(float64(x), float64(y)), true
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return strings.Compare(x.Hex(), y.Hex()), true
+		}
+	}
+	return 0, false
+}
+
+func number(v interface{}) float64 {
+	switch n := v.(type) {
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	}
+	return v.(float64)
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// find returns the documents matching filter, ordered by sort.
+func (c *Collection) find(filter, sortBy interface{}) []bson.M {
+	var docs []bson.M
+	for _, doc := range c.docs {
+		if c.match(doc, filter) {
+			docs = append(docs, doc)
+		}
+	}
+	if sortBy == nil {
+		return docs
+	}
+	var keys bson.D
+	raw, err := bson.Marshal(sortBy)
+	if err != nil {
+		panic(err)
+	}
+	if err := bson.Unmarshal(raw, &keys); err != nil {
+		panic(err)
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range keys {
+			cmp, _ := compare(docs[i][key.Key], docs[j][key.Key])
+			if cmp != 0 {
+				return (cmp < 0) == (number(key.Value) > 0)
+			}
+		}
+		return false
+	})
+	return docs
+}
+
+func (c *Collection) InsertOne(ctx context.Context, v interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc := document(v)
+	if err := c.insert(doc); err != nil {
+		return nil, err
+	}
+	return &mongo.InsertOneResult{InsertedID: doc["_id"]}, nil
+}
+
+// insert adds doc, with a new _id if it has none, unless its _id is taken.
+func (c *Collection) insert(doc bson.M) error {
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = primitive.NewObjectID()
+	}
+	for _, d := range c.docs {
+		if reflect.DeepEqual(d["_id"], doc["_id"]) {
+			return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000, Message: "duplicate key"}}}
+		}
+	}
+	c.docs = append(c.docs, doc)
+	return nil
+}
+
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o := options.MergeFindOptions(opts...)
+	var docs []interface{}
+	for _, doc := range c.find(filter, o.Sort) {
+		if o.Limit != nil && *o.Limit > 0 && len(docs) == int(*o.Limit) {
+			break
+		}
+		docs = append(docs, doc)
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if docs := c.find(filter, options.MergeFindOneOptions(opts...).Sort); len(docs) > 0 {
+		return mongo.NewSingleResultFromDocument(docs[0], nil, nil)
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ops := document(update)
+	if docs := c.find(filter, nil); len(docs) > 0 {
+		apply(docs[0], ops)
+		return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+	}
+	if o := options.MergeUpdateOptions(opts...); o.Upsert == nil || !*o.Upsert {
+		return &mongo.UpdateResult{}, nil
+	}
+	doc := bson.M{}
+	for k, v := range document(filter) {
+		if _, ok := operators(v); !ok && !strings.HasPrefix(k, "$") {
+			doc[k] = v
+		}
+	}
+	apply(doc, ops)
+	if err := c.insert(doc); err != nil {
+		return nil, err
+	}
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: doc["_id"]}, nil
+}
+
+// apply runs the $set, $unset and $push of ops on doc.
+func apply(doc bson.M, ops bson.M) {
+	for op, fields := range ops {
+		for _, f := range fields.(bson.D) {
+			switch op {
+			case "$set":
+				doc[f.Key] = f.Value
+			case "$unset":
+				delete(doc, f.Key)
+			case "$push":
+				list, _ := doc[f.Key].(bson.A)
+				doc[f.Key] = append(list, f.Value)
+			default:
+				panic(fmt.Sprintf("dbtest: unsupported update operator %s", op))
+			}
+		}
+	}
+}
+
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, doc := range c.docs {
+		if c.match(doc, filter) {
+			c.docs = append(c.docs[:i], c.docs[i+1:]...)
+			return &mongo.DeleteResult{DeletedCount: 1}, nil
+		}
+	}
+	return &mongo.DeleteResult{}, nil
+}
+
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
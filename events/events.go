@@ -0,0 +1,124 @@
+// Package events carries the domain events of the catalog between the write
+// paths and their consumers, within the process.
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	ProductCreated Type = "product.created"
+	ProductUpdated Type = "product.updated"
+	ProductDeleted Type = "product.deleted"
+	UserCreated    Type = "user.created"
+)
+
+// ErrGap is returned when resuming after an event the bus no longer holds:
+// events were missed and the consumer must reload its state.
+var ErrGap = errors.New("events: the events following the given one are no longer available")
+
+// Event is a change made to an entity. Subject is the id of the entity and
+// Data its state after the change, nil for deletions.
+type Event struct {
+	// ID is set by the bus. IDs increase, across restarts too as they start
+	// from the clock.
+	ID uint64
+	// UID identifies the event across processes and redeliveries. It is set
+	// by the outbox, empty for the events published directly.
+	UID string
+	// Tenant owns the entity, empty when unknown.
+	Tenant  string
+	Type    Type
+	Subject string
+	Data    interface{}
+	Time    time.Time
+}
+
+// Bus fans events out to its subscribers and keeps the latest ones so they
+// can resume. A nil Bus drops the events published to it.
+type Bus struct {
+	mu      sync.Mutex
+	subs    map[chan Event]struct{}
+	last    uint64
+	history []Event
+	size    int
+}
+
+// NewBus returns a bus keeping the last history events.
+func NewBus(history int) *Bus {
+	return &Bus{subs: map[chan Event]struct{}{}, last: uint64(time.Now().UnixMicro()), size: history}
+}
+
+// Publish numbers e and sends it to the subscribers without blocking.
+// Subscribers whose buffer is full are dropped: their channel is closed.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.last++
+	e.ID = b.last
+	if b.size > 0 {
+		if len(b.history) == b.size {
+			b.history = append(b.history[:0], b.history[1:]...)
+		}
+		b.history = append(b.history, e)
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published from now on,
+// buffering up to buffer of them, and a function ending the subscription.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.subscribe(buffer)
+}
+
+// Resume is Subscribe that also returns the events published after the
+// event after, or ErrGap when some of them are no longer held.
+func (b *Bus) Resume(after uint64, buffer int) ([]Event, <-chan Event, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if after > b.last {
+		return nil, nil, nil, ErrGap
+	}
+	var missed []Event
+	if after < b.last {
+		if len(b.history) == 0 || b.history[0].ID > after+1 {
+			return nil, nil, nil, ErrGap
+		}
+		missed = append(missed, b.history[after+1-b.history[0].ID:]...)
+	}
+	ch, cancel := b.subscribe(buffer)
+	return missed, ch, cancel, nil
+}
+
+// subscribe must be called with mu held.
+func (b *Bus) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	b := NewBus(0)
+	events, cancel := b.Subscribe(1)
+	b.Publish(Event{Type: ProductCreated, Subject: "1"})
+	e := <-events
+	assert.Equal(t, "1", e.Subject)
+	assert.False(t, e.Time.IsZero())
+
+	t.Run("slow subscribers are dropped", func(t *testing.T) {
+		b.Publish(Event{Type: ProductUpdated, Subject: "1"})
+		b.Publish(Event{Type: ProductDeleted, Subject: "1"})
+		assert.Equal(t, ProductUpdated, (<-events).Type)
+		_, open := <-events
+		assert.False(t, open)
+		cancel()
+	})
+	t.Run("nil bus", func(t *testing.T) {
+		var nilBus *Bus
+		nilBus.Publish(Event{Type: ProductCreated})
+	})
+}
+
+func TestResume(t *testing.T) {
+	b := NewBus(2)
+	for _, subject := range []string{"1", "2", "3"} {
+		b.Publish(Event{Type: ProductUpdated, Subject: subject})
+	}
+	live, cancel := b.Subscribe(1)
+	b.Publish(Event{Type: ProductUpdated, Subject: "4"})
+	last := (<-live).ID
+	cancel()
+
+	t.Run("replays the missed events", func(t *testing.T) {
+		missed, events, cancel, err := b.Resume(last-2, 1)
+		assert.NoError(t, err)
+		defer cancel()
+		assert.Len(t, missed, 2)
+		assert.Equal(t, "3", missed[0].Subject)
+		assert.Equal(t, "4", missed[1].Subject)
+		b.Publish(Event{Type: ProductUpdated, Subject: "5"})
+		assert.Equal(t, last+1, (<-events).ID)
+	})
+	t.Run("up to date", func(t *testing.T) {
+		missed, _, cancel, err := b.Resume(last+1, 1)
+		assert.NoError(t, err)
+		cancel()
+		assert.Empty(t, missed)
+	})
+	t.Run("gaps", func(t *testing.T) {
+		_, _, _, err := b.Resume(last-3, 1)
+		assert.ErrorIs(t, err, ErrGap)
+		_, _, _, err = b.Resume(last+2, 1)
+		assert.ErrorIs(t, err, ErrGap)
+	})
+}
@@ -0,0 +1,313 @@
+// Package graph serves the product catalog over GraphQL. Resolvers go through
+// the ProductHandler of the REST API, so products are validated and
+// authorized the same way.
+package graph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"tronicscorp/handlers"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxLimit caps the number of products of a page.
+const MaxLimit = 100
+
+// Request is a GraphQL query sent as JSON.
+type Request struct {
+	Query         string                 `json:"query" validate:"required"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Handler executes GraphQL queries against the catalog.
+type Handler struct {
+	products *handlers.ProductHandler
+	schema   graphql.Schema
+}
+
+// New returns a handler resolving products with products, which must use the
+// v1 representation.
+func New(products *handlers.ProductHandler) (*Handler, error) {
+	h := &Handler{products: products}
+	schema, err := h.newSchema()
+	if err != nil {
+		return nil, err
+	}
+	h.schema = schema
+	return h, nil
+}
+
+// Serve executes the query of a POST request. The request may carry a token,
+// checked beforehand, for the mutations and the me query.
+func (h *Handler) Serve(c echo.Context) error {
+	var req Request
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req.Query == "" {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "The body must be a JSON object with a query")
+	}
+	ctx := c.Request().Context()
+	s := &session{
+		viewer:   viewerOf(c),
+		language: c.Request().Header.Get("Accept-Language"),
+		vendors:  newLoader(func(vendors []string) (map[string]int, error) { return h.vendorCounts(ctx, vendors) }),
+		byName:   newLoader(func(names []string) (map[string]*handlers.Product, error) { return h.byNames(ctx, names) }),
+	}
+	result := graphql.Do(graphql.Params{
+		Schema:         h.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(ctx, sessionKey{}, s),
+	})
+	if result.HasErrors() {
+		logging.FromContext(ctx).Warn("GraphQL query failed", "operation", req.OperationName, "errors", len(result.Errors))
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// viewer is the authenticated user of a request.
+type viewer struct {
+	username string
+	admin    bool
+}
+
+func viewerOf(c echo.Context) *viewer {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	username, _ := claims["user_id"].(string)
+	admin, _ := claims["authorized"].(bool)
+	return &viewer{username: username, admin: admin}
+}
+
+// session holds the state of a request: its user, its language and the
+// loaders batching the lookups of its resolvers.
+type session struct {
+	viewer   *viewer
+	language string
+	vendors  *loader[string, int]
+	byName   *loader[string, *handlers.Product]
+}
+
+type sessionKey struct{}
+
+func sessionOf(ctx context.Context) *session {
+	return ctx.Value(sessionKey{}).(*session)
+}
+
+// authenticated returns the user of the request, or an unauthorized error.
+func (s *session) authenticated() (*viewer, error) {
+	if s.viewer == nil {
+		return nil, gqlError{problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Authentication required")}
+	}
+	return s.viewer, nil
+}
+
+func (s *session) admin() error {
+	v, err := s.authenticated()
+	if err != nil {
+		return err
+	}
+	if !v.admin {
+		return gqlError{problem.New(http.StatusForbidden, problem.CodeForbidden, "Not authorized")}
+	}
+	return nil
+}
+
+func (h *Handler) vendorCounts(ctx context.Context, vendors []string) (map[string]int, error) {
+	counts, err := h.products.VendorCounts(ctx, vendors)
+	if err != nil {
+		return nil, gqlError{err}
+	}
+	return counts, nil
+}
+
+func (h *Handler) byNames(ctx context.Context, names []string) (map[string]*handlers.Product, error) {
+	products, err := h.products.ByNames(ctx, names)
+	if err != nil {
+		return nil, gqlError{err}
+	}
+	byName := make(map[string]*handlers.Product, len(products))
+	for i := range products {
+		byName[products[i].Name] = &products[i]
+	}
+	return byName, nil
+}
+
+// gqlError renders a problem as a GraphQL error, its code, status and field
+// errors in the extensions.
+type gqlError struct {
+	p *problem.Problem
+}
+
+func (e gqlError) Error() string {
+	return e.p.Detail
+}
+
+func (e gqlError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.p.Code, "status": e.p.Status}
+	if len(e.p.Errors) > 0 {
+		ext["errors"] = e.p.Errors
+	}
+	return ext
+}
+
+// fields maps stored field names to GraphQL ones.
+var fields = map[string]string{
+	"product_name": "name",
+	"is_essential": "essential",
+}
+
+var itemPrefix = regexp.MustCompile(`^\[\d+\]\.`)
+
+// inputError reports a problem on the input argument of a mutation, with
+// GraphQL field names.
+func inputError(p *problem.Problem) error {
+	for i, fe := range p.Errors {
+		name := itemPrefix.ReplaceAllString(fe.Field, "")
+		if graphName, ok := fields[name]; ok {
+			name = graphName
+		}
+		p.Errors[i].Field = "input." + name
+	}
+	return gqlError{p}
+}
+
+func (h *Handler) product(p graphql.ResolveParams) (interface{}, error) {
+	product, err := h.products.Get(p.Context, p.Args["id"].(string))
+	if err != nil {
+		if err.Code == problem.CodeProductNotFound {
+			return nil, nil
+		}
+		return nil, gqlError{err}
+	}
+	return product, nil
+}
+
+func (h *Handler) list(p graphql.ResolveParams) (interface{}, error) {
+	limit, offset := p.Args["limit"].(int), p.Args["offset"].(int)
+	if limit < 0 || limit > MaxLimit || offset < 0 {
+		return nil, gqlError{problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "limit must be between 0 and 100 and offset positive")}
+	}
+	q := handlers.ProductQuery{Skip: int64(offset), Limit: int64(limit) + 1}
+	if filter, ok := p.Args["filter"].(map[string]interface{}); ok {
+		q.Vendor, _ = filter["vendor"].(string)
+		q.Name, _ = filter["name"].(string)
+		if essential, ok := filter["essential"].(bool); ok {
+			q.Essential = &essential
+		}
+		if min, ok := filter["minPrice"].(int); ok {
+			q.MinPrice = &min
+		}
+		if max, ok := filter["maxPrice"].(int); ok {
+			q.MaxPrice = &max
+		}
+	}
+	if sort, ok := p.Args["sort"].(map[string]interface{}); ok {
+		q.Sort = sort["field"].(string)
+		if sort["order"] == descending {
+			q.Sort = "-" + q.Sort
+		}
+	}
+	products, err := h.products.List(p.Context, q)
+	if err != nil {
+		return nil, gqlError{err}
+	}
+	page := page{items: products}
+	if len(products) > limit {
+		page.items, page.hasMore = products[:limit], true
+	}
+	return page, nil
+}
+
+type page struct {
+	items   []handlers.Product
+	hasMore bool
+}
+
+func (h *Handler) create(p graphql.ResolveParams) (interface{}, error) {
+	s := sessionOf(p.Context)
+	if _, err := s.authenticated(); err != nil {
+		return nil, err
+	}
+	product, err := decodeInput(p.Args["input"], handlers.Product{})
+	if err != nil {
+		return nil, err
+	}
+	ids, perr := h.products.Create(p.Context, []handlers.Product{product}, s.language)
+	if perr != nil {
+		return nil, inputError(perr)
+	}
+	product.ID = ids[0].(primitive.ObjectID)
+	return product, nil
+}
+
+func (h *Handler) update(p graphql.ResolveParams) (interface{}, error) {
+	s := sessionOf(p.Context)
+	if _, err := s.authenticated(); err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(storedNames(p.Args["input"].(map[string]interface{})))
+	if err != nil {
+		return nil, err
+	}
+	product, perr := h.products.Update(p.Context, p.Args["id"].(string), bytes.NewReader(body), s.language)
+	if perr != nil {
+		return nil, inputError(perr)
+	}
+	return product, nil
+}
+
+func (h *Handler) delete(p graphql.ResolveParams) (interface{}, error) {
+	if err := sessionOf(p.Context).admin(); err != nil {
+		return nil, err
+	}
+	count, err := h.products.Delete(p.Context, p.Args["id"].(string))
+	if err != nil {
+		return nil, gqlError{err}
+	}
+	return count > 0, nil
+}
+
+func me(p graphql.ResolveParams) (interface{}, error) {
+	v := sessionOf(p.Context).viewer
+	if v == nil {
+		return nil, nil
+	}
+	return *v, nil
+}
+
+// decodeInput converts a product input argument to a product, through its
+// stored JSON names.
+func decodeInput(input interface{}, product handlers.Product) (handlers.Product, error) {
+	body, err := json.Marshal(storedNames(input.(map[string]interface{})))
+	if err != nil {
+		return product, err
+	}
+	err = json.Unmarshal(body, &product)
+	return product, err
+}
+
+func storedNames(input map[string]interface{}) map[string]interface{} {
+	stored := make(map[string]interface{}, len(input))
+	for name, value := range input {
+		for from, to := range fields {
+			if to == name {
+				name = from
+			}
+		}
+		stored[name] = value
+	}
+	return stored
+}
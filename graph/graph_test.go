@@ -0,0 +1,221 @@
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tronicscorp/handlers"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection serves products from memory and counts the queries.
+type fakeCollection struct {
+	products   []handlers.Product
+	finds      int
+	aggregates int
+}
+
+func (f *fakeCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	p := document.(handlers.Product)
+	f.products = append(f.products, p)
+	return &mongo.InsertOneResult{InsertedID: p.ID}, nil
+}
+
+func (f *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	f.finds++
+	var names []string
+	if in, ok := filter.(bson.M)["product_name"].(bson.M); ok {
+		names = in["$in"].([]string)
+	}
+	var docs []interface{}
+	for _, p := range f.products {
+		if names == nil || contains(names, p.Name) {
+			docs = append(docs, p)
+		}
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (f *fakeCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	for _, p := range f.products {
+		if p.ID == filter.(bson.M)["_id"] {
+			return mongo.NewSingleResultFromDocument(p, nil, nil)
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (f *fakeCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return &mongo.UpdateResult{MatchedCount: 1}, nil
+}
+
+func (f *fakeCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+func (f *fakeCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	f.aggregates++
+	counts := map[string]int{}
+	for _, p := range f.products {
+		counts[p.Vendor]++
+	}
+	var docs []interface{}
+	for vendor, count := range counts {
+		docs = append(docs, bson.M{"_id": vendor, "count": count})
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func catalog() *fakeCollection {
+	return &fakeCollection{products: []handlers.Product{
+		{ID: primitive.NewObjectID(), Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme", Accessories: []string{"case", "charger"}},
+		{ID: primitive.NewObjectID(), Name: "tablet", Price: 700, Currency: "EUR", Vendor: "acme", Accessories: []string{"charger"}},
+		{ID: primitive.NewObjectID(), Name: "case", Price: 20, Currency: "EUR", Vendor: "cases inc"},
+		{ID: primitive.NewObjectID(), Name: "charger", Price: 30, Currency: "EUR", Vendor: "acme"},
+	}}
+}
+
+type response struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func run(t *testing.T, col *fakeCollection, claims jwt.MapClaims, query string) response {
+	t.Helper()
+	h, err := New(&handlers.ProductHandler{Col: col})
+	assert.NoError(t, err)
+	body, _ := json.Marshal(Request{Query: query})
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	if claims != nil {
+		c.Set("user", &jwt.Token{Claims: claims, Valid: true})
+	}
+	assert.NoError(t, h.Serve(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var res response
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	return res
+}
+
+func TestProductsQuery(t *testing.T) {
+	col := catalog()
+	res := run(t, col, nil, `{ products(limit: 2) { hasMore items { name vendor { name productCount } accessories { name price } } } }`)
+	assert.Empty(t, res.Errors)
+	page := res.Data["products"].(map[string]interface{})
+	assert.Equal(t, true, page["hasMore"])
+	items := page["items"].([]interface{})
+	assert.Len(t, items, 2)
+	phone := items[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"name": "acme", "productCount": 3.0}, phone["vendor"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "case", "price": 20.0},
+		map[string]interface{}{"name": "charger", "price": 30.0},
+	}, phone["accessories"])
+	// One query for the page, one for the accessories of all products and one
+	// for the vendors.
+	assert.Equal(t, 2, col.finds)
+	assert.Equal(t, 1, col.aggregates)
+}
+
+func TestProductQuery(t *testing.T) {
+	col := catalog()
+	res := run(t, col, nil, `{ product(id: "`+col.products[0].ID.Hex()+`") { name } missing: product(id: "`+primitive.NewObjectID().Hex()+`") { name } }`)
+	assert.Empty(t, res.Errors)
+	assert.Equal(t, map[string]interface{}{"name": "phone"}, res.Data["product"])
+	assert.Nil(t, res.Data["missing"])
+
+	res = run(t, col, nil, `{ product(id: "1") { name } }`)
+	assert.Equal(t, "invalid_id", res.Errors[0].Extensions["code"])
+}
+
+func TestMe(t *testing.T) {
+	res := run(t, catalog(), nil, `{ me { username } }`)
+	assert.Nil(t, res.Data["me"])
+	res = run(t, catalog(), jwt.MapClaims{"user_id": "jane@tronics.com", "authorized": true}, `{ me { username isAdmin } }`)
+	assert.Equal(t, map[string]interface{}{"username": "jane@tronics.com", "isAdmin": true}, res.Data["me"])
+}
+
+func TestMutations(t *testing.T) {
+	user := jwt.MapClaims{"user_id": "jane@tronics.com", "authorized": false}
+	create := `mutation { createProduct(input: {name: "mouse", price: 10, currency: "EUR", vendor: "acme"}) { id name } }`
+
+	t.Run("create needs a token", func(t *testing.T) {
+		res := run(t, catalog(), nil, create)
+		assert.Equal(t, "unauthorized", res.Errors[0].Extensions["code"])
+	})
+	t.Run("create", func(t *testing.T) {
+		col := catalog()
+		res := run(t, col, user, create)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, "mouse", res.Data["createProduct"].(map[string]interface{})["name"])
+		assert.Len(t, col.products, 5)
+	})
+	t.Run("create validates the product", func(t *testing.T) {
+		res := run(t, catalog(), user, `mutation { createProduct(input: {price: 10, currency: "EUR", vendor: "acme"}) { id } }`)
+		assert.Equal(t, "validation_failed", res.Errors[0].Extensions["code"])
+		fieldErrors := res.Errors[0].Extensions["errors"].([]interface{})
+		assert.Equal(t, "input.name", fieldErrors[0].(map[string]interface{})["field"])
+	})
+	t.Run("update", func(t *testing.T) {
+		col := catalog()
+		res := run(t, col, user, `mutation { updateProduct(id: "`+col.products[0].ID.Hex()+`", input: {price: 450}) { name price } }`)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, map[string]interface{}{"name": "phone", "price": 450.0}, res.Data["updateProduct"])
+	})
+	t.Run("delete needs an admin", func(t *testing.T) {
+		col := catalog()
+		query := `mutation { deleteProduct(id: "` + col.products[0].ID.Hex() + `") }`
+		res := run(t, col, user, query)
+		assert.Equal(t, "forbidden", res.Errors[0].Extensions["code"])
+		res = run(t, col, jwt.MapClaims{"user_id": "admin@tronics.com", "authorized": true}, query)
+		assert.Empty(t, res.Errors)
+		assert.Equal(t, true, res.Data["deleteProduct"])
+	})
+}
+
+func TestLoader(t *testing.T) {
+	var batches [][]string
+	l := newLoader(func(keys []string) (map[string]int, error) {
+		batches = append(batches, keys)
+		return map[string]int{"a": 1, "b": 2}, nil
+	})
+	a, b, a2 := l.load("a"), l.load("b"), l.load("a")
+	v, err := b()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+	v, _ = a()
+	assert.Equal(t, 1, v)
+	v, _ = a2()
+	assert.Equal(t, 1, v)
+	v, _ = l.load("c")()
+	assert.Equal(t, 0, v)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, batches)
+
+	failing := newLoader(func(keys []string) (map[string]int, error) { return nil, errors.New("down") })
+	_, err = failing.load("a")()
+	assert.EqualError(t, err, "down")
+}
@@ -0,0 +1,56 @@
+package graph
+
+import "sync"
+
+// loader batches the keys requested while resolving a level of a query into
+// a single fetch, dataloader style. graphql-go resolves every field of a
+// level before calling the thunks they returned, so the first thunk called
+// fetches the keys of all its siblings at once. A loader caches its results
+// and serves a single request.
+type loader[K comparable, V any] struct {
+	fetch   func(keys []K) (map[K]V, error)
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	done    map[K]result[V]
+}
+
+type result[V any] struct {
+	value V
+	err   error
+}
+
+func newLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *loader[K, V] {
+	return &loader[K, V]{fetch: fetch, queued: map[K]bool{}, done: map[K]result[V]{}}
+}
+
+// load queues key for the next fetch and returns a thunk returning its
+// value, the zero value when the fetch did not return it.
+func (l *loader[K, V]) load(key K) func() (V, error) {
+	l.mu.Lock()
+	if _, ok := l.done[key]; !ok && !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		r, ok := l.done[key]
+		if !ok {
+			l.dispatch()
+			r = l.done[key]
+		}
+		return r.value, r.err
+	}
+}
+
+// dispatch fetches the pending keys. It must be called with mu held.
+func (l *loader[K, V]) dispatch() {
+	keys := l.pending
+	l.pending, l.queued = nil, map[K]bool{}
+	values, err := l.fetch(keys)
+	for _, key := range keys {
+		l.done[key] = result[V]{value: values[key], err: err}
+	}
+}
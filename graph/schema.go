@@ -0,0 +1,206 @@
+package graph
+
+import (
+	"tronicscorp/handlers"
+
+	"github.com/graphql-go/graphql"
+)
+
+const descending = "desc"
+
+var sortOrder = graphql.NewEnum(graphql.EnumConfig{
+	Name: "SortOrder",
+	Values: graphql.EnumValueConfigMap{
+		"ASC":  {Value: "asc"},
+		"DESC": {Value: descending},
+	},
+})
+
+// productSortField values are stored field names.
+var productSortField = graphql.NewEnum(graphql.EnumConfig{
+	Name: "ProductSortField",
+	Values: graphql.EnumValueConfigMap{
+		"NAME":     {Value: "product_name"},
+		"PRICE":    {Value: "price"},
+		"DISCOUNT": {Value: "discount"},
+		"VENDOR":   {Value: "vendor"},
+	},
+})
+
+var productSort = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "ProductSort",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"field": {Type: graphql.NewNonNull(productSortField)},
+		"order": {Type: sortOrder, DefaultValue: "asc"},
+	},
+})
+
+var productFilter = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "ProductFilter",
+	Description: "Products match every given criterion.",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"vendor":    {Type: graphql.String},
+		"essential": {Type: graphql.Boolean},
+		"name":      {Type: graphql.String, Description: "Part of the name, ignoring case."},
+		"minPrice":  {Type: graphql.Int},
+		"maxPrice":  {Type: graphql.Int},
+	},
+})
+
+// productInputFields are the fields of a product written by mutations.
+// Required ones are checked by the product validation, for the same errors
+// as the REST API.
+func productInputFields() graphql.InputObjectConfigFieldMap {
+	return graphql.InputObjectConfigFieldMap{
+		"name":        {Type: graphql.String},
+		"price":       {Type: graphql.Int},
+		"currency":    {Type: graphql.String},
+		"discount":    {Type: graphql.Int},
+		"vendor":      {Type: graphql.String},
+		"accessories": {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+		"essential":   {Type: graphql.Boolean},
+		"categories":  {Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+	}
+}
+
+var productInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:   "ProductInput",
+	Fields: productInputFields(),
+})
+
+var productPatch = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name:        "ProductPatch",
+	Description: "The fields to change, the others are kept.",
+	Fields:      productInputFields(),
+})
+
+var userType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "User",
+	Fields: graphql.Fields{
+		"username": {Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(viewer).username, nil
+		}},
+		"isAdmin": {Type: graphql.NewNonNull(graphql.Boolean), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(viewer).admin, nil
+		}},
+	},
+})
+
+var vendorType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Vendor",
+	Fields: graphql.Fields{
+		"name": {Type: graphql.NewNonNull(graphql.String), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(string), nil
+		}},
+		"productCount": {Type: graphql.NewNonNull(graphql.Int), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			count := sessionOf(p.Context).vendors.load(p.Source.(string))
+			return func() (interface{}, error) { return count() }, nil
+		}},
+	},
+})
+
+// productField resolves a field of a product with get.
+func productField(typ graphql.Output, get func(p handlers.Product) interface{}) *graphql.Field {
+	return &graphql.Field{Type: typ, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(handlers.Product)), nil
+	}}
+}
+
+func newProductType() *graphql.Object {
+	var productType *graphql.Object
+	productType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Product",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":         productField(graphql.NewNonNull(graphql.ID), func(p handlers.Product) interface{} { return p.ID.Hex() }),
+				"name":       productField(graphql.NewNonNull(graphql.String), func(p handlers.Product) interface{} { return p.Name }),
+				"price":      productField(graphql.NewNonNull(graphql.Int), func(p handlers.Product) interface{} { return p.Price }),
+				"currency":   productField(graphql.NewNonNull(graphql.String), func(p handlers.Product) interface{} { return p.Currency }),
+				"discount":   productField(graphql.NewNonNull(graphql.Int), func(p handlers.Product) interface{} { return p.Discount }),
+				"essential":  productField(graphql.NewNonNull(graphql.Boolean), func(p handlers.Product) interface{} { return p.IsEssential }),
+				"categories": productField(graphql.NewList(graphql.NewNonNull(graphql.String)), func(p handlers.Product) interface{} { return p.Categories }),
+				"vendor":     productField(graphql.NewNonNull(vendorType), func(p handlers.Product) interface{} { return p.Vendor }),
+				"accessories": {
+					Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(productType))),
+					Description: "The accessories sold in the catalog, by name.",
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						names := p.Source.(handlers.Product).Accessories
+						loads := make([]func() (*handlers.Product, error), len(names))
+						for i, name := range names {
+							loads[i] = sessionOf(p.Context).byName.load(name)
+						}
+						return func() (interface{}, error) {
+							accessories := []handlers.Product{}
+							for _, load := range loads {
+								accessory, err := load()
+								if err != nil {
+									return nil, err
+								}
+								if accessory != nil {
+									accessories = append(accessories, *accessory)
+								}
+							}
+							return accessories, nil
+						}, nil
+					},
+				},
+			}
+		}),
+	})
+	return productType
+}
+
+func (h *Handler) newSchema() (graphql.Schema, error) {
+	productType := newProductType()
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ProductPage",
+		Fields: graphql.Fields{
+			"items": {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(productType))), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(page).items, nil
+			}},
+			"hasMore": {Type: graphql.NewNonNull(graphql.Boolean), Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(page).hasMore, nil
+			}},
+		},
+	})
+	id := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)}
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"products": {
+				Type: graphql.NewNonNull(pageType),
+				Args: graphql.FieldConfigArgument{
+					"filter": {Type: productFilter},
+					"sort":   {Type: productSort},
+					"limit":  {Type: graphql.Int, DefaultValue: 20},
+					"offset": {Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: h.list,
+			},
+			"product": {Type: productType, Args: graphql.FieldConfigArgument{"id": id}, Resolve: h.product},
+			"me":      {Type: userType, Description: "The authenticated user, null without a token.", Resolve: me},
+		},
+	})
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createProduct": {
+				Type:    graphql.NewNonNull(productType),
+				Args:    graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(productInput)}},
+				Resolve: h.create,
+			},
+			"updateProduct": {
+				Type:    graphql.NewNonNull(productType),
+				Args:    graphql.FieldConfigArgument{"id": id, "input": {Type: graphql.NewNonNull(productPatch)}},
+				Resolve: h.update,
+			},
+			"deleteProduct": {
+				Type:        graphql.NewNonNull(graphql.Boolean),
+				Description: "Requires an admin token.",
+				Args:        graphql.FieldConfigArgument{"id": id},
+				Resolve:     h.delete,
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
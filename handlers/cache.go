@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"tronicscorp/cache"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// cacheBuffer is the number of events InvalidateOnEvents may fall behind.
+const cacheBuffer = 64
+
+// cached returns the value of key in c, read with load on a miss. Only the
+// values are cached, the problems of load are returned to every caller
+// waiting for it. The keys are those of the tenant of ctx. Without cache,
+// load is called.
+func cached[T any](ctx context.Context, c *cache.Cache, key string, load func(ctx context.Context) (T, *problem.Problem)) (T, *problem.Problem) {
+	if c == nil {
+		return load(ctx)
+	}
+	if t, ok := tenant.FromContext(ctx); ok {
+		key = t.ID + ":" + key
+	}
+	var v T
+	data, err := c.Load(ctx, key, func(ctx context.Context) ([]byte, error) {
+		v, p := load(ctx)
+		if p != nil {
+			return nil, p
+		}
+		return bson.Marshal(bson.M{"v": v})
+	})
+	if err != nil {
+		var p *problem.Problem
+		if errors.As(err, &p) {
+			return v, p
+		}
+		logging.FromContext(ctx).Error("Unable to read the cache", "key", key, "error", err)
+		return v, dbError(err, "Unable to read the products")
+	}
+	var doc struct {
+		V bson.RawValue `bson:"v"`
+	}
+	if err := bson.Unmarshal(data, &doc); err == nil {
+		err = doc.V.Unmarshal(&v)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to decode the cached value", "key", key, "error", err)
+		return load(ctx)
+	}
+	return v, nil
+}
+
+// queryKey is the cache key of the products selected by q: the parameters
+// are sorted, and only their first value is used, as by findProducts.
+func queryKey(q url.Values) string {
+	first := url.Values{}
+	for k, v := range q {
+		first.Set(k, v[0])
+	}
+	return "query:" + first.Encode()
+}
+
+// invalidate drops the cached products after a write. A failure leaves them
+// cached until their TTL.
+func (h *ProductHandler) invalidate(ctx context.Context) {
+	if h.Cache == nil {
+		return
+	}
+	if err := h.Cache.Invalidate(ctx); err != nil {
+		logging.FromContext(ctx).Error("Unable to invalidate the product cache", "error", err)
+	}
+}
+
+// cacheControl lets the clients keep the product reads for MaxAge. The
+// reads depend on the tenant, named by a header or the token, which the
+// shared caches must key on as well.
+func (h *ProductHandler) cacheControl(c echo.Context) {
+	if h.MaxAge > 0 {
+		c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.MaxAge.Seconds())))
+		c.Response().Header().Add(echo.HeaderVary, tenant.Header+", x-auth-token")
+	}
+}
+
+// InvalidateOnEvents invalidates the product cache on the product events of
+// bus until ctx is done, for the writes made outside of this handler: out of
+// band, or by other instances when the outbox relays their events here. Being
+// dropped by the bus for falling behind also invalidates it.
+func (h *ProductHandler) InvalidateOnEvents(ctx context.Context, bus *events.Bus) error {
+	for {
+		changes, cancel := bus.Subscribe(cacheBuffer)
+		if err := h.invalidateOn(ctx, changes); err != nil {
+			cancel()
+			return err
+		}
+		h.invalidate(ctx)
+	}
+}
+
+func (h *ProductHandler) invalidateOn(ctx context.Context, changes <-chan events.Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			switch e.Type {
+			case events.ProductCreated, events.ProductUpdated, events.ProductDeleted:
+				h.invalidate(ctx)
+			}
+		}
+	}
+}
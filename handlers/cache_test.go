@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+	"tronicscorp/cache"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCached(t *testing.T) {
+	ctx := context.Background()
+	c := &cache.Cache{Name: "products", Store: cache.NewLRU(10), TTL: time.Minute}
+	p := Product{ID: primitive.NewObjectID(), Name: "phone", Price: 100, Currency: "EUR", Vendor: "acme"}
+	loads := 0
+	load := func(ctx context.Context) ([]Product, *problem.Problem) {
+		loads++
+		return []Product{p}, nil
+	}
+	for i := 0; i < 2; i++ {
+		got, err := cached(ctx, c, "query:", load)
+		assert.Nil(t, err)
+		assert.Equal(t, []Product{p}, got)
+	}
+	assert.Equal(t, 1, loads)
+
+	empty, err := cached(ctx, c, "query:vendor=none", func(ctx context.Context) ([]Product, *problem.Problem) {
+		return []Product{}, nil
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, empty, "an empty list stays a list")
+	empty, _ = cached[[]Product](ctx, c, "query:vendor=none", nil)
+	assert.Equal(t, []Product{}, empty)
+
+	missing := func(ctx context.Context) (Product, *problem.Problem) {
+		return Product{}, problem.New(http.StatusNotFound, problem.CodeProductNotFound, "not found")
+	}
+	_, err = cached(ctx, c, "id:missing", missing)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.Status)
+	}
+}
+
+func TestQueryKey(t *testing.T) {
+	a := queryKey(url.Values{"vendor": {"acme"}, "category": {"phones", "ignored"}})
+	b := queryKey(url.Values{"category": {"phones"}, "vendor": {"acme"}})
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, queryKey(url.Values{"vendor": {"acme"}}))
+}
+
+func TestCacheControl(t *testing.T) {
+	rec := httptest.NewRecorder()
+	h := &ProductHandler{MaxAge: 30 * time.Second}
+	h.cacheControl(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/products", nil), rec))
+	assert.Equal(t, "public, max-age=30", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "X-Tenant-ID, x-auth-token", rec.Header().Get("Vary"), "the reads of each tenant are cached apart")
+}
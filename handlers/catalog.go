@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProductQuery selects a page of products.
+type ProductQuery struct {
+	Vendor    string
+	Essential *bool
+	// Name matches the products whose name contains it, ignoring case.
+	Name     string
+	MinPrice *int
+	MaxPrice *int
+	// Sort is a stored field name, prefixed with "-" for a descending order.
+	// Products are ordered by id when empty and among equal values.
+	Sort  string
+	Skip  int64
+	Limit int64
+}
+
+func (q ProductQuery) filter() bson.M {
+	filter := bson.M{}
+	if q.Vendor != "" {
+		filter["vendor"] = q.Vendor
+	}
+	if q.Essential != nil {
+		filter["is_essential"] = *q.Essential
+	}
+	if q.Name != "" {
+		filter["product_name"] = bson.M{"$regex": regexp.QuoteMeta(q.Name), "$options": "i"}
+	}
+	price := bson.M{}
+	if q.MinPrice != nil {
+		price["$gte"] = *q.MinPrice
+	}
+	if q.MaxPrice != nil {
+		price["$lte"] = *q.MaxPrice
+	}
+	if len(price) > 0 {
+		filter["price"] = price
+	}
+	return filter
+}
+
+func (q ProductQuery) options() *options.FindOptions {
+	sort := bson.D{}
+	if q.Sort != "" {
+		field, order := strings.TrimPrefix(q.Sort, "-"), 1
+		if strings.HasPrefix(q.Sort, "-") {
+			order = -1
+		}
+		sort = append(sort, bson.E{Key: field, Value: order})
+	}
+	sort = append(sort, bson.E{Key: "_id", Value: 1})
+	opts := options.Find().SetSort(sort).SetSkip(q.Skip)
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	return opts
+}
+
+// Get returns the product id.
+func (h *ProductHandler) Get(ctx context.Context, id string) (Product, *problem.Problem) {
+	return cached(ctx, h.Cache, "id:"+id, func(ctx context.Context) (Product, *problem.Problem) {
+		return findProduct(ctx, id, h.Col)
+	})
+}
+
+// List returns the products selected by q.
+func (h *ProductHandler) List(ctx context.Context, q ProductQuery) ([]Product, *problem.Problem) {
+	return h.find(ctx, q.filter(), q.options())
+}
+
+// Each calls fn with the products selected by q as they are read, until fn
+// fails. Data layer errors are problems, the errors of fn are returned as is.
+func (h *ProductHandler) Each(ctx context.Context, q ProductQuery, fn func(p Product) error) error {
+	cursor, err := h.Col.Find(ctx, q.filter(), q.options())
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the products", "error", err)
+		return dbError(err, "Unable to find the products")
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var p Product
+		if err := cursor.Decode(&p); err != nil {
+			logging.FromContext(ctx).Error("Unable to read the cursor", "error", err)
+			return dbError(err, "Unable to parse retrieved products")
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the cursor", "error", err)
+		return dbError(err, "Unable to parse retrieved products")
+	}
+	return nil
+}
+
+// ByNames returns the products named in names, in no particular order.
+func (h *ProductHandler) ByNames(ctx context.Context, names []string) ([]Product, *problem.Problem) {
+	return h.find(ctx, bson.M{"product_name": bson.M{"$in": names}})
+}
+
+func (h *ProductHandler) find(ctx context.Context, filter bson.M, opts ...*options.FindOptions) ([]Product, *problem.Problem) {
+	products := []Product{}
+	cursor, err := h.Col.Find(ctx, filter, opts...)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the products", "error", err)
+		return nil, dbError(err, "Unable to find the products")
+	}
+	if err := cursor.All(ctx, &products); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the cursor", "error", err)
+		return nil, dbError(err, "Unable to parse retrieved products")
+	}
+	return products, nil
+}
+
+// VendorCounts returns the number of products of each vendor. Vendors
+// without products are left out.
+func (h *ProductHandler) VendorCounts(ctx context.Context, vendors []string) (map[string]int, *problem.Problem) {
+	cursor, err := h.Col.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"vendor": bson.M{"$in": vendors}}},
+		bson.M{"$group": bson.M{"_id": "$vendor", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to count the products", "error", err)
+		return nil, dbError(err, "Unable to count the products")
+	}
+	var groups []struct {
+		Vendor string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the cursor", "error", err)
+		return nil, dbError(err, "Unable to count the products")
+	}
+	counts := make(map[string]int, len(groups))
+	for _, g := range groups {
+		counts[g.Vendor] = g.Count
+	}
+	return counts, nil
+}
+
+// Create validates products against the current rules, with messages in the
+// language of acceptLanguage, and inserts them. It returns their ids, also set
+// on products.
+func (h *ProductHandler) Create(ctx context.Context, products []Product, acceptLanguage string) ([]interface{}, *problem.Problem) {
+	pv := h.validator(ctx)
+	trans := translator(acceptLanguage)
+	for i, product := range products {
+		if err := pv.Validate(product); err != nil {
+			logging.FromContext(ctx).Error("Unable to validate the product", "product_name", product.Name, "error", err)
+			return nil, renameFields(validationProblem(err, trans, fmt.Sprintf("[%d].", i)), h.representation())
+		}
+		if p := pv.checkCategories(ctx, product, trans, fmt.Sprintf("[%d].", i)); p != nil {
+			return nil, renameFields(p, h.representation())
+		}
+	}
+	var ids []interface{}
+	err := record(ctx, h.Outbox, h.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		var err *problem.Problem
+		ids, err = insertProducts(ctx, products, h.Col)
+		if err != nil {
+			return nil, err
+		}
+		evs := make([]events.Event, len(products))
+		for i, p := range products {
+			evs[i] = events.Event{Type: events.ProductCreated, Subject: p.ID.Hex(), Data: p}
+		}
+		return evs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.invalidate(ctx)
+	return ids, nil
+}
+
+// Update applies body, a partial product in the handler representation, to
+// the product id and saves it once validated.
+func (h *ProductHandler) Update(ctx context.Context, id string, body io.Reader, acceptLanguage string) (Product, *problem.Problem) {
+	// The body is read once: the write runs again when its transaction is
+	// retried.
+	data, er := io.ReadAll(body)
+	if er != nil {
+		logging.FromContext(ctx).Error("Unable to read the request payload", "error", er)
+		return Product{}, problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to read the request payload").WithCause(er)
+	}
+	var product Product
+	err := record(ctx, h.Outbox, h.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		var err *problem.Problem
+		product, err = modifyProduct(ctx, id, bytes.NewReader(data), h.representation(), h.validator(ctx), translator(acceptLanguage), h.Col)
+		if err != nil {
+			return nil, err
+		}
+		return []events.Event{{Type: events.ProductUpdated, Subject: id, Data: product}}, nil
+	})
+	if err == nil {
+		h.invalidate(ctx)
+	}
+	return product, err
+}
+
+// Delete deletes the product id and returns the number of deleted products.
+func (h *ProductHandler) Delete(ctx context.Context, id string) (int64, *problem.Problem) {
+	var count int64
+	err := record(ctx, h.Outbox, h.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		var err *problem.Problem
+		count, err = deleteProduct(ctx, id, h.Col)
+		if err != nil || count == 0 {
+			return nil, err
+		}
+		return []events.Event{{Type: events.ProductDeleted, Subject: id}}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		h.invalidate(ctx)
+	}
+	return count, nil
+}
@@ -0,0 +1,550 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"tronicscorp/dbiface"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SlugPattern matches the category slugs: lowercase letters and digits,
+// separated by hyphens.
+const SlugPattern = `^[a-z0-9]+(-[a-z0-9]+)*$`
+
+var validSlug = regexp.MustCompile(SlugPattern)
+
+// Category is a node of the product taxonomy, a tree of any depth. Products
+// belong to any number of categories, named by their slug, which never
+// changes.
+type Category struct {
+	ID   primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty" openapi:"readonly"`
+	Slug string             `json:"slug" bson:"slug" validate:"required,max=64"`
+	Name string             `json:"name" bson:"name" validate:"required,max=100"`
+	// Parent is the slug of the parent category, empty for the roots.
+	Parent string `json:"parent,omitempty" bson:"parent"`
+	// Ancestors are the slugs of the ancestors, the root first.
+	Ancestors []string `json:"ancestors,omitempty" bson:"ancestors" openapi:"readonly"`
+	// Position orders the siblings, then their slug.
+	Position int `json:"position" bson:"position"`
+	// Attributes apply to the products of the category and of its
+	// descendants.
+	Attributes map[string]string `json:"attributes,omitempty" bson:"attributes,omitempty"`
+	// Children are the subcategories, in order. Only set in the responses.
+	Children []Category `json:"children,omitempty" bson:"-" openapi:"readonly"`
+}
+
+// CategoryUpdate replaces the name, position and attributes of a category.
+type CategoryUpdate struct {
+	Name       string            `json:"name" validate:"required,max=100"`
+	Position   int               `json:"position"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// CategoryMove moves a category, with its descendants, under another parent.
+type CategoryMove struct {
+	// Parent is the slug of the new parent, the category becoming a root
+	// when empty.
+	Parent string `json:"parent"`
+	// Position, when set, replaces the position of the category.
+	Position *int `json:"position,omitempty"`
+}
+
+// CategoryMerge merges a category into another.
+type CategoryMerge struct {
+	// Into is the slug of the category receiving the products and the
+	// subcategories.
+	Into string `json:"into" validate:"required"`
+}
+
+// CategoriesHandler manages the product taxonomy.
+type CategoriesHandler struct {
+	Col dbiface.CollectionAPI
+	// Products renders the products of the categories in its representation,
+	// and saves the assignments changed by merges.
+	Products *ProductHandler
+}
+
+// ListCategories returns the category tree, roots first.
+func (h *CategoriesHandler) ListCategories(c echo.Context) error {
+	all, err := h.all(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	roots := tree(all, "")
+	if roots == nil {
+		roots = []Category{}
+	}
+	return c.JSON(http.StatusOK, roots)
+}
+
+// GetCategory returns a category with its descendants.
+func (h *CategoriesHandler) GetCategory(c echo.Context) error {
+	all, err := h.all(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	for _, cat := range all {
+		if cat.Slug == c.Param("slug") {
+			cat.Children = tree(all, cat.Slug)
+			return c.JSON(http.StatusOK, cat)
+		}
+	}
+	return categoryNotFound(c.Param("slug"))
+}
+
+// CreateCategory adds a category, under its parent if it has one.
+func (h *CategoriesHandler) CreateCategory(c echo.Context) error {
+	ctx := c.Request().Context()
+	trans := translator(c.Request().Header.Get("Accept-Language"))
+	var cat Category
+	if err := h.bind(c, &cat); err != nil {
+		return err
+	}
+	if !validSlug.MatchString(cat.Slug) {
+		return validationProblem(ruleViolations{{Field: "slug", Rule: "slug"}}, trans, "")
+	}
+	cat.Ancestors, cat.Children = nil, nil
+	if cat.Parent != "" {
+		parent, err := h.reference(ctx, "parent", cat.Parent, trans)
+		if err != nil {
+			return err
+		}
+		cat.Ancestors = lineage(parent)
+	}
+	if err := h.Col.FindOne(ctx, bson.M{"slug": cat.Slug}).Err(); err != mongo.ErrNoDocuments {
+		if err != nil {
+			logging.FromContext(ctx).Error("Unable to find the category", "slug", cat.Slug, "error", err)
+			return dbError(err, "Unable to find the category")
+		}
+		return categoryExists(cat.Slug)
+	}
+	cat.ID = primitive.NewObjectID()
+	_, err := h.Col.InsertOne(ctx, cat)
+	if mongo.IsDuplicateKeyError(err) {
+		return categoryExists(cat.Slug)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to insert the category", "error", err)
+		return dbError(err, "Unable to create the category")
+	}
+	logging.FromContext(ctx).Info("Category created", "slug", cat.Slug, "parent", cat.Parent)
+	return c.JSON(http.StatusCreated, cat)
+}
+
+// UpdateCategory replaces the name, position and attributes of a category.
+// Moves and merges change its place in the tree.
+func (h *CategoriesHandler) UpdateCategory(c echo.Context) error {
+	ctx := c.Request().Context()
+	var update CategoryUpdate
+	if err := h.bind(c, &update); err != nil {
+		return err
+	}
+	res, err := h.Col.UpdateOne(ctx, bson.M{"slug": c.Param("slug")}, bson.M{"$set": bson.M{
+		"name": update.Name, "position": update.Position, "attributes": update.Attributes,
+	}})
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to update the category", "slug", c.Param("slug"), "error", err)
+		return dbError(err, "Unable to update the category")
+	}
+	if res.MatchedCount == 0 {
+		return categoryNotFound(c.Param("slug"))
+	}
+	cat, p := h.find(ctx, c.Param("slug"))
+	if p != nil {
+		return p
+	}
+	return c.JSON(http.StatusOK, cat)
+}
+
+// DeleteCategory deletes a category without subcategories nor products.
+func (h *CategoriesHandler) DeleteCategory(c echo.Context) error {
+	ctx := c.Request().Context()
+	cat, p := h.find(ctx, c.Param("slug"))
+	if p != nil {
+		return p
+	}
+	for _, used := range []struct {
+		col    dbiface.CollectionAPI
+		filter bson.M
+	}{
+		{h.Col, bson.M{"parent": cat.Slug}},
+		{h.Products.Col, bson.M{"categories": cat.Slug}},
+	} {
+		err := used.col.FindOne(ctx, used.filter).Err()
+		if err == nil {
+			return problem.New(http.StatusConflict, problem.CodeCategoryNotEmpty,
+				"Category "+cat.Slug+" has subcategories or products, merge it into another instead")
+		}
+		if err != mongo.ErrNoDocuments {
+			logging.FromContext(ctx).Error("Unable to check the category is empty", "slug", cat.Slug, "error", err)
+			return dbError(err, "Unable to delete the category")
+		}
+	}
+	if _, err := h.Col.DeleteOne(ctx, bson.M{"_id": cat.ID}); err != nil {
+		logging.FromContext(ctx).Error("Unable to delete the category", "slug", cat.Slug, "error", err)
+		return dbError(err, "Unable to delete the category")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// MoveCategory moves a category and its descendants under another parent.
+// Products keep their categories.
+func (h *CategoriesHandler) MoveCategory(c echo.Context) error {
+	ctx := c.Request().Context()
+	trans := translator(c.Request().Header.Get("Accept-Language"))
+	var move CategoryMove
+	if err := h.bind(c, &move); err != nil {
+		return err
+	}
+	cat, p := h.find(ctx, c.Param("slug"))
+	if p != nil {
+		return p
+	}
+	var ancestors []string
+	if move.Parent != "" {
+		parent, p := h.reference(ctx, "parent", move.Parent, trans)
+		if p != nil {
+			return p
+		}
+		if parent.Slug == cat.Slug || contains(parent.Ancestors, cat.Slug) {
+			return categoryCycle(cat.Slug, parent.Slug)
+		}
+		ancestors = lineage(parent)
+	}
+	set := bson.M{"parent": move.Parent, "ancestors": ancestors}
+	if move.Position != nil {
+		set["position"] = *move.Position
+	}
+	p = record(ctx, h.Products.Outbox, h.Products.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": cat.ID}, bson.M{"$set": set}); err != nil {
+			logging.FromContext(ctx).Error("Unable to move the category", "slug", cat.Slug, "error", err)
+			return nil, dbError(err, "Unable to move the category")
+		}
+		return nil, h.reroot(ctx, cat.Slug, ancestors)
+	})
+	if p != nil {
+		return p
+	}
+	cat, p = h.find(ctx, cat.Slug)
+	if p != nil {
+		return p
+	}
+	return c.JSON(http.StatusOK, cat)
+}
+
+// MergeCategory merges a category into another: its products and its
+// subcategories move to the other, then it is deleted. Its attributes are
+// dropped. The products changed are published as updated.
+func (h *CategoriesHandler) MergeCategory(c echo.Context) error {
+	ctx := c.Request().Context()
+	trans := translator(c.Request().Header.Get("Accept-Language"))
+	var merge CategoryMerge
+	if err := h.bind(c, &merge); err != nil {
+		return err
+	}
+	from, p := h.find(ctx, c.Param("slug"))
+	if p != nil {
+		return p
+	}
+	into, p := h.reference(ctx, "into", merge.Into, trans)
+	if p != nil {
+		return p
+	}
+	if into.Slug == from.Slug || contains(into.Ancestors, from.Slug) {
+		return categoryCycle(from.Slug, into.Slug)
+	}
+	// Each step is done again when the merge is retried after a failure
+	// without transaction, until the category is deleted.
+	p = record(ctx, h.Products.Outbox, h.Products.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		products, p := h.Products.find(ctx, bson.M{"categories": from.Slug})
+		if p != nil {
+			return nil, p
+		}
+		evs := make([]events.Event, 0, len(products))
+		for _, product := range products {
+			product.Categories = replaceCategory(product.Categories, from.Slug, into.Slug)
+			if _, err := h.Products.Col.UpdateOne(ctx, bson.M{"_id": product.ID}, bson.M{"$set": bson.M{"categories": product.Categories}}); err != nil {
+				logging.FromContext(ctx).Error("Unable to reassign the product", "id", product.ID.Hex(), "error", err)
+				return nil, dbError(err, "Unable to reassign the products")
+			}
+			evs = append(evs, events.Event{Type: events.ProductUpdated, Subject: product.ID.Hex(), Data: product})
+		}
+		children, p := h.query(ctx, bson.M{"parent": from.Slug})
+		if p != nil {
+			return nil, p
+		}
+		ancestors := lineage(into)
+		for _, child := range children {
+			if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": child.ID}, bson.M{"$set": bson.M{"parent": into.Slug, "ancestors": ancestors}}); err != nil {
+				logging.FromContext(ctx).Error("Unable to move the category", "slug", child.Slug, "error", err)
+				return nil, dbError(err, "Unable to move the subcategories")
+			}
+			if p := h.reroot(ctx, child.Slug, ancestors); p != nil {
+				return nil, p
+			}
+		}
+		if _, err := h.Col.DeleteOne(ctx, bson.M{"_id": from.ID}); err != nil {
+			logging.FromContext(ctx).Error("Unable to delete the category", "slug", from.Slug, "error", err)
+			return nil, dbError(err, "Unable to delete the category")
+		}
+		return evs, nil
+	})
+	if p != nil {
+		return p
+	}
+	h.Products.invalidate(ctx)
+	logging.FromContext(ctx).Info("Category merged", "slug", from.Slug, "into", into.Slug)
+	into, p = h.find(ctx, into.Slug)
+	if p != nil {
+		return p
+	}
+	return c.JSON(http.StatusOK, into)
+}
+
+// GetCategoryProducts lists the products of a category and of its
+// descendants, with the attributes they inherit from their categories.
+func (h *CategoriesHandler) GetCategoryProducts(c echo.Context) error {
+	ctx := c.Request().Context()
+	all, p := h.all(ctx)
+	if p != nil {
+		return p
+	}
+	bySlug := make(map[string]Category, len(all))
+	for _, cat := range all {
+		bySlug[cat.Slug] = cat
+	}
+	if _, ok := bySlug[c.Param("slug")]; !ok {
+		return categoryNotFound(c.Param("slug"))
+	}
+	slugs := []string{c.Param("slug")}
+	for _, cat := range all {
+		if contains(cat.Ancestors, c.Param("slug")) {
+			slugs = append(slugs, cat.Slug)
+		}
+	}
+	products, p := h.Products.find(ctx, bson.M{"categories": bson.M{"$in": slugs}}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if p != nil {
+		return p
+	}
+	for i := range products {
+		products[i].Attributes = inherit(products[i], bySlug)
+	}
+	return c.JSON(http.StatusOK, h.Products.encodeAll(products))
+}
+
+// inherit returns the attributes of p and those of its categories and of
+// their ancestors. The attributes of p win, then those of its first
+// categories, and within a category those of the nearest one.
+func inherit(p Product, categories map[string]Category) map[string]string {
+	attributes := map[string]string{}
+	for i := len(p.Categories) - 1; i >= 0; i-- {
+		cat := categories[p.Categories[i]]
+		for _, slug := range append(cat.Ancestors[:len(cat.Ancestors):len(cat.Ancestors)], cat.Slug) {
+			for k, v := range categories[slug].Attributes {
+				attributes[k] = v
+			}
+		}
+	}
+	for k, v := range p.Attributes {
+		attributes[k] = v
+	}
+	if len(attributes) == 0 {
+		return nil
+	}
+	return attributes
+}
+
+// tree returns the children of parent in cats, with their descendants, in
+// order.
+func tree(cats []Category, parent string) []Category {
+	children := map[string][]Category{}
+	for _, cat := range cats {
+		children[cat.Parent] = append(children[cat.Parent], cat)
+	}
+	var build func(parent string) []Category
+	build = func(parent string) []Category {
+		nodes := children[parent]
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].Position != nodes[j].Position {
+				return nodes[i].Position < nodes[j].Position
+			}
+			return nodes[i].Slug < nodes[j].Slug
+		})
+		for i := range nodes {
+			nodes[i].Children = build(nodes[i].Slug)
+		}
+		return nodes
+	}
+	return build(parent)
+}
+
+// lineage returns the ancestors of the children of cat.
+func lineage(cat Category) []string {
+	return append(cat.Ancestors[:len(cat.Ancestors):len(cat.Ancestors)], cat.Slug)
+}
+
+// replaceCategory returns categories with from replaced by into, once.
+func replaceCategory(categories []string, from, into string) []string {
+	replaced := make([]string, 0, len(categories))
+	for _, slug := range categories {
+		if slug == from {
+			slug = into
+		}
+		if !contains(replaced, slug) {
+			replaced = append(replaced, slug)
+		}
+	}
+	return replaced
+}
+
+// reroot updates the ancestors of the descendants of slug, now under
+// ancestors. It only depends on their current ancestors, and can be run
+// again.
+func (h *CategoriesHandler) reroot(ctx context.Context, slug string, ancestors []string) *problem.Problem {
+	descendants, p := h.query(ctx, bson.M{"ancestors": slug})
+	if p != nil {
+		return p
+	}
+	for _, d := range descendants {
+		below := d.Ancestors[indexOf(d.Ancestors, slug)+1:]
+		updated := append(append(ancestors[:len(ancestors):len(ancestors)], slug), below...)
+		if _, err := h.Col.UpdateOne(ctx, bson.M{"_id": d.ID}, bson.M{"$set": bson.M{"ancestors": updated}}); err != nil {
+			logging.FromContext(ctx).Error("Unable to move the category", "slug", d.Slug, "error", err)
+			return dbError(err, "Unable to move the subcategories")
+		}
+	}
+	return nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// all returns every category.
+func (h *CategoriesHandler) all(ctx context.Context) ([]Category, *problem.Problem) {
+	return h.query(ctx, bson.M{})
+}
+
+func (h *CategoriesHandler) query(ctx context.Context, filter bson.M) ([]Category, *problem.Problem) {
+	cursor, err := h.Col.Find(ctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the categories", "error", err)
+		return nil, dbError(err, "Unable to find the categories")
+	}
+	var cats []Category
+	if err := cursor.All(ctx, &cats); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the categories", "error", err)
+		return nil, dbError(err, "Unable to read the categories")
+	}
+	return cats, nil
+}
+
+func (h *CategoriesHandler) find(ctx context.Context, slug string) (Category, *problem.Problem) {
+	var cat Category
+	err := h.Col.FindOne(ctx, bson.M{"slug": slug}).Decode(&cat)
+	if err == mongo.ErrNoDocuments {
+		return cat, categoryNotFound(slug)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the category", "slug", slug, "error", err)
+		return cat, dbError(err, "Unable to find the category")
+	}
+	return cat, nil
+}
+
+// reference returns the category slug named by the field of a request body,
+// which fails validation when it does not exist.
+func (h *CategoriesHandler) reference(ctx context.Context, field, slug string, trans ut.Translator) (Category, *problem.Problem) {
+	cat, p := h.find(ctx, slug)
+	if p != nil && p.Code == problem.CodeCategoryNotFound {
+		return cat, validationProblem(ruleViolations{{Field: field, Rule: "category_exists", Params: []string{slug}}}, trans, "")
+	}
+	return cat, p
+}
+
+func (h *CategoriesHandler) bind(c echo.Context, body interface{}) *problem.Problem {
+	if err := c.Bind(body); err != nil {
+		logging.FromContext(c.Request().Context()).Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	}
+	if err := v.Struct(body); err != nil {
+		return validationProblem(err, translator(c.Request().Header.Get("Accept-Language")), "")
+	}
+	return nil
+}
+
+// checkCategories checks that the categories of product exist, when the
+// validator knows them, and that product has the accessories its categories
+// and their ancestors require.
+func (p *ProductValidator) checkCategories(ctx context.Context, product Product, trans ut.Translator, prefix string) *problem.Problem {
+	if len(product.Categories) == 0 {
+		return nil
+	}
+	if p.categories == nil {
+		if violations := p.rules.checkAccessories(product, product.Categories); len(violations) > 0 {
+			return validationProblem(violations, trans, prefix)
+		}
+		return nil
+	}
+	cursor, err := p.categories.Find(ctx, bson.M{"slug": bson.M{"$in": product.Categories}}, options.Find().SetProjection(bson.M{"slug": 1, "ancestors": 1}))
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the categories", "error", err)
+		return dbError(err, "Unable to find the categories")
+	}
+	var found []Category
+	if err := cursor.All(ctx, &found); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the categories", "error", err)
+		return dbError(err, "Unable to read the categories")
+	}
+	known := make(map[string][]string, len(found))
+	for _, cat := range found {
+		known[cat.Slug] = cat.Ancestors
+	}
+	var violations ruleViolations
+	var slugs []string
+	for _, slug := range product.Categories {
+		ancestors, ok := known[slug]
+		if !ok {
+			violations = append(violations, ruleViolation{Field: "categories", Rule: "category_exists", Params: []string{slug}})
+			continue
+		}
+		for _, category := range append([]string{slug}, ancestors...) {
+			if !contains(slugs, category) {
+				slugs = append(slugs, category)
+			}
+		}
+	}
+	violations = append(violations, p.rules.checkAccessories(product, slugs)...)
+	if len(violations) > 0 {
+		return validationProblem(violations, trans, prefix)
+	}
+	return nil
+}
+
+func categoryNotFound(slug string) *problem.Problem {
+	return problem.New(http.StatusNotFound, problem.CodeCategoryNotFound, "Category "+slug+" does not exist")
+}
+
+func categoryExists(slug string) *problem.Problem {
+	return problem.New(http.StatusConflict, problem.CodeCategoryExists, "Category "+slug+" already exists")
+}
+
+func categoryCycle(slug, under string) *problem.Problem {
+	return problem.New(http.StatusConflict, problem.CodeCategoryCycle, "Category "+slug+" cannot go under itself or its descendant "+under)
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCategories(t *testing.T) {
+	ctx := tenant.NewContext(context.Background(), tenant.Tenant{ID: "acme"})
+	categories := tenant.Scope(&dbtest.Collection{})
+	bus := events.NewBus(0)
+	ph := &ProductHandler{Col: tenant.Scope(&dbtest.Collection{}), Events: bus, Categories: categories}
+	h := &CategoriesHandler{Col: categories, Products: ph}
+	e := echo.New()
+	serve := func(handler echo.HandlerFunc, method, slug, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("slug")
+		c.SetParamValues(slug)
+		if err := handler(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec
+	}
+	category := func(rec *httptest.ResponseRecorder) Category {
+		var cat Category
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cat))
+		return cat
+	}
+	e.HTTPErrorHandler = HTTPErrorHandler
+
+	for _, body := range []string{
+		`{"slug": "electronics", "name": "Electronics"}`,
+		`{"slug": "phones", "name": "Phones", "parent": "electronics", "attributes": {"warranty": "2y", "color": "any"}}`,
+		`{"slug": "smartphones", "name": "Smartphones", "parent": "phones", "attributes": {"os": "any"}}`,
+		`{"slug": "audio", "name": "Audio", "parent": "electronics", "position": 1}`,
+	} {
+		rec := serve(h.CreateCategory, http.MethodPost, "", body)
+		assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	t.Run("create", func(t *testing.T) {
+		rec := serve(h.CreateCategory, http.MethodPost, "", `{"slug": "Phones!", "name": "Phones"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"rule":"slug"`)
+		rec = serve(h.CreateCategory, http.MethodPost, "", `{"slug": "phones", "name": "Phones"}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"category_exists"`)
+		rec = serve(h.CreateCategory, http.MethodPost, "", `{"slug": "tablets", "name": "Tablets", "parent": "computers"}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"rule":"category_exists"`)
+	})
+
+	t.Run("tree", func(t *testing.T) {
+		var roots []Category
+		rec := serve(h.ListCategories, http.MethodGet, "", "")
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &roots))
+		if assert.Len(t, roots, 1) && assert.Len(t, roots[0].Children, 2) {
+			assert.Equal(t, "phones", roots[0].Children[0].Slug, "ordered by position")
+			assert.Equal(t, "audio", roots[0].Children[1].Slug)
+			assert.Equal(t, []string{"electronics", "phones"}, roots[0].Children[0].Children[0].Ancestors)
+		}
+		phones := category(serve(h.GetCategory, http.MethodGet, "phones", ""))
+		assert.Equal(t, "electronics", phones.Parent)
+		assert.Len(t, phones.Children, 1)
+		assert.Equal(t, http.StatusNotFound, serve(h.GetCategory, http.MethodGet, "tablets", "").Code)
+	})
+
+	ids, p := ph.Create(ctx, []Product{
+		{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme", Categories: []string{"smartphones"}, Attributes: map[string]string{"color": "black"}},
+		{Name: "headset", Price: 50, Currency: "EUR", Vendor: "acme", Categories: []string{"phones", "audio"}},
+	}, "")
+	assert.Nil(t, p)
+	headset := ids[1].(primitive.ObjectID).Hex()
+
+	t.Run("products", func(t *testing.T) {
+		_, p := ph.Create(ctx, []Product{{Name: "tablet", Price: 500, Currency: "EUR", Vendor: "acme", Categories: []string{"tablets"}}}, "")
+		if assert.NotNil(t, p) && assert.Len(t, p.Errors, 1) {
+			assert.Equal(t, "[0].categories", p.Errors[0].Field)
+			assert.Equal(t, "category_exists", p.Errors[0].Rule)
+		}
+
+		rules := DefaultProductRules()
+		rules.RequiredAccessories = map[string][]string{"electronics": {"charger"}}
+		strict := &ProductHandler{Col: ph.Col, Rules: NewRulesStore(&dbtest.Collection{}, rules), Categories: categories}
+		_, p = strict.Create(ctx, []Product{{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme", Categories: []string{"smartphones"}}}, "")
+		if assert.NotNil(t, p) && assert.Len(t, p.Errors, 1) {
+			assert.Equal(t, "[0].accessories", p.Errors[0].Field)
+			assert.Equal(t, "accessories must include charger for the electronics category", p.Errors[0].Message,
+				"the accessories of the ancestors are required")
+		}
+
+		var products []Product
+		rec := serve(h.GetCategoryProducts, http.MethodGet, "electronics", "")
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &products))
+		assert.Len(t, products, 2, "the products of the descendants are included")
+		rec = serve(h.GetCategoryProducts, http.MethodGet, "smartphones", "")
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &products))
+		if assert.Len(t, products, 1) {
+			assert.Equal(t, map[string]string{"warranty": "2y", "os": "any", "color": "black"}, products[0].Attributes,
+				"attributes are inherited, the product's and the nearest category's winning")
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		rec := serve(h.MoveCategory, http.MethodPost, "electronics", `{"parent": "smartphones"}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"category_cycle"`)
+
+		moved := category(serve(h.MoveCategory, http.MethodPost, "phones", `{"parent": "audio", "position": 3}`))
+		assert.Equal(t, []string{"electronics", "audio"}, moved.Ancestors)
+		assert.Equal(t, 3, moved.Position)
+		smartphones := category(serve(h.GetCategory, http.MethodGet, "smartphones", ""))
+		assert.Equal(t, []string{"electronics", "audio", "phones"}, smartphones.Ancestors, "the descendants move along")
+
+		root := category(serve(h.MoveCategory, http.MethodPost, "phones", `{"parent": ""}`))
+		assert.Empty(t, root.Ancestors)
+		smartphones = category(serve(h.GetCategory, http.MethodGet, "smartphones", ""))
+		assert.Equal(t, []string{"phones"}, smartphones.Ancestors)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		rec := serve(h.DeleteCategory, http.MethodDelete, "audio", "")
+		assert.Equal(t, http.StatusConflict, rec.Code, "audio has products")
+		assert.Contains(t, rec.Body.String(), `"code":"category_not_empty"`)
+		rec = serve(h.DeleteCategory, http.MethodDelete, "phones", "")
+		assert.Equal(t, http.StatusConflict, rec.Code, "phones has subcategories")
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		rec := serve(h.MergeCategory, http.MethodPost, "phones", `{"into": "smartphones"}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+
+		changes, cancel := bus.Subscribe(10)
+		defer cancel()
+		into := category(serve(h.MergeCategory, http.MethodPost, "phones", `{"into": "audio"}`))
+		assert.Equal(t, "audio", into.Slug)
+		assert.Equal(t, http.StatusNotFound, serve(h.GetCategory, http.MethodGet, "phones", "").Code)
+		smartphones := category(serve(h.GetCategory, http.MethodGet, "smartphones", ""))
+		assert.Equal(t, "audio", smartphones.Parent)
+		assert.Equal(t, []string{"electronics", "audio"}, smartphones.Ancestors)
+
+		p, err := ph.Get(ctx, headset)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"audio"}, p.Categories, "the assignments follow, once")
+		e := <-changes
+		assert.Equal(t, events.ProductUpdated, e.Type)
+		assert.Equal(t, headset, e.Subject)
+
+		rec = serve(h.DeleteCategory, http.MethodDelete, "electronics", "")
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		serve(h.CreateCategory, http.MethodPost, "", `{"slug": "cables", "name": "Cables"}`)
+		assert.Equal(t, http.StatusNoContent, serve(h.DeleteCategory, http.MethodDelete, "cables", "").Code)
+	})
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"tronicscorp/changes"
+	"tronicscorp/events"
+	"tronicscorp/tenant"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ProductEvent returns the event the API publishes for a change like c of
+// the products collection.
+func ProductEvent(c changes.Change) (events.Event, bool) {
+	id, ok := c.ID.ObjectIDOK()
+	if !ok {
+		return events.Event{}, false
+	}
+	if c.Op == changes.Delete {
+		return events.Event{Type: events.ProductDeleted, Tenant: tenantOf(c.Before), Subject: id.Hex()}, true
+	}
+	var p Product
+	if c.Doc == nil || bson.Unmarshal(c.Doc, &p) != nil {
+		return events.Event{}, false
+	}
+	t := events.ProductUpdated
+	if c.Op == changes.Insert {
+		t = events.ProductCreated
+	}
+	return events.Event{Type: t, Tenant: tenantOf(c.Doc), Subject: id.Hex(), Data: p}, true
+}
+
+// UserEvent returns the event the API publishes for a change like c of the
+// users collection: sign-ups only.
+func UserEvent(c changes.Change) (events.Event, bool) {
+	var u User
+	if c.Op != changes.Insert || bson.Unmarshal(c.Doc, &u) != nil || u.Email == "" {
+		return events.Event{}, false
+	}
+	return events.Event{Type: events.UserCreated, Tenant: tenantOf(c.Doc), Subject: u.Email, Data: User{Email: u.Email}}, true
+}
+
+// tenantOf returns the tenant of doc, empty when doc is nil, as for the
+// deletions without pre-image.
+func tenantOf(doc bson.Raw) string {
+	if doc == nil {
+		return ""
+	}
+	t, _ := doc.Lookup(tenant.Field).StringValueOK()
+	return t
+}
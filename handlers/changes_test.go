@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"testing"
+	"tronicscorp/changes"
+	"tronicscorp/events"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestProductEvent(t *testing.T) {
+	p := Product{ID: primitive.NewObjectID(), Name: "phone", Price: 100, Currency: "EUR", Vendor: "acme", Accessories: []string{}}
+	doc, err := bson.Marshal(bson.M{"_id": p.ID, "product_name": "phone", "price": 100, "currency": "EUR", "vendor": "acme", "discount": 0, "is_essential": false, "tenant": "globex"})
+	assert.NoError(t, err)
+	id := bson.RawValue{Type: bson.TypeObjectID, Value: p.ID[:]}
+
+	e, ok := ProductEvent(changes.Change{Op: changes.Insert, ID: id, Doc: doc})
+	assert.True(t, ok)
+	assert.Equal(t, events.ProductCreated, e.Type)
+	assert.Equal(t, p.ID.Hex(), e.Subject)
+	assert.Equal(t, "globex", e.Tenant)
+	// The data must encode as the API event does, for the listener to skip
+	// the API writes.
+	fromAPI, _ := bson.Marshal(p)
+	fromDB, _ := bson.Marshal(e.Data)
+	assert.Equal(t, fromAPI, fromDB)
+
+	e, ok = ProductEvent(changes.Change{Op: changes.Replace, ID: id, Doc: doc})
+	assert.True(t, ok)
+	assert.Equal(t, events.ProductUpdated, e.Type)
+
+	e, ok = ProductEvent(changes.Change{Op: changes.Delete, ID: id, Before: doc})
+	assert.True(t, ok)
+	assert.Equal(t, events.Event{Type: events.ProductDeleted, Tenant: "globex", Subject: p.ID.Hex()}, e,
+		"deletions take their tenant from the document before them")
+	assert.True(t, changeFilter{tenant: "globex"}.matches(e), "the streams of the tenant receive them")
+	e, ok = ProductEvent(changes.Change{Op: changes.Delete, ID: id})
+	assert.True(t, ok)
+	assert.Empty(t, e.Tenant, "without pre-image the tenant is unknown")
+
+	_, ok = ProductEvent(changes.Change{Op: changes.Update, ID: id})
+	assert.False(t, ok, "updates of documents deleted since have no event")
+}
+
+func TestUserEvent(t *testing.T) {
+	doc, _ := bson.Marshal(bson.M{"username": "jane@tronics.com", "password": "hash", "isadmin": true, "tenant": "globex"})
+	e, ok := UserEvent(changes.Change{Op: changes.Insert, Doc: doc})
+	assert.True(t, ok)
+	assert.Equal(t, events.Event{Type: events.UserCreated, Tenant: "globex", Subject: "jane@tronics.com", Data: User{Email: "jane@tronics.com"}}, e)
+
+	_, ok = UserEvent(changes.Change{Op: changes.Update, Doc: doc})
+	assert.False(t, ok)
+}
@@ -1,7 +1,13 @@
+//go:build integration
+
+// The tests tagged integration need a MongoDB server, the one of the
+// configuration: go test -tags integration ./handlers
+
 package handlers
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -25,19 +31,26 @@ var (
 
 func init() {
 	if err := cleanenv.ReadEnv(&cfg); err != nil {
+		log.Fatalf("Configurations cannot be read : %v", err)
+	}
+	var err error
+	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
+	c, err = mongo.Connect(context.Background(), options.Client().ApplyURI(connectURI))
+	if err != nil {
 		log.Fatalf("Unable to connect to database : %v", err)
 	}
 	db = c.Database(cfg.DBName)
 	col = db.Collection(cfg.ProductCollection)
 	usersCol = db.Collection(cfg.UsersCollection)
+	uh.Tokens = NewTokenIssuer(cfg.JwtTokenSecret)
 	isUserIndexUnique := true
 	indexModel := mongo.IndexModel{
-		Keys: bson.D{{"username", 1}},
+		Keys: bson.D{{Key: "username", Value: 1}},
 		Options: &options.IndexOptions{
 			Unique: &isUserIndexUnique,
 		},
 	}
-	_, err := usersCol.Indexes().CreateOne(context.Background(), indexModel)
+	_, err = usersCol.Indexes().CreateOne(context.Background(), indexModel)
 	if err != nil {
 		log.Fatalf("Unable to create an index : %+v", err)
 	}
@@ -51,5 +64,6 @@ func TestMain(m *testing.M) {
 	usersCol.Drop(ctx)
 	col.Drop(ctx)
 	db.Drop(ctx)
+	c.Disconnect(ctx)
 	os.Exit(testCode)
 }
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"tronicscorp/problem"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// dbError maps a data layer error to a problem, timeouts become 504 and
+// cancellations 503
+func dbError(err error, detail string) *problem.Problem {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		return problem.New(http.StatusGatewayTimeout, problem.CodeTimeout, "Request timed out").WithCause(err)
+	case errors.Is(err, context.Canceled):
+		return problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, "Request cancelled").WithCause(err)
+	}
+	return problem.New(http.StatusInternalServerError, problem.CodeInternal, detail).WithCause(err)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"tronicscorp/problem"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code int
+		kind problem.Code
+	}{
+		{"deadline exceeded", context.DeadlineExceeded, http.StatusGatewayTimeout, problem.CodeTimeout},
+		{"wrapped deadline exceeded", fmt.Errorf("find: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, problem.CodeTimeout},
+		{"cancelled", context.Canceled, http.StatusServiceUnavailable, problem.CodeUnavailable},
+		{"other", errors.New("boom"), http.StatusInternalServerError, problem.CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := dbError(tt.err, "Unable to find the product")
+			assert.Equal(t, tt.code, p.Status)
+			assert.Equal(t, tt.kind, p.Code)
+			assert.ErrorIs(t, p, tt.err)
+		})
+	}
+}
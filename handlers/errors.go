@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"tronicscorp/correlation"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// HTTPErrorHandler renders every error returned by handlers and middleware
+// as application/problem+json.
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	p := *problem.From(err)
+	ctx := c.Request().Context()
+	p.Instance = c.Request().URL.Path
+	p.CorrelationID = correlation.FromContext(ctx)
+	if p.Status >= http.StatusInternalServerError {
+		logging.FromContext(ctx).Error("Request failed", "status", p.Status, "code", p.Code, "error", err)
+	}
+	c.Response().Header().Set(echo.HeaderContentType, problem.ContentType)
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(p.Status)
+	} else {
+		err = c.JSON(p.Status, p)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to write the error response", "error", err)
+	}
+}
+
+func invalidID(id string) *problem.Problem {
+	return problem.New(http.StatusBadRequest, problem.CodeInvalidID, id+" is not a valid ObjectID")
+}
+
+func productLookupError(err error, id string) *problem.Problem {
+	if err == mongo.ErrNoDocuments {
+		return problem.New(http.StatusNotFound, problem.CodeProductNotFound, "Product "+id+" does not exist")
+	}
+	return dbError(err, "Unable to find the product")
+}
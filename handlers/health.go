@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Check is a named dependency check used by the readiness and status
+// endpoints.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type HealthHandler struct {
+	Checks   []Check
+	Draining func() bool
+	Version  string
+	Started  time.Time
+	Profile  func() string
+	Timeout  time.Duration
+}
+
+func (h *HealthHandler) runChecks(ctx context.Context) ([]checkResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	results := make([]checkResult, 0, len(h.Checks))
+	healthy := true
+	for _, check := range h.Checks {
+		start := time.Now()
+		err := check.Run(ctx)
+		res := checkResult{Name: check.Name, Status: "ok", Latency: time.Since(start).String()}
+		if err != nil {
+			res.Status = "failing"
+			res.Error = err.Error()
+			healthy = false
+		}
+		results = append(results, res)
+	}
+	return results, healthy
+}
+
+// Liveness reports that the process is up and serving.
+func (h *HealthHandler) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness reports whether the instance can take traffic: it is not
+// shutting down and every dependency check passes.
+func (h *HealthHandler) Readiness(c echo.Context) error {
+	if h.Draining() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+	}
+	results, healthy := h.runChecks(c.Request().Context())
+	status, code := "ok", http.StatusOK
+	if !healthy {
+		status, code = "failing", http.StatusServiceUnavailable
+	}
+	return c.JSON(code, map[string]interface{}{"status": status, "checks": results})
+}
+
+// Status lists dependency health and latency along with build and runtime
+// details, for operators.
+func (h *HealthHandler) Status(c echo.Context) error {
+	results, healthy := h.runChecks(c.Request().Context())
+	status := "ok"
+	if !healthy {
+		status = "degraded"
+	}
+	if h.Draining() {
+		status = "draining"
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"status":       status,
+		"version":      h.Version,
+		"profile":      h.Profile(),
+		"started_at":   h.Started.UTC().Format(time.RFC3339),
+		"uptime":       time.Since(h.Started).Round(time.Second).String(),
+		"dependencies": results,
+	})
+}
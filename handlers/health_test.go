@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	draining := false
+	var dbErr error
+	hh := HealthHandler{
+		Checks: []Check{
+			{Name: "mongo", Run: func(context.Context) error { return dbErr }},
+		},
+		Draining: func() bool { return draining },
+		Version:  "test",
+		Started:  time.Now(),
+		Profile:  func() string { return "test" },
+		Timeout:  time.Second,
+	}
+	call := func(handler echo.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		res := httptest.NewRecorder()
+		c := echo.New().NewContext(req, res)
+		assert.Nil(t, handler(c))
+		return res
+	}
+
+	t.Run("liveness", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(hh.Liveness).Code)
+	})
+	t.Run("ready", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(hh.Readiness).Code)
+	})
+	t.Run("not ready when a check fails", func(t *testing.T) {
+		dbErr = errors.New("no reachable servers")
+		defer func() { dbErr = nil }()
+		assert.Equal(t, http.StatusServiceUnavailable, call(hh.Readiness).Code)
+		var status map[string]interface{}
+		assert.Nil(t, json.Unmarshal(call(hh.Status).Body.Bytes(), &status))
+		assert.Equal(t, "degraded", status["status"])
+	})
+	t.Run("not ready while draining", func(t *testing.T) {
+		draining = true
+		defer func() { draining = false }()
+		assert.Equal(t, http.StatusServiceUnavailable, call(hh.Readiness).Code)
+		assert.Equal(t, http.StatusOK, call(hh.Liveness).Code)
+	})
+}
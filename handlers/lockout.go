@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// Lockout locks a username out for Window after MaxFailures failed logins
+// within Window.
+type Lockout struct {
+	MaxFailures int
+	Window      time.Duration
+
+	mu       sync.Mutex
+	accounts map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func NewLockout(maxFailures int, window time.Duration) *Lockout {
+	return &Lockout{MaxFailures: maxFailures, Window: window, accounts: map[string]*loginFailures{}}
+}
+
+// Locked reports whether username is currently locked out.
+func (l *Lockout) Locked(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.accounts[username]
+	return ok && time.Now().Before(f.lockedUntil)
+}
+
+// Fail records a failed login and reports whether it locked the account.
+func (l *Lockout) Fail(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	f, ok := l.accounts[username]
+	if !ok || now.Sub(f.first) > l.Window {
+		f = &loginFailures{first: now}
+		l.accounts[username] = f
+	}
+	f.count++
+	if f.count >= l.MaxFailures {
+		f.lockedUntil = now.Add(l.Window)
+		f.count = 0
+		f.first = now
+		return true
+	}
+	return false
+}
+
+// Reset forgets the failures of username after a successful login.
+func (l *Lockout) Reset(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.accounts, username)
+}
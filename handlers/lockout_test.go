@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockout(t *testing.T) {
+	l := NewLockout(3, time.Minute)
+	assert.False(t, l.Fail("a@b.com"))
+	assert.False(t, l.Fail("a@b.com"))
+	assert.False(t, l.Locked("a@b.com"))
+	assert.True(t, l.Fail("a@b.com"))
+	assert.True(t, l.Locked("a@b.com"))
+	assert.False(t, l.Locked("c@d.com"))
+
+	l.Reset("a@b.com")
+	assert.False(t, l.Locked("a@b.com"))
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/outbox"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxOutboxEntries caps the outbox entries listed at once.
+const maxOutboxEntries = 200
+
+// record runs write and delivers the events it returns: through ob, in the
+// same transaction as the write, or published on bus once written when ob is
+// nil. The events belong to the tenant of ctx.
+func record(ctx context.Context, ob *outbox.Outbox, bus *events.Bus, write func(ctx context.Context) ([]events.Event, *problem.Problem)) *problem.Problem {
+	if ob == nil {
+		evs, p := write(ctx)
+		if p != nil {
+			return p
+		}
+		for _, e := range owned(ctx, evs) {
+			bus.Publish(e)
+		}
+		return nil
+	}
+	err := ob.Write(ctx, func(ctx context.Context) ([]events.Event, error) {
+		evs, p := write(ctx)
+		if p != nil {
+			return nil, p
+		}
+		return owned(ctx, evs), nil
+	})
+	if err == nil {
+		return nil
+	}
+	var p *problem.Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	logging.FromContext(ctx).Error("Unable to record the events", "error", err)
+	return dbError(err, "Unable to record the change")
+}
+
+// owned sets the tenant of ctx on evs.
+func owned(ctx context.Context, evs []events.Event) []events.Event {
+	if t, ok := tenant.FromContext(ctx); ok {
+		for i := range evs {
+			evs[i].Tenant = t.ID
+		}
+	}
+	return evs
+}
+
+// DecodeEventData restores the data of the outbox entries to the types the
+// handlers publish.
+func DecodeEventData(t events.Type, data bson.Raw) (interface{}, error) {
+	switch t {
+	case events.ProductCreated, events.ProductUpdated:
+		var p Product
+		err := bson.Unmarshal(data, &p)
+		return p, err
+	case events.UserCreated:
+		var u User
+		err := bson.Unmarshal(data, &u)
+		u.Password = ""
+		return u, err
+	}
+	var doc bson.M
+	err := bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// OutboxHandler lets admins inspect the outbox and replay its events.
+type OutboxHandler struct {
+	Outbox *outbox.Outbox
+}
+
+// OutboxEntry is an outbox entry with its data.
+type OutboxEntry struct {
+	outbox.Entry `bson:",inline"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+// ReplayRequest selects the events to relay again.
+type ReplayRequest struct {
+	Since time.Time     `json:"since"`
+	Until time.Time     `json:"until"`
+	Types []events.Type `json:"types"`
+	// Sinks defaults to every sink.
+	Sinks []string `json:"sinks"`
+}
+
+// ReplayResult is the number of entries queued by a replay.
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+}
+
+// ListOutbox returns the latest entries, filtered by the status and type
+// parameters.
+func (h *OutboxHandler) ListOutbox(c echo.Context) error {
+	ctx := c.Request().Context()
+	var q outbox.Query
+	switch status := c.QueryParam("status"); status {
+	case "":
+	case "pending", "dispatched":
+		dispatched := status == "dispatched"
+		q.Dispatched = &dispatched
+	default:
+		return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "status must be one of pending, dispatched").
+			WithErrors(problem.FieldError{Field: "status", Rule: "oneof", Message: "status must be one of pending, dispatched"})
+	}
+	if t := c.QueryParam("type"); t != "" {
+		q.Types = []events.Type{events.Type(t)}
+	}
+	q.Limit, q.Latest = 50, true
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > maxOutboxEntries {
+			return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "limit must be between 1 and 200").
+				WithErrors(problem.FieldError{Field: "limit", Rule: "max", Message: "limit must be between 1 and 200"})
+		}
+		q.Limit = n
+	}
+	entries, err := h.Outbox.List(ctx, q)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the outbox entries", "error", err)
+		return dbError(err, "Unable to find the outbox entries")
+	}
+	res := make([]OutboxEntry, len(entries))
+	for i, entry := range entries {
+		res[i] = outboxEntry(entry)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *OutboxHandler) GetOutboxEntry(c echo.Context) error {
+	entry, err := h.find(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, outboxEntry(entry))
+}
+
+// ReplayOutboxEntry relays an entry again, to the sink query parameters or to
+// every sink.
+func (h *OutboxHandler) ReplayOutboxEntry(c echo.Context) error {
+	ctx := c.Request().Context()
+	entry, p := h.find(ctx, c.Param("id"))
+	if p != nil {
+		return p
+	}
+	if _, err := h.replay(ctx, outbox.Query{ID: entry.ID}, c.QueryParams()["sink"]); err != nil {
+		return err
+	}
+	entry, p = h.find(ctx, c.Param("id"))
+	if p != nil {
+		return p
+	}
+	return c.JSON(http.StatusAccepted, outboxEntry(entry))
+}
+
+// ReplayOutbox relays again the events of a time range, for instance to
+// rebuild a consumer.
+func (h *OutboxHandler) ReplayOutbox(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req ReplayRequest
+	if err := c.Bind(&req); err != nil {
+		logging.FromContext(ctx).Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	}
+	if !req.Since.IsZero() && !req.Until.IsZero() && !req.Until.After(req.Since) {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "until must be after since")
+	}
+	n, err := h.replay(ctx, outbox.Query{Since: req.Since, Until: req.Until, Types: req.Types}, req.Sinks)
+	if err != nil {
+		return err
+	}
+	logging.FromContext(ctx).Info("Outbox replayed", "entries", n, "sinks", req.Sinks)
+	return c.JSON(http.StatusAccepted, ReplayResult{Replayed: n})
+}
+
+// replay relays the entries of q again, to sinks or to every sink.
+func (h *OutboxHandler) replay(ctx context.Context, q outbox.Query, sinks []string) (int, *problem.Problem) {
+	n, err := h.Outbox.Replay(ctx, q, sinks)
+	if errors.Is(err, outbox.ErrUnknownSink) {
+		msg := "sinks must be among " + strings.Join(h.Outbox.SinkNames(), ", ")
+		return 0, problem.New(http.StatusBadRequest, problem.CodeValidationFailed, msg).
+			WithErrors(problem.FieldError{Field: "sinks", Rule: "oneof", Message: msg})
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to replay the outbox", "error", err)
+		return n, dbError(err, "Unable to replay the outbox")
+	}
+	return n, nil
+}
+
+func (h *OutboxHandler) find(ctx context.Context, id string) (outbox.Entry, *problem.Problem) {
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return outbox.Entry{}, invalidID(id)
+	}
+	entry, err := h.Outbox.Get(ctx, docID)
+	if err == mongo.ErrNoDocuments {
+		return entry, problem.New(http.StatusNotFound, problem.CodeOutboxEntryNotFound, "Outbox entry "+id+" does not exist")
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the outbox entry", "id", id, "error", err)
+		return entry, dbError(err, "Unable to find the outbox entry")
+	}
+	return entry, nil
+}
+
+func outboxEntry(entry outbox.Entry) OutboxEntry {
+	res := OutboxEntry{Entry: entry}
+	if len(entry.Data) > 0 {
+		var data bson.M
+		if err := bson.Unmarshal(entry.Data, &data); err == nil {
+			res.Data = data
+		}
+	}
+	return res
+}
@@ -2,33 +2,88 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
+	"tronicscorp/cache"
 	"tronicscorp/dbiface"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/outbox"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
 
+	ut "github.com/go-playground/universal-translator"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Product struct {
-	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Name        string             `json:"product_name" bson:"product_name" validate:"required,max=10"`
-	Price       int                `json:"price" bson:"price" validate:"required,max=2000"`
-	Currency    string             `json:"currency" bson:"currency" validate:"required, len=3"`
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty" openapi:"readonly"`
+	Name        string             `json:"product_name" bson:"product_name" validate:"required"`
+	Price       int                `json:"price" bson:"price" validate:"required"`
+	Currency    string             `json:"currency" bson:"currency" validate:"required,len=3"`
 	Discount    int                `json:"discount" bson:"discount"`
 	Vendor      string             `json:"vendor" bson:"vendor" validate:"required"`
 	Accessories []string           `json:"accessories,omitempty" bson:"accessories,omitempty"`
 	IsEssential bool               `json:"is_essential" bson:"is_essential"`
+	// Categories are the slugs of the categories of the taxonomy the product
+	// belongs to.
+	Categories []string `json:"categories,omitempty" bson:"categories,omitempty"`
+	// Attributes describe the product. Those of its categories are added
+	// when listing the products of a category.
+	Attributes map[string]string `json:"attributes,omitempty" bson:"attributes,omitempty"`
 }
 type ProductHandler struct {
-	Col dbiface.CollectionAPI
+	Col   dbiface.CollectionAPI
+	Rules *RulesStore
+	// Representation is the product shape of the API version, ProductV1 when
+	// nil.
+	Representation Representation
+	// Events receives the changes made to the products.
+	Events *events.Bus
+	// Outbox, when set, records the changes in the transaction making them
+	// and relays them to Events and the other sinks.
+	Outbox *outbox.Outbox
+	// Cache, when set, keeps the product reads until a write invalidates
+	// them.
+	Cache *cache.Cache
+	// MaxAge, when set, lets the clients keep the product reads as long.
+	MaxAge time.Duration
+	// Categories, when set, holds the categories the products may be
+	// assigned to.
+	Categories dbiface.CollectionAPI
 }
 
-func findProducts(ctx context.Context, q url.Values, collection dbiface.CollectionAPI) ([]Product, *echo.HTTPError) {
+func (h *ProductHandler) representation() Representation {
+	if h.Representation == nil {
+		return ProductV1
+	}
+	return h.Representation
+}
+
+// encodeAll renders products with the handler representation.
+func (h *ProductHandler) encodeAll(products []Product) []interface{} {
+	encoded := make([]interface{}, len(products))
+	for i, p := range products {
+		encoded[i] = h.representation().encode(p)
+	}
+	return encoded
+}
+
+// validator checks the products against the current rules, within the
+// limits of the tenant of ctx.
+func (h *ProductHandler) validator(ctx context.Context) *ProductValidator {
+	rules := h.Rules.Current()
+	if t, ok := tenant.FromContext(ctx); ok {
+		rules = rules.forTenant(t)
+	}
+	return &ProductValidator{validator: v, rules: rules, categories: h.Categories}
+}
+
+func findProducts(ctx context.Context, q url.Values, collection dbiface.CollectionAPI) ([]Product, *problem.Problem) {
 	var products []Product
 	filter := make(map[string]interface{})
 	for k, v := range q {
@@ -37,126 +92,153 @@ func findProducts(ctx context.Context, q url.Values, collection dbiface.Collecti
 	if filter["_id"] != nil {
 		docID, err := primitive.ObjectIDFromHex(filter["_id"].(string))
 		if err != nil {
-			log.Errorf("Unable to convert to object ID : %v", err)
-			return products, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to convert to ObjectID"})
+			logging.FromContext(ctx).Error("Unable to convert to ObjectID", "id", filter["_id"], "error", err)
+			return products, problem.New(http.StatusBadRequest, problem.CodeInvalidID, "_id is not a valid ObjectID")
 		}
 		filter["_id"] = docID
 	}
 	cursor, err := collection.Find(ctx, bson.M(filter))
 	if err != nil {
-		log.Errorf("Unable to find the products : %v", err)
-		return products, echo.NewHTTPError(http.StatusNotFound, errorMessage{"Unable to find the products"})
+		logging.FromContext(ctx).Error("Unable to find the products", "error", err)
+		return products, dbError(err, "Unable to find the products")
 	}
 	err = cursor.All(ctx, &products)
 	if err != nil {
-		log.Errorf("Unable to read the cursor : %v", err)
-		return products, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to parse retrivied products"})
+		logging.FromContext(ctx).Error("Unable to read the cursor", "error", err)
+		return products, dbError(err, "Unable to parse retrieved products")
 	}
 	return products, nil
 }
-func findProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (Product, *echo.HTTPError) {
+func findProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (Product, *problem.Problem) {
 	var product Product
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Errorf("Unable to convert to Object ID : %v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to convert to ObjectID"})
+		logging.FromContext(ctx).Error("Unable to convert to ObjectID", "id", id, "error", err)
+		return product, invalidID(id)
 	}
 	res := collection.FindOne(ctx, bson.M{"_id": docID})
 	err = res.Decode(&product)
 	if err != nil {
-		log.Errorf("Unable to find the product : %v", err)
-		return product, echo.NewHTTPError(http.StatusNotFound, errorMessage{"Unable to find the product"})
+		logging.FromContext(ctx).Error("Unable to find the product", "id", id, "error", err)
+		return product, productLookupError(err, id)
 	}
 	return product, nil
 }
 
 func (h *ProductHandler) GetProducts(c echo.Context) error {
-	products, httpError := findProducts(context.Background(), c.QueryParams(), h.Col)
-	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+	q := h.representation().filter(c.QueryParams())
+	products, err := cached(c.Request().Context(), h.Cache, queryKey(q), func(ctx context.Context) ([]Product, *problem.Problem) {
+		return findProducts(ctx, q, h.Col)
+	})
+	if err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, products)
+	h.cacheControl(c)
+	return c.JSON(http.StatusOK, h.encodeAll(products))
 }
 
 func (h ProductHandler) GetProduct(c echo.Context) error {
-	product, err := findProduct(context.Background(), c.Param("id"), h.Col)
+	product, err := h.Get(c.Request().Context(), c.Param("id"))
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, product)
+	h.cacheControl(c)
+	return c.JSON(http.StatusOK, h.representation().encode(product))
 }
 
-func deleteProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (int64, *echo.HTTPError) {
+func deleteProduct(ctx context.Context, id string, collection dbiface.CollectionAPI) (int64, *problem.Problem) {
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Errorf("Unable convert to ObjectID : %v", err)
-		return 0, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to convert to ObjectID"})
+		logging.FromContext(ctx).Error("Unable to convert to ObjectID", "id", id, "error", err)
+		return 0, invalidID(id)
 	}
 	res, err := collection.DeleteOne(ctx, bson.M{"_id": docID})
 	if err != nil {
-		log.Errorf("Unable to delete the product : %v", err)
-		return 0, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to delete the product"})
+		logging.FromContext(ctx).Error("Unable to delete the product", "id", id, "error", err)
+		return 0, dbError(err, "Unable to delete the product")
 	}
 	return res.DeletedCount, nil
 }
 
 func (h *ProductHandler) DeleteProduct(c echo.Context) error {
-	delCount, httpError := deleteProduct(context.Background(), c.Param("id"), h.Col)
-	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+	delCount, err := h.Delete(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
 	}
 	return c.JSON(http.StatusOK, delCount)
 }
 
-func modifyProduct(ctx context.Context, id string, reqBody io.ReadCloser, collection dbiface.CollectionAPI) (Product, *echo.HTTPError) {
+func modifyProduct(ctx context.Context, id string, reqBody io.Reader, rep Representation, pv *ProductValidator, trans ut.Translator, collection dbiface.CollectionAPI) (Product, *problem.Problem) {
 	var product Product
 	docID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		log.Errorf("cannot convert to objectid :%v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to convert to ObjectID"})
+		logging.FromContext(ctx).Error("Unable to convert to ObjectID", "id", id, "error", err)
+		return product, invalidID(id)
 	}
 	filter := bson.M{"_id": docID}
 	res := collection.FindOne(ctx, filter)
 	if err := res.Decode(&product); err != nil {
-		log.Errorf("Unable to decode to product :%v", err)
-		return product, echo.NewHTTPError(http.StatusNotFound, errorMessage{"Unable to find the product"})
+		logging.FromContext(ctx).Error("Unable to find the product", "id", id, "error", err)
+		return product, productLookupError(err, id)
 	}
 
-	if err := json.NewDecoder(reqBody).Decode(&product); err != nil {
-		log.Errorf("Unable to decode using reqbody :%v", err)
-		return product, echo.NewHTTPError(http.StatusBadRequest, errorMessage{"Unable to parse request payload"})
+	if err := rep.decode(reqBody, &product); err != nil {
+		logging.FromContext(ctx).Error("Unable to decode the request payload", "error", err)
+		return product, problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
 	}
 
-	if err := v.Struct(product); err != nil {
-		log.Errorf("Unable to validate the struct : %v", err)
-		return product, echo.NewHTTPError(http.StatusBadRequest, errorMessage{"Unable to validate the request payload"})
+	if err := pv.Validate(product); err != nil {
+		logging.FromContext(ctx).Error("Unable to validate the product", "id", id, "error", err)
+		return product, renameFields(validationProblem(err, trans, ""), rep)
+	}
+	if p := pv.checkCategories(ctx, product, trans, ""); p != nil {
+		return product, renameFields(p, rep)
 	}
 
-	_, err = collection.UpdateOne(ctx, filter, bson.M{"$set": product})
+	_, err = collection.UpdateOne(ctx, filter, productUpdate(product))
 	if err != nil {
-		log.Errorf("Unable to update the product :%v", err)
-		return product, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to update the product"})
+		logging.FromContext(ctx).Error("Unable to update the product", "id", id, "error", err)
+		return product, dbError(err, "Unable to update the product")
 	}
 	return product, nil
 }
 
+// productUpdate sets the fields of product and unsets the lists it emptied,
+// which it omits.
+func productUpdate(product Product) bson.M {
+	update := bson.M{"$set": product}
+	unset := bson.M{}
+	if len(product.Accessories) == 0 {
+		unset["accessories"] = ""
+	}
+	if len(product.Categories) == 0 {
+		unset["categories"] = ""
+	}
+	if len(product.Attributes) == 0 {
+		unset["attributes"] = ""
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
 func (h *ProductHandler) UpdateProduct(c echo.Context) error {
-	var product Product
-	product, httpError := modifyProduct(context.Background(), c.Param("id"), c.Request().Body, h.Col)
-	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+	product, err := h.Update(c.Request().Context(), c.Param("id"), c.Request().Body, c.Request().Header.Get("Accept-Language"))
+	if err != nil {
+		return err
 	}
-	return c.JSON(http.StatusOK, product)
+	return c.JSON(http.StatusOK, h.representation().encode(product))
 }
 
-func insertProducts(ctx context.Context, products []Product, collection dbiface.CollectionAPI) ([]interface{}, *echo.HTTPError) {
+func insertProducts(ctx context.Context, products []Product, collection dbiface.CollectionAPI) ([]interface{}, *problem.Problem) {
 	var insertedIds []interface{}
-	for _, product := range products {
-		product.ID = primitive.NewObjectID()
-		insertID, err := collection.InsertOne(ctx, product)
+	for i := range products {
+		products[i].ID = primitive.NewObjectID()
+		insertID, err := collection.InsertOne(ctx, products[i])
 		if err != nil {
-			log.Errorf("Unable to insert to Database :%v", err)
-			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Unable to insert to database")
+			logging.FromContext(ctx).Error("Unable to insert the product", "error", err)
+			return nil, dbError(err, "Unable to insert the product")
 		}
 		insertedIds = append(insertedIds, insertID.InsertedID)
 	}
@@ -165,21 +247,15 @@ func insertProducts(ctx context.Context, products []Product, collection dbiface.
 }
 
 func (h *ProductHandler) CreateProducts(c echo.Context) error {
-	var products []Product
-	c.Echo().Validator = &ProductValidator{validator: v}
-	if err := c.Bind(&products); err != nil {
-		log.Errorf("Unable to bind : %v", err)
-		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse request payload")
-	}
-	for _, product := range products {
-		if err := c.Validate(product); err != nil {
-			log.Errorf("Unable to validate the product %+v %v", product, err)
-			return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload")
-		}
-	}
-	IDs, err := insertProducts(context.Background(), products, h.Col)
+	logger := logging.FromContext(c.Request().Context())
+	products, err := h.representation().decodeList(c.Request().Body)
 	if err != nil {
-		return err
+		logger.Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	}
+	IDs, perr := h.Create(c.Request().Context(), products, c.Request().Header.Get("Accept-Language"))
+	if perr != nil {
+		return perr
 	}
 	return c.JSON(http.StatusCreated, IDs)
 }
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"regexp"
+	"tronicscorp/problem"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Representation is the shape of products in a version of the API. Products
+// are stored and validated as Product; a representation converts them at the
+// edges.
+type Representation interface {
+	// encode returns the value to render for p.
+	encode(p Product) interface{}
+	// decode decodes a request body onto p, keeping the fields it omits.
+	decode(body io.Reader, p *Product) error
+	// decodeList decodes a request body holding a list of products.
+	decodeList(body io.Reader) ([]Product, error)
+	// filter maps query parameters to stored field names.
+	filter(q url.Values) url.Values
+	// field maps a stored field name to its name in the representation.
+	field(name string) string
+}
+
+// ProductV1 renders products as stored.
+var ProductV1 Representation = productV1{}
+
+// ProductV2 renders products as ProductV2Body.
+var ProductV2 Representation = productV2{}
+
+type productV1 struct{}
+
+func (productV1) encode(p Product) interface{} {
+	return p
+}
+
+func (productV1) decode(body io.Reader, p *Product) error {
+	return json.NewDecoder(body).Decode(p)
+}
+
+func (productV1) decodeList(body io.Reader) ([]Product, error) {
+	var products []Product
+	err := json.NewDecoder(body).Decode(&products)
+	return products, err
+}
+
+func (productV1) filter(q url.Values) url.Values {
+	return q
+}
+
+func (productV1) field(name string) string {
+	return name
+}
+
+// ProductV2Body is the v2 product: clearer names and the price carrying its
+// currency.
+type ProductV2Body struct {
+	ID          primitive.ObjectID `json:"id,omitempty" openapi:"readonly"`
+	Name        string             `json:"name" validate:"required"`
+	Price       Money              `json:"price" validate:"required"`
+	Discount    int                `json:"discount"`
+	Vendor      string             `json:"vendor" validate:"required"`
+	Accessories []string           `json:"accessories,omitempty"`
+	Essential   bool               `json:"essential"`
+	Categories  []string           `json:"categories,omitempty"`
+	Attributes  map[string]string  `json:"attributes,omitempty"`
+}
+
+type Money struct {
+	Amount   int    `json:"amount" validate:"required"`
+	Currency string `json:"currency" validate:"required,len=3"`
+}
+
+// v2Fields maps stored field names to v2 ones.
+var v2Fields = map[string]string{
+	"_id":          "id",
+	"product_name": "name",
+	"price":        "price.amount",
+	"currency":     "price.currency",
+	"is_essential": "essential",
+}
+
+type productV2 struct{}
+
+func (productV2) encode(p Product) interface{} {
+	return ProductV2Body{
+		ID:          p.ID,
+		Name:        p.Name,
+		Price:       Money{Amount: p.Price, Currency: p.Currency},
+		Discount:    p.Discount,
+		Vendor:      p.Vendor,
+		Accessories: p.Accessories,
+		Essential:   p.IsEssential,
+		Categories:  p.Categories,
+		Attributes:  p.Attributes,
+	}
+}
+
+func (r productV2) decode(body io.Reader, p *Product) error {
+	b := r.encode(*p).(ProductV2Body)
+	if err := json.NewDecoder(body).Decode(&b); err != nil {
+		return err
+	}
+	*p = b.product(p.ID)
+	return nil
+}
+
+func (productV2) decodeList(body io.Reader) ([]Product, error) {
+	var bodies []ProductV2Body
+	if err := json.NewDecoder(body).Decode(&bodies); err != nil {
+		return nil, err
+	}
+	products := make([]Product, len(bodies))
+	for i, b := range bodies {
+		products[i] = b.product(primitive.NilObjectID)
+	}
+	return products, nil
+}
+
+func (b ProductV2Body) product(id primitive.ObjectID) Product {
+	return Product{
+		ID:          id,
+		Name:        b.Name,
+		Price:       b.Price.Amount,
+		Currency:    b.Price.Currency,
+		Discount:    b.Discount,
+		Vendor:      b.Vendor,
+		Accessories: b.Accessories,
+		IsEssential: b.Essential,
+		Categories:  b.Categories,
+		Attributes:  b.Attributes,
+	}
+}
+
+func (productV2) filter(q url.Values) url.Values {
+	stored := url.Values{}
+	for key, values := range q {
+		name := key
+		for from, to := range v2Fields {
+			if to == key {
+				name = from
+			}
+		}
+		stored[name] = values
+	}
+	return stored
+}
+
+func (productV2) field(name string) string {
+	if v2, ok := v2Fields[name]; ok {
+		return v2
+	}
+	return name
+}
+
+var itemPrefix = regexp.MustCompile(`^\[\d+\]\.`)
+
+// renameFields rewrites the field errors of p for the representation.
+func renameFields(p *problem.Problem, rep Representation) *problem.Problem {
+	if p == nil {
+		return nil
+	}
+	for i, fe := range p.Errors {
+		prefix := itemPrefix.FindString(fe.Field)
+		p.Errors[i].Field = prefix + rep.field(fe.Field[len(prefix):])
+	}
+	return p
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"tronicscorp/problem"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestProductV2(t *testing.T) {
+	id := primitive.NewObjectID()
+	stored := Product{ID: id, Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme", IsEssential: true}
+
+	t.Run("encode", func(t *testing.T) {
+		assert.Equal(t, ProductV2Body{ID: id, Name: "phone", Price: Money{Amount: 500, Currency: "EUR"}, Vendor: "acme", Essential: true},
+			ProductV2.encode(stored))
+	})
+	t.Run("partial decode keeps omitted fields", func(t *testing.T) {
+		p := stored
+		assert.NoError(t, ProductV2.decode(strings.NewReader(`{"name":"tablet","price":{"amount":700}}`), &p))
+		assert.Equal(t, id, p.ID)
+		assert.Equal(t, "tablet", p.Name)
+		assert.Equal(t, 700, p.Price)
+		assert.Equal(t, "EUR", p.Currency)
+		assert.True(t, p.IsEssential)
+	})
+	t.Run("decode list", func(t *testing.T) {
+		products, err := ProductV2.decodeList(strings.NewReader(`[{"name":"tv","price":{"amount":1,"currency":"USD"},"vendor":"acme"}]`))
+		assert.NoError(t, err)
+		assert.Equal(t, []Product{{Name: "tv", Price: 1, Currency: "USD", Vendor: "acme"}}, products)
+	})
+	t.Run("filter and field names", func(t *testing.T) {
+		assert.Equal(t, url.Values{"product_name": {"tv"}, "vendor": {"acme"}}, ProductV2.filter(url.Values{"name": {"tv"}, "vendor": {"acme"}}))
+		p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "").
+			WithErrors(problem.FieldError{Field: "[1].currency"}, problem.FieldError{Field: "product_name"})
+		renameFields(p, ProductV2)
+		assert.Equal(t, "[1].price.currency", p.Errors[0].Field)
+		assert.Equal(t, "name", p.Errors[1].Field)
+	})
+}
@@ -0,0 +1,508 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"tronicscorp/dbiface"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/yaml.v3"
+)
+
+// productRulesID is the _id of the product rules document in the rules
+// collection.
+const productRulesID = "product"
+
+// anyCurrency keys the price bounds applying to currencies without their own.
+const anyCurrency = "*"
+
+// ProductRules are the catalog validation rules that can change without a
+// release. Structural checks (required fields, currency format) stay in the
+// Product struct tags. RequiredAccessories are keyed by category slug and
+// apply to the products of the category and of its descendants.
+type ProductRules struct {
+	Version               int                    `json:"version" bson:"version" yaml:"version"`
+	NameMinLength         int                    `json:"name_min_length" bson:"name_min_length" yaml:"name_min_length"`
+	NameMaxLength         int                    `json:"name_max_length" bson:"name_max_length" yaml:"name_max_length"`
+	Prices                map[string]PriceBounds `json:"prices" bson:"prices" yaml:"prices"`
+	Vendors               []string               `json:"vendors,omitempty" bson:"vendors,omitempty" yaml:"vendors"`
+	Currencies            []string               `json:"currencies,omitempty" bson:"currencies,omitempty" yaml:"currencies"`
+	RequiredAccessories   map[string][]string    `json:"required_accessories,omitempty" bson:"required_accessories,omitempty" yaml:"required_accessories"`
+	DiscountNotAbovePrice bool                   `json:"discount_not_above_price" bson:"discount_not_above_price" yaml:"discount_not_above_price"`
+	UpdatedAt             time.Time              `json:"updated_at,omitempty" bson:"updated_at,omitempty" yaml:"-"`
+	UpdatedBy             string                 `json:"updated_by,omitempty" bson:"updated_by,omitempty" yaml:"-"`
+}
+
+// PriceBounds are the inclusive price limits of a currency. A zero Max means
+// no upper limit.
+type PriceBounds struct {
+	Min int `json:"min" bson:"min" yaml:"min"`
+	Max int `json:"max" bson:"max" yaml:"max"`
+}
+
+// DefaultProductRules are the rules used when neither the rules file nor the
+// rules collection provide any.
+func DefaultProductRules() ProductRules {
+	return ProductRules{
+		NameMaxLength: 10,
+		Prices:        map[string]PriceBounds{anyCurrency: {Max: 2000}},
+	}
+}
+
+// LoadProductRules reads rules from a YAML file. A missing file yields the
+// default rules.
+func LoadProductRules(file string) (ProductRules, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultProductRules(), nil
+	}
+	if err != nil {
+		return ProductRules{}, fmt.Errorf("unable to read product rules %s: %w", file, err)
+	}
+	var r ProductRules
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return ProductRules{}, fmt.Errorf("unable to parse product rules %s: %w", file, err)
+	}
+	if errs := r.check(); len(errs) > 0 {
+		return ProductRules{}, fmt.Errorf("invalid product rules %s: %s", file, errs[0].Message)
+	}
+	return r, nil
+}
+
+// check reports inconsistencies in the rules themselves.
+func (r ProductRules) check() []problem.FieldError {
+	var errs []problem.FieldError
+	add := func(field, rule, msg string) {
+		errs = append(errs, problem.FieldError{Field: field, Rule: rule, Message: msg})
+	}
+	if r.NameMinLength < 0 || r.NameMaxLength < 0 {
+		add("name_min_length", "min", "name lengths must not be negative")
+	}
+	if r.NameMaxLength > 0 && r.NameMinLength > r.NameMaxLength {
+		add("name_min_length", "ltefield", "name_min_length must not be greater than name_max_length")
+	}
+	for _, currency := range sortedKeys(r.Prices) {
+		b := r.Prices[currency]
+		field := "prices." + currency
+		if currency != anyCurrency && len(currency) != 3 {
+			add(field, "len", "currency must be 3 characters or *")
+		}
+		if b.Min < 0 || b.Max < 0 {
+			add(field, "min", "price bounds must not be negative")
+		}
+		if b.Max > 0 && b.Min > b.Max {
+			add(field, "ltefield", "min must not be greater than max")
+		}
+	}
+	for _, currency := range r.Currencies {
+		if len(currency) != 3 {
+			add("currencies", "len", "currencies must be 3 characters")
+		}
+	}
+	for _, category := range sortedKeys(r.RequiredAccessories) {
+		if len(r.RequiredAccessories[category]) == 0 {
+			add("required_accessories."+category, "required", "at least one accessory must be listed")
+		}
+	}
+	return errs
+}
+
+// Check returns the rules p breaks, as ruleViolations, or nil.
+func (r ProductRules) Check(p Product) error {
+	var violations ruleViolations
+	add := func(field, rule string, params ...string) {
+		violations = append(violations, ruleViolation{Field: field, Rule: rule, Params: params})
+	}
+	if n := len([]rune(p.Name)); n < r.NameMinLength || (r.NameMaxLength > 0 && n > r.NameMaxLength) {
+		add("product_name", "name_length", strconv.Itoa(r.NameMinLength), strconv.Itoa(r.NameMaxLength))
+	}
+	if b, ok := r.priceBounds(p.Currency); ok && (p.Price < b.Min || (b.Max > 0 && p.Price > b.Max)) {
+		add("price", "price_range", strconv.Itoa(b.Min), strconv.Itoa(b.Max), p.Currency)
+	}
+	if len(r.Vendors) > 0 && !contains(r.Vendors, p.Vendor) {
+		add("vendor", "allowed_vendor")
+	}
+	if len(r.Currencies) > 0 && !contains(r.Currencies, p.Currency) {
+		add("currency", "allowed_currency")
+	}
+	if r.DiscountNotAbovePrice && p.Discount > p.Price {
+		add("discount", "discount_not_above_price")
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+// checkAccessories returns the accessories p lacks that its categories
+// require. categories are the slugs of the categories of p and of their
+// ancestors.
+func (r ProductRules) checkAccessories(p Product, categories []string) ruleViolations {
+	var violations ruleViolations
+	for _, category := range categories {
+		for _, accessory := range r.RequiredAccessories[category] {
+			if !contains(p.Accessories, accessory) {
+				violations = append(violations, ruleViolation{Field: "accessories", Rule: "required_accessories", Params: []string{accessory, category}})
+			}
+		}
+	}
+	return violations
+}
+
+// forTenant returns r within the limits of t: its currencies replace those
+// of r, its maximum price and name length cap those of r.
+func (r ProductRules) forTenant(t tenant.Tenant) ProductRules {
+	if len(t.Currencies) > 0 {
+		r.Currencies = t.Currencies
+	}
+	if t.NameMaxLength > 0 && (r.NameMaxLength == 0 || r.NameMaxLength > t.NameMaxLength) {
+		r.NameMaxLength = t.NameMaxLength
+	}
+	if t.MaxPrice > 0 {
+		prices := make(map[string]PriceBounds, len(r.Prices)+1)
+		for currency, b := range r.Prices {
+			if b.Max == 0 || b.Max > t.MaxPrice {
+				b.Max = t.MaxPrice
+			}
+			prices[currency] = b
+		}
+		if _, ok := prices[anyCurrency]; !ok {
+			prices[anyCurrency] = PriceBounds{Max: t.MaxPrice}
+		}
+		r.Prices = prices
+	}
+	return r
+}
+
+func (r ProductRules) priceBounds(currency string) (PriceBounds, bool) {
+	if b, ok := r.Prices[currency]; ok {
+		return b, true
+	}
+	b, ok := r.Prices[anyCurrency]
+	return b, ok
+}
+
+// ruleViolation is a broken product rule. Its message is rendered in the
+// request language by validationProblem.
+type ruleViolation struct {
+	Field  string
+	Rule   string
+	Params []string
+}
+
+type ruleViolations []ruleViolation
+
+func (v ruleViolations) Error() string {
+	rules := make([]string, len(v))
+	for i, violation := range v {
+		rules[i] = violation.Field + ": " + violation.Rule
+	}
+	return "product rules violated: " + strings.Join(rules, ", ")
+}
+
+// ruleMessages are the rule violation messages by locale. {0} is the field.
+var ruleMessages = map[string]map[string]string{
+	"en": {
+		"name_length":              "{0} must be between {1} and {2} characters long",
+		"price_range":              "{0} must be between {1} and {2} {3}",
+		"allowed_vendor":           "{0} is not an allowed vendor",
+		"allowed_currency":         "{0} is not an allowed currency",
+		"required_accessories":     "{0} must include {1} for the {2} category",
+		"discount_not_above_price": "{0} must not be greater than the price",
+		"category_exists":          "{0} must only name existing categories, {1} does not exist",
+		"slug":                     "{0} must be lowercase letters and digits, separated by hyphens",
+	},
+	"pt_BR": {
+		"name_length":              "{0} deve ter entre {1} e {2} caracteres",
+		"price_range":              "{0} deve estar entre {1} e {2} {3}",
+		"allowed_vendor":           "{0} não é um fornecedor permitido",
+		"allowed_currency":         "{0} não é uma moeda permitida",
+		"required_accessories":     "{0} deve incluir {1} para a categoria {2}",
+		"discount_not_above_price": "{0} não deve ser maior que o preço",
+		"category_exists":          "{0} deve nomear apenas categorias existentes, {1} não existe",
+		"slug":                     "{0} deve conter letras minúsculas e dígitos, separados por hífens",
+	},
+	"fr": {
+		"name_length":              "{0} doit contenir entre {1} et {2} caractères",
+		"price_range":              "{0} doit être compris entre {1} et {2} {3}",
+		"allowed_vendor":           "{0} n'est pas un fournisseur autorisé",
+		"allowed_currency":         "{0} n'est pas une devise autorisée",
+		"required_accessories":     "{0} doit inclure {1} pour la catégorie {2}",
+		"discount_not_above_price": "{0} ne doit pas être supérieur au prix",
+		"category_exists":          "{0} ne doit nommer que des catégories existantes, {1} n'existe pas",
+		"slug":                     "{0} doit être composé de minuscules et de chiffres, séparés par des tirets",
+	},
+}
+
+// RulesStore keeps the active product rules. Rules saved by admins live in
+// the rules collection and take precedence over the seed from the rules file.
+type RulesStore struct {
+	Col     dbiface.CollectionAPI
+	current atomic.Pointer[ProductRules]
+}
+
+func NewRulesStore(col dbiface.CollectionAPI, seed ProductRules) *RulesStore {
+	s := &RulesStore{Col: col}
+	s.current.Store(&seed)
+	return s
+}
+
+// Current returns the active rules. A nil store has the default rules.
+func (s *RulesStore) Current() ProductRules {
+	if s == nil {
+		return DefaultProductRules()
+	}
+	return *s.current.Load()
+}
+
+// Refresh loads the rules saved in the collection, if any.
+func (s *RulesStore) Refresh(ctx context.Context) error {
+	var r ProductRules
+	err := s.Col.FindOne(ctx, bson.M{"_id": productRulesID}).Decode(&r)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.current.Store(&r)
+	return nil
+}
+
+// Watch refreshes the rules now and every interval until ctx is done, so
+// edits made through another instance are picked up.
+func (s *RulesStore) Watch(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Unable to refresh the product rules", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// errRulesConflict is returned by save when the stored rules are no longer
+// the version the store holds, saved meanwhile by another admin or instance.
+var errRulesConflict = errors.New("the product rules changed meanwhile")
+
+// save stores r as the version following r.Version, the one the admin
+// edited, and activates it. The rules are only replaced if r.Version is
+// still the stored version; the first version, before any is stored, is
+// inserted.
+func (s *RulesStore) save(ctx context.Context, r ProductRules) (ProductRules, error) {
+	edited := r.Version
+	r.Version = edited + 1
+	r.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	res, err := s.Col.UpdateOne(ctx, bson.M{"_id": productRulesID, "version": edited}, bson.M{"$set": r},
+		options.Update().SetUpsert(edited == 0))
+	if mongo.IsDuplicateKeyError(err) || err == nil && res.MatchedCount == 0 && res.UpsertedCount == 0 {
+		// Pick up the stored version, for the admin to review it.
+		if err := s.Refresh(ctx); err != nil {
+			slog.Error("Unable to refresh the product rules", "error", err)
+		}
+		return r, errRulesConflict
+	}
+	if err != nil {
+		return r, err
+	}
+	s.current.Store(&r)
+	return r, nil
+}
+
+// RulesHandler lets admins read and edit the product rules.
+type RulesHandler struct {
+	Store *RulesStore
+	// Products are those of every tenant, checked within the limits of
+	// their tenant, found in Tenants.
+	Products dbiface.CollectionAPI
+	Tenants  *tenant.Registry
+	// Categories, when set, are the categories scoped to the tenant of the
+	// context, whose ancestors select the required accessories.
+	Categories dbiface.CollectionAPI
+}
+
+// maxReportedProducts caps the products listed in a rules change report.
+const maxReportedProducts = 100
+
+type InvalidProduct struct {
+	ID     string               `json:"_id"`
+	Name   string               `json:"product_name"`
+	Tenant string               `json:"tenant"`
+	Errors []problem.FieldError `json:"errors"`
+}
+
+// RulesReport lists the stored products a rules change rejects, each
+// product being checked within the limits of its tenant.
+type RulesReport struct {
+	Rules        ProductRules     `json:"rules"`
+	DryRun       bool             `json:"dry_run"`
+	Checked      int              `json:"checked"`
+	InvalidCount int              `json:"invalid_count"`
+	Invalid      []InvalidProduct `json:"invalid"`
+	Truncated    bool             `json:"truncated,omitempty"`
+	// Tenants breaks the counts down by tenant.
+	Tenants map[string]TenantCounts `json:"tenants"`
+}
+
+// TenantCounts are the products of a tenant checked and rejected by a rules
+// change.
+type TenantCounts struct {
+	Checked      int `json:"checked"`
+	InvalidCount int `json:"invalid_count"`
+}
+
+func (h *RulesHandler) GetProductRules(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.Store.Current())
+}
+
+// UpdateProductRules replaces the product rules and reports the existing
+// products they reject. With ?dry_run=true only the report is produced. The
+// version of the body is the one the admin edited, 0 for the first one.
+func (h *RulesHandler) UpdateProductRules(c echo.Context) error {
+	ctx := c.Request().Context()
+	logger := logging.FromContext(ctx)
+	var rules ProductRules
+	if err := c.Bind(&rules); err != nil {
+		logger.Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	}
+	if errs := rules.check(); len(errs) > 0 {
+		return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "The rules are inconsistent").WithErrors(errs...)
+	}
+	dryRun, _ := strconv.ParseBool(c.QueryParam("dry_run"))
+	report := RulesReport{Rules: rules, DryRun: dryRun, Invalid: []InvalidProduct{}, Tenants: map[string]TenantCounts{}}
+	trans := translator(c.Request().Header.Get("Accept-Language"))
+	if err := checkProducts(ctx, rules, h.Products, h.Categories, h.Tenants, trans, &report); err != nil {
+		logger.Error("Unable to check the products against the rules", "error", err)
+		return err
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	rules.UpdatedBy = requestUser(c)
+	saved, err := h.Store.save(ctx, rules)
+	if err == errRulesConflict {
+		return problem.New(http.StatusConflict, problem.CodeRulesConflict,
+			"The product rules were changed meanwhile, review them and retry")
+	}
+	if err != nil {
+		logger.Error("Unable to save the product rules", "error", err)
+		return dbError(err, "Unable to save the product rules")
+	}
+	logger.Info("Product rules updated", "version", saved.Version, "invalid_products", report.InvalidCount)
+	report.Rules = saved
+	return c.JSON(http.StatusOK, report)
+}
+
+// checkProducts validates every stored product against rules, within the
+// limits of its tenant and with the categories of its tenant, filling report.
+func checkProducts(ctx context.Context, rules ProductRules, collection, categories dbiface.CollectionAPI, tenants *tenant.Registry, trans ut.Translator, report *RulesReport) *problem.Problem {
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return dbError(err, "Unable to find the products")
+	}
+	defer cursor.Close(ctx)
+	validators := map[string]*ProductValidator{}
+	for cursor.Next(ctx) {
+		var product Product
+		if err := cursor.Decode(&product); err != nil {
+			return dbError(err, "Unable to parse retrieved products")
+		}
+		owner, _ := cursor.Current.Lookup(tenant.Field).StringValueOK()
+		if owner == "" {
+			owner = tenants.Default().ID
+		}
+		pv, ok := validators[owner]
+		if !ok {
+			// A tenant removed from the configuration has no limits.
+			t, _ := tenants.Lookup(owner)
+			pv = &ProductValidator{validator: v, rules: rules.forTenant(t), categories: categories}
+			validators[owner] = pv
+		}
+		counts := report.Tenants[owner]
+		counts.Checked++
+		report.Checked++
+		var errs []problem.FieldError
+		if err := pv.Validate(product); err != nil {
+			errs = validationProblem(err, trans, "").Errors
+		}
+		if p := pv.checkCategories(tenant.NewContext(ctx, tenant.Tenant{ID: owner}), product, trans, ""); p != nil {
+			if p.Code != problem.CodeValidationFailed {
+				return p
+			}
+			errs = append(errs, p.Errors...)
+		}
+		if len(errs) == 0 {
+			report.Tenants[owner] = counts
+			continue
+		}
+		counts.InvalidCount++
+		report.Tenants[owner] = counts
+		report.InvalidCount++
+		if len(report.Invalid) == maxReportedProducts {
+			report.Truncated = true
+			continue
+		}
+		report.Invalid = append(report.Invalid, InvalidProduct{
+			ID:     product.ID.Hex(),
+			Name:   product.Name,
+			Tenant: owner,
+			Errors: errs,
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return dbError(err, "Unable to read the products")
+	}
+	return nil
+}
+
+// requestUser returns the user_id claim of the authenticated request.
+func requestUser(c echo.Context) string {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	user, _ := claims["user_id"].(string)
+	return user
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
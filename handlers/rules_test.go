@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"tronicscorp/dbiface/dbtest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProductRules(t *testing.T) {
+	rules := ProductRules{
+		NameMinLength:         2,
+		NameMaxLength:         10,
+		Prices:                map[string]PriceBounds{"*": {Min: 1, Max: 2000}, "JPY": {Min: 100, Max: 300000}},
+		Vendors:               []string{"acme", "globex"},
+		RequiredAccessories:   map[string][]string{"phone": {"charger"}},
+		DiscountNotAbovePrice: true,
+	}
+	valid := Product{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme", Categories: []string{"phone"}, Accessories: []string{"charger"}}
+
+	t.Run("valid product", func(t *testing.T) {
+		assert.NoError(t, rules.Check(valid))
+	})
+	t.Run("price bounds per currency", func(t *testing.T) {
+		p := valid
+		p.Price, p.Currency = 5000, "JPY"
+		assert.NoError(t, rules.Check(p))
+		p.Currency = "USD"
+		assert.Equal(t, ruleViolations{{Field: "price", Rule: "price_range", Params: []string{"1", "2000", "USD"}}}, rules.Check(p))
+	})
+	t.Run("every broken rule is reported", func(t *testing.T) {
+		p := valid
+		p.Name, p.Vendor, p.Accessories, p.Discount = "x", "initech", nil, 600
+		var fields []string
+		for _, rv := range rules.Check(p).(ruleViolations) {
+			fields = append(fields, rv.Field)
+		}
+		assert.Equal(t, []string{"product_name", "vendor", "discount"}, fields)
+	})
+	t.Run("required accessories", func(t *testing.T) {
+		p := valid
+		p.Accessories = nil
+		assert.Equal(t, ruleViolations{{Field: "accessories", Rule: "required_accessories", Params: []string{"charger", "phone"}}},
+			rules.checkAccessories(p, p.Categories))
+		assert.Empty(t, rules.checkAccessories(p, []string{"audio"}))
+	})
+	t.Run("violations are translated", func(t *testing.T) {
+		p := valid
+		p.Discount = 600
+		pv := &ProductValidator{validator: v, rules: rules}
+		problem := validationProblem(pv.Validate(p), translator("pt-BR"), "")
+		assert.Len(t, problem.Errors, 1)
+		assert.Equal(t, "discount não deve ser maior que o preço", problem.Errors[0].Message)
+	})
+	t.Run("inconsistent rules", func(t *testing.T) {
+		bad := ProductRules{NameMinLength: 5, NameMaxLength: 2, Prices: map[string]PriceBounds{"EURO": {Min: 10, Max: 1}}}
+		var fields []string
+		for _, fe := range bad.check() {
+			fields = append(fields, fe.Field)
+		}
+		assert.Equal(t, []string{"name_min_length", "prices.EURO", "prices.EURO"}, fields)
+	})
+}
+
+func TestLoadProductRules(t *testing.T) {
+	dir := t.TempDir()
+	t.Run("missing file gives the defaults", func(t *testing.T) {
+		rules, err := LoadProductRules(filepath.Join(dir, "missing.yaml"))
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultProductRules(), rules)
+	})
+	t.Run("file", func(t *testing.T) {
+		file := filepath.Join(dir, "rules.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte("name_max_length: 20\nprices:\n  EUR: {min: 1, max: 10}\nvendors: [acme]\n"), 0o600))
+		rules, err := LoadProductRules(file)
+		assert.NoError(t, err)
+		assert.Equal(t, 20, rules.NameMaxLength)
+		assert.Equal(t, PriceBounds{Min: 1, Max: 10}, rules.Prices["EUR"])
+		assert.Equal(t, []string{"acme"}, rules.Vendors)
+	})
+	t.Run("invalid file", func(t *testing.T) {
+		file := filepath.Join(dir, "invalid.yaml")
+		assert.NoError(t, os.WriteFile(file, []byte("name_min_length: -1\n"), 0o600))
+		_, err := LoadProductRules(file)
+		assert.Error(t, err)
+	})
+}
+
+func TestRulesStoreSave(t *testing.T) {
+	ctx := context.Background()
+	col := &dbtest.Collection{}
+	first, second := NewRulesStore(col, DefaultProductRules()), NewRulesStore(col, DefaultProductRules())
+	edit := func(version, maxLength int) ProductRules {
+		rules := DefaultProductRules()
+		rules.Version, rules.NameMaxLength = version, maxLength
+		return rules
+	}
+
+	saved, err := first.save(ctx, edit(0, 20))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saved.Version)
+	_, err = second.save(ctx, edit(0, 30))
+	assert.Equal(t, errRulesConflict, err, "the first version is only inserted once")
+	assert.Equal(t, 20, second.Current().NameMaxLength, "the conflict picks up the stored version")
+
+	saved, err = second.save(ctx, edit(1, 30))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, saved.Version)
+	_, err = second.save(ctx, edit(1, 40))
+	assert.Equal(t, errRulesConflict, err, "an admin having read version 1 does not overwrite version 2")
+	_, err = first.save(ctx, edit(3, 40))
+	assert.Equal(t, errRulesConflict, err, "nor does an unknown version")
+	assert.Equal(t, 30, first.Current().NameMaxLength)
+	assert.Len(t, col.Docs(), 1)
+}
@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// StreamReset tells a resuming client that events were missed: it must
+// reload the products before applying the following changes.
+const StreamReset events.Type = "stream.reset"
+
+const (
+	// streamBuffer is the number of events a stream may lag behind before it
+	// is closed. The client then resumes from the last event it received.
+	streamBuffer = 256
+	writeWait    = 10 * time.Second
+)
+
+// ProductChange is a change pushed to the product streams.
+type ProductChange struct {
+	EventID string      `json:"event_id"`
+	Type    events.Type `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	// Product is the product after the change, in the representation of the
+	// API version. It is omitted for deletions.
+	Product interface{} `json:"product,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// StreamHandler pushes the product changes published on Events to clients,
+// as Server-Sent Events or over a WebSocket.
+type StreamHandler struct {
+	Events *events.Bus
+	// Representation is the product shape of the API version, ProductV1 when
+	// nil.
+	Representation Representation
+	// AllowOrigin checks the origin of cross-origin WebSocket requests, which
+	// are rejected when nil.
+	AllowOrigin func(origin string) (bool, error)
+	// Done ends the open streams when closed, on shutdown.
+	Done <-chan struct{}
+	// Heartbeat is the interval of the keep-alive messages.
+	Heartbeat time.Duration
+}
+
+// changeSink writes changes to a client.
+type changeSink interface {
+	send(change ProductChange) error
+	ping() error
+	// gone is closed when the client leaves.
+	gone() <-chan struct{}
+	close()
+}
+
+// StreamProducts pushes the changes of the products of the request tenant
+// matching the vendor and id query parameters, every change of the tenant
+// when there are none. A client resumes after the event of the Last-Event-ID
+// header or last_event_id parameter.
+// Requests asking for a WebSocket upgrade get the changes as JSON messages.
+func (s *StreamHandler) StreamProducts(c echo.Context) error {
+	lastID := c.Request().Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.QueryParam("last_event_id")
+	}
+	var missed []events.Event
+	var changes <-chan events.Event
+	var cancel func()
+	reset := false
+	if lastID == "" {
+		changes, cancel = s.Events.Subscribe(streamBuffer)
+	} else {
+		after, err := strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, lastID+" is not an event id")
+		}
+		missed, changes, cancel, err = s.Events.Resume(after, streamBuffer)
+		if errors.Is(err, events.ErrGap) {
+			reset = true
+			changes, cancel = s.Events.Subscribe(streamBuffer)
+		}
+	}
+	defer cancel()
+
+	var sink changeSink
+	if websocket.IsWebSocketUpgrade(c.Request()) {
+		ws, err := s.upgrade(c)
+		if err != nil {
+			// The upgrader has already replied.
+			logging.FromContext(c.Request().Context()).Warn("Unable to upgrade to a WebSocket", "error", err)
+			return nil
+		}
+		sink = ws
+	} else {
+		sink = newSSESink(c)
+	}
+	defer sink.close()
+
+	q := c.QueryParams()
+	match := changeFilter{vendors: q["vendor"], ids: q["id"]}
+	if t, ok := tenant.FromContext(c.Request().Context()); ok {
+		match.tenant = t.ID
+	}
+	if reset {
+		if err := sink.send(ProductChange{Type: StreamReset, Time: time.Now()}); err != nil {
+			return nil
+		}
+	}
+	for _, e := range missed {
+		if err := s.push(sink, match, e); err != nil {
+			return nil
+		}
+	}
+	heartbeat := time.NewTicker(s.heartbeat())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-sink.gone():
+			return nil
+		case <-s.Done:
+			return nil
+		case <-heartbeat.C:
+			if err := sink.ping(); err != nil {
+				return nil
+			}
+		case e, ok := <-changes:
+			if !ok {
+				// Too far behind: the client resumes from its last event.
+				return nil
+			}
+			if err := s.push(sink, match, e); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func (s *StreamHandler) push(sink changeSink, match changeFilter, e events.Event) error {
+	if !match.matches(e) {
+		return nil
+	}
+	change := ProductChange{EventID: strconv.FormatUint(e.ID, 10), Type: e.Type, ID: e.Subject, Time: e.Time}
+	if p, ok := e.Data.(Product); ok {
+		change.Product = s.representation().encode(p)
+	}
+	return sink.send(change)
+}
+
+func (s *StreamHandler) representation() Representation {
+	if s.Representation == nil {
+		return ProductV1
+	}
+	return s.Representation
+}
+
+func (s *StreamHandler) heartbeat() time.Duration {
+	if s.Heartbeat <= 0 {
+		return 15 * time.Second
+	}
+	return s.Heartbeat
+}
+
+// changeFilter matches the product events of the tenant, when set, and of
+// the given vendors and ids. Deletions carry no product, so they match
+// whatever the vendors.
+type changeFilter struct {
+	tenant  string
+	vendors []string
+	ids     []string
+}
+
+func (f changeFilter) matches(e events.Event) bool {
+	switch e.Type {
+	case events.ProductCreated, events.ProductUpdated, events.ProductDeleted:
+	default:
+		return false
+	}
+	if f.tenant != "" && e.Tenant != f.tenant {
+		return false
+	}
+	if len(f.ids) > 0 && !contains(f.ids, e.Subject) {
+		return false
+	}
+	if p, ok := e.Data.(Product); ok && len(f.vendors) > 0 {
+		return contains(f.vendors, p.Vendor)
+	}
+	return true
+}
+
+// sseSink writes Server-Sent Events.
+type sseSink struct {
+	res  *echo.Response
+	done <-chan struct{}
+}
+
+func newSSESink(c echo.Context) *sseSink {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprint(res, "retry: 3000\n\n")
+	res.Flush()
+	return &sseSink{res: res, done: c.Request().Context().Done()}
+}
+
+func (s *sseSink) send(change ProductChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if change.EventID != "" {
+		fmt.Fprintf(s.res, "id: %s\n", change.EventID)
+	}
+	if _, err := fmt.Fprintf(s.res, "event: %s\ndata: %s\n\n", change.Type, data); err != nil {
+		return err
+	}
+	s.res.Flush()
+	return nil
+}
+
+func (s *sseSink) ping() error {
+	if _, err := fmt.Fprint(s.res, ": ping\n\n"); err != nil {
+		return err
+	}
+	s.res.Flush()
+	return nil
+}
+
+func (s *sseSink) gone() <-chan struct{} {
+	return s.done
+}
+
+func (s *sseSink) close() {}
+
+// wsSink writes JSON messages to a WebSocket.
+type wsSink struct {
+	conn *websocket.Conn
+	done chan struct{}
+}
+
+func (s *StreamHandler) upgrade(c echo.Context) (*wsSink, error) {
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get(echo.HeaderOrigin)
+		if u, err := url.Parse(origin); origin == "" || (err == nil && strings.EqualFold(u.Host, r.Host)) {
+			return true
+		}
+		if s.AllowOrigin == nil {
+			return false
+		}
+		allowed, err := s.AllowOrigin(origin)
+		return err == nil && allowed
+	}}
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ws := &wsSink{conn: conn, done: make(chan struct{})}
+	// Read the control frames, and notice when the client leaves.
+	go func() {
+		defer close(ws.done)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return ws, nil
+}
+
+func (s *wsSink) send(change ProductChange) error {
+	s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return s.conn.WriteJSON(change)
+}
+
+func (s *wsSink) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+func (s *wsSink) gone() <-chan struct{} {
+	return s.done
+}
+
+func (s *wsSink) close() {
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+	s.conn.Close()
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"tronicscorp/events"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newStreamServer(t *testing.T, bus *events.Bus) *httptest.Server {
+	done := make(chan struct{})
+	e := echo.New()
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.GET("/products/stream", (&StreamHandler{Events: bus, Representation: ProductV2, Done: done}).StreamProducts)
+	srv := httptest.NewServer(e)
+	t.Cleanup(func() {
+		close(done)
+		srv.Close()
+	})
+	return srv
+}
+
+// readEvents reads n Server-Sent Events, as "<id> <event>".
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	var got []string
+	var id string
+	for len(got) < n {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return got
+		}
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "event: "):
+			got = append(got, id+" "+strings.TrimSpace(strings.TrimPrefix(line, "event: ")))
+			id = ""
+		}
+	}
+	return got
+}
+
+func TestStreamProducts(t *testing.T) {
+	bus := events.NewBus(10)
+	srv := newStreamServer(t, bus)
+	acme := Product{ID: primitive.NewObjectID(), Name: "phone", Vendor: "acme"}
+	other := Product{ID: primitive.NewObjectID(), Name: "tv", Vendor: "other"}
+
+	published, cancel := bus.Subscribe(10)
+	defer cancel()
+	var ids []string
+	publish := func(e events.Event) {
+		bus.Publish(e)
+		ids = append(ids, strconv.FormatUint((<-published).ID, 10))
+	}
+	publish(events.Event{Type: events.ProductCreated, Subject: acme.ID.Hex(), Data: acme})
+	publish(events.Event{Type: events.ProductCreated, Subject: other.ID.Hex(), Data: other})
+	publish(events.Event{Type: events.ProductDeleted, Subject: other.ID.Hex()})
+
+	t.Run("resume filtered by vendor", func(t *testing.T) {
+		first, _ := strconv.ParseUint(ids[0], 10, 64)
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/products/stream?vendor=acme", nil)
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(first-1, 10))
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, "text/event-stream", res.Header.Get(echo.HeaderContentType))
+		r := bufio.NewReader(res.Body)
+		// The deletion has no vendor to filter on.
+		assert.Equal(t, []string{ids[0] + " product.created", ids[2] + " product.deleted"}, readEvents(t, r, 2))
+		publish(events.Event{Type: events.ProductUpdated, Subject: other.ID.Hex(), Data: other})
+		publish(events.Event{Type: events.ProductUpdated, Subject: acme.ID.Hex(), Data: acme})
+		assert.Equal(t, []string{ids[4] + " product.updated"}, readEvents(t, r, 1))
+	})
+	t.Run("resume after a gap resets", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/products/stream?last_event_id=1")
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, []string{" stream.reset"}, readEvents(t, bufio.NewReader(res.Body), 1))
+	})
+	t.Run("invalid event id", func(t *testing.T) {
+		res, err := http.Get(srv.URL + "/products/stream?last_event_id=x")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+	t.Run("websocket filtered by id", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/products/stream?id="+acme.ID.Hex(), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		publish(events.Event{Type: events.ProductDeleted, Subject: other.ID.Hex()})
+		publish(events.Event{Type: events.ProductUpdated, Subject: acme.ID.Hex(), Data: acme})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var change struct {
+			EventID string                 `json:"event_id"`
+			Type    events.Type            `json:"type"`
+			ID      string                 `json:"id"`
+			Product map[string]interface{} `json:"product"`
+		}
+		assert.NoError(t, conn.ReadJSON(&change))
+		assert.Equal(t, ids[len(ids)-1], change.EventID)
+		assert.Equal(t, events.ProductUpdated, change.Type)
+		assert.Equal(t, acme.ID.Hex(), change.ID)
+		assert.Equal(t, "phone", change.Product["name"])
+	})
+	t.Run("websocket rejects other origins", func(t *testing.T) {
+		_, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/products/stream",
+			http.Header{"Origin": {"https://evil.example"}})
+		assert.Error(t, err)
+		if assert.NotNil(t, res) {
+			assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tronicscorp/cache"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestTenantIsolation checks that the handlers serving a tenant neither read
+// nor write the products and users of another.
+func TestTenantIsolation(t *testing.T) {
+	acme := tenant.NewContext(context.Background(), tenant.Tenant{ID: "acme"})
+	globex := tenant.NewContext(context.Background(), tenant.Tenant{ID: "globex", Currencies: []string{"USD"}, MaxPrice: 100})
+	col := &dbtest.Collection{}
+	bus := events.NewBus(0)
+	h := &ProductHandler{
+		Col:    tenant.Scope(col),
+		Events: bus,
+		Cache:  &cache.Cache{Name: "products", Store: cache.NewLRU(10), TTL: time.Minute},
+	}
+
+	changes, cancel := bus.Subscribe(1)
+	ids, err := h.Create(acme, []Product{{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme"}}, "")
+	assert.Nil(t, err)
+	phone := ids[0].(primitive.ObjectID).Hex()
+	assert.Equal(t, "acme", col.Docs()[0][tenant.Field], "the product is stored with its tenant")
+	assert.Equal(t, "acme", (<-changes).Tenant, "the event names the tenant")
+	cancel()
+
+	t.Run("products", func(t *testing.T) {
+		_, err := h.Get(globex, phone)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusNotFound, err.Status)
+		}
+		products, err := h.List(globex, ProductQuery{Vendor: "acme"})
+		assert.Nil(t, err)
+		assert.Empty(t, products)
+		_, err = h.Update(globex, phone, strings.NewReader(`{"price": 1}`), "")
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusNotFound, err.Status)
+		}
+		count, err := h.Delete(globex, phone)
+		assert.Nil(t, err)
+		assert.Zero(t, count)
+
+		p, err := h.Get(acme, phone)
+		assert.Nil(t, err)
+		assert.Equal(t, 500, p.Price, "the product is left untouched")
+	})
+
+	t.Run("query parameters cannot name another tenant", func(t *testing.T) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/products?tenant=acme", nil).WithContext(globex)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, h.GetProducts(e.NewContext(req, rec)))
+		assert.JSONEq(t, `[]`, rec.Body.String())
+	})
+
+	t.Run("cached reads", func(t *testing.T) {
+		for _, ctx := range []context.Context{acme, globex, acme} {
+			h.Get(ctx, phone)
+		}
+		_, err := h.Get(globex, phone)
+		assert.NotNil(t, err, "the product read by acme is not cached for globex")
+	})
+
+	t.Run("tenant limits", func(t *testing.T) {
+		_, err := h.Create(globex, []Product{{Name: "phone", Price: 50, Currency: "EUR", Vendor: "globex"}}, "")
+		if assert.NotNil(t, err) && assert.Len(t, err.Errors, 1) {
+			assert.Equal(t, "[0].currency", err.Errors[0].Field)
+		}
+		_, err = h.Create(globex, []Product{{Name: "phone", Price: 500, Currency: "USD", Vendor: "globex"}}, "")
+		if assert.NotNil(t, err) && assert.Len(t, err.Errors, 1) {
+			assert.Equal(t, "[0].price", err.Errors[0].Field)
+		}
+		_, err = h.Create(acme, []Product{{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme"}}, "")
+		assert.Nil(t, err, "the limits are those of the tenant")
+	})
+
+	t.Run("users", func(t *testing.T) {
+		users := tenant.Scope(&dbtest.Collection{})
+		jane := User{Email: "jane@tronics.com", Password: "password"}
+		_, err := insertUser(acme, jane, users)
+		assert.Nil(t, err)
+		_, err = authenticateUser(globex, jane, users)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusNotFound, err.Status)
+		}
+		_, err = insertUser(globex, jane, users)
+		assert.Nil(t, err, "the same username signs up with each tenant")
+		_, err = insertUser(acme, jane, users)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusBadRequest, err.Status)
+		}
+		_, err = authenticateUser(acme, jane, users)
+		assert.Nil(t, err)
+	})
+
+	t.Run("fails without tenant", func(t *testing.T) {
+		_, err := h.List(context.Background(), ProductQuery{})
+		if assert.NotNil(t, err) {
+			assert.Equal(t, http.StatusInternalServerError, err.Status)
+		}
+		_, err = h.Create(context.Background(), []Product{{Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme"}}, "")
+		assert.NotNil(t, err)
+	})
+}
+
+// TestRulesReportByTenant checks that a rules change checks the products of
+// each tenant within its limits.
+func TestRulesReportByTenant(t *testing.T) {
+	tenants, err := tenant.NewRegistry("default",
+		tenant.Tenant{ID: "acme", Currencies: []string{"USD"}},
+		tenant.Tenant{ID: "globex", Currencies: []string{"EUR"}, MaxPrice: 100})
+	assert.NoError(t, err)
+	col := &dbtest.Collection{}
+	ctx := context.Background()
+	// As stored: acme has a product in a currency it does not use, written
+	// out-of-band, and the tablet was written before the tenants.
+	for _, doc := range []bson.M{
+		{"product_name": "phone", "price": 500, "currency": "USD", "vendor": "acme", "tenant": "acme"},
+		{"product_name": "charger", "price": 20, "currency": "EUR", "vendor": "acme", "tenant": "acme"},
+		{"product_name": "phone", "price": 50, "currency": "EUR", "vendor": "globex", "tenant": "globex"},
+		{"product_name": "tablet", "price": 1500, "currency": "EUR", "vendor": "initech"},
+	} {
+		col.InsertOne(ctx, doc)
+	}
+
+	rh := &RulesHandler{Store: NewRulesStore(&dbtest.Collection{}, DefaultProductRules()), Products: col, Tenants: tenants}
+	rules := DefaultProductRules()
+	rules.Currencies = []string{"USD"}
+	body, _ := json.Marshal(rules)
+	req := httptest.NewRequest(http.MethodPut, "/rules/products?dry_run=true", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, rh.UpdateProductRules(echo.New().NewContext(req, rec)))
+	var report RulesReport
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+
+	assert.Equal(t, 4, report.Checked)
+	assert.Equal(t, map[string]TenantCounts{
+		"acme":    {Checked: 2, InvalidCount: 1},
+		"globex":  {Checked: 1},
+		"default": {Checked: 1, InvalidCount: 1},
+	}, report.Tenants, "globex replaces the currencies, acme narrows them")
+	if assert.Len(t, report.Invalid, 2) {
+		assert.Equal(t, "acme", report.Invalid[0].Tenant)
+		assert.Equal(t, "charger", report.Invalid[0].Name)
+		assert.Equal(t, "default", report.Invalid[1].Tenant)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+	"tronicscorp/tenant"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// TokenIssuer signs access tokens. The signing secret can be swapped at
+// runtime when the configuration is reloaded.
+type TokenIssuer struct {
+	mu     sync.RWMutex
+	secret []byte
+	TTL    time.Duration
+}
+
+// NewTokenIssuer returns an issuer signing with secret for 15 minutes tokens.
+func NewTokenIssuer(secret string) *TokenIssuer {
+	return &TokenIssuer{secret: []byte(secret), TTL: 15 * time.Minute}
+}
+
+// SetSecret replaces the signing secret.
+func (t *TokenIssuer) SetSecret(secret string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.secret = []byte(secret)
+}
+
+// Secret returns the current signing secret.
+func (t *TokenIssuer) Secret() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.secret
+}
+
+// Keyfunc can be used to verify tokens signed by the issuer.
+func (t *TokenIssuer) Keyfunc(*jwt.Token) (interface{}, error) {
+	return t.Secret(), nil
+}
+
+// createToken signs a token of u for the tenant of ctx, the only one
+// accepting it.
+func (t *TokenIssuer) createToken(ctx context.Context, u User) (string, error) {
+	claims := jwt.MapClaims{}
+	claims["authorized"] = u.IsAdmin
+	claims["user_id"] = u.Email
+	claims["exp"] = time.Now().Add(t.TTL).Unix()
+	if tt, ok := tenant.FromContext(ctx); ok {
+		claims[tenant.Claim] = tt.ID
+		if tt.Audience != "" {
+			claims["aud"] = tt.Audience
+		}
+	}
+	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return at.SignedString(t.Secret())
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignUpIsNeverAdmin(t *testing.T) {
+	users := &dbtest.Collection{}
+	tokens := NewTokenIssuer("secret")
+	uh := &UsersHandler{Col: users, Tokens: tokens, Events: events.NewBus(0)}
+	body := `{"username": "mallory@tronics.com", "passwprd": "password", "isadmin": true}`
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, uh.CreateUser(echo.New().NewContext(req, rec)))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	token, err := jwt.Parse(strings.TrimPrefix(rec.Header().Get("x-auth-token"), "Bearer "), tokens.Keyfunc)
+	if assert.NoError(t, err) {
+		assert.Equal(t, false, token.Claims.(jwt.MapClaims)["authorized"])
+	}
+	if docs := users.Docs(); assert.Len(t, docs, 1) {
+		assert.Equal(t, false, docs[0]["isadmin"])
+	}
+}
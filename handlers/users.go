@@ -2,15 +2,17 @@ package handlers
 
 import (
 	"context"
+	"log/slog"
 	"net/http"
-	"time"
-	"tronicscorp/config"
 	"tronicscorp/dbiface"
+	"tronicscorp/events"
+	"tronicscorp/logging"
+	"tronicscorp/metrics"
+	"tronicscorp/outbox"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
 
-	"github.com/golang-jwt/jwt"
-	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/gommon/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
@@ -18,22 +20,26 @@ import (
 
 type User struct {
 	Email    string `json:"username" bson:"username" validate:"required,email"`
-	Password string `json:"passwprd" bson:"password" validate:"required, min=8, max=300"`
+	Password string `json:"passwprd,omitempty" bson:"password" validate:"required,min=8,max=300" openapi:"writeonly"`
 	IsAdmin  bool   `json:"isadmin,omitempty" bson:"isadmin"`
 }
 
-type UsersHandler struct {
-	Col dbiface.CollectionAPI
+// LogValue keeps the password out of the logs.
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("username", u.Email), slog.Bool("isadmin", u.IsAdmin))
 }
 
-type errorMessage struct {
-	Message string `json:"message"`
+type UsersHandler struct {
+	Col     dbiface.CollectionAPI
+	Tokens  *TokenIssuer
+	Lockout *Lockout
+	// Events receives the sign-ups.
+	Events *events.Bus
+	// Outbox, when set, records the sign-ups with the users and relays them
+	// to Events and the other sinks.
+	Outbox *outbox.Outbox
 }
 
-var (
-	prop config.Properties
-)
-
 func isCredValid(givenPwd, storedPwd string) bool {
 	if err := bcrypt.CompareHashAndPassword([]byte(storedPwd), []byte(givenPwd)); err != nil {
 		return false
@@ -41,111 +47,132 @@ func isCredValid(givenPwd, storedPwd string) bool {
 	return true
 }
 
-func (u User) createToken() (string, error) {
-	if err := cleanenv.ReadEnv(&prop); err != nil {
-		log.Fatalf("Configuration cannot be read : %v", err)
-	}
-	claims := jwt.MapClaims{}
-	claims["authorized"] = u.IsAdmin
-	claims["user_id"] = u.Email
-	claims["exp"] = time.Now().Add(time.Minute * 15).Unix()
-	at := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
-	token, err := at.SignedString([]byte(prop.JwtTokenSecret))
-	if err != nil {
-		log.Errorf("Unable to generate the token :%v", err)
-		return "", err
-	}
-	return token, nil
-}
-
-func insertUser(ctx context.Context, user User, collection dbiface.CollectionAPI) (User, *echo.HTTPError) {
+func insertUser(ctx context.Context, user User, collection dbiface.CollectionAPI) (User, *problem.Problem) {
 	var newUser User
 	res := collection.FindOne(ctx, bson.M{"username": user.Email})
 	err := res.Decode(&newUser)
 	if err != nil && err != mongo.ErrNoDocuments {
-		log.Errorf("Unable to decode retrieved user: %v", err)
-		return newUser, echo.NewHTTPError(http.StatusUnprocessableEntity, errorMessage{"Unable to decode retrieved user"})
+		logging.FromContext(ctx).Error("Unable to decode retrieved user", "error", err)
+		return newUser, dbError(err, "Unable to decode retrieved user")
 	}
 	if newUser.Email != "" {
-		log.Errorf("User by %s already exists", user.Email)
-		return newUser, echo.NewHTTPError(http.StatusBadRequest, errorMessage{"User already exists"})
+		logging.FromContext(ctx).Warn("User already exists", "username", user.Email)
+		return newUser, problem.New(http.StatusBadRequest, problem.CodeUserExists, "User already exists")
 	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 8)
 	if err != nil {
-		log.Errorf("Unable to hash the password: %v", err)
-		return newUser, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to process the password"})
+		logging.FromContext(ctx).Error("Unable to hash the password", "error", err)
+		return newUser, problem.New(http.StatusInternalServerError, problem.CodeInternal, "Unable to process the password").WithCause(err)
 	}
 	user.Password = string(hashedPassword)
 	_, err = collection.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		logging.FromContext(ctx).Warn("User already exists", "username", user.Email)
+		return newUser, problem.New(http.StatusBadRequest, problem.CodeUserExists, "User already exists")
+	}
 	if err != nil {
-		log.Errorf("Unable to insert the user :%+v", err)
-		return newUser, echo.NewHTTPError(http.StatusInternalServerError, errorMessage{"Unable to create the user"})
+		logging.FromContext(ctx).Error("Unable to insert the user", "error", err)
+		return newUser, dbError(err, "Unable to create the user")
 	}
 	return User{Email: user.Email}, nil
 }
-func authenticateUser(ctx context.Context, reqUser User, collection dbiface.CollectionAPI) (User, *echo.HTTPError) {
+func authenticateUser(ctx context.Context, reqUser User, collection dbiface.CollectionAPI) (User, *problem.Problem) {
 	var storedUser User
 	res := collection.FindOne(ctx, bson.M{"username": reqUser.Email})
 	err := res.Decode(&storedUser)
 	if err != nil && err != mongo.ErrNoDocuments {
-		log.Errorf("Unable to decode retrieved user: %v", err)
-		return storedUser, echo.NewHTTPError(http.StatusUnprocessableEntity, "Unable to decode retrieved user")
+		logging.FromContext(ctx).Error("Unable to decode retrieved user", "error", err)
+		return storedUser, dbError(err, "Unable to decode retrieved user")
 	}
 	if err == mongo.ErrNoDocuments {
-		log.Errorf("User %s does not exist.", reqUser.Email)
-		return storedUser, echo.NewHTTPError(http.StatusNotFound, "User does not exist")
+		logging.FromContext(ctx).Warn("User does not exist", "username", reqUser.Email)
+		return storedUser, problem.New(http.StatusNotFound, problem.CodeUserNotFound, "User does not exist")
 	}
 	if !isCredValid(reqUser.Password, storedUser.Password) {
-		return storedUser, echo.NewHTTPError(http.StatusUnauthorized, "Credentials invalid")
+		return storedUser, problem.New(http.StatusUnauthorized, problem.CodeInvalidCredentials, "Credentials invalid")
 	}
-	return User{Email: storedUser.Email}, nil
+	return User{Email: storedUser.Email, IsAdmin: storedUser.IsAdmin}, nil
 }
 
 func (h *UsersHandler) AuthnUser(c echo.Context) error {
+	logger := logging.FromContext(c.Request().Context())
 	var user User
 	c.Echo().Validator = &userValidator{validator: v}
 	if err := c.Bind(&user); err != nil {
-		log.Errorf("Unable to bind to user struct.")
-		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Unable to parse the request payload.")
+		logger.Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusUnprocessableEntity, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
 	}
 	if err := c.Validate(user); err != nil {
-		log.Errorf("Unable to validate the requested body.")
-		return echo.NewHTTPError(http.StatusBadRequest, "Unable to validate request payload.")
+		logger.Error("Unable to validate the request payload", "error", err)
+		return validationProblem(err, translator(c.Request().Header.Get("Accept-Language")), "")
+	}
+	email := user.Email
+	// A username is only unique within its tenant, and so are the lockouts.
+	account := email
+	if t, ok := tenant.FromContext(c.Request().Context()); ok {
+		account = t.ID + "/" + email
 	}
-	user, err := authenticateUser(context.Background(), user, h.Col)
+	if h.Lockout != nil && h.Lockout.Locked(account) {
+		metrics.AuthAttempts.WithLabelValues("locked").Inc()
+		logger.Warn("User is locked out", "username", email)
+		return problem.New(http.StatusTooManyRequests, problem.CodeAccountLocked, "Too many failed attempts, try again later")
+	}
+	user, err := authenticateUser(c.Request().Context(), user, h.Col)
 	if err != nil {
-		log.Errorf("Unable to authenticate to database.")
+		logger.Warn("Unable to authenticate the user", "username", email, "status", err.Status)
+		if err.Status == http.StatusUnauthorized || err.Status == http.StatusNotFound {
+			metrics.AuthAttempts.WithLabelValues("failure").Inc()
+			if h.Lockout != nil && h.Lockout.Fail(account) {
+				metrics.AuthLockouts.Inc()
+			}
+		}
 		return err
 	}
-	token, er := user.createToken()
+	metrics.AuthAttempts.WithLabelValues("success").Inc()
+	logging.WithAttrs(c, "user_id", email)
+	if h.Lockout != nil {
+		h.Lockout.Reset(account)
+	}
+	token, er := h.Tokens.createToken(c.Request().Context(), user)
 	if er != nil {
-		log.Errorf("Unable to generate the token.")
-		return echo.NewHTTPError(http.StatusInternalServerError, "Unable to generate the token")
+		logger.Error("Unable to generate the token", "error", er)
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Unable to generate the token").WithCause(er)
 	}
-	c.Response().Header().Set("x-auth-token", "Bearer"+token)
+	c.Response().Header().Set("x-auth-token", "Bearer "+token)
 	return c.JSON(http.StatusOK, User{Email: user.Email})
 }
 
 func (h *UsersHandler) CreateUser(c echo.Context) error {
+	logger := logging.FromContext(c.Request().Context())
 	var user User
 	c.Echo().Validator = &userValidator{validator: v}
 	if err := c.Bind(&user); err != nil {
-		log.Errorf("Unable to bind to user struct.")
-		return c.JSON(http.StatusUnprocessableEntity, errorMessage{"Unable to parse the request payload."})
+		logger.Error("Unable to bind the request payload", "error", err)
+		return problem.New(http.StatusUnprocessableEntity, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
 	}
 	if err := c.Validate(user); err != nil {
-		log.Errorf("Unable to validate the requested body.")
-		c.JSON(http.StatusBadRequest, errorMessage{"Unable to validate request body"})
-	}
-	resUser, httpError := insertUser(context.Background(), user, h.Col)
+		logger.Error("Unable to validate the request payload", "error", err)
+		return validationProblem(err, translator(c.Request().Header.Get("Accept-Language")), "")
+	}
+	// Admins are made in the database, never by signing up.
+	user.IsAdmin = false
+	var resUser User
+	httpError := record(c.Request().Context(), h.Outbox, h.Events, func(ctx context.Context) ([]events.Event, *problem.Problem) {
+		var err *problem.Problem
+		resUser, err = insertUser(ctx, user, h.Col)
+		if err != nil {
+			return nil, err
+		}
+		return []events.Event{{Type: events.UserCreated, Subject: resUser.Email, Data: resUser}}, nil
+	})
 	if httpError != nil {
-		return c.JSON(httpError.Code, httpError.Message)
+		return httpError
 	}
-	token, err := user.createToken()
+	token, err := h.Tokens.createToken(c.Request().Context(), user)
 	if err != nil {
-		log.Errorf("Unable to generate the token")
-		return c.JSON(http.StatusInternalServerError, errorMessage{"Unable to generate the token"})
+		logger.Error("Unable to generate the token", "error", err)
+		return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Unable to generate the token").WithCause(err)
 	}
-	c.Response().Header().Set("x-auth-token", "Bearer"+token)
+	c.Response().Header().Set("x-auth-token", "Bearer "+token)
 	return c.JSON(http.StatusCreated, resUser)
 }
@@ -1,3 +1,5 @@
+//go:build integration
+
 package handlers
 
 import (
@@ -5,6 +7,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"tronicscorp/problem"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
@@ -23,8 +26,10 @@ func TestUsers(t *testing.T) {
 		c := e.NewContext(req, res)
 		uh.Col = usersCol
 		err := uh.CreateUser(c)
+		HTTPErrorHandler(err, c)
 		t.Logf("res: %#+v\n", string(res.Body.Bytes()))
 		assert.NotNil(t, err)
 		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, problem.ContentType, res.Header().Get(echo.HeaderContentType))
 	})
 }
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"tronicscorp/openapi"
+	"tronicscorp/problem"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	"github.com/go-playground/locales/pt_BR"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/go-playground/validator.v9"
+	en_translations "gopkg.in/go-playground/validator.v9/translations/en"
+	fr_translations "gopkg.in/go-playground/validator.v9/translations/fr"
+	pt_BR_translations "gopkg.in/go-playground/validator.v9/translations/pt_BR"
+)
+
+// uni holds the translators of the supported locales, English being the
+// fallback.
+var uni = ut.New(en.New(), en.New(), pt_BR.New(), fr.New())
+
+// regionalLocales serve the base languages without translator of their own.
+var regionalLocales = map[string]string{"pt": "pt_BR"}
+
+// newValidator returns a validator that reports fields by their JSON name
+// and has messages registered for every supported locale.
+func newValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	registrations := map[string]func(*validator.Validate, ut.Translator) error{
+		"en":    en_translations.RegisterDefaultTranslations,
+		"pt_BR": pt_BR_translations.RegisterDefaultTranslations,
+		"fr":    fr_translations.RegisterDefaultTranslations,
+	}
+	for locale, register := range registrations {
+		trans, _ := uni.GetTranslator(locale)
+		if err := register(validate, trans); err != nil {
+			panic(fmt.Sprintf("unable to register %s validation messages: %v", locale, err))
+		}
+		for _, messages := range []map[string]map[string]string{ruleMessages, schemaMessages} {
+			for key, text := range messages[locale] {
+				if err := trans.Add(key, text, false); err != nil {
+					panic(fmt.Sprintf("unable to register %s message %s: %v", locale, key, err))
+				}
+			}
+		}
+	}
+	return validate
+}
+
+// translator picks the best supported locale from an Accept-Language header.
+func translator(acceptLanguage string) ut.Translator {
+	trans, _ := uni.FindTranslator(preferredLocales(acceptLanguage)...)
+	return trans
+}
+
+// preferredLocales returns the languages of an Accept-Language header by
+// decreasing quality, each followed by its base language ("pt-BR" gives
+// "pt_BR" then "pt"), then by the regional locale serving the base language
+// ("pt" gives "pt" then "pt_BR").
+func preferredLocales(header string) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		langs = append(langs, lang{tag: tag, q: q})
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	var locales []string
+	for _, l := range langs {
+		base, region, ok := strings.Cut(l.tag, "-")
+		base = strings.ToLower(base)
+		var locale string
+		if ok {
+			locale = base + "_" + strings.ToUpper(region)
+			locales = append(locales, locale)
+		}
+		locales = append(locales, base)
+		if regional, ok := regionalLocales[base]; ok && regional != locale {
+			locales = append(locales, regional)
+		}
+	}
+	return locales
+}
+
+// validationProblem turns a validation or product rules error into a validation_failed
+// problem listing every rejected field, with messages translated by trans.
+// prefix is prepended to field names, for items of a list.
+func validationProblem(err error, trans ut.Translator, prefix string) *problem.Problem {
+	p := problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Unable to validate the request payload").WithCause(err)
+	var errs validator.ValidationErrors
+	if errors.As(err, &errs) {
+		for _, fe := range errs {
+			p.WithErrors(problem.FieldError{
+				Field:   prefix + fieldPath(fe),
+				Rule:    fe.Tag(),
+				Message: fe.Translate(trans),
+			})
+		}
+	}
+	var violations ruleViolations
+	if errors.As(err, &violations) {
+		for _, rv := range violations {
+			msg, err := trans.T(rv.Rule, append([]string{rv.Field}, rv.Params...)...)
+			if err != nil {
+				msg = rv.Rule
+			}
+			p.WithErrors(problem.FieldError{Field: prefix + rv.Field, Rule: rv.Rule, Message: msg})
+		}
+	}
+	return p
+}
+
+// fieldPath returns the JSON path of the field without the struct name.
+func fieldPath(fe validator.FieldError) string {
+	_, path, _ := strings.Cut(fe.Namespace(), ".")
+	return path
+}
+
+// schemaRules maps the JSON Schema keywords reported by the OpenAPI validator
+// to the validator tag names used in problem field errors.
+var schemaRules = map[string]string{
+	"minLength": "min",
+	"maxLength": "max",
+	"minimum":   "min",
+	"maximum":   "max",
+	"minItems":  "min",
+	"maxItems":  "max",
+	"enum":      "oneof",
+}
+
+// schemaMessages are the OpenAPI validator messages by locale. {0} is the
+// field.
+var schemaMessages = map[string]map[string]string{
+	"en": {
+		"schema_required":  "{0} is a required field",
+		"schema_type":      "{0} must be of type {1}",
+		"schema_minLength": "{0} must be at least {1} characters in length",
+		"schema_maxLength": "{0} must be a maximum of {1} characters in length",
+		"schema_minimum":   "{0} must be {1} or greater",
+		"schema_maximum":   "{0} must be {1} or less",
+		"schema_minItems":  "{0} must contain at least {1} items",
+		"schema_maxItems":  "{0} must contain at maximum {1} items",
+		"schema_pattern":   "{0} has an invalid format",
+		"schema_format":    "{0} must be a valid {1}",
+		"schema_enum":      "{0} must be one of [{1}]",
+	},
+	"pt_BR": {
+		"schema_required":  "{0} é um campo requerido",
+		"schema_type":      "{0} deve ser do tipo {1}",
+		"schema_minLength": "{0} deve ter pelo menos {1} caracteres",
+		"schema_maxLength": "{0} deve ter no máximo {1} caracteres",
+		"schema_minimum":   "{0} deve ser {1} ou superior",
+		"schema_maximum":   "{0} deve ser {1} ou menor",
+		"schema_minItems":  "{0} deve conter pelo menos {1} itens",
+		"schema_maxItems":  "{0} deve conter no máximo {1} itens",
+		"schema_pattern":   "{0} tem um formato inválido",
+		"schema_format":    "{0} deve ser um {1} válido",
+		"schema_enum":      "{0} deve ser um de [{1}]",
+	},
+	"fr": {
+		"schema_required":  "{0} est un champ obligatoire",
+		"schema_type":      "{0} doit être de type {1}",
+		"schema_minLength": "{0} doit faire au moins {1} caractères",
+		"schema_maxLength": "{0} doit faire au maximum {1} caractères",
+		"schema_minimum":   "{0} doit être égal à {1} ou plus",
+		"schema_maximum":   "{0} doit être égal à {1} ou moins",
+		"schema_minItems":  "{0} doit contenir au moins {1} éléments",
+		"schema_maxItems":  "{0} doit contenir au maximum {1} éléments",
+		"schema_pattern":   "{0} n'a pas un format valide",
+		"schema_format":    "{0} doit être un {1} valide",
+		"schema_enum":      "{0} doit être l'un des choix suivants [{1}]",
+	},
+}
+
+// SchemaProblem converts an OpenAPI validation error to a problem, with
+// messages translated by the request Accept-Language. Invalid path
+// parameters are ids, invalid responses are internal errors.
+func SchemaProblem(c echo.Context, err *openapi.ValidationError) error {
+	var p *problem.Problem
+	switch {
+	case err.In == "response":
+		p = problem.New(http.StatusInternalServerError, problem.CodeInternal, "The response does not match its documented schema")
+	case err.Err != nil:
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	case err.In == "path":
+		p = problem.New(http.StatusBadRequest, problem.CodeInvalidID, "The path parameters are invalid")
+	default:
+		p = problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Unable to validate the request "+err.In)
+	}
+	trans := translator(c.Request().Header.Get("Accept-Language"))
+	for _, violation := range err.Violations {
+		rule, ok := schemaRules[violation.Keyword]
+		if !ok {
+			rule = violation.Keyword
+		}
+		if violation.Keyword == "format" {
+			rule = violation.Params[0]
+		}
+		msg, terr := trans.T("schema_"+violation.Keyword, append([]string{violation.Field}, violation.Params...)...)
+		if terr != nil {
+			msg = strings.TrimSpace(violation.Field + " " + violation.Message)
+		}
+		p.WithErrors(problem.FieldError{Field: violation.Field, Rule: rule, Message: msg})
+	}
+	return p.WithCause(err)
+}
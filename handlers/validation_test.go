@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"testing"
+	"tronicscorp/problem"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidationProblem(t *testing.T) {
+	product := Product{Name: "phone", Price: 100, Currency: "EURO", Vendor: "acme"}
+	t.Run("reports fields by json name", func(t *testing.T) {
+		p := validationProblem(v.Struct(product), translator(""), "[1].")
+		assert.Equal(t, problem.CodeValidationFailed, p.Code)
+		assert.Equal(t, []problem.FieldError{{
+			Field:   "[1].currency",
+			Rule:    "len",
+			Message: "currency must be 3 characters in length",
+		}}, p.Errors)
+	})
+	t.Run("translates by accept language", func(t *testing.T) {
+		p := validationProblem(v.Struct(User{}), translator("de;q=0.9, pt-BR;q=0.8, en;q=0.1"), "")
+		assert.Len(t, p.Errors, 2)
+		assert.Equal(t, "username", p.Errors[0].Field)
+		assert.Equal(t, "required", p.Errors[0].Rule)
+		assert.Equal(t, "username é um campo requerido", p.Errors[0].Message)
+	})
+	t.Run("password length applies", func(t *testing.T) {
+		p := validationProblem(v.Struct(User{Email: "a@b.co", Password: "short"}), translator("fr"), "")
+		assert.Len(t, p.Errors, 1)
+		assert.Equal(t, "passwprd", p.Errors[0].Field)
+		assert.Equal(t, "min", p.Errors[0].Rule)
+	})
+}
+
+func TestPreferredLocales(t *testing.T) {
+	assert.Equal(t, []string{"pt_BR", "pt", "en"}, preferredLocales("en;q=0.5, pt-br"))
+	assert.Equal(t, []string{"pt", "pt_BR", "en"}, preferredLocales("pt, en;q=0.5"))
+	assert.Equal(t, "pt_BR", translator("pt").Locale(), "pt is served by pt_BR")
+	assert.Empty(t, preferredLocales(""))
+}
@@ -1,19 +1,31 @@
 package handlers
 
-import "gopkg.in/go-playground/validator.v9"
+import (
+	"tronicscorp/dbiface"
+
+	"gopkg.in/go-playground/validator.v9"
+)
 
 var (
-	v = validator.New()
+	v = newValidator()
 )
 
 //ProductValidator a product validator
 type ProductValidator struct {
-	validator *validator.Validate
+	validator  *validator.Validate
+	rules      ProductRules
+	categories dbiface.CollectionAPI
 }
 
-//Validate validates a product
+//Validate validates a product against its struct tags, then the product rules
 func (p *ProductValidator) Validate(i interface{}) error {
-	return p.validator.Struct(i)
+	if err := p.validator.Struct(i); err != nil {
+		return err
+	}
+	if product, ok := i.(Product); ok {
+		return p.rules.Check(product)
+	}
+	return nil
 }
 
 type userValidator struct {
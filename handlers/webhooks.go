@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	"tronicscorp/webhooks"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDeliveries caps the deliveries listed at once.
+const maxDeliveries = 200
+
+// WebhooksHandler lets admins manage the webhook subscriptions and inspect
+// their deliveries.
+type WebhooksHandler struct {
+	Dispatcher *webhooks.Dispatcher
+}
+
+// CreateWebhook subscribes an endpoint. The response is the only one holding
+// the signing secret.
+func (h *WebhooksHandler) CreateWebhook(c echo.Context) error {
+	ctx := c.Request().Context()
+	sub, err := h.bind(c)
+	if err != nil {
+		return err
+	}
+	if sub.Secret == "" {
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			return problem.New(http.StatusInternalServerError, problem.CodeInternal, "Unable to generate the secret").WithCause(err)
+		}
+		sub.Secret = secret
+	}
+	sub.ID = primitive.NewObjectID()
+	sub.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if _, err := h.Dispatcher.Webhooks.InsertOne(ctx, sub); err != nil {
+		logging.FromContext(ctx).Error("Unable to insert the webhook", "error", err)
+		return dbError(err, "Unable to create the webhook")
+	}
+	logging.FromContext(ctx).Info("Webhook created", "webhook_id", sub.ID.Hex(), "url", sub.URL)
+	return c.JSON(http.StatusCreated, sub)
+}
+
+func (h *WebhooksHandler) ListWebhooks(c echo.Context) error {
+	ctx := c.Request().Context()
+	cursor, err := h.Dispatcher.Webhooks.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the webhooks", "error", err)
+		return dbError(err, "Unable to find the webhooks")
+	}
+	subs := []webhooks.Subscription{}
+	if err := cursor.All(ctx, &subs); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the webhooks", "error", err)
+		return dbError(err, "Unable to read the webhooks")
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return c.JSON(http.StatusOK, subs)
+}
+
+func (h *WebhooksHandler) GetWebhook(c echo.Context) error {
+	sub, err := h.find(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	sub.Secret = ""
+	return c.JSON(http.StatusOK, sub)
+}
+
+// UpdateWebhook replaces the url, events, description and state of a webhook.
+// The secret is only replaced when one is given.
+func (h *WebhooksHandler) UpdateWebhook(c echo.Context) error {
+	ctx := c.Request().Context()
+	current, p := h.find(ctx, c.Param("id"))
+	if p != nil {
+		return p
+	}
+	sub, err := h.bind(c)
+	if err != nil {
+		return err
+	}
+	set := bson.M{"url": sub.URL, "events": sub.Events, "description": sub.Description, "disabled": sub.Disabled}
+	if sub.Secret != "" {
+		set["secret"] = sub.Secret
+	}
+	if _, err := h.Dispatcher.Webhooks.UpdateOne(ctx, bson.M{"_id": current.ID}, bson.M{"$set": set}); err != nil {
+		logging.FromContext(ctx).Error("Unable to update the webhook", "error", err)
+		return dbError(err, "Unable to update the webhook")
+	}
+	sub.ID, sub.CreatedAt, sub.Secret = current.ID, current.CreatedAt, ""
+	return c.JSON(http.StatusOK, sub)
+}
+
+// DeleteWebhook removes a webhook. Its pending deliveries are dead-lettered
+// when attempted.
+func (h *WebhooksHandler) DeleteWebhook(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return invalidID(c.Param("id"))
+	}
+	res, err := h.Dispatcher.Webhooks.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to delete the webhook", "error", err)
+		return dbError(err, "Unable to delete the webhook")
+	}
+	if res.DeletedCount == 0 {
+		return webhookNotFound(c.Param("id"))
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// PingWebhook sends a webhook.ping event to a webhook, to check the receiver.
+func (h *WebhooksHandler) PingWebhook(c echo.Context) error {
+	ctx := c.Request().Context()
+	sub, err := h.find(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	delivery, er := h.Dispatcher.Ping(ctx, sub.ID)
+	if er != nil {
+		logging.FromContext(ctx).Error("Unable to record the ping", "error", er)
+		return dbError(er, "Unable to record the ping")
+	}
+	return c.JSON(http.StatusAccepted, delivery)
+}
+
+// ListDeliveries lists the latest deliveries, of a webhook when the path has
+// an id, filtered by the status parameter. The dead letters are the
+// deliveries with the dead status.
+func (h *WebhooksHandler) ListDeliveries(c echo.Context) error {
+	ctx := c.Request().Context()
+	filter := bson.M{}
+	if c.Param("id") != "" {
+		sub, err := h.find(ctx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		filter["webhook_id"] = sub.ID
+	}
+	switch status := webhooks.Status(c.QueryParam("status")); status {
+	case "":
+	case webhooks.StatusPending, webhooks.StatusSucceeded, webhooks.StatusDead:
+		filter["status"] = status
+	default:
+		return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "status must be one of pending, succeeded, dead").
+			WithErrors(problem.FieldError{Field: "status", Rule: "oneof", Message: "status must be one of pending, succeeded, dead"})
+	}
+	limit := int64(50)
+	if raw := c.QueryParam("limit"); raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 1 || n > maxDeliveries {
+			return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "limit must be between 1 and 200").
+				WithErrors(problem.FieldError{Field: "limit", Rule: "max", Message: "limit must be between 1 and 200"})
+		}
+		limit = n
+	}
+	cursor, err := h.Dispatcher.Deliveries.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the deliveries", "error", err)
+		return dbError(err, "Unable to find the deliveries")
+	}
+	deliveries := []webhooks.Delivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		logging.FromContext(ctx).Error("Unable to read the deliveries", "error", err)
+		return dbError(err, "Unable to read the deliveries")
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// Redeliver queues a delivery again, typically a dead letter, for one more
+// attempt.
+func (h *WebhooksHandler) Redeliver(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		return invalidID(c.Param("id"))
+	}
+	found, err := h.Dispatcher.Redeliver(ctx, id)
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to queue the delivery", "error", err)
+		return dbError(err, "Unable to queue the delivery")
+	}
+	if !found {
+		return problem.New(http.StatusNotFound, problem.CodeDeliveryNotFound, "Delivery "+c.Param("id")+" does not exist")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
+
+func (h *WebhooksHandler) bind(c echo.Context) (webhooks.Subscription, error) {
+	var sub webhooks.Subscription
+	if err := c.Bind(&sub); err != nil {
+		logging.FromContext(c.Request().Context()).Error("Unable to bind the request payload", "error", err)
+		return sub, problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to parse the request payload").WithCause(err)
+	}
+	if err := v.Struct(sub); err != nil {
+		return sub, validationProblem(err, translator(c.Request().Header.Get("Accept-Language")), "")
+	}
+	return sub, nil
+}
+
+func (h *WebhooksHandler) find(ctx context.Context, id string) (webhooks.Subscription, *problem.Problem) {
+	var sub webhooks.Subscription
+	docID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return sub, invalidID(id)
+	}
+	err = h.Dispatcher.Webhooks.FindOne(ctx, bson.M{"_id": docID}).Decode(&sub)
+	if err == mongo.ErrNoDocuments {
+		return sub, webhookNotFound(id)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Unable to find the webhook", "error", err)
+		return sub, dbError(err, "Unable to find the webhook")
+	}
+	return sub, nil
+}
+
+func webhookNotFound(id string) *problem.Problem {
+	return problem.New(http.StatusNotFound, problem.CodeWebhookNotFound, "Webhook "+id+" does not exist")
+}
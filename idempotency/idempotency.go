@@ -0,0 +1,229 @@
+// Package idempotency makes the retries of a request safe: the requests
+// sending an Idempotency-Key header are processed once, the retries getting
+// the stored response of the first one.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+	"tronicscorp/dbiface"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// Header is the request header of the keys.
+	Header = "Idempotency-Key"
+	// ReplayedHeader flags the stored responses.
+	ReplayedHeader = "Idempotent-Replayed"
+	// MaxKeyLength is the length of the longest key accepted.
+	MaxKeyLength = 255
+)
+
+// record is a key, locked while its request is processed, then holding the
+// response.
+type record struct {
+	ID string `bson:"_id"`
+	// Fingerprint is the hash of the method, the URI and the body of the
+	// request.
+	Fingerprint string      `bson:"fingerprint"`
+	Done        bool        `bson:"done"`
+	LockedUntil time.Time   `bson:"locked_until"`
+	Status      int         `bson:"status,omitempty"`
+	Header      http.Header `bson:"header,omitempty"`
+	Body        []byte      `bson:"body,omitempty"`
+	ExpireAt    time.Time   `bson:"expire_at"`
+}
+
+// Config configures Middleware.
+type Config struct {
+	// Col stores the keys. Its TTL index on expire_at forgets them.
+	Col dbiface.CollectionAPI
+	// TTL is how long the responses are kept, 24 hours when zero.
+	TTL time.Duration
+	// Lock is how long a request holds its key at most: a client retrying
+	// after it gets the key, as when the instance processing the request
+	// stopped. A minute when zero.
+	Lock time.Duration
+	// Scope returns the owner of the keys of the request, for clients not to
+	// see the responses of each other.
+	Scope func(c echo.Context) string
+}
+
+// Middleware processes the requests sending a key once. The first response
+// is stored, unless a server error, and sent again to the retries with the
+// Idempotent-Replayed header. A retry while the request is processed gets a
+// 409 Conflict, and a key sent with another request a 422 Unprocessable
+// Entity. The errors of the handler are rendered here, to be stored.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	if cfg.TTL <= 0 {
+		cfg.TTL = 24 * time.Hour
+	}
+	if cfg.Lock <= 0 {
+		cfg.Lock = time.Minute
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(Header)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > MaxKeyLength {
+				return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "Unable to validate the request header").
+					WithErrors(problem.FieldError{Field: Header, Rule: "max", Message: fmt.Sprintf("%s must be at most %d characters", Header, MaxKeyLength)})
+			}
+			fingerprint, err := fingerprint(c.Request())
+			if err != nil {
+				return problem.New(http.StatusBadRequest, problem.CodeInvalidPayload, "Unable to read the request payload").WithCause(err)
+			}
+			id := cfg.Scope(c) + ":" + key
+			rec, err := cfg.acquire(c.Request().Context(), id, fingerprint)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				return replay(c, rec)
+			}
+			return cfg.process(c, next, id)
+		}
+	}
+}
+
+// fingerprint returns the hash of the method, the URI and the body of req,
+// left for the handler to read.
+func fingerprint(req *http.Request) (string, error) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// acquire locks the key id for the request of fingerprint. It returns the
+// record of the key when it holds the response to send again.
+func (cfg Config) acquire(ctx context.Context, id, fingerprint string) (*record, error) {
+	now := time.Now()
+	_, err := cfg.Col.InsertOne(ctx, record{ID: id, Fingerprint: fingerprint, LockedUntil: now.Add(cfg.Lock), ExpireAt: now.Add(cfg.TTL)})
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, unavailable(ctx, err)
+	}
+	var rec record
+	if err := cfg.Col.FindOne(ctx, bson.M{"_id": id}).Decode(&rec); err == mongo.ErrNoDocuments {
+		return nil, conflict()
+	} else if err != nil {
+		return nil, unavailable(ctx, err)
+	}
+	switch {
+	case rec.Fingerprint != fingerprint:
+		return nil, problem.New(http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReuse,
+			"The "+Header+" was used for another request")
+	case rec.Done:
+		return &rec, nil
+	case rec.LockedUntil.After(now):
+		return nil, conflict()
+	}
+	// The lock expired: take it over, unless another retry did.
+	res, err := cfg.Col.UpdateOne(ctx, bson.M{"_id": id, "done": false, "locked_until": rec.LockedUntil},
+		bson.M{"$set": bson.M{"locked_until": now.Add(cfg.Lock), "expire_at": now.Add(cfg.TTL)}})
+	if err != nil {
+		return nil, unavailable(ctx, err)
+	}
+	if res.ModifiedCount == 0 {
+		return nil, conflict()
+	}
+	return nil, nil
+}
+
+// process runs the request holding the key id and stores its response, or
+// releases the key after a server error for the request to be retried.
+func (cfg Config) process(c echo.Context, next echo.HandlerFunc, id string) error {
+	before := c.Response().Header().Clone()
+	res := c.Response()
+	rec := &recorder{ResponseWriter: res.Writer}
+	res.Writer = rec
+	err := next(c)
+	if err != nil {
+		c.Error(err)
+	}
+	res.Writer = rec.ResponseWriter
+
+	// The request may have timed out: store within a context of its own.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request().Context()), 5*time.Second)
+	defer cancel()
+	logger := logging.FromContext(ctx)
+	if !res.Committed || res.Status >= http.StatusInternalServerError {
+		if _, derr := cfg.Col.DeleteOne(ctx, bson.M{"_id": id, "done": false}); derr != nil {
+			logger.Error("Unable to release the idempotency key", "error", derr)
+		}
+		return err
+	}
+	header := http.Header{}
+	for name, values := range res.Header() {
+		if old, ok := before[name]; !ok || !slices.Equal(old, values) {
+			header[name] = values
+		}
+	}
+	_, uerr := cfg.Col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"done":      true,
+		"status":    res.Status,
+		"header":    header,
+		"body":      rec.body.Bytes(),
+		"expire_at": time.Now().Add(cfg.TTL),
+	}})
+	if uerr != nil {
+		// The retries get a conflict until the lock expires, then run again.
+		logger.Error("Unable to store the idempotent response", "error", uerr)
+	}
+	return err
+}
+
+// replay sends the stored response of rec.
+func replay(c echo.Context, rec *record) error {
+	header := c.Response().Header()
+	for name, values := range rec.Header {
+		header[name] = values
+	}
+	header.Set(ReplayedHeader, "true")
+	c.Response().WriteHeader(rec.Status)
+	_, err := c.Response().Write(rec.Body)
+	return err
+}
+
+func conflict() *problem.Problem {
+	return problem.New(http.StatusConflict, problem.CodeIdempotencyConflict,
+		"A request with this "+Header+" is being processed, retry later")
+}
+
+func unavailable(ctx context.Context, err error) *problem.Problem {
+	logging.FromContext(ctx).Error("Unable to check the idempotency key", "error", err)
+	return problem.New(http.StatusServiceUnavailable, problem.CodeUnavailable, "Unable to check the "+Header).WithCause(err)
+}
+
+// recorder copies the body of a response.
+type recorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
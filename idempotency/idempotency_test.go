@@ -0,0 +1,123 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	col := &dbtest.Collection{}
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		if !c.Response().Committed {
+			p := problem.From(err)
+			c.JSON(p.Status, p)
+		}
+	}
+	calls := 0
+	var handler echo.HandlerFunc
+	e.POST("/products", func(c echo.Context) error {
+		calls++
+		return handler(c)
+	}, Middleware(Config{Col: col, Scope: func(c echo.Context) string { return c.Request().Header.Get("X-User") }}))
+	send := func(key, user, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set(Header, key)
+		}
+		req.Header.Set("X-User", user)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+	created := func(c echo.Context) error {
+		c.Response().Header().Set("Location", "/products/1")
+		return c.JSON(http.StatusCreated, []string{"1"})
+	}
+
+	t.Run("replays the first response", func(t *testing.T) {
+		calls, handler = 0, created
+		first := send("k1", "jane", `{"name":"phone"}`)
+		assert.Equal(t, http.StatusCreated, first.Code)
+		again := send("k1", "jane", `{"name":"phone"}`)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusCreated, again.Code)
+		assert.Equal(t, first.Body.String(), again.Body.String())
+		assert.Equal(t, "/products/1", again.Header().Get("Location"))
+		assert.Equal(t, "true", again.Header().Get(ReplayedHeader))
+		assert.Empty(t, first.Header().Get(ReplayedHeader))
+
+		send("k1", "john", `{"name":"phone"}`)
+		assert.Equal(t, 2, calls, "the keys are scoped")
+		send("", "jane", `{"name":"phone"}`)
+		send("", "jane", `{"name":"phone"}`)
+		assert.Equal(t, 4, calls, "requests without key are not deduplicated")
+	})
+	t.Run("rejects a key reused for another request", func(t *testing.T) {
+		res := send("k1", "jane", `{"name":"tablet"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+		assert.Contains(t, res.Body.String(), string(problem.CodeIdempotencyKeyReuse))
+	})
+	t.Run("replays the client errors", func(t *testing.T) {
+		calls = 0
+		handler = func(c echo.Context) error {
+			return problem.New(http.StatusBadRequest, problem.CodeValidationFailed, "price is required")
+		}
+		send("k2", "jane", `{}`)
+		res := send("k2", "jane", `{}`)
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Contains(t, res.Body.String(), "price is required")
+	})
+	t.Run("releases the key after a server error", func(t *testing.T) {
+		calls = 0
+		handler = func(c echo.Context) error {
+			return errors.New("database down")
+		}
+		assert.Equal(t, http.StatusInternalServerError, send("k3", "jane", `{}`).Code)
+		handler = created
+		assert.Equal(t, http.StatusCreated, send("k3", "jane", `{}`).Code)
+		assert.Equal(t, 2, calls)
+	})
+	t.Run("rejects concurrent duplicates", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		handler = func(c echo.Context) error {
+			close(started)
+			<-release
+			return created(c)
+		}
+		done := make(chan int)
+		go func() {
+			done <- send("k4", "jane", `{}`).Code
+		}()
+		<-started
+		res := send("k4", "jane", `{}`)
+		assert.Equal(t, http.StatusConflict, res.Code)
+		assert.Contains(t, res.Body.String(), string(problem.CodeIdempotencyConflict))
+		close(release)
+		assert.Equal(t, http.StatusCreated, <-done)
+	})
+	t.Run("takes over an expired lock", func(t *testing.T) {
+		calls, handler = 0, created
+		// The instance processing k5 stopped.
+		col.InsertOne(context.Background(), record{ID: "jane:k5", Fingerprint: fingerprintOf(t, `{}`), LockedUntil: time.Now().Add(-time.Second)})
+		assert.Equal(t, http.StatusCreated, send("k5", "jane", `{}`).Code)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func fingerprintOf(t *testing.T, body string) string {
+	fp, err := fingerprint(httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(body)))
+	assert.NoError(t, err)
+	return fp
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"tronicscorp/config"
+	"tronicscorp/handlers"
+	"tronicscorp/ratelimit"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The route groups of the rate limits. The routes are in the default group
+// unless their endpoint names another.
+const (
+	groupDefault  = "default"
+	groupProducts = "products"
+	groupAuth     = "auth"
+)
+
+// apiKeyHeader is the header of the API keys identifying the clients to the
+// rate limits.
+const apiKeyHeader = "X-API-Key"
+
+// rateLimiter limits each client of each route group to the quota of the
+// group. The quotas and the API keys follow the configuration reloads.
+func (a *App) rateLimiter(cfg config.Properties, limits *reloadableLimits, tokens *handlers.TokenIssuer, skipper func(c echo.Context) bool) echo.MiddlewareFunc {
+	var store ratelimit.Store = ratelimit.NewMemory()
+	if cfg.RateLimitStore == "redis" {
+		if client := a.redisClient(cfg); client != nil {
+			store = ratelimit.Redis{Client: client, Prefix: "tronics:ratelimit:"}
+		}
+	}
+	return ratelimit.Middleware(ratelimit.Config{
+		Skipper: skipper,
+		Store:   store,
+		Quota: func(c echo.Context) (string, ratelimit.Quota) {
+			group := a.rateGroups[c.Request().Method+" "+c.Path()]
+			if group == "" {
+				group = groupDefault
+			}
+			return group, limits.quota(group)
+		},
+		Client: func(c echo.Context) string {
+			return clientKey(c, limits, tokens)
+		},
+	})
+}
+
+// clientKey identifies the client of a request by its API key, the user of
+// its token, of its tenant, or else its address. Unknown keys and invalid
+// tokens are ignored, so that clients cannot get fresh buckets by making
+// them up.
+func clientKey(c echo.Context, limits *reloadableLimits, tokens *handlers.TokenIssuer) string {
+	if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+		if name, ok := limits.client(key); ok {
+			return "key:" + name
+		}
+	}
+	if user, ok := tokenClaims(c, tokens)["user_id"].(string); ok && user != "" {
+		t, _ := tenant.FromContext(c.Request().Context())
+		return t.ID + "/user:" + user
+	}
+	return "ip:" + c.RealIP()
+}
+
+// ipExtractor returns the client address of the requests: the one of the
+// peer, or the one it forwards in X-Forwarded-For when it is one of the
+// trusted proxies.
+func ipExtractor(proxies []string) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range proxies {
+		switch proxy {
+		case "loopback":
+			opts = append(opts, echo.TrustLoopback(true))
+		case "linklocal":
+			opts = append(opts, echo.TrustLinkLocal(true))
+		case "private":
+			opts = append(opts, echo.TrustPrivateNet(true))
+		default:
+			_, ipNet, err := net.ParseCIDR(proxy)
+			if err != nil {
+				ip := net.ParseIP(proxy)
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+			}
+			opts = append(opts, echo.TrustIPRange(ipNet))
+		}
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
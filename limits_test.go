@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tronicscorp/config"
+	"tronicscorp/handlers"
+	"tronicscorp/tenant"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimits(t *testing.T) {
+	a := newRoutedApp(t)
+	login := func(remote, forwarded string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth", nil)
+		req.RemoteAddr = remote
+		if forwarded != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, forwarded)
+		}
+		res := httptest.NewRecorder()
+		a.echo.ServeHTTP(res, req)
+		return res
+	}
+
+	// The default auth quota is a burst of 10.
+	for i := 0; i < 10; i++ {
+		res := login("203.0.113.7:1234", "")
+		assert.NotEqual(t, http.StatusTooManyRequests, res.Code)
+	}
+	res := login("203.0.113.7:1234", "")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.NotEmpty(t, res.Header().Get("Retry-After"))
+
+	res = login("203.0.113.7:1234", "198.51.100.1")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code, "untrusted proxies cannot forward addresses")
+	res = login("10.0.0.2:1234", "203.0.113.8")
+	assert.Equal(t, "9", res.Header().Get("RateLimit-Remaining"), "trusted proxies forward the client address")
+
+	res = httptest.NewRecorder()
+	a.echo.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/v1/products/42", nil))
+	assert.Equal(t, "100", res.Header().Get("RateLimit-Limit"), "products have their own group")
+}
+
+func TestClientKey(t *testing.T) {
+	mgr, err := config.NewManager([]string{"--api-keys", "partner:s3cret"})
+	assert.NoError(t, err)
+	limits := &reloadableLimits{}
+	limits.set(mgr.Current())
+	tokens := handlers.NewTokenIssuer("secret")
+	keyOf := func(tenantID, header, value string) string {
+		ctx := tenant.NewContext(context.Background(), tenant.Tenant{ID: tenantID})
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.RemoteAddr = "203.0.113.7:1234"
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return clientKey(echo.New().NewContext(req, httptest.NewRecorder()), limits, tokens)
+	}
+	key := func(header, value string) string {
+		return keyOf("default", header, value)
+	}
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": "jane@tronics.com"}).SignedString([]byte("secret"))
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": "jane@tronics.com"}).SignedString([]byte("guess"))
+
+	assert.Equal(t, "key:partner", key(apiKeyHeader, "s3cret"))
+	assert.Equal(t, "ip:203.0.113.7", key(apiKeyHeader, "made-up"))
+	assert.Equal(t, "default/user:jane@tronics.com", key("x-auth-token", "Bearer "+token))
+	assert.Equal(t, "acme/user:jane@tronics.com", keyOf("acme", "x-auth-token", "Bearer "+token),
+		"the same email signs up with each tenant, with its own buckets")
+	assert.Equal(t, "ip:203.0.113.7", key("x-auth-token", "Bearer "+forged))
+	assert.Equal(t, "ip:203.0.113.7", key("", ""))
+}
+
+func TestKeyScope(t *testing.T) {
+	scope := func(tenantID, remote string, claims jwt.MapClaims) string {
+		ctx := tenant.NewContext(context.Background(), tenant.Tenant{ID: tenantID})
+		req := httptest.NewRequest(http.MethodPost, "/users", nil).WithContext(ctx)
+		req.RemoteAddr = remote
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		if claims != nil {
+			c.Set("user", jwt.NewWithClaims(jwt.SigningMethodHS256, claims))
+		}
+		return keyScope(c)
+	}
+	jane := jwt.MapClaims{"user_id": "jane@tronics.com"}
+	assert.Equal(t, "acme/user:jane@tronics.com", scope("acme", "203.0.113.7:1234", jane))
+	assert.Equal(t, scope("acme", "203.0.113.7:1234", jane), scope("acme", "203.0.113.8:1234", jane), "users keep their keys across addresses")
+	assert.NotEqual(t, scope("acme", "203.0.113.7:1234", jane), scope("globex", "203.0.113.7:1234", jane))
+	assert.Equal(t, "acme/anonymous:203.0.113.7", scope("acme", "203.0.113.7:1234", nil))
+	assert.NotEqual(t, scope("acme", "203.0.113.7:1234", nil), scope("acme", "203.0.113.8:1234", nil), "anonymous clients do not share their keys")
+}
@@ -0,0 +1,87 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	redactedValue = "********"
+)
+
+// sensitiveKeys are attribute keys, or parts of keys, whose values are never
+// written out.
+var sensitiveKeys = []string{"password", "passwprd", "token", "secret", "authorization", "cookie"}
+
+// Options configures a logger.
+type Options struct {
+	Format string
+	Level  slog.Leveler
+	// Errors with the same message beyond SampleFirst per SampleTick are only
+	// logged every SampleThereafter occurrences. Zero disables sampling.
+	SampleFirst      int
+	SampleThereafter int
+	SampleTick       time.Duration
+}
+
+// New returns a logger writing to w that redacts sensitive attributes.
+func New(w io.Writer, opts Options) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level, ReplaceAttr: redact}
+	var h slog.Handler
+	if opts.Format == FormatJSON {
+		h = slog.NewJSONHandler(w, handlerOpts)
+	} else {
+		h = slog.NewTextHandler(w, handlerOpts)
+	}
+	if opts.SampleFirst > 0 {
+		h = newSamplingHandler(h, opts.SampleFirst, opts.SampleThereafter, opts.SampleTick)
+	}
+	return slog.New(h)
+}
+
+// ParseLevel converts a configured level name to a slog level. "off" maps
+// to a level above every record.
+func ParseLevel(name string) slog.Level {
+	switch name {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	case "off":
+		return slog.LevelError + 100
+	}
+	return slog.LevelInfo
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, redactedValue)
+		}
+	}
+	return a
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
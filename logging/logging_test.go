@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"tronicscorp/correlation"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Format: FormatJSON})
+	logger.Info("login", "username", "a@b.com", "password", "hunter22", "x-auth-token", "Bearer abc")
+
+	var line map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "a@b.com", line["username"])
+	assert.Equal(t, redactedValue, line["password"])
+	assert.Equal(t, redactedValue, line["x-auth-token"])
+}
+
+func TestSampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Format: FormatText, SampleFirst: 2, SampleThereafter: 5, SampleTick: time.Hour})
+	for i := 0; i < 12; i++ {
+		logger.Error("Unable to find the product")
+		logger.Info("not sampled")
+	}
+	assert.Equal(t, 4, strings.Count(buf.String(), "Unable to find the product"))
+	assert.Equal(t, 12, strings.Count(buf.String(), "not sampled"))
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	e := echo.New()
+	e.Pre(correlation.Middleware)
+	e.Use(Middleware(New(&buf, Options{Format: FormatJSON}), nil))
+	e.GET("/product/:id", func(c echo.Context) error {
+		WithAttrs(c, "user_id", "a@b.com")
+		FromContext(c.Request().Context()).Info("Handling")
+		return c.NoContent(http.StatusNoContent)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/product/42", nil)
+	req.Header.Set(correlation.Header, "abc123")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	for _, raw := range lines {
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(raw), &line))
+		assert.Equal(t, "abc123", line["correlation_id"])
+		assert.Equal(t, "/product/:id", line["route"])
+		assert.Equal(t, "a@b.com", line["user_id"])
+	}
+	var completed map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &completed))
+	assert.Equal(t, float64(http.StatusNoContent), completed["status"])
+	assert.Contains(t, completed, "latency")
+}
+
+func TestParseLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelWarn, ParseLevel("warn"))
+	assert.Equal(t, slog.LevelInfo, ParseLevel("info"))
+}
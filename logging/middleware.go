@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+	"tronicscorp/correlation"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Middleware stores a request scoped logger, tagged with the correlation ID
+// and route, in the request context and logs every completed request with
+// its status and latency. Skipped requests are served but not logged.
+func Middleware(base *slog.Logger, skip func(echo.Context) bool) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			logger := base.With(
+				slog.String("correlation_id", correlation.FromContext(req.Context())),
+				slog.String("method", req.Method),
+				slog.String("route", c.Path()),
+			)
+			c.SetRequest(req.WithContext(NewContext(req.Context(), logger)))
+			err := next(c)
+			if skip != nil && skip(c) {
+				return err
+			}
+			status := c.Response().Status
+			if err != nil {
+				status = problem.Status(err)
+			}
+			logger = FromContext(c.Request().Context())
+			attrs := []slog.Attr{
+				slog.Int("status", status),
+				slog.Duration("latency", time.Since(start)),
+				slog.String("remote_ip", c.RealIP()),
+				slog.Int64("bytes_out", c.Response().Size),
+			}
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+				if err != nil {
+					attrs = append(attrs, slog.String("error", err.Error()))
+				}
+			}
+			logger.LogAttrs(c.Request().Context(), level, "request completed", attrs...)
+			return err
+		}
+	}
+}
+
+// WithAttrs adds attrs to the logger of the request, e.g. the authenticated
+// user once it is known.
+func WithAttrs(c echo.Context, attrs ...any) {
+	ctx := c.Request().Context()
+	c.SetRequest(c.Request().WithContext(NewContext(ctx, FromContext(ctx).With(attrs...))))
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// samplingHandler throttles repeated error records: per tick, the first
+// records with a given message are passed through, then only every
+// thereafter-th one. Records below error level are never sampled.
+type samplingHandler struct {
+	next       slog.Handler
+	first      int
+	thereafter int
+	tick       time.Duration
+	state      *samplingState
+}
+
+type samplingState struct {
+	mu     sync.Mutex
+	reset  time.Time
+	counts map[string]int
+}
+
+func newSamplingHandler(next slog.Handler, first, thereafter int, tick time.Duration) *samplingHandler {
+	return &samplingHandler{
+		next:       next,
+		first:      first,
+		thereafter: thereafter,
+		tick:       tick,
+		state:      &samplingState{counts: map[string]int{}},
+	}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelError || h.allow(r.Message, r.Time) {
+		return h.next.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *samplingHandler) allow(message string, now time.Time) bool {
+	s := h.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.After(s.reset) {
+		s.reset = now.Add(h.tick)
+		s.counts = map[string]int{}
+	}
+	s.counts[message]++
+	n := s.counts[message]
+	if n <= h.first {
+		return true
+	}
+	return h.thereafter > 0 && (n-h.first)%h.thereafter == 0
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{h.next.WithAttrs(attrs), h.first, h.thereafter, h.tick, h.state}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{h.next.WithGroup(name), h.first, h.thereafter, h.tick, h.state}
+}
@@ -2,119 +2,130 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"tronicscorp/config"
 	"tronicscorp/handlers"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
 
 	"github.com/golang-jwt/jwt"
-	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"github.com/labstack/gommon/log"
-	"github.com/labstack/gommon/random"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-const (
-	CorrelationID = "X-Correlation-ID"
-)
-
-var (
-	c        *mongo.Client
-	db       *mongo.Database
-	prodCol  *mongo.Collection
-	usersCol *mongo.Collection
-	cfg      config.Properties
-)
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
 
-func init() {
-	if err := cleanenv.ReadEnv(&cfg); err != nil {
-		log.Fatalf("Configurations cannot be read: %v", err)
+func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, ok := c.Get("user").(*jwt.Token)
+		if !ok {
+			return problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "Unable to parse token")
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if authorized, _ := claims["authorized"].(bool); !authorized {
+			return problem.New(http.StatusForbidden, problem.CodeForbidden, "Not authorized")
+		}
+		return next(c)
 	}
+}
 
-	connectURI := fmt.Sprintf("mongodb://%s:%s", cfg.DBHost, cfg.DBPort)
-	c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(connectURI))
-	if err != nil {
-		log.Fatalf("Unable to connect to database : %v", err)
+// withUser tags the request logger with the authenticated user. It must run
+// after the JWT middleware.
+func withUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token, ok := c.Get("user").(*jwt.Token); ok {
+			if claims, ok := token.Claims.(jwt.MapClaims); ok {
+				logging.WithAttrs(c, "user_id", claims["user_id"])
+			}
+		}
+		return next(c)
 	}
+}
 
-	db = c.Database(cfg.DBName)
-	prodCol = db.Collection(cfg.ProductCollection)
-	usersCol = db.Collection(cfg.UsersCollection)
+// operatorOnly restricts a route to the default tenant, the operator of the
+// deployment: the product rules, the webhooks and the outbox are shared by
+// the tenants.
+func operatorOnly(tenants *tenant.Registry) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if t, ok := tenant.FromContext(c.Request().Context()); !ok || t.ID != tenants.Default().ID {
+				return problem.New(http.StatusForbidden, problem.CodeForbidden, "Only the operator tenant is allowed to do this")
+			}
+			return next(c)
+		}
+	}
+}
 
-	isUserIndexUnique := true
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{{"username", 1}},
-		Options: &options.IndexOptions{
-			Unique: &isUserIndexUnique,
-		},
+// tokenClaims returns the claims of the token of a request, nil when it has
+// no valid one.
+func tokenClaims(c echo.Context, tokens *handlers.TokenIssuer) jwt.MapClaims {
+	raw := c.Request().Header.Get("x-auth-token")
+	if raw == "" {
+		return nil
 	}
-	_, err = usersCol.Indexes().CreateOne(context.Background(), indexModel)
-	if err != nil {
-		log.Fatalf("Unable to create an index : %+v", err)
+	token, err := jwt.Parse(strings.TrimPrefix(raw, "Bearer "), tokens.Keyfunc)
+	if err != nil || !token.Valid {
+		return nil
 	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	return claims
 }
 
-func addCorrelationID(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		id := c.Request().Header.Get(CorrelationID)
-		var newID string
-		if id == "" {
-			newID = random.String(12)
-		} else {
-			newID = id
+// keyScope returns the owner of the idempotency keys of a request, within
+// its tenant: its user, or else its address, so that two anonymous clients
+// picking the same key do not share it.
+func keyScope(c echo.Context) string {
+	t, _ := tenant.FromContext(c.Request().Context())
+	if token, ok := c.Get("user").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			if user, ok := claims["user_id"].(string); ok {
+				return t.ID + "/user:" + user
+			}
 		}
-		c.Request().Header.Set(CorrelationID, newID)
-		c.Response().Header().Set(CorrelationID, newID)
-		return next(c)
 	}
+	return t.ID + "/anonymous:" + c.RealIP()
 }
 
-func adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		hToken := c.Request().Header.Get("x-auth-token")
-		token := strings.Split(hToken, "")[1]
-		claims := jwt.MapClaims{}
-		_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
-			return []byte(cfg.JwtTokenSecret), nil
-		})
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Unable to parse token")
-		}
-		if !claims["authorized"].(bool) {
-			return echo.NewHTTPError(http.StatusForbidden, "Not authorized")
-		}
-		return next(c)
-	}
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	e := echo.New()
-	e.Logger.SetLevel(log.DEBUG)
-	e.Pre(middleware.RemoveTrailingSlash())
-	e.Pre(addCorrelationID)
-	jwtMiddleware := middleware.JWTWithConfig(middleware.JWTConfig{
-		SigningKey:  []byte(cfg.JwtTokenSecret),
-		TokenLookup: "Header:x-auth-token",
-	})
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: `${time_rfc3339_nano} ${remote_ip} ${host} ${method} ${uri} ${user_agent}` +
-			`${status} ${error} ${latency_human}` + "\n",
-	}))
-	h := &handlers.ProductHandler{Col: prodCol}
-	uh := &handlers.UsersHandler{Col: usersCol}
-	e.GET("/product/:id", h.GetProduct)
-	e.DELETE("/product/:id", h.DeleteProduct, jwtMiddleware, adminMiddleware)
-	e.PUT("/products/:id", h.UpdateProduct, middleware.BodyLimit("1M"), jwtMiddleware)
-	e.POST("/products", h.CreateProducts, middleware.BodyLimit("1M"), jwtMiddleware)
-	e.GET("/products", h.GetProducts)
-
-	e.POST("/users", uh.CreateUser)
-	e.POST("/auth", uh.AuthnUser)
-	e.Logger.Infof("Listening on %s:%s", cfg.Host, cfg.Port)
-	e.Logger.Fatal(e.Start(fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)))
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Args[2:], os.Stdout); err != nil {
+			fatal("Unable to run the config command", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "webhooks" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runWebhooksCommand(ctx, os.Args[2:], os.Stdout); err != nil {
+			fatal("Unable to run the webhooks command", err)
+		}
+		return
+	}
+	mgr, err := config.NewManager(os.Args[1:])
+	if err != nil {
+		fatal("Configurations cannot be read", err)
+	}
+	app, err := NewApp(mgr)
+	if err != nil {
+		fatal("Unable to start", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cfg := mgr.Current()
+	slog.Info("Listening", "host", cfg.Host, "port", cfg.Port, "grpc_port", cfg.GRPCPort, "version", version, "profile", cfg.Profile)
+	if err := app.Run(ctx); err != nil {
+		fatal("Server stopped", err)
+	}
+	slog.Info("Server stopped")
 }
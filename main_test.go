@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/handlers"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	users := &dbtest.Collection{}
+	password, err := bcrypt.GenerateFromPassword([]byte("password"), 8)
+	assert.NoError(t, err)
+	for _, doc := range []bson.M{
+		{"username": "admin@tronics.com", "password": string(password), "isadmin": true},
+		{"username": "jane@tronics.com", "password": string(password), "isadmin": false},
+	} {
+		users.InsertOne(context.Background(), doc)
+	}
+	tokens := handlers.NewTokenIssuer("secret")
+	uh := &handlers.UsersHandler{Col: users, Tokens: tokens}
+	e := echo.New()
+	e.HTTPErrorHandler = handlers.HTTPErrorHandler
+	// login returns the status of an admin route for the token of username.
+	login := func(username string) int {
+		body := `{"username": "` + username + `", "passwprd": "password"}`
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, uh.AuthnUser(e.NewContext(req, rec)))
+		token, err := jwt.Parse(strings.TrimPrefix(rec.Header().Get("x-auth-token"), "Bearer "), tokens.Keyfunc)
+		assert.NoError(t, err)
+
+		rec = httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.Set("user", token)
+		if err := adminMiddleware(func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })(c); err != nil {
+			e.HTTPErrorHandler(err, c)
+		}
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusNoContent, login("admin@tronics.com"), "the token of an admin logging in is an admin one")
+	assert.Equal(t, http.StatusForbidden, login("jane@tronics.com"))
+}
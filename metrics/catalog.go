@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+	"tronicscorp/dbiface"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// RefreshCatalog updates the catalog gauges from the products collection
+// every interval until ctx is done.
+func RefreshCatalog(ctx context.Context, products dbiface.CollectionAPI, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := refreshProductsByVendor(ctx, products); err != nil && ctx.Err() == nil {
+			slog.Error("Unable to refresh catalog metrics", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func refreshProductsByVendor(ctx context.Context, products dbiface.CollectionAPI) error {
+	pipeline := bson.A{bson.M{"$group": bson.M{"_id": "$vendor", "count": bson.M{"$sum": 1}}}}
+	cursor, err := products.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	var counts []struct {
+		Vendor string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	if err := cursor.All(ctx, &counts); err != nil {
+		return err
+	}
+	ProductsByVendor.Reset()
+	for _, c := range counts {
+		ProductsByVendor.WithLabelValues(c.Vendor).Set(float64(c.Count))
+	}
+	return nil
+}
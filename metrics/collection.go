@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"context"
+	"time"
+	"tronicscorp/dbiface"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection wraps a dbiface.CollectionAPI and records the latency and errors
+// of every operation. Documents not found by FindOne are not errors.
+type Collection struct {
+	dbiface.CollectionAPI
+	Name string
+}
+
+// InstrumentCollection returns col recording metrics under name.
+func InstrumentCollection(name string, col dbiface.CollectionAPI) *Collection {
+	return &Collection{CollectionAPI: col, Name: name}
+}
+
+func (c *Collection) observe(operation string, start time.Time, err error) {
+	DBDuration.WithLabelValues(c.Name, operation).Observe(time.Since(start).Seconds())
+	if err != nil && err != mongo.ErrNoDocuments {
+		DBErrors.WithLabelValues(c.Name, operation).Inc()
+	}
+}
+
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	start := time.Now()
+	res, err := c.CollectionAPI.InsertOne(ctx, document, opts...)
+	c.observe("insert_one", start, err)
+	return res, err
+}
+
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	start := time.Now()
+	cursor, err := c.CollectionAPI.Find(ctx, filter, opts...)
+	c.observe("find", start, err)
+	return cursor, err
+}
+
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	start := time.Now()
+	res := c.CollectionAPI.FindOne(ctx, filter, opts...)
+	c.observe("find_one", start, res.Err())
+	return res
+}
+
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	start := time.Now()
+	res, err := c.CollectionAPI.UpdateOne(ctx, filter, update, opts...)
+	c.observe("update_one", start, err)
+	return res, err
+}
+
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	start := time.Now()
+	res, err := c.CollectionAPI.DeleteOne(ctx, filter, opts...)
+	c.observe("delete_one", start, err)
+	return res, err
+}
+
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	start := time.Now()
+	cursor, err := c.CollectionAPI.Aggregate(ctx, pipeline, opts...)
+	c.observe("aggregate", start, err)
+	return cursor, err
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tronics"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route template and status.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route template and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// AuthAttempts counts logins by result: success, failure or locked.
+	AuthAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      "Authentication attempts by result.",
+	}, []string{"result"})
+
+	AuthLockouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_lockouts_total",
+		Help:      "Accounts locked after too many failed logins.",
+	})
+
+	DBDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "MongoDB operation latency by collection and operation.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"collection", "operation"})
+
+	DBErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_operation_errors_total",
+		Help:      "MongoDB operation errors by collection and operation.",
+	}, []string{"collection", "operation"})
+
+	// DeprecatedRequests counts calls to the unversioned routes kept as
+	// aliases, to know when they can be removed.
+	DeprecatedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deprecated_requests_total",
+		Help:      "Requests to deprecated routes by method and route template.",
+	}, []string{"method", "route"})
+
+	// OutOfBandChanges counts the changes made outside of the API, by source
+	// collection and operation.
+	OutOfBandChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "out_of_band_changes_total",
+		Help:      "Changes made to the collections outside of the API by collection and operation.",
+	}, []string{"collection", "operation"})
+
+	// CacheRequests counts the cache lookups by cache and result: hit, miss,
+	// or error when the cache could not be read.
+	CacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups by cache and result.",
+	}, []string{"cache", "result"})
+
+	// RateLimitedRequests counts the requests rejected by the rate limits, by
+	// route group.
+	RateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Requests rejected by the rate limits by route group.",
+	}, []string{"group"})
+
+	ProductsByVendor = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "catalog_products",
+		Help:      "Products in the catalog by vendor.",
+	}, []string{"vendor"})
+)
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Middleware records the count and latency of every request, labelled by the
+// route template rather than the raw path to keep cardinality bounded.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			status = problem.Status(err)
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := []string{c.Request().Method, route, strconv.Itoa(status)}
+		HTTPRequests.WithLabelValues(labels...).Inc()
+		HTTPDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware)
+	e.GET("/product/:id", func(c echo.Context) error {
+		if c.Param("id") == "missing" {
+			return echo.NewHTTPError(http.StatusNotFound, "Unable to find the product")
+		}
+		return c.String(http.StatusOK, "ok")
+	})
+	for _, id := range []string{"a", "b", "missing"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/product/"+id, nil))
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/product/:id", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/product/:id", "404")))
+}
+
+type fakeCollection struct {
+	Collection
+	err error
+}
+
+func (f *fakeCollection) DeleteOne(context.Context, interface{}, ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return &mongo.DeleteResult{}, f.err
+}
+
+func TestCollection(t *testing.T) {
+	fake := &fakeCollection{}
+	col := InstrumentCollection("products_test", fake)
+	_, err := col.DeleteOne(context.Background(), nil)
+	assert.Nil(t, err)
+	fake.err = errors.New("connection reset")
+	_, err = col.DeleteOne(context.Background(), nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(DBErrors.WithLabelValues("products_test", "delete_one")))
+	assert.Equal(t, 1, testutil.CollectAndCount(DBDuration, "tronics_db_operation_duration_seconds"))
+}
@@ -0,0 +1,266 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"tronicscorp/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collection records the applied migrations, one document per version.
+const Collection = "migrations"
+
+// Migration is a versioned, idempotent change to the database.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database, cfg config.Properties) error
+}
+
+type record struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// requiredIndexes lists the indexes, by collection, the application relies on.
+func requiredIndexes(cfg config.Properties) map[string][]string {
+	return map[string][]string{
+		cfg.ProductCollection:    {"tenant_1", "tenant_1_categories_1"},
+		cfg.UsersCollection:      {"tenant_1_username_1"},
+		cfg.CategoriesCollection: {"tenant_1_slug_1", "tenant_1_parent_1", "tenant_1_ancestors_1"},
+		cfg.DeliveriesCollection: {"status_1_next_attempt_1", "webhook_id_1__id_-1"},
+		cfg.OutboxCollection:     {"dispatched_1_next_attempt_1", "subject_1__id_-1"},
+	}
+}
+
+var all = []Migration{
+	{
+		Version:     1,
+		Description: "unique index on users username",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			isUserIndexUnique := true
+			indexModel := mongo.IndexModel{
+				Keys: bson.D{{Key: "username", Value: 1}},
+				Options: &options.IndexOptions{
+					Unique: &isUserIndexUnique,
+				},
+			}
+			_, err := db.Collection(cfg.UsersCollection).Indexes().CreateOne(ctx, indexModel)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "indexes on webhook deliveries, expiring after 30 days",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			_, err := db.Collection(cfg.DeliveriesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+				{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "_id", Value: -1}}},
+				{Keys: bson.D{{Key: "created_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(30 * 24 * 60 * 60)},
+			})
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "indexes on the outbox, dispatched entries expiring at expire_at",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			// Creating the indexes also creates the collection, which
+			// transactions cannot do before MongoDB 4.4.
+			_, err := db.Collection(cfg.OutboxCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "dispatched", Value: 1}, {Key: "next_attempt", Value: 1}}},
+				{Keys: bson.D{{Key: "time", Value: 1}}},
+				{Keys: bson.D{{Key: "expire_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+			})
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "index on the outbox subject, to find the latest event of an entity",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			_, err := db.Collection(cfg.OutboxCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "subject", Value: 1}, {Key: "_id", Value: -1}},
+			})
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "idempotency keys expiring at expire_at",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			_, err := db.Collection(cfg.IdempotencyCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expire_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "products and users of the default tenant, usernames unique by tenant",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			for _, col := range []string{cfg.ProductCollection, cfg.UsersCollection} {
+				_, err := db.Collection(col).UpdateMany(ctx, bson.M{"tenant": bson.M{"$exists": false}},
+					bson.M{"$set": bson.M{"tenant": cfg.DefaultTenant}})
+				if err != nil {
+					return err
+				}
+			}
+			_, err := db.Collection(cfg.ProductCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "tenant", Value: 1}},
+			})
+			if err != nil {
+				return err
+			}
+			users := db.Collection(cfg.UsersCollection).Indexes()
+			_, err = users.CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "username", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				return err
+			}
+			// Dropped once its replacement exists, for the usernames to
+			// stay unique meanwhile.
+			if _, err := users.DropOne(ctx, "username_1"); err != nil && !isIndexNotFound(err) {
+				return err
+			}
+			return nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "category slugs unique by tenant, indexes on the category tree and the product categories",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			_, err := db.Collection(cfg.CategoriesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+				{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "parent", Value: 1}}},
+				{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "ancestors", Value: 1}}},
+			})
+			if err != nil {
+				return err
+			}
+			_, err = db.Collection(cfg.ProductCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "categories", Value: 1}},
+			})
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "pre-images of the product changes, for the deletions to name their tenant",
+		Up: func(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+			err := db.RunCommand(ctx, bson.D{
+				{Key: "collMod", Value: cfg.ProductCollection},
+				{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+			}).Err()
+			if isUnsupported(err) {
+				slog.Warn("The server does not record pre-images, the out-of-band deletions of products will name no tenant", "error", err)
+				return nil
+			}
+			return err
+		},
+	},
+}
+
+// isUnsupported reports whether err is the error of a server not supporting
+// the pre-images: before MongoDB 6.0, or standalone.
+func isUnsupported(err error) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	switch cmdErr.Code {
+	case 20, 72, 40415: // IllegalOperation, InvalidOptions, unknown field
+		return true
+	}
+	return false
+}
+
+// isIndexNotFound reports whether err is the error of dropping a missing
+// index.
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 27
+}
+
+// Apply runs the migrations that have not been recorded yet, in order.
+func Apply(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+	pending, err := Pending(ctx, db)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		if err := m.Up(ctx, db, cfg); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		rec := record{Version: m.Version, Description: m.Description, AppliedAt: time.Now().UTC()}
+		if _, err := db.Collection(Collection).InsertOne(ctx, rec); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("unable to record migration %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// Pending returns the migrations that have not been applied.
+func Pending(ctx context.Context, db *mongo.Database) ([]Migration, error) {
+	cursor, err := db.Collection(Collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read applied migrations: %w", err)
+	}
+	var records []record
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, fmt.Errorf("unable to read applied migrations: %w", err)
+	}
+	applied := make(map[int]bool, len(records))
+	for _, r := range records {
+		applied[r.Version] = true
+	}
+	var pending []Migration
+	for _, m := range all {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// CheckApplied returns an error if a migration is pending.
+func CheckApplied(ctx context.Context, db *mongo.Database) error {
+	pending, err := Pending(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d migrations pending, first is %d", len(pending), pending[0].Version)
+	}
+	return nil
+}
+
+// CheckIndexes returns an error if a required index is missing.
+func CheckIndexes(ctx context.Context, db *mongo.Database, cfg config.Properties) error {
+	for col, names := range requiredIndexes(cfg) {
+		specs, err := db.Collection(col).Indexes().ListSpecifications(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list indexes of %s: %w", col, err)
+		}
+		present := make(map[string]bool, len(specs))
+		for _, spec := range specs {
+			present[spec.Name] = true
+		}
+		for _, name := range names {
+			if !present[name] {
+				return fmt.Errorf("index %s missing on %s", name, col)
+			}
+		}
+	}
+	return nil
+}
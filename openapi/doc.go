@@ -0,0 +1,143 @@
+package openapi
+
+// Doc describes a route for the spec. Models are Go values whose types are
+// turned into schemas; a *Schema is used as is.
+type Doc struct {
+	id          string
+	summary     string
+	description string
+	tags        []string
+	deprecated  bool
+	secured     bool
+	pathParams  map[string]*Schema
+	query       interface{}
+	params      []*Parameter
+	body        interface{}
+	bodyType    string
+	partial     bool
+	responses   []response
+	errors      []int
+}
+
+type response struct {
+	status      int
+	description string
+	model       interface{}
+	contentType string
+	headers     map[string]string
+}
+
+// Describe starts the documentation of a route.
+func Describe(summary string) *Doc {
+	return &Doc{summary: summary, pathParams: map[string]*Schema{}}
+}
+
+// ID sets the operation id. It defaults to the handler method name.
+func (d *Doc) ID(id string) *Doc {
+	d.id = id
+	return d
+}
+
+func (d *Doc) Description(description string) *Doc {
+	d.description = description
+	return d
+}
+
+func (d *Doc) Tags(tags ...string) *Doc {
+	d.tags = append(d.tags, tags...)
+	return d
+}
+
+func (d *Doc) Deprecated() *Doc {
+	d.deprecated = true
+	return d
+}
+
+// Secured marks the route as requiring the x-auth-token header.
+func (d *Doc) Secured() *Doc {
+	d.secured = true
+	return d
+}
+
+// Param sets the schema of a path parameter, a string by default.
+func (d *Doc) Param(name string, schema *Schema) *Doc {
+	d.pathParams[name] = schema
+	return d
+}
+
+// Query documents the scalar properties of model as query parameters.
+func (d *Doc) Query(model interface{}) *Doc {
+	d.query = model
+	return d
+}
+
+// QueryParam documents an optional query parameter.
+func (d *Doc) QueryParam(name, description string, schema *Schema) *Doc {
+	d.params = append(d.params, &Parameter{Name: name, In: "query", Description: description, Schema: schema})
+	return d
+}
+
+// HeaderParam documents an optional request header.
+func (d *Doc) HeaderParam(name, description string, schema *Schema) *Doc {
+	d.params = append(d.params, &Parameter{Name: name, In: "header", Description: description, Schema: schema})
+	return d
+}
+
+// Body documents a JSON request body.
+func (d *Doc) Body(model interface{}) *Doc {
+	d.body = model
+	d.bodyType = echoJSON
+	return d
+}
+
+// PartialBody documents a JSON request body of which every property is
+// optional, for partial updates.
+func (d *Doc) PartialBody(model interface{}) *Doc {
+	d.partial = true
+	return d.Body(model)
+}
+
+// Returns documents a JSON response. A nil model documents an empty body.
+func (d *Doc) Returns(status int, model interface{}) *Doc {
+	return d.ReturnsAs(status, echoJSON, model)
+}
+
+// ReturnsAs documents a response of another content type.
+func (d *Doc) ReturnsAs(status int, contentType string, model interface{}) *Doc {
+	d.responses = append(d.responses, response{status: status, model: model, contentType: contentType})
+	return d
+}
+
+// Header documents a header of the last documented response.
+func (d *Doc) Header(name, description string) *Doc {
+	res := &d.responses[len(d.responses)-1]
+	if res.headers == nil {
+		res.headers = map[string]string{}
+	}
+	res.headers[name] = description
+	return d
+}
+
+// Errors documents the problem responses of the route besides the default
+// one. Secured routes document 401 on their own.
+func (d *Doc) Errors(statuses ...int) *Doc {
+	d.errors = append(d.errors, statuses...)
+	return d
+}
+
+const echoJSON = "application/json"
+
+// Any is the schema of any JSON value.
+func Any() *Schema {
+	return &Schema{}
+}
+
+// Object is the schema of a free form JSON object.
+func Object() *Schema {
+	return &Schema{Type: "object", AdditionalProperties: Any()}
+}
+
+// Text is the schema of a text/plain or text/html response.
+func Text() *Schema {
+	return &Schema{Type: "string"}
+}
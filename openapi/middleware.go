@@ -0,0 +1,273 @@
+package openapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ValidationError reports the parts of a request or response that do not
+// match the document. In is "path", "query", "body" or "response".
+type ValidationError struct {
+	In         string
+	Violations []Violation
+	Err        error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("invalid %s: %v", e.In, e.Err)
+	}
+	fields := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		fields[i] = v.Field + " " + v.Message
+	}
+	return fmt.Sprintf("invalid %s: %s", e.In, strings.Join(fields, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+type ValidatorConfig struct {
+	Skipper middleware.Skipper
+	// MaxBodySize caps the request bodies read for validation.
+	MaxBodySize int64
+	// Responses enables response validation. JSON responses are buffered and
+	// replaced by the Error result when they do not match their schema.
+	Responses bool
+	// Error converts a validation error to the error returned to echo.
+	Error func(c echo.Context, err *ValidationError) error
+}
+
+// Operation returns the documented operation of an echo route.
+func (s *Spec) Operation(method, echoPath string) *Operation {
+	return s.doc.Paths[Path(echoPath)][strings.ToLower(method)]
+}
+
+// Validator returns a middleware validating the requests, and optionally the
+// responses, of documented routes against the spec. It must be registered
+// with Use so the route is known.
+func (s *Spec) Validator(cfg ValidatorConfig) echo.MiddlewareFunc {
+	if cfg.Skipper == nil {
+		cfg.Skipper = middleware.DefaultSkipper
+	}
+	if cfg.Error == nil {
+		cfg.Error = func(c echo.Context, err *ValidationError) error { return err }
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.Skipper(c) {
+				return next(c)
+			}
+			op := s.Operation(c.Request().Method, c.Path())
+			if op == nil {
+				return next(c)
+			}
+			doc := s.Document()
+			if err := validateRequest(c, doc, op, cfg.MaxBodySize); err != nil {
+				var verr *ValidationError
+				if errors.As(err, &verr) {
+					return cfg.Error(c, verr)
+				}
+				return err
+			}
+			if !cfg.Responses || c.Request().Method == http.MethodHead {
+				return next(c)
+			}
+			return validateResponse(c, doc, op, next, cfg.Error)
+		}
+	}
+}
+
+func validateRequest(c echo.Context, doc *Document, op *Operation, maxBody int64) error {
+	path := &validator{doc: doc, direction: inbound}
+	query := &validator{doc: doc, direction: inbound}
+	header := &validator{doc: doc, direction: inbound}
+	for _, p := range op.Parameters {
+		switch p.In {
+		case "path":
+			raw := c.Param(p.Name)
+			path.validate(p.Name, parseParam(raw, p.Schema), p.Schema)
+		case "query":
+			values, ok := c.QueryParams()[p.Name]
+			if !ok {
+				if p.Required {
+					query.fail(p.Name, "required", "is required")
+				}
+				continue
+			}
+			query.validate(p.Name, parseParam(values[0], p.Schema), p.Schema)
+		case "header":
+			if raw := c.Request().Header.Get(p.Name); raw != "" {
+				header.validate(p.Name, parseParam(raw, p.Schema), p.Schema)
+			}
+		}
+	}
+	if len(path.violations) > 0 {
+		return &ValidationError{In: "path", Violations: path.violations}
+	}
+	if len(query.violations) > 0 {
+		return &ValidationError{In: "query", Violations: query.violations}
+	}
+	if len(header.violations) > 0 {
+		return &ValidationError{In: "header", Violations: header.violations}
+	}
+	if op.RequestBody == nil {
+		return nil
+	}
+	media, ok := op.RequestBody.Content[echo.MIMEApplicationJSON]
+	if !ok || !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return nil
+	}
+	body, err := readBody(c.Request(), maxBody)
+	if err != nil {
+		return err
+	}
+	value, err := decode(body)
+	if err != nil {
+		return &ValidationError{In: "body", Err: err}
+	}
+	v := &validator{doc: doc, direction: inbound}
+	v.validate("", value, media.Schema)
+	if len(v.violations) > 0 {
+		return &ValidationError{In: "body", Violations: v.violations}
+	}
+	return nil
+}
+
+// readBody reads the request body and puts it back for the handler.
+func readBody(req *http.Request, max int64) ([]byte, error) {
+	r := io.Reader(req.Body)
+	if max > 0 {
+		r = io.LimitReader(req.Body, max+1)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(len(body)) > max {
+		return nil, echo.ErrStatusRequestEntityTooLarge
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func decode(body []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, errors.New("the body is empty")
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func validateResponse(c echo.Context, doc *Document, op *Operation, next echo.HandlerFunc, onError func(echo.Context, *ValidationError) error) error {
+	res := c.Response()
+	rec := &recorder{ResponseWriter: res.Writer}
+	res.Writer = rec
+	err := next(c)
+	res.Writer = rec.ResponseWriter
+	if rec.passthrough || !res.Committed {
+		return err
+	}
+	if err == nil {
+		if verr := checkResponse(doc, op, rec.status, rec.buf.Bytes()); verr != nil {
+			// Discard the response and report the error instead.
+			res.Committed, res.Status, res.Size = false, http.StatusOK, 0
+			res.Header().Del(echo.HeaderContentLength)
+			return onError(c, verr)
+		}
+	}
+	rec.ResponseWriter.WriteHeader(rec.status)
+	_, werr := rec.ResponseWriter.Write(rec.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+func checkResponse(doc *Document, op *Operation, status int, body []byte) *ValidationError {
+	documented, ok := op.Responses[strconv.Itoa(status)]
+	if !ok && status >= http.StatusBadRequest {
+		documented, ok = op.Responses["default"]
+	}
+	if !ok {
+		return &ValidationError{In: "response", Violations: []Violation{{
+			Keyword: "status", Params: []string{strconv.Itoa(status)}, Message: fmt.Sprintf("status %d is not documented", status),
+		}}}
+	}
+	media, ok := documented.Content[echo.MIMEApplicationJSON]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+	value, err := decode(body)
+	if err != nil {
+		return &ValidationError{In: "response", Err: err}
+	}
+	v := &validator{doc: doc, direction: outbound}
+	v.validate("", value, media.Schema)
+	if len(v.violations) > 0 {
+		return &ValidationError{In: "response", Violations: v.violations}
+	}
+	return nil
+}
+
+// recorder buffers JSON responses so they can be validated before being
+// sent. Other responses, and flushed or hijacked ones, pass through.
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	if !strings.HasPrefix(r.Header().Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		r.passthrough = true
+		r.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.passthrough {
+		return r.ResponseWriter.Write(b)
+	}
+	return r.buf.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if !r.passthrough {
+		r.passthrough = true
+		r.ResponseWriter.WriteHeader(r.status)
+		r.ResponseWriter.Write(r.buf.Bytes())
+		r.buf.Reset()
+	}
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.passthrough = true
+	return http.NewResponseController(r.ResponseWriter).Hijack()
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,117 @@
+package openapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newValidatedEcho(responses bool, handler echo.HandlerFunc) *echo.Echo {
+	e := echo.New()
+	spec := New(Info{Title: "test", Version: "1"}, problem{})
+	e.Use(spec.Validator(ValidatorConfig{MaxBodySize: 64, Responses: responses}))
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			c.JSON(http.StatusTeapot, verr.Violations)
+			return
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+	spec.Route(e.GET("/items/:id", handler), Describe("Get").Param("id", ObjectID()).
+		QueryParam("limit", "", &Schema{Type: "integer"}).Returns(http.StatusOK, item{}))
+	maxKey := 8
+	spec.Route(e.POST("/items", handler), Describe("Create").HeaderParam("Idempotency-Key", "", &Schema{Type: "string", MaxLength: &maxKey}).
+		Body(item{}).Returns(http.StatusCreated, item{}))
+	spec.Route(e.GET("/text", handler), Describe("Text").ReturnsAs(http.StatusOK, "text/plain", Text()))
+	return e
+}
+
+func serve(e *echo.Echo, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+	return res
+}
+
+func TestValidatorRequests(t *testing.T) {
+	called := false
+	e := newValidatedEcho(false, func(c echo.Context) error {
+		called = true
+		return c.NoContent(http.StatusOK)
+	})
+	tests := []struct {
+		name, method, target, body string
+		status                     int
+		contains                   string
+	}{
+		{"valid path and query", http.MethodGet, "/items/64f1c0a2e4b0a1b2c3d4e5f6?limit=10", "", http.StatusOK, ""},
+		{"invalid path param", http.MethodGet, "/items/42", "", http.StatusTeapot, `"Field":"id","Keyword":"pattern"`},
+		{"invalid query param", http.MethodGet, "/items/64f1c0a2e4b0a1b2c3d4e5f6?limit=ten", "", http.StatusTeapot, `"Field":"limit","Keyword":"type"`},
+		{"valid body", http.MethodPost, "/items", `{"name":"phone","code":"EUR"}`, http.StatusOK, ""},
+		{"missing field", http.MethodPost, "/items", `{"name":"phone"}`, http.StatusTeapot, `"Field":"code","Keyword":"required"`},
+		{"nested errors", http.MethodPost, "/items", `{"name":"p","code":"EUR","tags":[1]}`, http.StatusTeapot, `"Field":"tags[0]","Keyword":"type"`},
+		{"body too large", http.MethodPost, "/items", `{"name":"` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, ""},
+		{"malformed body", http.MethodPost, "/items", `{"name":`, http.StatusTeapot, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			res := serve(e, tt.method, tt.target, tt.body)
+			assert.Equal(t, tt.status, res.Code)
+			assert.Equal(t, tt.status == http.StatusOK, called)
+			assert.Contains(t, res.Body.String(), tt.contains)
+		})
+	}
+	t.Run("invalid header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"name":"phone","code":"EUR"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Idempotency-Key", "too-long-a-key")
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		assert.Equal(t, http.StatusTeapot, res.Code)
+		assert.Contains(t, res.Body.String(), `"Field":"Idempotency-Key","Keyword":"maxLength"`)
+	})
+}
+
+func TestValidatorResponses(t *testing.T) {
+	body := ""
+	e := newValidatedEcho(true, func(c echo.Context) error {
+		if c.Path() == "/text" {
+			return c.String(http.StatusOK, body)
+		}
+		return c.JSONBlob(http.StatusOK, []byte(body))
+	})
+	t.Run("valid response is sent", func(t *testing.T) {
+		body = `{"name":"phone","code":"EUR"}`
+		res := serve(e, http.MethodGet, "/items/64f1c0a2e4b0a1b2c3d4e5f6", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, body, res.Body.String())
+	})
+	t.Run("invalid response is replaced", func(t *testing.T) {
+		body = `{"name":"phone","code":"EURO"}`
+		res := serve(e, http.MethodGet, "/items/64f1c0a2e4b0a1b2c3d4e5f6", "")
+		assert.Equal(t, http.StatusTeapot, res.Code)
+		assert.Contains(t, res.Body.String(), `"Field":"code","Keyword":"maxLength"`)
+	})
+	t.Run("undocumented status", func(t *testing.T) {
+		body = `{"name":"phone","code":"EUR"}`
+		res := serve(e, http.MethodPost, "/items", body)
+		assert.Equal(t, http.StatusTeapot, res.Code)
+		assert.Contains(t, res.Body.String(), `"Keyword":"status"`)
+	})
+	t.Run("other content types pass through", func(t *testing.T) {
+		body = "hello"
+		res := serve(e, http.MethodGet, "/text", "")
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "hello", res.Body.String())
+	})
+}
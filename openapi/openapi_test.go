@@ -0,0 +1,76 @@
+package openapi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type problem struct {
+	Status int `json:"status"`
+}
+
+type base struct {
+	ID primitive.ObjectID `json:"_id,omitempty" openapi:"readonly"`
+}
+
+type item struct {
+	base
+	Name    string            `json:"name" validate:"required,min=2,max=10"`
+	Code    string            `json:"code" validate:"required,len=3"`
+	Price   int               `json:"price" validate:"gte=1,lt=100"`
+	Kind    string            `json:"kind,omitempty" validate:"oneof=a b"`
+	Tags    []string          `json:"tags" validate:"max=5,dive,required"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+	Parent  *item             `json:"parent,omitempty"`
+	Secret  string            `json:"-"`
+	hidden  string
+}
+
+func TestSchemas(t *testing.T) {
+	g := newSchemas()
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/item"}, g.of(item{}))
+	s := g.components["item"]
+	assert.Equal(t, []string{"name", "code"}, s.Required)
+	assert.Len(t, s.Properties, 9)
+	assert.True(t, s.Properties["_id"].ReadOnly)
+	assert.Equal(t, 2, *s.Properties["name"].MinLength)
+	assert.Equal(t, 10, *s.Properties["name"].MaxLength)
+	assert.Equal(t, 3, *s.Properties["code"].MinLength)
+	assert.Equal(t, 3, *s.Properties["code"].MaxLength)
+	assert.Equal(t, 1.0, *s.Properties["price"].Minimum)
+	assert.Equal(t, 99.0, *s.Properties["price"].Maximum)
+	assert.Equal(t, []interface{}{"a", "b"}, s.Properties["kind"].Enum)
+	assert.Equal(t, 5, *s.Properties["tags"].MaxItems)
+	assert.Equal(t, "string", s.Properties["labels"].AdditionalProperties.Type)
+	assert.Equal(t, "date-time", s.Properties["created"].Format)
+	assert.Equal(t, "#/components/schemas/item", s.Properties["parent"].Ref)
+	assert.Equal(t, "array", g.of([]item{}).Type)
+}
+
+func TestSpec(t *testing.T) {
+	e := echo.New()
+	handler := func(c echo.Context) error { return nil }
+	spec := New(Info{Title: "test", Version: "1"}, problem{})
+	spec.Route(e.GET("/items/:id", handler), Describe("Get").ID("GetItem").Param("id", ObjectID()).Returns(http.StatusOK, item{}))
+	spec.Route(e.POST("/items", handler), Describe("Create").Secured().Body(item{}).Returns(http.StatusCreated, nil).Errors(http.StatusBadRequest))
+	e.DELETE("/items/:id", handler)
+
+	assert.Equal(t, []string{"DELETE /items/:id"}, spec.Undocumented(e.Routes()))
+	doc := spec.Document()
+	get := doc.Paths["/items/{id}"]["get"]
+	assert.Equal(t, "GetItem", get.OperationID)
+	assert.Equal(t, "path", get.Parameters[0].In)
+	assert.Equal(t, ObjectID().Pattern, get.Parameters[0].Schema.Pattern)
+	post := doc.Paths["/items"]["post"]
+	assert.Contains(t, post.Responses, "401")
+	assert.Contains(t, post.Responses, "400")
+	assert.Nil(t, post.Responses["201"].Content)
+	assert.Equal(t, "#/components/schemas/problem", post.Responses["default"].Content[ProblemContentType].Schema.Ref)
+	assert.Equal(t, "object", doc.Resolve(post.RequestBody.Content["application/json"].Schema).Type)
+}
@@ -0,0 +1,218 @@
+package openapi
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const schemaRefPrefix = "#/components/schemas/"
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	objectIDType = reflect.TypeOf(primitive.ObjectID{})
+)
+
+// ObjectID is the schema of a MongoDB ObjectID in its hex form.
+func ObjectID() *Schema {
+	return &Schema{Type: "string", Pattern: "^[0-9a-fA-F]{24}$"}
+}
+
+// schemas generates JSON schemas from Go types. Named struct types become
+// components and are referenced.
+type schemas struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func newSchemas() *schemas {
+	return &schemas{components: map[string]*Schema{}, names: map[reflect.Type]string{}}
+}
+
+// of returns the schema of the type of v. A nil v is any value.
+func (g *schemas) of(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{}
+	}
+	if s, ok := v.(*Schema); ok {
+		return s
+	}
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *schemas) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case objectIDType:
+		return ObjectID()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.componentName(t)
+			g.names[t] = name
+			g.components[name] = &Schema{}
+			*g.components[name] = *g.object(t)
+		}
+		return &Schema{Ref: schemaRefPrefix + name}
+	}
+	return &Schema{}
+}
+
+// componentName is the type name, qualified by its package when two packages
+// declare the same name.
+func (g *schemas) componentName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := g.components[name]; taken {
+		pkg := t.PkgPath()
+		name = pkg[strings.LastIndex(pkg, "/")+1:] + "." + name
+	}
+	return name
+}
+
+func (g *schemas) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	g.fields(t, s)
+	return s
+}
+
+func (g *schemas) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, omitted := jsonName(f)
+		if omitted {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.fields(ft, s)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		prop := g.schema(f.Type)
+		if constrain(prop, f.Tag.Get("validate")) {
+			s.Required = append(s.Required, name)
+		}
+		for _, opt := range strings.Split(f.Tag.Get("openapi"), ",") {
+			switch opt {
+			case "readonly":
+				prop.ReadOnly = true
+			case "writeonly":
+				prop.WriteOnly = true
+			}
+		}
+		s.Properties[name] = prop
+	}
+}
+
+// jsonName returns the JSON name of f, and whether encoding/json skips it.
+func jsonName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", true
+	}
+	return strings.SplitN(tag, ",", 2)[0], false
+}
+
+// constrain applies the validator tag rules to s and reports whether the
+// field is required.
+func constrain(s *Schema, tag string) bool {
+	required := false
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "dive":
+			return required
+		case "required":
+			required = true
+		case "email":
+			s.Format = "email"
+		case "url":
+			s.Format = "uri"
+		case "oneof":
+			for _, v := range strings.Fields(param) {
+				s.Enum = append(s.Enum, v)
+			}
+		case "len", "min", "max", "gt", "gte", "lt", "lte":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				continue
+			}
+			bound(s, name, n)
+		}
+	}
+	return required
+}
+
+func bound(s *Schema, rule string, n int) {
+	atLeast := rule == "len" || rule == "min" || rule == "gte" || rule == "gt"
+	atMost := rule == "len" || rule == "max" || rule == "lte" || rule == "lt"
+	switch s.Type {
+	case "string":
+		if atLeast {
+			s.MinLength = &n
+		}
+		if atMost {
+			s.MaxLength = &n
+		}
+	case "array":
+		if atLeast {
+			s.MinItems = &n
+		}
+		if atMost {
+			s.MaxItems = &n
+		}
+	case "integer", "number":
+		f := float64(n)
+		switch rule {
+		case "gt":
+			f++
+		case "lt":
+			f--
+		}
+		if atLeast {
+			s.Minimum = &f
+		}
+		if atMost {
+			v := f
+			s.Maximum = &v
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TokenScheme is the name of the x-auth-token security scheme.
+const TokenScheme = "token"
+
+// ProblemContentType is the media type of error responses.
+const ProblemContentType = "application/problem+json"
+
+var pathParam = regexp.MustCompile(`:(\w+)`)
+
+// Spec collects the documentation of the routes as they are registered and
+// builds the OpenAPI document from it.
+type Spec struct {
+	doc     Document
+	schemas *schemas
+	problem interface{}
+	ids     map[string]int
+}
+
+// New returns an empty spec. problem is the model of error responses.
+func New(info Info, problem interface{}) *Spec {
+	s := &Spec{
+		doc: Document{
+			OpenAPI: Version,
+			Info:    info,
+			Paths:   map[string]PathItem{},
+			Components: Components{SecuritySchemes: map[string]*SecurityScheme{
+				TokenScheme: {
+					Type:        "apiKey",
+					In:          "header",
+					Name:        "x-auth-token",
+					Description: `"Bearer <token>", with the token returned in the x-auth-token header by POST /auth.`,
+				},
+			}},
+		},
+		schemas: newSchemas(),
+		problem: problem,
+		ids:     map[string]int{},
+	}
+	return s
+}
+
+// Route documents r with d and returns r.
+func (s *Spec) Route(r *echo.Route, d *Doc) *echo.Route {
+	path := Path(r.Path)
+	item, ok := s.doc.Paths[path]
+	if !ok {
+		item = PathItem{}
+		s.doc.Paths[path] = item
+	}
+	item[strings.ToLower(r.Method)] = s.operation(r, d)
+	return r
+}
+
+// Path converts an echo route path to an OpenAPI path template.
+func Path(echoPath string) string {
+	return pathParam.ReplaceAllString(echoPath, "{$1}")
+}
+
+// Document returns the OpenAPI document of the routes documented so far.
+func (s *Spec) Document() *Document {
+	doc := s.doc
+	doc.Components.Schemas = s.schemas.components
+	return &doc
+}
+
+// Undocumented returns the routes that have no documentation, as
+// "METHOD path".
+func (s *Spec) Undocumented(routes []*echo.Route) []string {
+	var missing []string
+	for _, r := range routes {
+		if _, ok := s.doc.Paths[Path(r.Path)][strings.ToLower(r.Method)]; !ok {
+			missing = append(missing, r.Method+" "+r.Path)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Handler serves the document as JSON.
+func (s *Spec) Handler(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Document())
+}
+
+func (s *Spec) operation(r *echo.Route, d *Doc) *Operation {
+	op := &Operation{
+		OperationID: s.operationID(d.id, r.Name),
+		Summary:     d.summary,
+		Description: d.description,
+		Tags:        d.tags,
+		Responses:   map[string]*Response{},
+		Deprecated:  d.deprecated,
+	}
+	for _, m := range pathParam.FindAllStringSubmatch(r.Path, -1) {
+		schema, ok := d.pathParams[m[1]]
+		if !ok {
+			schema = &Schema{Type: "string"}
+		}
+		op.Parameters = append(op.Parameters, &Parameter{Name: m[1], In: "path", Required: true, Schema: schema})
+	}
+	if d.query != nil {
+		op.Parameters = append(op.Parameters, s.queryParams(d.query)...)
+	}
+	op.Parameters = append(op.Parameters, d.params...)
+	if d.body != nil {
+		schema := s.schemas.of(d.body)
+		if d.partial {
+			partial := *s.Document().Resolve(schema)
+			partial.Required = nil
+			schema = &partial
+		}
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]*MediaType{d.bodyType: {Schema: schema}},
+		}
+	}
+	for _, res := range d.responses {
+		response := &Response{Description: res.description}
+		if response.Description == "" {
+			response.Description = http.StatusText(res.status)
+		}
+		if res.model != nil {
+			response.Content = map[string]*MediaType{res.contentType: {Schema: s.schemas.of(res.model)}}
+		}
+		for name, desc := range res.headers {
+			if response.Headers == nil {
+				response.Headers = map[string]*Header{}
+			}
+			response.Headers[name] = &Header{Description: desc, Schema: &Schema{Type: "string"}}
+		}
+		op.Responses[strconv.Itoa(res.status)] = response
+	}
+	errors := d.errors
+	if d.secured {
+		op.Security = []map[string][]string{{TokenScheme: {}}}
+		errors = append(errors, http.StatusUnauthorized)
+	}
+	for _, status := range errors {
+		op.Responses[strconv.Itoa(status)] = s.problemResponse(http.StatusText(status))
+	}
+	op.Responses["default"] = s.problemResponse("Unexpected error")
+	return op
+}
+
+func (s *Spec) problemResponse(description string) *Response {
+	return &Response{
+		Description: description,
+		Content:     map[string]*MediaType{ProblemContentType: {Schema: s.schemas.of(s.problem)}},
+	}
+}
+
+// queryParams returns an optional query parameter per scalar property of
+// model.
+func (s *Spec) queryParams(model interface{}) []*Parameter {
+	schema := s.Document().Resolve(s.schemas.of(model))
+	var params []*Parameter
+	for _, name := range sortedKeys(schema.Properties) {
+		prop := schema.Properties[name]
+		switch prop.Type {
+		case "string", "integer", "number", "boolean":
+			p := *prop
+			p.MinLength, p.MaxLength, p.Minimum, p.Maximum, p.ReadOnly = nil, nil, nil, nil, false
+			params = append(params, &Parameter{Name: name, In: "query", Schema: &p})
+		}
+	}
+	return params
+}
+
+// operationID returns id, or the handler method name, made unique.
+func (s *Spec) operationID(id, handler string) string {
+	if id == "" {
+		id = handler[strings.LastIndex(handler, ".")+1:]
+		id = strings.TrimSuffix(id, "-fm")
+	}
+	s.ids[id]++
+	if n := s.ids[id]; n > 1 {
+		return fmt.Sprintf("%s%d", id, n)
+	}
+	return id
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
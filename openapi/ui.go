@@ -0,0 +1,26 @@
+package openapi
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+//go:embed ui.html
+var uiPage string
+
+var uiTemplate = template.Must(template.New("ui").Parse(uiPage))
+
+// UI serves a Swagger UI page rendering the document at specURL.
+func UI(title, specURL string) echo.HandlerFunc {
+	var page bytes.Buffer
+	if err := uiTemplate.Execute(&page, map[string]string{"Title": title, "SpecURL": specURL}); err != nil {
+		panic(err)
+	}
+	return func(c echo.Context) error {
+		return c.HTMLBlob(http.StatusOK, page.Bytes())
+	}
+}
@@ -0,0 +1,222 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Violation is a value that does not match its schema. Keyword is the JSON
+// Schema keyword that failed and Params its arguments, for translations.
+type Violation struct {
+	Field   string
+	Keyword string
+	Params  []string
+	Message string
+}
+
+// direction tells whether a value is sent by the client or by the server, for
+// readOnly and writeOnly properties.
+type direction int
+
+const (
+	inbound direction = iota
+	outbound
+)
+
+var patterns sync.Map
+
+type validator struct {
+	doc        *Document
+	direction  direction
+	violations []Violation
+}
+
+func (v *validator) fail(field, keyword, message string, params ...string) {
+	v.violations = append(v.violations, Violation{Field: field, Keyword: keyword, Params: params, Message: message})
+}
+
+// validate checks value, decoded with json.Decoder.UseNumber, against s.
+func (v *validator) validate(field string, value interface{}, s *Schema) {
+	s = v.doc.Resolve(s)
+	if s == nil {
+		return
+	}
+	if !v.checkType(field, value, s.Type) {
+		return
+	}
+	if len(s.Enum) > 0 && !inEnum(value, s.Enum) {
+		values := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			values[i] = fmt.Sprint(e)
+		}
+		v.fail(field, "enum", fmt.Sprintf("must be one of %s", strings.Join(values, ", ")), strings.Join(values, " "))
+	}
+	switch value := value.(type) {
+	case string:
+		v.validateString(field, value, s)
+	case json.Number:
+		v.validateNumber(field, value, s)
+	case []interface{}:
+		if s.MinItems != nil && len(value) < *s.MinItems {
+			v.fail(field, "minItems", fmt.Sprintf("must contain at least %d items", *s.MinItems), strconv.Itoa(*s.MinItems))
+		}
+		if s.MaxItems != nil && len(value) > *s.MaxItems {
+			v.fail(field, "maxItems", fmt.Sprintf("must contain at most %d items", *s.MaxItems), strconv.Itoa(*s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range value {
+				v.validate(fmt.Sprintf("%s[%d]", field, i), item, s.Items)
+			}
+		}
+	case map[string]interface{}:
+		v.validateObject(field, value, s)
+	}
+}
+
+func (v *validator) checkType(field string, value interface{}, typ string) bool {
+	ok := true
+	switch typ {
+	case "":
+		return true
+	case "string":
+		_, ok = value.(string)
+	case "boolean":
+		_, ok = value.(bool)
+	case "number":
+		_, ok = value.(json.Number)
+	case "integer":
+		var n json.Number
+		if n, ok = value.(json.Number); ok {
+			f, err := n.Float64()
+			ok = err == nil && f == math.Trunc(f)
+		}
+	case "array":
+		_, ok = value.([]interface{})
+	case "object":
+		_, ok = value.(map[string]interface{})
+	}
+	if !ok {
+		v.fail(field, "type", "must be of type "+typ, typ)
+	}
+	return ok
+}
+
+func (v *validator) validateString(field, value string, s *Schema) {
+	n := utf8.RuneCountInString(value)
+	if s.MinLength != nil && n < *s.MinLength {
+		v.fail(field, "minLength", fmt.Sprintf("must be at least %d characters long", *s.MinLength), strconv.Itoa(*s.MinLength))
+	}
+	if s.MaxLength != nil && n > *s.MaxLength {
+		v.fail(field, "maxLength", fmt.Sprintf("must be at most %d characters long", *s.MaxLength), strconv.Itoa(*s.MaxLength))
+	}
+	if s.Pattern != "" && !pattern(s.Pattern).MatchString(value) {
+		v.fail(field, "pattern", "does not match "+s.Pattern, s.Pattern)
+	}
+	if s.Format != "" && !validFormat(s.Format, value) {
+		v.fail(field, "format", "must be a valid "+s.Format, s.Format)
+	}
+}
+
+func (v *validator) validateNumber(field string, value json.Number, s *Schema) {
+	f, _ := value.Float64()
+	if s.Minimum != nil && f < *s.Minimum {
+		v.fail(field, "minimum", fmt.Sprintf("must be %v or greater", *s.Minimum), fmt.Sprint(*s.Minimum))
+	}
+	if s.Maximum != nil && f > *s.Maximum {
+		v.fail(field, "maximum", fmt.Sprintf("must be %v or less", *s.Maximum), fmt.Sprint(*s.Maximum))
+	}
+}
+
+func (v *validator) validateObject(field string, value map[string]interface{}, s *Schema) {
+	for _, name := range s.Required {
+		prop := v.doc.Resolve(s.Properties[name])
+		if prop != nil && ((v.direction == inbound && prop.ReadOnly) || (v.direction == outbound && prop.WriteOnly)) {
+			continue
+		}
+		if value[name] == nil {
+			v.fail(join(field, name), "required", "is required")
+		}
+	}
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := s.Properties[name]
+		if !ok {
+			prop = s.AdditionalProperties
+		}
+		// Optional properties may be null, as Go encodes nil slices and maps.
+		if prop == nil || value[name] == nil {
+			continue
+		}
+		v.validate(join(field, name), value[name], prop)
+	}
+}
+
+func join(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		if fmt.Sprint(e) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func pattern(expr string) *regexp.Regexp {
+	if re, ok := patterns.Load(expr); ok {
+		return re.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(expr)
+	patterns.Store(expr, re)
+	return re
+}
+
+func validFormat(format, value string) bool {
+	switch format {
+	case "email":
+		addr, err := mail.ParseAddress(value)
+		return err == nil && addr.Address == value
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, value)
+		return err == nil
+	case "uri":
+		_, err := url.ParseRequestURI(value)
+		return err == nil
+	}
+	return true
+}
+
+// parseParam converts a path or query parameter to the JSON value its schema
+// expects, so it can be validated like a body value.
+func parseParam(raw string, s *Schema) interface{} {
+	switch s.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(raw, 64); err == nil {
+			return json.Number(raw)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
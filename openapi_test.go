@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"tronicscorp/config"
+	"tronicscorp/handlers"
+	"tronicscorp/problem"
+	"tronicscorp/tenant"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newRoutedApp returns an app with its routes registered. The database client
+// is never used, so no server is needed.
+func newRoutedApp(t *testing.T) *App {
+	mgr, err := config.NewManager(nil)
+	assert.Nil(t, err)
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:1"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	a := &App{cfg: mgr, echo: echo.New(), client: client, db: client.Database("tronics"), logLevel: new(slog.LevelVar), api: newSpec()}
+	a.rules = handlers.NewRulesStore(a.collection("rules"), handlers.DefaultProductRules())
+	a.tenants, err = tenant.NewRegistry("default", tenant.Tenant{ID: "globex", Audience: "globex-shop"})
+	assert.Nil(t, err)
+	assert.Nil(t, a.routes())
+	return a
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	a := newRoutedApp(t)
+	routes := a.echo.Routes()
+	assert.Empty(t, a.api.Undocumented(routes), "routes missing from the OpenAPI document")
+
+	doc := a.api.Document()
+	operations := 0
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			operations++
+			assert.Contains(t, op.Responses, "default", "%s %s", method, path)
+		}
+	}
+	assert.Equal(t, len(routes), operations, "documented operations that are not registered")
+
+	product := doc.Components.Schemas["Product"]
+	assert.ElementsMatch(t, []string{"product_name", "price", "currency", "vendor"}, product.Required)
+	assert.Equal(t, 3, *product.Properties["currency"].MinLength)
+	user := doc.Components.Schemas["User"]
+	assert.Equal(t, "email", user.Properties["username"].Format)
+	assert.True(t, user.Properties["passwprd"].WriteOnly)
+	assert.Equal(t, []map[string][]string{{"token": {}}}, doc.Paths["/products"]["post"].Security)
+}
+
+func TestRequestValidation(t *testing.T) {
+	a := newRoutedApp(t)
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Accept-Language", "fr")
+		res := httptest.NewRecorder()
+		a.echo.ServeHTTP(res, req)
+		return res
+	}
+	t.Run("invalid id", func(t *testing.T) {
+		res := serve(http.MethodGet, "/product/42", "")
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Contains(t, res.Body.String(), `"code":"invalid_id"`)
+	})
+	t.Run("invalid body", func(t *testing.T) {
+		res := serve(http.MethodPost, "/users", `{"username":"krunal"}`)
+		assert.Equal(t, http.StatusBadRequest, res.Code)
+		assert.Equal(t, problem.ContentType, res.Header().Get(echo.HeaderContentType))
+		var p problem.Problem
+		assert.Nil(t, json.Unmarshal(res.Body.Bytes(), &p))
+		assert.Equal(t, problem.CodeValidationFailed, p.Code)
+		assert.Equal(t, []problem.FieldError{
+			{Field: "passwprd", Rule: "required", Message: "passwprd est un champ obligatoire"},
+			{Field: "username", Rule: "email", Message: "username doit être un email valide"},
+		}, p.Errors)
+	})
+}
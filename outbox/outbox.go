@@ -0,0 +1,329 @@
+// Package outbox makes the domain events as durable as the writes producing
+// them. Writes append their events to an outbox collection in the same
+// transaction, and a relay sends the entries to the sinks until each one has
+// accepted them: events are delivered at least once, even across crashes.
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+	"tronicscorp/dbiface"
+	"tronicscorp/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// batchSize is the number of entries relayed at once.
+const batchSize = 100
+
+// Entry is an event waiting in the outbox, or already relayed.
+type Entry struct {
+	ID      primitive.ObjectID `json:"id" bson:"_id"`
+	Type    events.Type        `json:"type" bson:"type"`
+	Tenant  string             `json:"tenant,omitempty" bson:"tenant,omitempty"`
+	Subject string             `json:"subject,omitempty" bson:"subject,omitempty"`
+	Data    bson.Raw           `json:"-" bson:"data,omitempty"`
+	Time    time.Time          `json:"time" bson:"time"`
+	// Pending lists the sinks that have not accepted the entry yet.
+	Pending     []string  `json:"pending" bson:"pending"`
+	Dispatched  bool      `json:"dispatched" bson:"dispatched"`
+	Attempts    int       `json:"attempts" bson:"attempts"`
+	LastError   string    `json:"last_error,omitempty" bson:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt" bson:"next_attempt"`
+	// ExpireAt is set once dispatched, for the TTL index to remove the entry.
+	ExpireAt *time.Time `json:"-" bson:"expire_at,omitempty"`
+}
+
+// Sink receives the relayed events. Send may be called again with an event it
+// already accepted, after a crash or a replay.
+type Sink interface {
+	Send(ctx context.Context, e events.Event) error
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(ctx context.Context, e events.Event) error
+
+func (f SinkFunc) Send(ctx context.Context, e events.Event) error {
+	return f(ctx, e)
+}
+
+// BusSink publishes the events on an in-process bus.
+type BusSink struct {
+	Bus *events.Bus
+}
+
+func (s BusSink) Send(ctx context.Context, e events.Event) error {
+	s.Bus.Publish(e)
+	return nil
+}
+
+// Transactor runs fn in a transaction: the operations made with the context
+// fn receives are committed together, or not at all. fn may run again when
+// the transaction is retried.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// MongoTransactor runs transactions on a replica set or a sharded cluster.
+type MongoTransactor struct {
+	Client *mongo.Client
+}
+
+func (t MongoTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return t.Client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, fn(sc)
+		})
+		return err
+	})
+}
+
+// Outbox records the events of the writes and relays them to Sinks.
+type Outbox struct {
+	Col dbiface.CollectionAPI
+	// Tx makes the writes and their events atomic. Without it they are
+	// made one after the other, and a crash in between loses the events.
+	Tx    Transactor
+	Sinks map[string]Sink
+	// Decode restores the data of the entries, stored as BSON, to the type
+	// the sinks expect.
+	Decode func(t events.Type, data bson.Raw) (interface{}, error)
+	// Poll is the interval at which the relay looks for the entries written
+	// by other instances, or due for a retry.
+	Poll time.Duration
+	// Backoff is the delay before retrying an entry a sink refused, doubled
+	// after each failure up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long dispatched entries are kept, for replays.
+	Retention time.Duration
+
+	once sync.Once
+	wake chan struct{}
+}
+
+func (o *Outbox) init() {
+	o.once.Do(func() {
+		o.wake = make(chan struct{}, 1)
+		if o.Poll <= 0 {
+			o.Poll = time.Second
+		}
+		if o.Backoff <= 0 {
+			o.Backoff = time.Second
+		}
+		if o.MaxBackoff <= 0 {
+			o.MaxBackoff = 5 * time.Minute
+		}
+		if o.Retention <= 0 {
+			o.Retention = 7 * 24 * time.Hour
+		}
+	})
+}
+
+// SinkNames returns the names of the sinks, sorted.
+func (o *Outbox) SinkNames() []string {
+	names := make([]string, 0, len(o.Sinks))
+	for name := range o.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write runs write, then appends the events it returns to the outbox, in one
+// transaction. The error of write is returned as is.
+func (o *Outbox) Write(ctx context.Context, write func(ctx context.Context) ([]events.Event, error)) error {
+	o.init()
+	run := func(ctx context.Context) error {
+		evs, err := write(ctx)
+		if err != nil {
+			return err
+		}
+		return o.append(ctx, evs)
+	}
+	var err error
+	if o.Tx == nil {
+		err = run(ctx)
+	} else {
+		err = o.Tx.WithTransaction(ctx, run)
+	}
+	if err == nil {
+		o.notify()
+	}
+	return err
+}
+
+func (o *Outbox) append(ctx context.Context, evs []events.Event) error {
+	now := time.Now().UTC()
+	for _, e := range evs {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		entry := Entry{
+			ID:          primitive.NewObjectID(),
+			Type:        e.Type,
+			Tenant:      e.Tenant,
+			Subject:     e.Subject,
+			Time:        e.Time.UTC(),
+			Pending:     o.SinkNames(),
+			NextAttempt: now,
+		}
+		if e.Data != nil {
+			data, err := bson.Marshal(e.Data)
+			if err != nil {
+				return fmt.Errorf("unable to encode the %s event: %w", e.Type, err)
+			}
+			entry.Data = data
+		}
+		if _, err := o.Col.InsertOne(ctx, entry); err != nil {
+			return fmt.Errorf("unable to append the %s event to the outbox: %w", e.Type, err)
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Relay sends the pending entries to their sinks until ctx is done.
+func (o *Outbox) Relay(ctx context.Context) error {
+	o.init()
+	ticker := time.NewTicker(o.Poll)
+	defer ticker.Stop()
+	for {
+		if err := o.RelayDue(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Unable to relay the outbox", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// RelayDue sends the entries due, oldest first.
+func (o *Outbox) RelayDue(ctx context.Context) error {
+	o.init()
+	for {
+		now := time.Now().UTC()
+		cursor, err := o.Col.Find(ctx, bson.M{"dispatched": false, "next_attempt": bson.M{"$lte": now}},
+			options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(batchSize))
+		if err != nil {
+			return err
+		}
+		var due []Entry
+		if err := cursor.All(ctx, &due); err != nil {
+			return err
+		}
+		for _, entry := range due {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if o.claim(ctx, entry, now) {
+				o.relay(ctx, entry)
+			}
+		}
+		if len(due) < batchSize {
+			return nil
+		}
+	}
+}
+
+// claim leases an entry to this relay, so other instances skip it while it
+// is sent.
+func (o *Outbox) claim(ctx context.Context, entry Entry, now time.Time) bool {
+	res, err := o.Col.UpdateOne(ctx,
+		bson.M{"_id": entry.ID, "dispatched": false, "next_attempt": entry.NextAttempt},
+		bson.M{"$set": bson.M{"next_attempt": now.Add(time.Minute)}})
+	if err != nil {
+		slog.Error("Unable to claim the outbox entry", "entry_id", entry.ID.Hex(), "error", err)
+		return false
+	}
+	return res.ModifiedCount > 0
+}
+
+// relay sends entry to its pending sinks and records which accepted it.
+func (o *Outbox) relay(ctx context.Context, entry Entry) {
+	logger := slog.With("entry_id", entry.ID.Hex(), "type", entry.Type)
+	e, decodeErr := o.event(entry)
+	var failures []error
+	var pending []string
+	for _, name := range entry.Pending {
+		err := decodeErr
+		if err == nil {
+			if sink, ok := o.Sinks[name]; ok {
+				err = sink.Send(ctx, e)
+			} else {
+				err = errors.New("unknown sink")
+			}
+		}
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", name, err))
+			pending = append(pending, name)
+		}
+	}
+	if ctx.Err() != nil {
+		// Shutting down: the lease expires and the entry is relayed again.
+		return
+	}
+	now := time.Now().UTC()
+	set := bson.M{"pending": pending, "attempts": entry.Attempts + 1}
+	if len(pending) == 0 {
+		expire := now.Add(o.Retention)
+		set["pending"], set["dispatched"], set["expire_at"], set["last_error"] = []string{}, true, expire, ""
+	} else {
+		set["last_error"] = errors.Join(failures...).Error()
+		set["next_attempt"] = now.Add(o.backoff(entry.Attempts + 1))
+		logger.Warn("Unable to relay the outbox entry", "attempt", entry.Attempts+1, "pending", pending, "error", set["last_error"])
+	}
+	if _, err := o.Col.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": set}); err != nil {
+		logger.Error("Unable to record the relay of the outbox entry", "error", err)
+	}
+}
+
+// event restores the event of entry. Its UID is the entry id, the same when
+// the entry is relayed again.
+func (o *Outbox) event(entry Entry) (events.Event, error) {
+	e := events.Event{UID: entry.ID.Hex(), Tenant: entry.Tenant, Type: entry.Type, Subject: entry.Subject, Time: entry.Time}
+	if len(entry.Data) == 0 {
+		return e, nil
+	}
+	if o.Decode == nil {
+		var data bson.M
+		err := bson.Unmarshal(entry.Data, &data)
+		e.Data = data
+		return e, err
+	}
+	data, err := o.Decode(entry.Type, entry.Data)
+	if err != nil {
+		return e, fmt.Errorf("unable to decode the data: %w", err)
+	}
+	e.Data = data
+	return e, nil
+}
+
+// backoff is the delay before the attempt following the nth one.
+func (o *Outbox) backoff(n int) time.Duration {
+	delay := o.Backoff
+	for i := 1; i < n && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.MaxBackoff {
+		return o.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,176 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// recorder is a sink keeping the events it accepts, failing while err is set.
+type recorder struct {
+	mu     sync.Mutex
+	err    error
+	events []events.Event
+}
+
+func (r *recorder) Send(ctx context.Context, e events.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recorder) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+func (r *recorder) received() []events.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]events.Event(nil), r.events...)
+}
+
+// fakeTx fails the transactions while err is set, after running fn as a
+// database would before aborting.
+type fakeTx struct {
+	err error
+}
+
+func (t *fakeTx) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	return t.err
+}
+
+type widget struct {
+	Name string `bson:"name"`
+}
+
+func entryOf(t *testing.T, col *dbtest.Collection, id interface{}) Entry {
+	var entry Entry
+	assert.NoError(t, col.FindOne(context.Background(), bson.M{"_id": id}).Decode(&entry))
+	return entry
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	col := &dbtest.Collection{}
+	bus, broker := &recorder{}, &recorder{}
+	ob := &Outbox{
+		Col:   col,
+		Sinks: map[string]Sink{"bus": bus, "broker": broker},
+		Decode: func(t events.Type, data bson.Raw) (interface{}, error) {
+			var w widget
+			err := bson.Unmarshal(data, &w)
+			return w, err
+		},
+		Backoff: time.Millisecond,
+	}
+	write := func(name string) func(ctx context.Context) ([]events.Event, error) {
+		return func(ctx context.Context) ([]events.Event, error) {
+			return []events.Event{{Type: "widget.created", Subject: name, Data: widget{Name: name}}}, nil
+		}
+	}
+
+	t.Run("relays the entries to every sink", func(t *testing.T) {
+		assert.NoError(t, ob.Write(ctx, write("w1")))
+		if !assert.Len(t, col.Docs(), 1) {
+			return
+		}
+		entry := entryOf(t, col, col.Docs()[0]["_id"])
+		assert.Equal(t, []string{"broker", "bus"}, entry.Pending)
+		assert.False(t, entry.Dispatched)
+
+		assert.NoError(t, ob.RelayDue(ctx))
+		got := bus.received()
+		if assert.Len(t, got, 1) {
+			assert.Equal(t, entry.ID.Hex(), got[0].UID)
+			assert.Equal(t, "w1", got[0].Subject)
+			assert.Equal(t, widget{Name: "w1"}, got[0].Data)
+		}
+		assert.Equal(t, got, broker.received())
+		entry = entryOf(t, col, entry.ID)
+		assert.True(t, entry.Dispatched)
+		assert.Empty(t, entry.Pending)
+		assert.NotNil(t, entry.ExpireAt)
+	})
+	t.Run("retries the sinks that failed only", func(t *testing.T) {
+		broker.fail(errors.New("broker down"))
+		assert.NoError(t, ob.Write(ctx, write("w2")))
+		assert.NoError(t, ob.RelayDue(ctx))
+		id := col.Docs()[1]["_id"]
+		entry := entryOf(t, col, id)
+		assert.Equal(t, []string{"broker"}, entry.Pending)
+		assert.False(t, entry.Dispatched)
+		assert.Equal(t, 1, entry.Attempts)
+		assert.Equal(t, "broker: broker down", entry.LastError)
+		assert.Len(t, bus.received(), 2)
+
+		broker.fail(nil)
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, ob.RelayDue(ctx))
+		assert.True(t, entryOf(t, col, id).Dispatched)
+		assert.Len(t, bus.received(), 2)
+		sent := broker.received()
+		if assert.Len(t, sent, 2) {
+			assert.Equal(t, entry.ID.Hex(), sent[1].UID)
+		}
+	})
+	t.Run("drops the events of failed writes", func(t *testing.T) {
+		tx := &fakeTx{}
+		failing := &Outbox{Col: &dbtest.Collection{}, Tx: tx}
+		err := failing.Write(ctx, func(ctx context.Context) ([]events.Event, error) {
+			return nil, errors.New("invalid widget")
+		})
+		assert.EqualError(t, err, "invalid widget")
+		tx.err = errors.New("write conflict")
+		assert.EqualError(t, failing.Write(ctx, write("w3")), "write conflict")
+	})
+	t.Run("replays with the original ids", func(t *testing.T) {
+		first := entryOf(t, col, col.Docs()[0]["_id"])
+		n, err := ob.Replay(ctx, Query{ID: first.ID}, []string{"broker"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		entry := entryOf(t, col, first.ID)
+		assert.Equal(t, []string{"broker"}, entry.Pending)
+		assert.Nil(t, entry.ExpireAt)
+
+		assert.NoError(t, ob.RelayDue(ctx))
+		sent := broker.received()
+		if assert.Len(t, sent, 3) {
+			assert.Equal(t, first.ID.Hex(), sent[2].UID)
+		}
+		assert.Len(t, bus.received(), 2)
+
+		n, err = ob.Replay(ctx, Query{Since: first.Time, Types: []events.Type{"widget.created"}}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		n, err = ob.Replay(ctx, Query{Types: []events.Type{"widget.deleted"}}, nil)
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		_, err = ob.Replay(ctx, Query{}, []string{"carrier-pigeon"})
+		assert.ErrorIs(t, err, ErrUnknownSink)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	o := &Outbox{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	var delays []time.Duration
+	for n := 1; n <= 5; n++ {
+		delays = append(delays, o.backoff(n))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+}
@@ -0,0 +1,135 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"tronicscorp/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxReplay caps the entries replayed at once.
+const MaxReplay = 10000
+
+// ErrUnknownSink is returned when a replay names a sink the outbox lacks.
+var ErrUnknownSink = errors.New("outbox: unknown sink")
+
+// Query selects outbox entries, oldest first.
+type Query struct {
+	// ID selects that entry alone when set.
+	ID primitive.ObjectID
+	// Dispatched selects the dispatched entries, or the pending ones, when
+	// set.
+	Dispatched *bool
+	Types      []events.Type
+	// Since and Until bound the time of the events when set.
+	Since time.Time
+	Until time.Time
+	Limit int64
+	// Latest lists the newest entries first.
+	Latest bool
+}
+
+func (q Query) filter() bson.M {
+	filter := bson.M{}
+	if !q.ID.IsZero() {
+		filter["_id"] = q.ID
+	}
+	if q.Dispatched != nil {
+		filter["dispatched"] = *q.Dispatched
+	}
+	if len(q.Types) > 0 {
+		filter["type"] = bson.M{"$in": q.Types}
+	}
+	at := bson.M{}
+	if !q.Since.IsZero() {
+		at["$gte"] = q.Since.UTC()
+	}
+	if !q.Until.IsZero() {
+		at["$lt"] = q.Until.UTC()
+	}
+	if len(at) > 0 {
+		filter["time"] = at
+	}
+	return filter
+}
+
+// List returns the entries selected by q.
+func (o *Outbox) List(ctx context.Context, q Query) ([]Entry, error) {
+	order := 1
+	if q.Latest {
+		order = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: order}})
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	cursor, err := o.Col.Find(ctx, q.filter(), opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	err = cursor.All(ctx, &entries)
+	return entries, err
+}
+
+// Get returns the entry id, or mongo.ErrNoDocuments.
+func (o *Outbox) Get(ctx context.Context, id primitive.ObjectID) (Entry, error) {
+	var entry Entry
+	err := o.Col.FindOne(ctx, bson.M{"_id": id}).Decode(&entry)
+	return entry, err
+}
+
+// Latest returns the latest entry about subject, or mongo.ErrNoDocuments.
+func (o *Outbox) Latest(ctx context.Context, subject string) (Entry, error) {
+	var entry Entry
+	err := o.Col.FindOne(ctx, bson.M{"subject": subject},
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&entry)
+	return entry, err
+}
+
+// Replay relays the entries selected by q again, to sinks or to every sink
+// when empty, whether they were dispatched or not. Sinks receive them with
+// their original UID. It returns the number of entries replayed, at most
+// MaxReplay.
+func (o *Outbox) Replay(ctx context.Context, q Query, sinks []string) (int, error) {
+	o.init()
+	if len(sinks) == 0 {
+		sinks = o.SinkNames()
+	}
+	for _, name := range sinks {
+		if _, ok := o.Sinks[name]; !ok {
+			return 0, fmt.Errorf("%w %q", ErrUnknownSink, name)
+		}
+	}
+	if q.Limit <= 0 || q.Limit > MaxReplay {
+		q.Limit = MaxReplay
+	}
+	entries, err := o.List(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	replayed := 0
+	for _, entry := range entries {
+		_, err := o.Col.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": bson.M{
+			"pending":      sinks,
+			"dispatched":   false,
+			"attempts":     0,
+			"next_attempt": now,
+			"expire_at":    nil,
+		}})
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		o.notify()
+	}
+	return replayed, nil
+}
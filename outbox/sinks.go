@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"tronicscorp/events"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Message is the JSON encoding of the events sent to the brokers. ID is the
+// UID of the event: consumers drop the messages whose ID they have seen.
+type Message struct {
+	ID      string      `json:"id"`
+	Type    events.Type `json:"type"`
+	Tenant  string      `json:"tenant,omitempty"`
+	Subject string      `json:"subject,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func encode(e events.Event) ([]byte, error) {
+	return json.Marshal(Message{ID: e.UID, Type: e.Type, Tenant: e.Tenant, Subject: e.Subject, Time: e.Time.UTC(), Data: e.Data})
+}
+
+// NATSSink publishes the events to the subject Prefix.<type>, with the UID as
+// Nats-Msg-Id so that JetStream streams drop the duplicates.
+type NATSSink struct {
+	Conn   *nats.Conn
+	Prefix string
+}
+
+func (s NATSSink) Send(ctx context.Context, e events.Event) error {
+	body, err := encode(e)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(s.Prefix + "." + string(e.Type))
+	msg.Header.Set(nats.MsgIdHdr, e.UID)
+	msg.Data = body
+	if err := s.Conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	// The publish is only buffered: wait for the server to have it.
+	return s.Conn.FlushWithContext(ctx)
+}
+
+// KafkaSink writes the events to the topic of Writer, keyed by subject so the
+// events of an entity keep their order.
+type KafkaSink struct {
+	Writer *kafka.Writer
+}
+
+func (s KafkaSink) Send(ctx context.Context, e events.Event) error {
+	body, err := encode(e)
+	if err != nil {
+		return err
+	}
+	return s.Writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(e.Subject),
+		Value: body,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(e.Type)},
+			{Key: "id", Value: []byte(e.UID)},
+		},
+	})
+}
@@ -0,0 +1,144 @@
+package problem
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ContentType is the media type of problem details responses.
+const ContentType = "application/problem+json"
+
+// Code is a stable, machine readable error code. Codes are documented in
+// docs/errors.md and must not be renamed.
+type Code string
+
+const (
+	CodeInvalidID           Code = "invalid_id"
+	CodeInvalidPayload      Code = "invalid_payload"
+	CodeValidationFailed    Code = "validation_failed"
+	CodeProductNotFound     Code = "product_not_found"
+	CodeUserNotFound        Code = "user_not_found"
+	CodeUserExists          Code = "user_exists"
+	CodeWebhookNotFound     Code = "webhook_not_found"
+	CodeDeliveryNotFound    Code = "delivery_not_found"
+	CodeOutboxEntryNotFound Code = "outbox_entry_not_found"
+	CodeRulesConflict       Code = "rules_conflict"
+	CodeCategoryNotFound    Code = "category_not_found"
+	CodeCategoryExists      Code = "category_exists"
+	CodeCategoryCycle       Code = "category_cycle"
+	CodeCategoryNotEmpty    Code = "category_not_empty"
+	CodeIdempotencyConflict Code = "idempotency_conflict"
+	CodeIdempotencyKeyReuse Code = "idempotency_key_reused"
+	CodeUnknownTenant       Code = "unknown_tenant"
+	CodeTenantMismatch      Code = "tenant_mismatch"
+	CodeInvalidCredentials  Code = "invalid_credentials"
+	CodeAccountLocked       Code = "account_locked"
+	CodeUnauthorized        Code = "unauthorized"
+	CodeForbidden           Code = "forbidden"
+	CodeNotFound            Code = "not_found"
+	CodeMethodNotAllowed    Code = "method_not_allowed"
+	CodePayloadTooLarge     Code = "payload_too_large"
+	CodeRateLimited         Code = "rate_limited"
+	CodeTimeout             Code = "timeout"
+	CodeUnavailable         Code = "unavailable"
+	CodeInternal            Code = "internal"
+)
+
+// Problem is an RFC 7807 problem details object. It implements error so
+// handlers can return it and let the central error handler render it.
+type Problem struct {
+	Type          string       `json:"type"`
+	Title         string       `json:"title"`
+	Status        int          `json:"status"`
+	Detail        string       `json:"detail,omitempty"`
+	Instance      string       `json:"instance,omitempty"`
+	Code          Code         `json:"code"`
+	CorrelationID string       `json:"correlation_id,omitempty"`
+	Errors        []FieldError `json:"errors,omitempty"`
+
+	cause error
+}
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// New returns a problem with the given status, code and detail.
+func New(status int, code Code, detail string) *Problem {
+	return &Problem{
+		Type:   "/problems/" + string(code),
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// WithCause records the underlying error. It is logged but never rendered.
+func (p *Problem) WithCause(err error) *Problem {
+	p.cause = err
+	return p
+}
+
+// WithErrors attaches field level errors.
+func (p *Problem) WithErrors(errs ...FieldError) *Problem {
+	p.Errors = append(p.Errors, errs...)
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.cause != nil {
+		return fmt.Sprintf("%s: %s: %v", p.Code, p.Detail, p.cause)
+	}
+	return fmt.Sprintf("%s: %s", p.Code, p.Detail)
+}
+
+func (p *Problem) Unwrap() error {
+	return p.cause
+}
+
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:            CodeInvalidPayload,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnprocessableEntity:   CodeInvalidPayload,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+	http.StatusGatewayTimeout:        CodeTimeout,
+}
+
+// From converts any error to a problem. Echo HTTP errors keep their status
+// and message, other errors become opaque internal errors.
+func From(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	var httpError *echo.HTTPError
+	if errors.As(err, &httpError) {
+		code, ok := statusCodes[httpError.Code]
+		if !ok {
+			code = CodeInternal
+		}
+		detail := http.StatusText(httpError.Code)
+		if msg, ok := httpError.Message.(string); ok {
+			detail = msg
+		}
+		return New(httpError.Code, code, detail).WithCause(httpError.Internal)
+	}
+	return New(http.StatusInternalServerError, CodeInternal, "An unexpected error occurred").WithCause(err)
+}
+
+// Status returns the HTTP status err will be rendered with.
+func Status(err error) int {
+	return From(err).Status
+}
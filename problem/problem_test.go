@@ -0,0 +1,42 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrom(t *testing.T) {
+	t.Run("problem is returned as is", func(t *testing.T) {
+		p := New(http.StatusNotFound, CodeProductNotFound, "missing")
+		assert.Same(t, p, From(p))
+		assert.Equal(t, "/problems/product_not_found", p.Type)
+		assert.Equal(t, "Not Found", p.Title)
+	})
+	t.Run("echo errors keep their status", func(t *testing.T) {
+		p := From(echo.NewHTTPError(http.StatusRequestEntityTooLarge))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, p.Status)
+		assert.Equal(t, CodePayloadTooLarge, p.Code)
+		p = From(echo.ErrUnauthorized)
+		assert.Equal(t, CodeUnauthorized, p.Code)
+	})
+	t.Run("other errors are internal and hide the cause", func(t *testing.T) {
+		cause := errors.New("connection reset")
+		p := From(cause)
+		assert.Equal(t, http.StatusInternalServerError, p.Status)
+		assert.Equal(t, CodeInternal, p.Code)
+		assert.ErrorIs(t, p, cause)
+		body, err := json.Marshal(p)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(body), "connection reset")
+	})
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, http.StatusTooManyRequests, Status(New(http.StatusTooManyRequests, CodeAccountLocked, "")))
+	assert.Equal(t, http.StatusInternalServerError, Status(errors.New("boom")))
+}
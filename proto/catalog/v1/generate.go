@@ -0,0 +1,6 @@
+// Package catalogv1 holds the messages and gRPC stubs of the catalog service,
+// generated from catalog.proto with protoc-gen-go v1.31.0 and
+// protoc-gen-go-grpc v1.3.0.
+package catalogv1
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative catalog.proto
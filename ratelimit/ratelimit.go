@@ -0,0 +1,139 @@
+// Package ratelimit throttles the clients with token buckets: a client may
+// send Burst requests at once, then Rate per second. The buckets are kept in
+// memory, for a single instance, or in Redis, shared by the instances.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"tronicscorp/metrics"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Quota is the size and refill rate of a bucket. A zero Rate is no limit.
+type Quota struct {
+	// Rate is the number of requests per second.
+	Rate float64
+	// Burst is the number of requests at once, Rate rounded up when zero.
+	Burst int
+}
+
+// Unlimited reports whether q lets every request through.
+func (q Quota) Unlimited() bool {
+	return q.Rate <= 0
+}
+
+func (q Quota) burst() int {
+	if q.Burst > 0 {
+		return q.Burst
+	}
+	return int(math.Max(1, math.Ceil(q.Rate)))
+}
+
+// window is how long an empty bucket takes to fill.
+func (q Quota) window() time.Duration {
+	return seconds(float64(q.burst()) / q.Rate)
+}
+
+// Result is the state of a bucket after a request.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next request is allowed, when this
+	// one is not.
+	RetryAfter time.Duration
+}
+
+// result returns the result of a request leaving tokens in the bucket.
+func (q Quota) result(allowed bool, tokens float64) Result {
+	r := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(q.burst()) - tokens) / q.Rate),
+	}
+	if !allowed {
+		r.RetryAfter = seconds((1 - tokens) / q.Rate)
+	}
+	return r
+}
+
+// refill returns the tokens of a bucket left with tokens elapsed ago.
+func (q Quota) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(float64(q.burst()), tokens+elapsed.Seconds()*q.Rate)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Store keeps the buckets.
+type Store interface {
+	// Take takes a token from the bucket of key, if it has one.
+	Take(ctx context.Context, key string, q Quota) (Result, error)
+}
+
+// Config configures Middleware.
+type Config struct {
+	Skipper middleware.Skipper
+	Store   Store
+	// Quota returns the route group of the request and its quota. Each group
+	// has its own buckets.
+	Quota func(c echo.Context) (group string, q Quota)
+	// Client identifies the client of the request.
+	Client func(c echo.Context) string
+}
+
+// Middleware rejects the requests of the clients out of tokens with 429 Too
+// Many Requests. The responses carry the RateLimit-Limit, -Remaining, -Reset
+// and -Policy headers of the IETF draft, and Retry-After once rejected. The
+// requests are let through when the store fails.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	if cfg.Skipper == nil {
+		cfg.Skipper = middleware.DefaultSkipper
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.Skipper(c) {
+				return next(c)
+			}
+			group, q := cfg.Quota(c)
+			if q.Unlimited() {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+			res, err := cfg.Store.Take(ctx, group+":"+cfg.Client(c), q)
+			if err != nil {
+				slog.Warn("Unable to check the rate limit, letting the request through", "group", group, "error", err)
+				return next(c)
+			}
+			header := c.Response().Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(q.burst()))
+			header.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+			header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", q.burst(), ceilSeconds(q.window())))
+			if res.Allowed {
+				return next(c)
+			}
+			metrics.RateLimitedRequests.WithLabelValues(group).Inc()
+			retry := ceilSeconds(res.RetryAfter)
+			header.Set("Retry-After", strconv.Itoa(retry))
+			return problem.New(http.StatusTooManyRequests, problem.CodeRateLimited,
+				fmt.Sprintf("Too many requests, retry in %d seconds", retry))
+		}
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds, as the headers want.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	q := Quota{Rate: 2, Burst: 3}
+
+	for i := 2; i >= 0; i-- {
+		res, _ := m.Take(ctx, "a", q)
+		assert.True(t, res.Allowed)
+		assert.Equal(t, i, res.Remaining)
+	}
+	res, _ := m.Take(ctx, "a", q)
+	assert.False(t, res.Allowed)
+	assert.Equal(t, 500*time.Millisecond, res.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, res.Reset)
+
+	res, _ = m.Take(ctx, "b", q)
+	assert.True(t, res.Allowed, "each key has its bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	res, _ = m.Take(ctx, "a", q)
+	assert.True(t, res.Allowed, "refilled")
+	assert.Equal(t, 0, res.Remaining)
+
+	now = now.Add(time.Hour)
+	m.Take(ctx, "c", q)
+	assert.Len(t, m.buckets, 1, "the full buckets are forgotten")
+}
+
+func TestQuota(t *testing.T) {
+	assert.True(t, Quota{}.Unlimited())
+	assert.Equal(t, 1, Quota{Rate: 0.2}.burst())
+	assert.Equal(t, 3, Quota{Rate: 2.5}.burst())
+	assert.Equal(t, 50*time.Second, Quota{Rate: 0.2, Burst: 10}.window())
+}
+
+// failingStore fails every Take.
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, q Quota) (Result, error) {
+	return Result{}, errors.New("store down")
+}
+
+func TestMiddleware(t *testing.T) {
+	quotas := map[string]Quota{"auth": {Rate: 0.2, Burst: 2}, "products": {Rate: 10, Burst: 20}}
+	cfg := Config{
+		Store: NewMemory(),
+		Quota: func(c echo.Context) (string, Quota) {
+			group := c.Request().Header.Get("X-Group")
+			return group, quotas[group]
+		},
+		Client: func(c echo.Context) string {
+			return c.RealIP()
+		},
+	}
+	send := func(cfg Config, group string) (*httptest.ResponseRecorder, error) {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+		req.Header.Set("X-Group", group)
+		res := httptest.NewRecorder()
+		err := Middleware(cfg)(func(c echo.Context) error {
+			return c.NoContent(http.StatusNoContent)
+		})(e.NewContext(req, res))
+		return res, err
+	}
+
+	res, err := send(cfg, "auth")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", res.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", res.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "5", res.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=10", res.Header().Get("RateLimit-Policy"))
+	send(cfg, "auth")
+
+	res, err = send(cfg, "auth")
+	assert.Equal(t, http.StatusTooManyRequests, problem.Status(err))
+	assert.Equal(t, "5", res.Header().Get("Retry-After"))
+	assert.Equal(t, "0", res.Header().Get("RateLimit-Remaining"))
+
+	res, err = send(cfg, "products")
+	assert.NoError(t, err, "each group has its buckets")
+	assert.Equal(t, "19", res.Header().Get("RateLimit-Remaining"))
+
+	res, err = send(cfg, "default")
+	assert.NoError(t, err, "no quota, no limit")
+	assert.Empty(t, res.Header().Get("RateLimit-Limit"))
+
+	cfg.Store = failingStore{}
+	_, err = send(cfg, "auth")
+	assert.NoError(t, err, "let through when the store fails")
+}
@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// sweepInterval is how often Memory forgets the full buckets.
+const sweepInterval = time.Minute
+
+// Memory keeps the buckets in process: each instance limits the clients on
+// its own.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	quota  Quota
+}
+
+// NewMemory returns an empty memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, q Quota) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.sweep(now)
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(q.burst())}
+		m.buckets[key] = b
+	} else {
+		b.tokens = q.refill(b.tokens, now.Sub(b.last))
+	}
+	b.last, b.quota = now, q
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return q.result(allowed, b.tokens), nil
+}
+
+// sweep forgets the buckets full again, as good as new ones.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if b.quota.refill(b.tokens, now.Sub(b.last)) >= float64(b.quota.burst()) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// take updates a bucket atomically. It expires once full again, as good as
+// a new one.
+var take = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = burst
+if b[1] then
+	tokens = math.min(burst, tonumber(b[1]) + math.max(0, now - tonumber(b[2])) / 1000 * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// Redis keeps the buckets in Redis, shared by the instances. The buckets are
+// refilled with the clock of the instances, which must be in sync.
+type Redis struct {
+	Client redis.UniversalClient
+	// Prefix namespaces the keys, for several applications to share a
+	// server.
+	Prefix string
+}
+
+func (s Redis) Take(ctx context.Context, key string, q Quota) (Result, error) {
+	now := time.Now().UnixMilli()
+	res, err := take.Run(ctx, s.Client, []string{s.Prefix + key}, q.burst(), q.Rate, now).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	allowed, _ := res[0].(int64)
+	raw, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return Result{}, err
+	}
+	return q.result(allowed == 1, tokens), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"tronicscorp/config"
+	"tronicscorp/logging"
+	"tronicscorp/ratelimit"
+)
+
+// reloadableLimits holds the rate limit quotas of the route groups and the
+// API keys, replaced at runtime. Replacing a quota keeps the buckets.
+type reloadableLimits struct {
+	quotas atomic.Pointer[map[string]ratelimit.Quota]
+	keys   atomic.Pointer[[]apiKey]
+}
+
+// apiKey identifies the client sending Key as Name.
+type apiKey struct {
+	Name, Key string
+}
+
+func (l *reloadableLimits) set(p config.Properties) {
+	l.quotas.Store(&map[string]ratelimit.Quota{
+		groupDefault:  {Rate: p.RateLimit, Burst: p.RateBurst},
+		groupProducts: {Rate: p.ProductsRateLimit, Burst: p.ProductsRateBurst},
+		groupAuth:     {Rate: p.AuthRateLimit, Burst: p.AuthRateBurst},
+	})
+	keys := make([]apiKey, 0, len(p.APIKeys))
+	for _, k := range p.APIKeys {
+		name, key, _ := strings.Cut(k, ":")
+		keys = append(keys, apiKey{Name: name, Key: key})
+	}
+	l.keys.Store(&keys)
+}
+
+func (l *reloadableLimits) quota(group string) ratelimit.Quota {
+	return (*l.quotas.Load())[group]
+}
+
+// client returns the name of the API key key.
+func (l *reloadableLimits) client(key string) (string, bool) {
+	for _, k := range *l.keys.Load() {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return k.Name, true
+		}
+	}
+	return "", false
+}
+
+// reloadableOrigins answers CORS origin checks from the latest snapshot.
+type reloadableOrigins struct {
+	origins atomic.Pointer[[]string]
+}
+
+func (o *reloadableOrigins) set(origins []string) {
+	o.origins.Store(&origins)
+}
+
+func (o *reloadableOrigins) allow(origin string) (bool, error) {
+	for _, allowed := range *o.origins.Load() {
+		if allowed == "*" || allowed == origin {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func applyRuntimeConfig(p config.Properties, level *slog.LevelVar, limits *reloadableLimits, origins *reloadableOrigins) {
+	level.Set(logging.ParseLevel(p.LogLevel))
+	limits.set(p)
+	origins.set(p.CORSOrigins)
+}
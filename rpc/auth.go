@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"tronicscorp/correlation"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+	catalogv1 "tronicscorp/proto/catalog/v1"
+	"tronicscorp/tenant"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/gommon/random"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// access is what a method requires from the caller.
+type access int
+
+const (
+	public access = iota
+	authenticated
+	admin
+)
+
+// permissions mirrors the middleware of the REST routes. Unlisted methods
+// are public.
+var permissions = map[string]access{
+	catalogv1.CatalogService_Create_FullMethodName: authenticated,
+	catalogv1.CatalogService_Update_FullMethodName: authenticated,
+	catalogv1.CatalogService_Delete_FullMethodName: admin,
+}
+
+// authenticator checks the tokens and permissions of the calls, resolves
+// their tenant, and gives each one a logger tagged with its correlation ID,
+// method, tenant and user.
+type authenticator struct {
+	keyfunc jwt.Keyfunc
+	tenants *tenant.Registry
+}
+
+func (a authenticator) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	start := time.Now()
+	var res interface{}
+	if err == nil {
+		res, err = handler(ctx, req)
+	}
+	logCall(ctx, start, err)
+	return res, err
+}
+
+func (a authenticator) stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authorize(ss.Context(), info.FullMethod)
+	start := time.Now()
+	if err == nil {
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+	logCall(ctx, start, err)
+	return err
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize returns the context of the call, with its tenant and logger,
+// once its token is checked against the tenant and the permission of method.
+// The tenant is named by the x-tenant-id metadata, or else the token.
+func (a authenticator) authorize(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := first(md, correlation.Header)
+	if id == "" {
+		id = random.String(12)
+	}
+	ctx = correlation.NewContext(ctx, id)
+	logger := slog.Default().With(slog.String("correlation_id", id), slog.String("rpc", method))
+	ctx = logging.NewContext(ctx, logger)
+
+	var claims jwt.MapClaims
+	if raw := first(md, "x-auth-token"); raw != "" {
+		token, err := jwt.Parse(strings.TrimPrefix(raw, "Bearer "), a.verify)
+		if err != nil || !token.Valid {
+			return ctx, statusOf(problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "invalid or expired jwt"))
+		}
+		claims, _ = token.Claims.(jwt.MapClaims)
+		logger = logger.With("user_id", claims["user_id"])
+		ctx = logging.NewContext(ctx, logger)
+	}
+	t, perr := a.tenants.Resolve(first(md, tenant.Header), "", claims)
+	if perr != nil {
+		return ctx, statusOf(perr)
+	}
+	ctx = tenant.NewContext(ctx, t)
+	ctx = logging.NewContext(ctx, logger.With("tenant", t.ID))
+	required := permissions[method]
+	if required >= authenticated && claims == nil {
+		return ctx, statusOf(problem.New(http.StatusUnauthorized, problem.CodeUnauthorized, "missing or malformed jwt"))
+	}
+	if authorized, _ := claims["authorized"].(bool); required == admin && !authorized {
+		return ctx, statusOf(problem.New(http.StatusForbidden, problem.CodeForbidden, "Not authorized"))
+	}
+	return ctx, nil
+}
+
+// verify only accepts the HS256 tokens issued by the REST API.
+func (a authenticator) verify(t *jwt.Token) (interface{}, error) {
+	if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v", t.Method.Alg())
+	}
+	return a.keyfunc(t)
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func logCall(ctx context.Context, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	attrs := []slog.Attr{slog.String("code", code.String()), slog.Duration("latency", time.Since(start))}
+	switch code {
+	case codes.Unknown, codes.Internal, codes.DataLoss, codes.Unavailable, codes.DeadlineExceeded:
+		level = slog.LevelError
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	logging.FromContext(ctx).LogAttrs(ctx, level, "rpc completed", attrs...)
+}
@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"net/http"
+	"tronicscorp/problem"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+// Domain is the domain of the ErrorInfo details.
+const Domain = "tronicscorp"
+
+// statusCodes maps the HTTP statuses of problems to gRPC codes, which
+// grpc-gateway maps back to the same statuses, but 413 and 422 that become 400.
+var statusCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.Aborted,
+	http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+	http.StatusUnprocessableEntity:   codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusNotImplemented:        codes.Unimplemented,
+	http.StatusServiceUnavailable:    codes.Unavailable,
+	http.StatusGatewayTimeout:        codes.DeadlineExceeded,
+}
+
+// statusOf converts a problem to a gRPC status, with its code as the reason
+// of an ErrorInfo and its field errors as a BadRequest.
+func statusOf(p *problem.Problem) error {
+	code, ok := statusCodes[p.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	st := status.New(code, p.Detail)
+	details := []protoiface.MessageV1{&errdetails.ErrorInfo{Reason: string(p.Code), Domain: Domain}}
+	if len(p.Errors) > 0 {
+		br := &errdetails.BadRequest{}
+		for _, fe := range p.Errors {
+			br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{Field: fe.Field, Description: fe.Message})
+		}
+		details = append(details, br)
+	}
+	if withDetails, err := st.WithDetails(details...); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
@@ -0,0 +1,267 @@
+// Package rpc serves the product catalog over gRPC, for internal services.
+// It shares the ProductHandler of the REST API, so products are stored,
+// validated and authorized the same way.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"tronicscorp/events"
+	"tronicscorp/handlers"
+	"tronicscorp/problem"
+	catalogv1 "tronicscorp/proto/catalog/v1"
+	"tronicscorp/tenant"
+
+	"github.com/golang-jwt/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watchBuffer is the number of events a watcher may lag behind before it is
+// disconnected.
+const watchBuffer = 64
+
+// CatalogServer implements catalogv1.CatalogServiceServer.
+type CatalogServer struct {
+	catalogv1.UnimplementedCatalogServiceServer
+	// Products must use the v1 representation.
+	Products *handlers.ProductHandler
+	Events   *events.Bus
+}
+
+// NewServer returns a gRPC server serving catalog to the tenants,
+// authenticating calls with the tokens verified by keyfunc.
+func NewServer(catalog *CatalogServer, keyfunc jwt.Keyfunc, tenants *tenant.Registry) *grpc.Server {
+	a := authenticator{keyfunc: keyfunc, tenants: tenants}
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(a.unary), grpc.ChainStreamInterceptor(a.stream))
+	catalogv1.RegisterCatalogServiceServer(srv, catalog)
+	return srv
+}
+
+func (s *CatalogServer) Get(ctx context.Context, req *catalogv1.GetRequest) (*catalogv1.Product, error) {
+	p, err := s.Products.Get(ctx, req.Id)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return toProto(p), nil
+}
+
+func (s *CatalogServer) List(req *catalogv1.ListRequest, stream catalogv1.CatalogService_ListServer) error {
+	q := handlers.ProductQuery{
+		Vendor:    req.Vendor,
+		Essential: req.Essential,
+		Name:      req.Name,
+		Skip:      req.Offset,
+		Limit:     req.Limit,
+	}
+	if req.MinPrice != nil {
+		min := int(*req.MinPrice)
+		q.MinPrice = &min
+	}
+	if req.MaxPrice != nil {
+		max := int(*req.MaxPrice)
+		q.MaxPrice = &max
+	}
+	if req.OrderBy != "" {
+		name := strings.TrimPrefix(req.OrderBy, "-")
+		field, ok := storedFields[name]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "unable to order by %q", name)
+		}
+		q.Sort = strings.TrimSuffix(req.OrderBy, name) + field
+	}
+	err := s.Products.Each(stream.Context(), q, func(p handlers.Product) error {
+		return stream.Send(toProto(p))
+	})
+	var p *problem.Problem
+	if errors.As(err, &p) {
+		return statusOf(p)
+	}
+	return err
+}
+
+func (s *CatalogServer) Create(ctx context.Context, req *catalogv1.CreateRequest) (*catalogv1.Product, error) {
+	products := []handlers.Product{fromProto(req.Product)}
+	if _, err := s.Products.Create(ctx, products, language(ctx)); err != nil {
+		return nil, statusOf(fieldNames(err, "product."))
+	}
+	return toProto(products[0]), nil
+}
+
+func (s *CatalogServer) Update(ctx context.Context, req *catalogv1.UpdateRequest) (*catalogv1.Product, error) {
+	body, err := patch(req)
+	if err != nil {
+		return nil, err
+	}
+	p, perr := s.Products.Update(ctx, req.Id, bytes.NewReader(body), language(ctx))
+	if perr != nil {
+		return nil, statusOf(fieldNames(perr, "product."))
+	}
+	return toProto(p), nil
+}
+
+func (s *CatalogServer) Delete(ctx context.Context, req *catalogv1.DeleteRequest) (*catalogv1.DeleteResponse, error) {
+	deleted, err := s.Products.Delete(ctx, req.Id)
+	if err != nil {
+		return nil, statusOf(err)
+	}
+	return &catalogv1.DeleteResponse{Deleted: deleted}, nil
+}
+
+// Watch sends the events of the bus matching the request, of the tenant of
+// the call only. Deletions carry no
+// product, so they are sent whatever the vendor filter. The headers are sent
+// once the call is subscribed, so clients may wait for them before writing.
+func (s *CatalogServer) Watch(req *catalogv1.WatchRequest, stream catalogv1.CatalogService_WatchServer) error {
+	changes, cancel := s.Events.Subscribe(watchBuffer)
+	defer cancel()
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e, ok := <-changes:
+			if !ok {
+				return status.Error(codes.Aborted, "the watcher fell behind, watch again")
+			}
+			event := toEvent(e)
+			if t, _ := tenant.FromContext(stream.Context()); e.Tenant != t.ID {
+				continue
+			}
+			if event == nil || (req.Id != "" && event.Id != req.Id) ||
+				(req.Vendor != "" && event.Product != nil && event.Product.Vendor != req.Vendor) {
+				continue
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storedFields maps the fields of catalogv1.Product to stored field names.
+var storedFields = map[string]string{
+	"id":          "_id",
+	"name":        "product_name",
+	"price":       "price",
+	"currency":    "currency",
+	"discount":    "discount",
+	"vendor":      "vendor",
+	"accessories": "accessories",
+	"essential":   "is_essential",
+	"categories":  "categories",
+}
+
+// patch returns the JSON body changing the fields of the update mask.
+func patch(req *catalogv1.UpdateRequest) ([]byte, error) {
+	p := req.GetProduct()
+	all := map[string]interface{}{
+		"product_name": p.GetName(),
+		"price":        p.GetPrice(),
+		"currency":     p.GetCurrency(),
+		"discount":     p.GetDiscount(),
+		"vendor":       p.GetVendor(),
+		"accessories":  p.GetAccessories(),
+		"is_essential": p.GetEssential(),
+		"categories":   p.GetCategories(),
+	}
+	paths := req.GetUpdateMask().GetPaths()
+	if len(paths) == 0 {
+		return json.Marshal(all)
+	}
+	masked := map[string]interface{}{}
+	for _, path := range paths {
+		field, ok := all[storedFields[path]]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unable to update %q", path)
+		}
+		masked[storedFields[path]] = field
+	}
+	return json.Marshal(masked)
+}
+
+var protoFields = func() map[string]string {
+	fields := make(map[string]string, len(storedFields))
+	for proto, stored := range storedFields {
+		fields[stored] = proto
+	}
+	return fields
+}()
+
+var itemPrefix = regexp.MustCompile(`^\[\d+\]\.`)
+
+// fieldNames renames the field errors of p to the fields of the request.
+func fieldNames(p *problem.Problem, prefix string) *problem.Problem {
+	for i, fe := range p.Errors {
+		name := itemPrefix.ReplaceAllString(fe.Field, "")
+		if proto, ok := protoFields[name]; ok {
+			name = proto
+		}
+		p.Errors[i].Field = prefix + name
+	}
+	return p
+}
+
+// language returns the accept-language metadata of the call.
+func language(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get("accept-language"); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func toProto(p handlers.Product) *catalogv1.Product {
+	return &catalogv1.Product{
+		Id:          p.ID.Hex(),
+		Name:        p.Name,
+		Price:       int64(p.Price),
+		Currency:    p.Currency,
+		Discount:    int64(p.Discount),
+		Vendor:      p.Vendor,
+		Accessories: p.Accessories,
+		Essential:   p.IsEssential,
+		Categories:  p.Categories,
+	}
+}
+
+func fromProto(p *catalogv1.Product) handlers.Product {
+	return handlers.Product{
+		Name:        p.GetName(),
+		Price:       int(p.GetPrice()),
+		Currency:    p.GetCurrency(),
+		Discount:    int(p.GetDiscount()),
+		Vendor:      p.GetVendor(),
+		Accessories: p.GetAccessories(),
+		IsEssential: p.GetEssential(),
+		Categories:  p.GetCategories(),
+	}
+}
+
+var eventTypes = map[events.Type]catalogv1.ProductEvent_Type{
+	events.ProductCreated: catalogv1.ProductEvent_CREATED,
+	events.ProductUpdated: catalogv1.ProductEvent_UPDATED,
+	events.ProductDeleted: catalogv1.ProductEvent_DELETED,
+}
+
+// toEvent converts a product event, nil for other events.
+func toEvent(e events.Event) *catalogv1.ProductEvent {
+	typ, ok := eventTypes[e.Type]
+	if !ok {
+		return nil
+	}
+	event := &catalogv1.ProductEvent{Type: typ, Id: e.Subject, Time: timestamppb.New(e.Time)}
+	if p, ok := e.Data.(handlers.Product); ok {
+		event.Product = toProto(p)
+	}
+	return event
+}
@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+	"tronicscorp/events"
+	"tronicscorp/handlers"
+	catalogv1 "tronicscorp/proto/catalog/v1"
+	"tronicscorp/tenant"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+var secret = []byte("secret")
+
+// fakeCollection serves products from memory.
+type fakeCollection struct {
+	products []handlers.Product
+}
+
+func (f *fakeCollection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	p := document.(handlers.Product)
+	f.products = append(f.products, p)
+	return &mongo.InsertOneResult{InsertedID: p.ID}, nil
+}
+
+func (f *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	var docs []interface{}
+	for _, p := range f.products {
+		docs = append(docs, p)
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (f *fakeCollection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	for _, p := range f.products {
+		if p.ID == filter.(bson.M)["_id"] {
+			return mongo.NewSingleResultFromDocument(p, nil, nil)
+		}
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (f *fakeCollection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return &mongo.UpdateResult{MatchedCount: 1}, nil
+}
+
+func (f *fakeCollection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return &mongo.DeleteResult{DeletedCount: 1}, nil
+}
+
+func (f *fakeCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+func newClient(t *testing.T) (catalogv1.CatalogServiceClient, *fakeCollection) {
+	col := &fakeCollection{products: []handlers.Product{
+		{ID: primitive.NewObjectID(), Name: "phone", Price: 500, Currency: "EUR", Vendor: "acme"},
+		{ID: primitive.NewObjectID(), Name: "tablet", Price: 700, Currency: "EUR", Vendor: "acme"},
+	}}
+	bus := events.NewBus(0)
+	tenants, err := tenant.NewRegistry("default", tenant.Tenant{ID: "globex"})
+	assert.NoError(t, err)
+	srv := NewServer(&CatalogServer{Products: &handlers.ProductHandler{Col: col, Events: bus}, Events: bus},
+		func(*jwt.Token) (interface{}, error) { return secret, nil }, tenants)
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return catalogv1.NewCatalogServiceClient(conn), col
+}
+
+func withToken(t *testing.T, admin bool) context.Context {
+	return withTenantToken(t, admin, "")
+}
+
+// withTenantToken authenticates as a user of tenant, of the default one when
+// empty.
+func withTenantToken(t *testing.T, admin bool, tenant string) context.Context {
+	claims := jwt.MapClaims{"user_id": "jane@tronics.com", "authorized": admin}
+	if tenant != "" {
+		claims["tenant"] = tenant
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	assert.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(), "x-auth-token", "Bearer "+token)
+}
+
+func reason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestGetAndList(t *testing.T) {
+	client, col := newClient(t)
+	ctx := context.Background()
+
+	p, err := client.Get(ctx, &catalogv1.GetRequest{Id: col.products[0].ID.Hex()})
+	assert.NoError(t, err)
+	assert.Equal(t, "phone", p.Name)
+	assert.Equal(t, int64(500), p.Price)
+
+	_, err = client.Get(ctx, &catalogv1.GetRequest{Id: primitive.NewObjectID().Hex()})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, "product_not_found", reason(err))
+
+	_, err = client.Get(ctx, &catalogv1.GetRequest{Id: "1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.List(ctx, &catalogv1.ListRequest{Vendor: "acme", OrderBy: "name"})
+	assert.NoError(t, err)
+	var names []string
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"phone", "tablet"}, names)
+
+	stream, _ = client.List(ctx, &catalogv1.ListRequest{OrderBy: "weight"})
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestWrites(t *testing.T) {
+	client, col := newClient(t)
+	product := &catalogv1.Product{Name: "mouse", Price: 10, Currency: "EUR", Vendor: "acme"}
+
+	t.Run("create needs a token", func(t *testing.T) {
+		_, err := client.Create(context.Background(), &catalogv1.CreateRequest{Product: product})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("invalid tokens are rejected", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-auth-token", "Bearer nope")
+		_, err := client.Get(ctx, &catalogv1.GetRequest{Id: col.products[0].ID.Hex()})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+	t.Run("create", func(t *testing.T) {
+		p, err := client.Create(withToken(t, false), &catalogv1.CreateRequest{Product: product})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, p.Id)
+		assert.Len(t, col.products, 3)
+	})
+	t.Run("create validates the product", func(t *testing.T) {
+		_, err := client.Create(withToken(t, false), &catalogv1.CreateRequest{Product: &catalogv1.Product{Price: 10, Currency: "EUR", Vendor: "acme"}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, "validation_failed", reason(err))
+		var fields []string
+		for _, d := range status.Convert(err).Details() {
+			if br, ok := d.(*errdetails.BadRequest); ok {
+				for _, v := range br.FieldViolations {
+					fields = append(fields, v.Field)
+				}
+			}
+		}
+		assert.Equal(t, []string{"product.name"}, fields)
+	})
+	t.Run("update changes the masked fields", func(t *testing.T) {
+		p, err := client.Update(withToken(t, false), &catalogv1.UpdateRequest{
+			Id:         col.products[0].ID.Hex(),
+			Product:    &catalogv1.Product{Price: 450},
+			UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"price"}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "phone", p.Name)
+		assert.Equal(t, int64(450), p.Price)
+	})
+	t.Run("delete needs an admin", func(t *testing.T) {
+		req := &catalogv1.DeleteRequest{Id: col.products[0].ID.Hex()}
+		_, err := client.Delete(withToken(t, false), req)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		res, err := client.Delete(withToken(t, true), req)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), res.Deleted)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	client, col := newClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &catalogv1.WatchRequest{Vendor: "acme"})
+	assert.NoError(t, err)
+	_, err = stream.Header()
+	assert.NoError(t, err)
+	other, err := client.Watch(metadata.AppendToOutgoingContext(ctx, "x-tenant-id", "globex"), &catalogv1.WatchRequest{})
+	assert.NoError(t, err)
+	_, err = other.Header()
+	assert.NoError(t, err)
+	_, err = client.Delete(withToken(t, true), &catalogv1.DeleteRequest{Id: col.products[1].ID.Hex()})
+	assert.NoError(t, err)
+	_, err = client.Create(withToken(t, false), &catalogv1.CreateRequest{Product: &catalogv1.Product{Name: "case", Price: 5, Currency: "EUR", Vendor: "other"}})
+	assert.NoError(t, err)
+	_, err = client.Update(withToken(t, false), &catalogv1.UpdateRequest{Id: col.products[0].ID.Hex(), Product: &catalogv1.Product{Discount: 5},
+		UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{"discount"}}})
+	assert.NoError(t, err)
+
+	e, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, catalogv1.ProductEvent_DELETED, e.Type)
+	e, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, catalogv1.ProductEvent_UPDATED, e.Type)
+	assert.Equal(t, int64(5), e.Product.Discount)
+
+	_, err = client.Create(withTenantToken(t, false, "globex"), &catalogv1.CreateRequest{Product: &catalogv1.Product{Name: "case", Price: 5, Currency: "EUR", Vendor: "globex"}})
+	assert.NoError(t, err)
+	e, err = other.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, "globex", e.Product.Vendor, "the changes of the other tenants are not sent")
+}
+
+func TestTenants(t *testing.T) {
+	client, col := newClient(t)
+	get := &catalogv1.GetRequest{Id: col.products[0].ID.Hex()}
+
+	_, err := client.Get(metadata.AppendToOutgoingContext(context.Background(), "x-tenant-id", "initech"), get)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "unknown_tenant", reason(err))
+
+	_, err = client.Get(metadata.AppendToOutgoingContext(withTenantToken(t, false, "globex"), "x-tenant-id", "default"), get)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "the tokens of a tenant are refused by the others")
+	assert.Equal(t, "tenant_mismatch", reason(err))
+
+	_, err = client.Get(withTenantToken(t, false, "globex"), get)
+	assert.NoError(t, err, "the tenant of the token is the one of the call")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tronicscorp/config"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenants(t *testing.T) {
+	a := newRoutedApp(t)
+	serve := func(method, target, tenantID string, claims jwt.MapClaims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if tenantID != "" {
+			req.Header.Set("X-Tenant-ID", tenantID)
+		}
+		if claims != nil {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.DefaultJwtTokenSecret))
+			assert.NoError(t, err)
+			req.Header.Set("x-auth-token", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		a.echo.ServeHTTP(res, req)
+		return res
+	}
+	globexAdmin := jwt.MapClaims{"user_id": "jane@globex.com", "authorized": true, "tenant": "globex", "aud": "globex-shop"}
+
+	res := serve(http.MethodGet, "/v1/products/42", "initech", nil)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	assert.Contains(t, res.Body.String(), `"code":"unknown_tenant"`)
+
+	res = serve(http.MethodGet, "/v1/products/42", "default", globexAdmin)
+	assert.Equal(t, http.StatusForbidden, res.Code, "the token of a tenant is refused by the others")
+	assert.Contains(t, res.Body.String(), `"code":"tenant_mismatch"`)
+
+	res = serve(http.MethodGet, "/v1/products/42", "globex", jwt.MapClaims{"user_id": "jane@globex.com", "tenant": "globex"})
+	assert.Equal(t, http.StatusForbidden, res.Code, "the audience of the tenant is required")
+
+	res = serve(http.MethodGet, "/v1/products/42", "", globexAdmin)
+	assert.Equal(t, http.StatusBadRequest, res.Code, "the token names the tenant")
+	assert.Contains(t, res.Body.String(), `"code":"invalid_id"`)
+
+	res = serve(http.MethodGet, "/v1/rules/products", "", globexAdmin)
+	assert.Equal(t, http.StatusForbidden, res.Code, "the admins of a tenant do not administer the deployment")
+	assert.Contains(t, res.Body.String(), `"code":"forbidden"`)
+
+	res = serve(http.MethodPost, "/v1/webhooks/deliveries/5f1f1f1f1f1f1f1f1f1f1f1f/redeliver", "", globexAdmin)
+	assert.Equal(t, http.StatusForbidden, res.Code, "nor redeliver the webhooks of the deployment")
+	assert.Contains(t, res.Body.String(), `"code":"forbidden"`)
+}
@@ -0,0 +1,130 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"tronicscorp/dbiface"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoTenant is returned by the scoped collections called with a context
+// without tenant.
+var ErrNoTenant = errors.New("tenant: no tenant in the context")
+
+// Scope returns col restricted to the tenant of the context of each call:
+// the filters only match its documents, the inserted documents are its own
+// and the pipelines start by selecting its documents. The calls without
+// tenant fail with ErrNoTenant. The $lookup stages of the pipelines are not
+// restricted.
+func Scope(col dbiface.CollectionAPI) dbiface.CollectionAPI {
+	return scoped{col: col}
+}
+
+type scoped struct {
+	col dbiface.CollectionAPI
+}
+
+func (s scoped) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	owned := make(bson.D, 0, len(doc)+1)
+	for _, e := range doc {
+		if e.Key != Field {
+			owned = append(owned, e)
+		}
+	}
+	return s.col.InsertOne(ctx, append(owned, bson.E{Key: Field, Value: t.ID}), opts...)
+}
+
+func (s scoped) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	f, err := scopeFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.col.Find(ctx, f, opts...)
+}
+
+func (s scoped) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	f, err := scopeFilter(ctx, filter)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.M{}, err, nil)
+	}
+	return s.col.FindOne(ctx, f, opts...)
+}
+
+func (s scoped) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	f, err := scopeFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.col.UpdateOne(ctx, f, update, opts...)
+}
+
+func (s scoped) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	f, err := scopeFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.col.DeleteOne(ctx, f, opts...)
+}
+
+func (s scoped) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	match := bson.D{{Key: "$match", Value: bson.M{Field: t.ID}}}
+	var scopedPipeline interface{}
+	switch p := pipeline.(type) {
+	case bson.A:
+		scopedPipeline = append(bson.A{match}, p...)
+	case []interface{}:
+		scopedPipeline = append([]interface{}{match}, p...)
+	case mongo.Pipeline:
+		scopedPipeline = append(mongo.Pipeline{match}, p...)
+	case []bson.D:
+		scopedPipeline = append([]bson.D{match}, p...)
+	case []bson.M:
+		scopedPipeline = append([]bson.M{{"$match": bson.M{Field: t.ID}}}, p...)
+	default:
+		return nil, fmt.Errorf("tenant: unable to scope a pipeline of type %T", pipeline)
+	}
+	return s.col.Aggregate(ctx, scopedPipeline, opts...)
+}
+
+// scopeFilter restricts filter to the documents of the tenant of ctx. The
+// tenant of a bson.M filter is replaced, other filters are combined with the
+// tenant one.
+func scopeFilter(ctx context.Context, filter interface{}) (interface{}, error) {
+	t, ok := FromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	switch f := filter.(type) {
+	case nil:
+		return bson.M{Field: t.ID}, nil
+	case bson.M:
+		scoped := make(bson.M, len(f)+1)
+		for k, v := range f {
+			scoped[k] = v
+		}
+		scoped[Field] = t.ID
+		return scoped, nil
+	default:
+		return bson.M{"$and": bson.A{f, bson.M{Field: t.ID}}}, nil
+	}
+}
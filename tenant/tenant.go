@@ -0,0 +1,214 @@
+// Package tenant serves several brands from one deployment. Each request
+// belongs to a tenant, resolved from its header, its subdomain or its token,
+// and the collections wrapped by Scope only read and write the documents of
+// that tenant.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"tronicscorp/logging"
+	"tronicscorp/problem"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Header names the tenant of a request.
+	Header = "X-Tenant-ID"
+	// Claim is the token claim holding the tenant the token was issued for.
+	Claim = "tenant"
+	// Field is the document field holding the tenant.
+	Field = "tenant"
+)
+
+// validID matches the tenant ids, usable as subdomains.
+var validID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Tenant is a brand served by the deployment, with its own products, users
+// and limits.
+type Tenant struct {
+	ID string `yaml:"id"`
+	// Audience is the aud claim of the tokens issued for the tenant, and
+	// required from the tokens it accepts. None when empty.
+	Audience string `yaml:"audience"`
+	// Currencies are the currencies the products may have, any when empty.
+	Currencies []string `yaml:"currencies"`
+	// MaxPrice caps the prices of every currency, no cap when zero.
+	MaxPrice int `yaml:"max_price"`
+	// NameMaxLength caps the length of the product names, no cap when zero.
+	NameMaxLength int `yaml:"name_max_length"`
+}
+
+// Registry holds the tenants, one of them being the default.
+type Registry struct {
+	def     string
+	tenants map[string]Tenant
+}
+
+// NewRegistry returns a registry of tenants and of the default tenant def,
+// added when missing from tenants.
+func NewRegistry(def string, tenants ...Tenant) (*Registry, error) {
+	r := &Registry{def: def, tenants: map[string]Tenant{}}
+	for _, t := range append(tenants, Tenant{ID: def}) {
+		if _, ok := r.tenants[t.ID]; ok {
+			if t.ID == def {
+				continue
+			}
+			return nil, fmt.Errorf("tenant %q is listed twice", t.ID)
+		}
+		if !validID.MatchString(t.ID) {
+			return nil, fmt.Errorf("tenant id %q is not a lowercase DNS label", t.ID)
+		}
+		if t.MaxPrice < 0 || t.NameMaxLength < 0 {
+			return nil, fmt.Errorf("tenant %q limits must not be negative", t.ID)
+		}
+		for _, currency := range t.Currencies {
+			if len(currency) != 3 {
+				return nil, fmt.Errorf("tenant %q currency %q must be 3 characters", t.ID, currency)
+			}
+		}
+		r.tenants[t.ID] = t
+	}
+	return r, nil
+}
+
+// Load reads the tenants from a YAML file. A missing file yields the default
+// tenant only.
+func Load(file, def string) (*Registry, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewRegistry(def)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read tenants %s: %w", file, err)
+	}
+	var doc struct {
+		Tenants []Tenant `yaml:"tenants"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse tenants %s: %w", file, err)
+	}
+	r, err := NewRegistry(def, doc.Tenants...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenants %s: %w", file, err)
+	}
+	return r, nil
+}
+
+// Default returns the default tenant, owning the data written before the
+// deployment served several tenants.
+func (r *Registry) Default() Tenant {
+	return r.tenants[r.def]
+}
+
+// Lookup returns the tenant id.
+func (r *Registry) Lookup(id string) (Tenant, bool) {
+	t, ok := r.tenants[id]
+	return t, ok
+}
+
+// Resolve returns the tenant of a request: the one named by id, else the one
+// of the subdomain of host, else the one claims, the verified claims of its
+// token if any, were issued for, else the default one. The token must have
+// been issued for the tenant resolved.
+func (r *Registry) Resolve(id, host string, claims jwt.MapClaims) (Tenant, *problem.Problem) {
+	claimed, _ := claims[Claim].(string)
+	if id == "" {
+		id = r.subdomain(host)
+	}
+	if id == "" {
+		id = claimed
+	}
+	if id == "" {
+		id = r.def
+	}
+	t, ok := r.tenants[id]
+	if !ok {
+		return Tenant{}, problem.New(http.StatusBadRequest, problem.CodeUnknownTenant, fmt.Sprintf("Tenant %s does not exist", id))
+	}
+	if claims != nil {
+		if err := r.Authorize(t, claims); err != nil {
+			return Tenant{}, err
+		}
+	}
+	return t, nil
+}
+
+// Authorize checks that claims were issued for t: the tokens issued before
+// the tenants, without tenant claim, are the default tenant ones.
+func (r *Registry) Authorize(t Tenant, claims jwt.MapClaims) *problem.Problem {
+	claimed, _ := claims[Claim].(string)
+	if claimed == "" {
+		claimed = r.def
+	}
+	if claimed != t.ID || (t.Audience != "" && !claims.VerifyAudience(t.Audience, true)) {
+		return problem.New(http.StatusForbidden, problem.CodeTenantMismatch, "The token was not issued for tenant "+t.ID)
+	}
+	return nil
+}
+
+// subdomain returns the tenant whose id is the first label of host, if any.
+func (r *Registry) subdomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, rest, ok := strings.Cut(host, ".")
+	if !ok || rest == "" || net.ParseIP(host) != nil {
+		return ""
+	}
+	if _, ok := r.tenants[label]; !ok {
+		return ""
+	}
+	return label
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t.
+func NewContext(ctx context.Context, t Tenant) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the tenant of ctx.
+func FromContext(ctx context.Context) (Tenant, bool) {
+	t, ok := ctx.Value(contextKey{}).(Tenant)
+	return t, ok
+}
+
+// Config configures Middleware.
+type Config struct {
+	Skipper  func(c echo.Context) bool
+	Registry *Registry
+	// Claims returns the verified claims of the token of the request, nil
+	// without a valid token.
+	Claims func(c echo.Context) jwt.MapClaims
+}
+
+// Middleware resolves the tenant of the requests and adds it to their
+// context and logger.
+func Middleware(cfg Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if cfg.Skipper != nil && cfg.Skipper(c) {
+				return next(c)
+			}
+			req := c.Request()
+			t, err := cfg.Registry.Resolve(req.Header.Get(Header), req.Host, cfg.Claims(c))
+			if err != nil {
+				return err
+			}
+			c.SetRequest(req.WithContext(NewContext(req.Context(), t)))
+			logging.WithAttrs(c, "tenant", t.ID)
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package tenant
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	r, err := Load(filepath.Join(dir, "missing.yaml"), "default")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", r.Default().ID)
+
+	file := filepath.Join(dir, "tenants.yaml")
+	os.WriteFile(file, []byte("tenants:\n  - id: acme\n    audience: acme-shop\n    currencies: [USD]\n    max_price: 500\n"), 0o600)
+	r, err = Load(file, "default")
+	assert.NoError(t, err)
+	acme, ok := r.Lookup("acme")
+	assert.True(t, ok)
+	assert.Equal(t, Tenant{ID: "acme", Audience: "acme-shop", Currencies: []string{"USD"}, MaxPrice: 500}, acme)
+	_, ok = r.Lookup("default")
+	assert.True(t, ok)
+
+	for _, invalid := range [][]Tenant{
+		{{ID: "Acme"}},
+		{{ID: "acme"}, {ID: "acme"}},
+		{{ID: "acme", Currencies: []string{"DOLLAR"}}},
+		{{ID: "acme", MaxPrice: -1}},
+	} {
+		_, err := NewRegistry("default", invalid...)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	r, err := NewRegistry("default", Tenant{ID: "acme", Audience: "acme-shop"}, Tenant{ID: "globex"})
+	assert.NoError(t, err)
+	resolve := func(id, host string, claims jwt.MapClaims) string {
+		tt, p := r.Resolve(id, host, claims)
+		if p != nil {
+			return string(p.Code)
+		}
+		return tt.ID
+	}
+
+	assert.Equal(t, "default", resolve("", "api.tronics.com", nil))
+	assert.Equal(t, "acme", resolve("acme", "api.tronics.com", nil), "the header names the tenant")
+	assert.Equal(t, "acme", resolve("", "acme.tronics.com:8080", nil), "so does the subdomain")
+	assert.Equal(t, "globex", resolve("globex", "acme.tronics.com", nil), "the header wins")
+	assert.Equal(t, "default", resolve("", "localhost:8080", nil))
+	assert.Equal(t, "default", resolve("", "127.0.0.1", nil))
+	assert.Equal(t, "unknown_tenant", resolve("initech", "", nil))
+
+	assert.Equal(t, "globex", resolve("", "", jwt.MapClaims{Claim: "globex"}), "and else the token")
+	assert.Equal(t, "default", resolve("", "", jwt.MapClaims{"user_id": "jane"}), "the tokens without tenant are the default one's")
+	assert.Equal(t, "tenant_mismatch", resolve("globex", "", jwt.MapClaims{Claim: "acme"}))
+	assert.Equal(t, "tenant_mismatch", resolve("", "globex.tronics.com", jwt.MapClaims{"user_id": "jane"}))
+	assert.Equal(t, "tenant_mismatch", resolve("acme", "", jwt.MapClaims{Claim: "acme"}), "the audience is required")
+	assert.Equal(t, "tenant_mismatch", resolve("acme", "", jwt.MapClaims{Claim: "acme", "aud": "globex-shop"}))
+	assert.Equal(t, "acme", resolve("acme", "", jwt.MapClaims{Claim: "acme", "aud": "acme-shop"}))
+
+	_, p := r.Resolve("globex", "", jwt.MapClaims{Claim: "acme", "aud": "acme-shop"})
+	if assert.NotNil(t, p) {
+		assert.Equal(t, http.StatusForbidden, p.Status)
+	}
+}
+
+// recorder records the arguments of the calls.
+type recorder struct {
+	filter, document, pipeline interface{}
+}
+
+func (r *recorder) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	r.document = document
+	return &mongo.InsertOneResult{}, nil
+}
+
+func (r *recorder) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	r.filter = filter
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+func (r *recorder) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	r.filter = filter
+	return mongo.NewSingleResultFromDocument(bson.M{}, nil, nil)
+}
+
+func (r *recorder) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	r.filter = filter
+	return &mongo.UpdateResult{}, nil
+}
+
+func (r *recorder) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	r.filter = filter
+	return &mongo.DeleteResult{}, nil
+}
+
+func (r *recorder) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	r.pipeline = pipeline
+	return mongo.NewCursorFromDocuments(nil, nil, nil)
+}
+
+func TestScope(t *testing.T) {
+	rec := &recorder{}
+	col := Scope(rec)
+	ctx := NewContext(context.Background(), Tenant{ID: "acme"})
+
+	col.Find(ctx, bson.M{"vendor": "acme", Field: "globex"})
+	assert.Equal(t, bson.M{"vendor": "acme", Field: "acme"}, rec.filter, "the tenant of the filter is replaced")
+	col.FindOne(ctx, nil)
+	assert.Equal(t, bson.M{Field: "acme"}, rec.filter)
+	col.UpdateOne(ctx, bson.D{{Key: "_id", Value: 1}}, bson.M{})
+	assert.Equal(t, bson.M{"$and": bson.A{bson.D{{Key: "_id", Value: 1}}, bson.M{Field: "acme"}}}, rec.filter)
+	col.DeleteOne(ctx, bson.M{"_id": 1})
+	assert.Equal(t, bson.M{"_id": 1, Field: "acme"}, rec.filter)
+
+	col.InsertOne(ctx, struct {
+		Name   string `bson:"name"`
+		Tenant string `bson:"tenant"`
+	}{"phone", "globex"})
+	assert.Equal(t, bson.D{{Key: "name", Value: "phone"}, {Key: Field, Value: "acme"}}, rec.document)
+
+	col.Aggregate(ctx, bson.A{bson.M{"$group": bson.M{"_id": "$vendor"}}})
+	assert.Equal(t, bson.A{bson.D{{Key: "$match", Value: bson.M{Field: "acme"}}}, bson.M{"$group": bson.M{"_id": "$vendor"}}}, rec.pipeline)
+	_, err := col.Aggregate(ctx, "not a pipeline")
+	assert.Error(t, err)
+
+	t.Run("fails without tenant", func(t *testing.T) {
+		rec := &recorder{}
+		col := Scope(rec)
+		ctx := context.Background()
+		_, err := col.Find(ctx, bson.M{})
+		assert.ErrorIs(t, err, ErrNoTenant)
+		assert.ErrorIs(t, col.FindOne(ctx, bson.M{}).Err(), ErrNoTenant)
+		_, err = col.InsertOne(ctx, bson.M{})
+		assert.ErrorIs(t, err, ErrNoTenant)
+		_, err = col.UpdateOne(ctx, bson.M{}, bson.M{})
+		assert.ErrorIs(t, err, ErrNoTenant)
+		_, err = col.DeleteOne(ctx, bson.M{})
+		assert.ErrorIs(t, err, ErrNoTenant)
+		_, err = col.Aggregate(ctx, bson.A{})
+		assert.ErrorIs(t, err, ErrNoTenant)
+		assert.Equal(t, &recorder{}, rec, "the collection is not called")
+	})
+}
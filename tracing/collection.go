@@ -0,0 +1,142 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"tronicscorp/correlation"
+	"tronicscorp/dbiface"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Collection wraps a dbiface.CollectionAPI and records a client span for
+// every operation. Filters are recorded by shape only, with every value
+// replaced by "?".
+type Collection struct {
+	dbiface.CollectionAPI
+	Name string
+}
+
+// TraceCollection returns col recording spans under name.
+func TraceCollection(name string, col dbiface.CollectionAPI) *Collection {
+	return &Collection{CollectionAPI: col, Name: name}
+}
+
+func (c *Collection) start(ctx context.Context, operation string, filter interface{}) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemMongoDB,
+		semconv.DBMongoDBCollection(c.Name),
+		semconv.DBOperation(operation),
+		attribute.String(CorrelationIDKey, correlation.FromContext(ctx)),
+	}
+	if filter != nil {
+		attrs = append(attrs, semconv.DBStatement(Shape(filter)))
+	}
+	return tracer().Start(ctx, "mongodb."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	if err != nil && err != mongo.ErrNoDocuments {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Shape renders a filter or pipeline as JSON with its values masked, e.g.
+// {"_id":"?","vendor":{"$in":["?"]}}.
+func Shape(filter interface{}) string {
+	raw, err := bson.Marshal(bson.M{"f": filter})
+	if err != nil {
+		return "?"
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return "?"
+	}
+	out, err := json.Marshal(mask(doc["f"]))
+	if err != nil {
+		return "?"
+	}
+	return string(out)
+}
+
+func mask(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.M:
+		shaped := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			shaped[k] = mask(val)
+		}
+		return shaped
+	case bson.D:
+		shaped := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			shaped[e.Key] = mask(e.Value)
+		}
+		return shaped
+	case bson.A:
+		if len(v) == 0 {
+			return []interface{}{}
+		}
+		// operators like $in take lists of values, one placeholder is enough
+		if _, ok := v[0].(bson.M); !ok {
+			return []interface{}{"?"}
+		}
+		shaped := make([]interface{}, len(v))
+		for i, val := range v {
+			shaped[i] = mask(val)
+		}
+		return shaped
+	default:
+		return "?"
+	}
+}
+
+func (c *Collection) InsertOne(ctx context.Context, document interface{}, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	ctx, span := c.start(ctx, "insertOne", nil)
+	res, err := c.CollectionAPI.InsertOne(ctx, document, opts...)
+	end(span, err)
+	return res, err
+}
+
+func (c *Collection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	ctx, span := c.start(ctx, "find", filter)
+	cursor, err := c.CollectionAPI.Find(ctx, filter, opts...)
+	end(span, err)
+	return cursor, err
+}
+
+func (c *Collection) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	ctx, span := c.start(ctx, "findOne", filter)
+	res := c.CollectionAPI.FindOne(ctx, filter, opts...)
+	end(span, res.Err())
+	return res
+}
+
+func (c *Collection) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	ctx, span := c.start(ctx, "updateOne", filter)
+	res, err := c.CollectionAPI.UpdateOne(ctx, filter, update, opts...)
+	end(span, err)
+	return res, err
+}
+
+func (c *Collection) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	ctx, span := c.start(ctx, "deleteOne", filter)
+	res, err := c.CollectionAPI.DeleteOne(ctx, filter, opts...)
+	end(span, err)
+	return res, err
+}
+
+func (c *Collection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	ctx, span := c.start(ctx, "aggregate", pipeline)
+	cursor, err := c.CollectionAPI.Aggregate(ctx, pipeline, opts...)
+	end(span, err)
+	return cursor, err
+}
@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"net/http"
+	"tronicscorp/correlation"
+	"tronicscorp/problem"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request, continuing the trace
+// given in the traceparent header, and writes the span context back in the
+// response so callers can find the trace.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		route := c.Path()
+		if route == "" {
+			route = req.URL.Path
+		}
+		ctx, span := tracer().Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(req.Method),
+				semconv.HTTPRoute(route),
+				attribute.String(CorrelationIDKey, correlation.FromContext(ctx)),
+			),
+		)
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(c.Response().Header()))
+
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			status = problem.Status(err)
+			span.RecordError(err)
+		}
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"tronicscorp/correlation"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestShape(t *testing.T) {
+	tests := []struct {
+		filter interface{}
+		shape  string
+	}{
+		{bson.M{"_id": "64b7f0c2e4b0a1a2b3c4d5e6"}, `{"_id":"?"}`},
+		{bson.M{"vendor": bson.M{"$in": bson.A{"google", "apple"}}, "price": 250}, `{"price":"?","vendor":{"$in":["?"]}}`},
+		{bson.D{{Key: "username", Value: "a@b.com"}}, `{"username":"?"}`},
+		{bson.A{bson.M{"$group": bson.M{"_id": "$vendor"}}}, `[{"$group":{"_id":"?"}}]`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.shape, Shape(tt.filter))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	e := echo.New()
+	e.Pre(correlation.Middleware)
+	e.Use(Middleware)
+	e.GET("/product/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	req := httptest.NewRequest(http.MethodGet, "/product/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(correlation.Header, "abc123")
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	span := spans[0]
+	assert.Equal(t, "GET /product/:id", span.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	assert.Contains(t, span.Attributes(), attribute.String(CorrelationIDKey, "abc123"))
+	assert.Contains(t, res.Header().Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, "abc123", res.Header().Get(correlation.Header))
+}
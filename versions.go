@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"tronicscorp/metrics"
+	"tronicscorp/openapi"
+
+	"github.com/labstack/echo/v4"
+)
+
+// apiVersion describes a version of the API for the documentation of its
+// endpoints.
+type apiVersion struct {
+	prefix   string
+	suffix   string
+	product  interface{}
+	products interface{}
+}
+
+// endpoint is a route of the versioned API, served under every version. v2
+// defaults to v1 when the version does not change the endpoint. legacy is the
+// unversioned path, kept as a deprecated alias of the v1 route.
+type endpoint struct {
+	id         string
+	method     string
+	path       string
+	legacy     string
+	v1, v2     echo.HandlerFunc
+	middleware []echo.MiddlewareFunc
+	doc        func(v apiVersion) *openapi.Doc
+	// group is the rate limit group of the endpoint, the default one when
+	// empty.
+	group string
+}
+
+// register adds the endpoints under each version, and their legacy aliases.
+func (a *App) register(versions []apiVersion, endpoints []endpoint) {
+	for _, ep := range endpoints {
+		for i, v := range versions {
+			handler := ep.v1
+			if i > 0 && ep.v2 != nil {
+				handler = ep.v2
+			}
+			route := a.echo.Add(ep.method, v.prefix+ep.path, handler, ep.middleware...)
+			a.api.Route(route, ep.doc(v).ID(ep.id+v.suffix))
+			a.rateGroups[ep.method+" "+v.prefix+ep.path] = ep.group
+		}
+		if ep.legacy == "" {
+			continue
+		}
+		v1 := versions[0]
+		route := a.echo.Add(ep.method, ep.legacy, ep.v1, ep.middleware...)
+		a.api.Route(route, ep.doc(v1).ID(ep.id+"Legacy").Deprecated())
+		a.legacy[ep.method+" "+ep.legacy] = v1.prefix + ep.path
+		a.rateGroups[ep.method+" "+ep.legacy] = ep.group
+	}
+}
+
+// deprecation flags the responses of legacy routes with the Deprecation
+// (RFC 9745) and Sunset (RFC 8594) headers and a link to the v1 route, and
+// counts their use.
+func deprecation(legacy map[string]string, deprecated, sunset time.Time) echo.MiddlewareFunc {
+	deprecatedAt := "@" + strconv.FormatInt(deprecated.Unix(), 10)
+	sunsetAt := sunset.UTC().Format(http.TimeFormat)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			successor, ok := legacy[c.Request().Method+" "+c.Path()]
+			if ok {
+				header := c.Response().Header()
+				header.Set("Deprecation", deprecatedAt)
+				header.Set("Sunset", sunsetAt)
+				header.Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, fillParams(successor, c)))
+				metrics.DeprecatedRequests.WithLabelValues(c.Request().Method, c.Path()).Inc()
+			}
+			return next(c)
+		}
+	}
+}
+
+// fillParams replaces the parameters of a route template with the values of
+// the current request.
+func fillParams(template string, c echo.Context) string {
+	for _, name := range c.ParamNames() {
+		template = strings.Replace(template, ":"+name, c.Param(name), 1)
+	}
+	return template
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	a := newRoutedApp(t)
+	get := func(target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		a.echo.ServeHTTP(res, httptest.NewRequest(http.MethodGet, target, nil))
+		return res
+	}
+
+	t.Run("legacy routes are deprecated", func(t *testing.T) {
+		res := get("/product/42")
+		assert.Equal(t, "@1792368000", res.Header().Get("Deprecation"))
+		assert.Equal(t, "Fri, 30 Apr 2027 00:00:00 GMT", res.Header().Get("Sunset"))
+		assert.Equal(t, `</v1/products/42>; rel="successor-version"`, res.Header().Get("Link"))
+	})
+	t.Run("versioned routes are not", func(t *testing.T) {
+		for _, target := range []string{"/v1/products/42", "/v2/products/42"} {
+			res := get(target)
+			assert.Equal(t, http.StatusBadRequest, res.Code, target)
+			assert.Empty(t, res.Header().Get("Deprecation"), target)
+		}
+	})
+	t.Run("documentation", func(t *testing.T) {
+		doc := a.api.Document()
+		assert.True(t, doc.Paths["/product/{id}"]["get"].Deprecated)
+		assert.Equal(t, "GetProductLegacy", doc.Paths["/product/{id}"]["get"].OperationID)
+		assert.Equal(t, "GetProductV2", doc.Paths["/v2/products/{id}"]["get"].OperationID)
+		v2 := doc.Components.Schemas["ProductV2Body"]
+		assert.ElementsMatch(t, []string{"name", "price", "vendor"}, v2.Required)
+		assert.Equal(t, "#/components/schemas/Money", v2.Properties["price"].Ref)
+	})
+}
@@ -0,0 +1,350 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"tronicscorp/dbiface"
+	"tronicscorp/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// eventBuffer is the number of events the dispatcher may lag behind the
+	// bus before missing some.
+	eventBuffer = 1024
+	// batchSize is the number of due deliveries attempted at once.
+	batchSize = 100
+	// maxResponse is the length of the response bodies kept in the log.
+	maxResponse = 1024
+)
+
+// Dispatcher records a delivery for every event of the bus each subscription
+// wants, and sends the due deliveries. Deliveries are stored, so the ones
+// pending are retried after a restart, and several instances may share the
+// collections.
+type Dispatcher struct {
+	Webhooks   dbiface.CollectionAPI
+	Deliveries dbiface.CollectionAPI
+	// Client sends the deliveries; its timeout bounds each attempt.
+	Client *http.Client
+	// MaxAttempts is the number of attempts before a delivery is dead.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled after each
+	// failed attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Poll is the interval at which due retries are looked for.
+	Poll time.Duration
+	// Workers is the number of deliveries sent concurrently.
+	Workers int
+
+	once sync.Once
+	wake chan struct{}
+}
+
+func (d *Dispatcher) init() {
+	d.once.Do(func() {
+		d.wake = make(chan struct{}, 1)
+		if d.Client == nil {
+			d.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+		if d.MaxAttempts <= 0 {
+			d.MaxAttempts = 8
+		}
+		if d.Backoff <= 0 {
+			d.Backoff = 30 * time.Second
+		}
+		if d.MaxBackoff <= 0 {
+			d.MaxBackoff = 6 * time.Hour
+		}
+		if d.Poll <= 0 {
+			d.Poll = 5 * time.Second
+		}
+		if d.Workers <= 0 {
+			d.Workers = 4
+		}
+	})
+}
+
+// Run dispatches the events published on bus until ctx is done. With a nil
+// bus, only the deliveries queued with Enqueue are sent.
+func (d *Dispatcher) Run(ctx context.Context, bus *events.Bus) error {
+	d.init()
+	if bus != nil {
+		done := make(chan struct{})
+		defer func() { <-done }()
+		go func() {
+			defer close(done)
+			d.record(ctx, bus)
+		}()
+	}
+	ticker := time.NewTicker(d.Poll)
+	defer ticker.Stop()
+	for {
+		if err := d.SendDue(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Unable to send the webhook deliveries", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// record enqueues the events of bus until ctx is done.
+func (d *Dispatcher) record(ctx context.Context, bus *events.Bus) {
+	for ctx.Err() == nil {
+		changes, cancel := bus.Subscribe(eventBuffer)
+		d.consume(ctx, changes)
+		cancel()
+		if ctx.Err() == nil {
+			slog.Error("The webhook dispatcher fell behind, events were not delivered")
+		}
+	}
+}
+
+func (d *Dispatcher) consume(ctx context.Context, changes <-chan events.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-changes:
+			if !ok {
+				return
+			}
+			if err := d.Enqueue(ctx, e); err != nil && ctx.Err() == nil {
+				slog.Error("Unable to record the webhook deliveries", "event_id", e.ID, "type", e.Type, "error", err)
+			}
+		}
+	}
+}
+
+// Enqueue records a delivery of e for each subscription wanting it.
+func (d *Dispatcher) Enqueue(ctx context.Context, e events.Event) error {
+	d.init()
+	cursor, err := d.Webhooks.Find(ctx, bson.M{"disabled": false})
+	if err != nil {
+		return err
+	}
+	var subs []Subscription
+	if err := cursor.All(ctx, &subs); err != nil {
+		return err
+	}
+	queued := false
+	for _, sub := range subs {
+		if !sub.Wants(e.Type) {
+			continue
+		}
+		if _, err := d.enqueue(ctx, sub.ID, e); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		d.notify()
+	}
+	return nil
+}
+
+// Ping records a test delivery to the subscription id.
+func (d *Dispatcher) Ping(ctx context.Context, id primitive.ObjectID) (Delivery, error) {
+	d.init()
+	delivery, err := d.enqueue(ctx, id, events.Event{
+		ID:      uint64(time.Now().UnixMicro()),
+		Type:    Ping,
+		Subject: id.Hex(),
+		Time:    time.Now(),
+	})
+	if err == nil {
+		d.notify()
+	}
+	return delivery, err
+}
+
+// Redeliver sends the delivery id again, dead or not, as soon as possible.
+// It reports whether the delivery exists.
+func (d *Dispatcher) Redeliver(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	d.init()
+	res, err := d.Deliveries.UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"status": StatusPending, "next_attempt": time.Now().UTC()}})
+	if err != nil {
+		return false, err
+	}
+	d.notify()
+	return res.MatchedCount > 0, nil
+}
+
+func (d *Dispatcher) enqueue(ctx context.Context, webhook primitive.ObjectID, e events.Event) (Delivery, error) {
+	eventID := e.UID
+	if eventID == "" {
+		eventID = strconv.FormatUint(e.ID, 10)
+	}
+	body, err := json.Marshal(Payload{ID: eventID, Type: e.Type, Tenant: e.Tenant, Subject: e.Subject, Time: e.Time.UTC(), Data: e.Data})
+	if err != nil {
+		return Delivery{}, fmt.Errorf("unable to encode event %d: %w", e.ID, err)
+	}
+	now := time.Now().UTC()
+	delivery := Delivery{
+		ID:          primitive.NewObjectID(),
+		Webhook:     webhook,
+		EventID:     eventID,
+		EventType:   e.Type,
+		Payload:     string(body),
+		Status:      StatusPending,
+		Attempts:    []Attempt{},
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+	_, err = d.Deliveries.InsertOne(ctx, delivery)
+	return delivery, err
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SendDue attempts the pending deliveries whose next attempt is due.
+func (d *Dispatcher) SendDue(ctx context.Context) error {
+	d.init()
+	for {
+		now := time.Now().UTC()
+		cursor, err := d.Deliveries.Find(ctx,
+			bson.M{"status": StatusPending, "next_attempt": bson.M{"$lte": now}},
+			options.Find().SetSort(bson.D{{Key: "next_attempt", Value: 1}}).SetLimit(batchSize))
+		if err != nil {
+			return err
+		}
+		var due []Delivery
+		if err := cursor.All(ctx, &due); err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, d.Workers)
+		for _, delivery := range due {
+			if !d.claim(ctx, delivery, now) {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(delivery Delivery) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				d.attempt(ctx, delivery)
+			}(delivery)
+		}
+		wg.Wait()
+		if len(due) < batchSize || ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// claim leases a due delivery to this dispatcher for the duration of an
+// attempt, so other instances skip it.
+func (d *Dispatcher) claim(ctx context.Context, delivery Delivery, now time.Time) bool {
+	lease := now.Add(d.Client.Timeout + time.Minute)
+	res, err := d.Deliveries.UpdateOne(ctx,
+		bson.M{"_id": delivery.ID, "status": StatusPending, "next_attempt": delivery.NextAttempt},
+		bson.M{"$set": bson.M{"next_attempt": lease}})
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("Unable to claim the webhook delivery", "delivery_id", delivery.ID.Hex(), "error", err)
+		}
+		return false
+	}
+	return res.ModifiedCount > 0
+}
+
+// attempt sends delivery and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, delivery Delivery) {
+	logger := slog.With("delivery_id", delivery.ID.Hex(), "webhook_id", delivery.Webhook.Hex(), "event_type", delivery.EventType)
+	var sub Subscription
+	err := d.Webhooks.FindOne(ctx, bson.M{"_id": delivery.Webhook}).Decode(&sub)
+	var attempt Attempt
+	if err != nil {
+		attempt = Attempt{At: time.Now().UTC(), Error: "webhook unavailable: " + err.Error()}
+	} else {
+		attempt = d.send(ctx, sub, delivery)
+	}
+	if ctx.Err() != nil {
+		// Shutting down: the lease expires and the delivery is retried.
+		return
+	}
+	update := bson.M{}
+	switch n := len(delivery.Attempts) + 1; {
+	case attempt.Error == "":
+		update["status"] = StatusSucceeded
+		logger.Info("Webhook delivered", "status", attempt.StatusCode, "attempt", n)
+	case n >= d.MaxAttempts:
+		update["status"] = StatusDead
+		logger.Error("Webhook delivery dead", "attempt", n, "error", attempt.Error)
+	default:
+		update["next_attempt"] = attempt.At.Add(d.backoff(n))
+		update["status"] = StatusPending
+		logger.Warn("Webhook delivery failed", "attempt", n, "retry_at", update["next_attempt"], "error", attempt.Error)
+	}
+	_, err = d.Deliveries.UpdateOne(ctx, bson.M{"_id": delivery.ID}, bson.M{"$set": update, "$push": bson.M{"attempts": attempt}})
+	if err != nil {
+		logger.Error("Unable to record the webhook attempt", "error", err)
+	}
+}
+
+// backoff is the delay before the attempt following the nth one.
+func (d *Dispatcher) backoff(n int) time.Duration {
+	delay := d.Backoff
+	for i := 1; i < n && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		return d.MaxBackoff
+	}
+	return delay
+}
+
+// send posts the payload of delivery to sub. Any 2xx response is a success.
+func (d *Dispatcher) send(ctx context.Context, sub Subscription, delivery Delivery) Attempt {
+	start := time.Now()
+	attempt := Attempt{At: start.UTC()}
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tronics-Webhooks/1")
+	req.Header.Set(EventHeader, string(delivery.EventType))
+	req.Header.Set(DeliveryHeader, delivery.ID.Hex())
+	req.Header.Set(TimestampHeader, strconv.FormatInt(start.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, start.Unix(), body))
+	res, err := d.Client.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	excerpt, _ := io.ReadAll(io.LimitReader(res.Body, maxResponse))
+	attempt.StatusCode = res.StatusCode
+	attempt.Response = string(excerpt)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		attempt.Error = "unexpected status " + res.Status
+	}
+	return attempt
+}
@@ -0,0 +1,134 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"tronicscorp/dbiface/dbtest"
+	"tronicscorp/events"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// receiver is a webhook endpoint answering with status.
+type receiver struct {
+	status   atomic.Int32
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	r.mu.Unlock()
+	w.WriteHeader(int(r.status.Load()))
+	w.Write([]byte("thanks"))
+}
+
+// received returns the requests received so far and their bodies.
+func (r *receiver) received() ([]*http.Request, [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request(nil), r.requests...), append([][]byte(nil), r.bodies...)
+}
+
+func deliveryOf(t *testing.T, col *dbtest.Collection, id primitive.ObjectID) Delivery {
+	var d Delivery
+	assert.NoError(t, col.FindOne(context.Background(), bson.M{"_id": id}).Decode(&d))
+	return d
+}
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+	recv := &receiver{}
+	recv.status.Store(http.StatusOK)
+	srv := httptest.NewServer(recv)
+	defer srv.Close()
+
+	subs, deliveries := &dbtest.Collection{}, &dbtest.Collection{}
+	products := Subscription{ID: primitive.NewObjectID(), URL: srv.URL, Secret: "products-secret-value", Events: []events.Type{events.ProductCreated}}
+	users := Subscription{ID: primitive.NewObjectID(), URL: srv.URL, Secret: "users-secret-value", Events: []events.Type{events.UserCreated}}
+	disabled := Subscription{ID: primitive.NewObjectID(), URL: srv.URL, Secret: "disabled-secret-value", Disabled: true}
+	for _, sub := range []Subscription{products, users, disabled} {
+		subs.InsertOne(ctx, sub)
+	}
+	d := &Dispatcher{Webhooks: subs, Deliveries: deliveries, MaxAttempts: 2, Backoff: time.Millisecond}
+
+	t.Run("delivers signed events to the subscriptions wanting them", func(t *testing.T) {
+		data := map[string]interface{}{"product_name": "phone"}
+		assert.NoError(t, d.Enqueue(ctx, events.Event{ID: 42, Type: events.ProductCreated, Subject: "p1", Data: data, Time: time.Now()}))
+		assert.Len(t, deliveries.Docs(), 1)
+		assert.NoError(t, d.SendDue(ctx))
+
+		requests, bodies := recv.received()
+		if !assert.Len(t, requests, 1) {
+			return
+		}
+		req, body := requests[0], bodies[0]
+		assert.Equal(t, "product.created", req.Header.Get(EventHeader))
+		assert.NoError(t, Verify(products.Secret, req.Header, body, time.Minute))
+		var payload Payload
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, "42", payload.ID)
+		assert.Equal(t, "p1", payload.Subject)
+		assert.Equal(t, data, payload.Data)
+
+		delivery := deliveryOf(t, deliveries, deliveries.Docs()[0]["_id"].(primitive.ObjectID))
+		assert.Equal(t, StatusSucceeded, delivery.Status)
+		if assert.Len(t, delivery.Attempts, 1) {
+			assert.Equal(t, http.StatusOK, delivery.Attempts[0].StatusCode)
+			assert.Equal(t, "thanks", delivery.Attempts[0].Response)
+		}
+	})
+	t.Run("retries then dead-letters", func(t *testing.T) {
+		recv.status.Store(http.StatusInternalServerError)
+		delivery, err := d.Ping(ctx, users.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, d.SendDue(ctx))
+		retried := deliveryOf(t, deliveries, delivery.ID)
+		assert.Equal(t, StatusPending, retried.Status)
+		assert.True(t, retried.NextAttempt.After(retried.Attempts[0].At))
+
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, d.SendDue(ctx))
+		dead := deliveryOf(t, deliveries, delivery.ID)
+		assert.Equal(t, StatusDead, dead.Status)
+		assert.Len(t, dead.Attempts, 2)
+		assert.Equal(t, "unexpected status 500 Internal Server Error", dead.Attempts[1].Error)
+
+		recv.status.Store(http.StatusNoContent)
+		found, err := d.Redeliver(ctx, delivery.ID)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.NoError(t, d.SendDue(ctx))
+		assert.Equal(t, StatusSucceeded, deliveryOf(t, deliveries, delivery.ID).Status)
+	})
+	t.Run("deleted webhooks dead-letter their deliveries", func(t *testing.T) {
+		subs.DeleteOne(ctx, bson.M{"_id": products.ID})
+		before, _ := recv.received()
+		delivery, err := d.Ping(ctx, products.ID)
+		assert.NoError(t, err)
+		assert.NoError(t, d.SendDue(ctx))
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, d.SendDue(ctx))
+		assert.Equal(t, StatusDead, deliveryOf(t, deliveries, delivery.ID).Status)
+		after, _ := recv.received()
+		assert.Equal(t, len(before), len(after))
+	})
+	t.Run("unknown deliveries", func(t *testing.T) {
+		found, err := d.Redeliver(ctx, primitive.NewObjectID())
+		assert.NoError(t, err)
+		assert.False(t, found)
+	})
+}
@@ -0,0 +1,149 @@
+// Package webhooks delivers the domain events to the HTTP endpoints partners
+// subscribe to. Payloads are signed with the secret of the subscription, and
+// failed deliveries are retried with an exponential backoff until they are
+// dead-lettered.
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"tronicscorp/events"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Headers of the delivery requests.
+const (
+	EventHeader     = "X-Tronics-Event"
+	DeliveryHeader  = "X-Tronics-Delivery"
+	TimestampHeader = "X-Tronics-Timestamp"
+	SignatureHeader = "X-Tronics-Signature"
+)
+
+// Ping is the type of the test events sent on demand to a subscription.
+const Ping events.Type = "webhook.ping"
+
+// Subscription is an endpoint receiving the events of the listed types, every
+// type when Events is empty.
+type Subscription struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty" openapi:"readonly"`
+	URL         string             `json:"url" bson:"url" validate:"required,url"`
+	Events      []events.Type      `json:"events,omitempty" bson:"events,omitempty" validate:"dive,oneof=product.created product.updated product.deleted user.created"`
+	Description string             `json:"description,omitempty" bson:"description,omitempty" validate:"max=200"`
+	// Secret signs the payloads. It is generated when not given, and only
+	// returned when the subscription is created.
+	Secret    string    `json:"secret,omitempty" bson:"secret" validate:"omitempty,min=16,max=100"`
+	Disabled  bool      `json:"disabled" bson:"disabled"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at" openapi:"readonly"`
+}
+
+// Wants reports whether the subscription receives events of type t.
+func (s Subscription) Wants(t events.Type) bool {
+	if s.Disabled {
+		return false
+	}
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Status is the state of a delivery.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusSucceeded Status = "succeeded"
+	// StatusDead deliveries ran out of attempts. They are only retried on
+	// demand.
+	StatusDead Status = "dead"
+)
+
+// Delivery is an event sent, or to send, to a subscription, with the log of
+// its attempts.
+type Delivery struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Webhook     primitive.ObjectID `json:"webhook_id" bson:"webhook_id"`
+	EventID     string             `json:"event_id" bson:"event_id"`
+	EventType   events.Type        `json:"event_type" bson:"event_type"`
+	Payload     string             `json:"payload" bson:"payload"`
+	Status      Status             `json:"status" bson:"status"`
+	Attempts    []Attempt          `json:"attempts" bson:"attempts"`
+	NextAttempt time.Time          `json:"next_attempt" bson:"next_attempt"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// Attempt is a request made for a delivery. StatusCode is 0 when no response
+// was received.
+type Attempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"status_code,omitempty" bson:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	// Response is the start of the response body.
+	Response   string `json:"response,omitempty" bson:"response,omitempty"`
+	DurationMS int64  `json:"duration_ms" bson:"duration_ms"`
+}
+
+// Payload is the JSON body of the delivery requests.
+type Payload struct {
+	ID      string      `json:"id"`
+	Type    events.Type `json:"type"`
+	Tenant  string      `json:"tenant,omitempty"`
+	Subject string      `json:"subject,omitempty"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// Sign returns the signature header of body sent at timestamp: "v1=" followed
+// by the hex HMAC-SHA256, keyed by secret, of the timestamp, a dot and body.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	ErrNoSignature = errors.New("webhooks: missing signature or timestamp")
+	ErrSignature   = errors.New("webhooks: signature mismatch")
+	ErrExpired     = errors.New("webhooks: timestamp outside of the tolerance")
+)
+
+// Verify checks the signature of a delivery received with header, rejecting
+// the ones signed more than tolerance ago, which may be replays. Receivers
+// written in Go can use it as is.
+func Verify(secret string, header http.Header, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(header.Get(TimestampHeader), 10, 64)
+	signature := header.Get(SignatureHeader)
+	if err != nil || signature == "" {
+		return ErrNoSignature
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body))) {
+		return ErrSignature
+	}
+	return nil
+}
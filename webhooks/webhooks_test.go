@@ -0,0 +1,43 @@
+package webhooks
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+	"tronicscorp/events"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	signed := func(at time.Time, body []byte) http.Header {
+		h := http.Header{}
+		h.Set(TimestampHeader, strconv.FormatInt(at.Unix(), 10))
+		h.Set(SignatureHeader, Sign("secret", at.Unix(), body))
+		return h
+	}
+	assert.NoError(t, Verify("secret", signed(time.Now(), body), body, time.Minute))
+	assert.ErrorIs(t, Verify("other", signed(time.Now(), body), body, time.Minute), ErrSignature)
+	assert.ErrorIs(t, Verify("secret", signed(time.Now(), []byte(`{"id":"2"}`)), body, time.Minute), ErrSignature)
+	assert.ErrorIs(t, Verify("secret", signed(time.Now().Add(-time.Hour), body), body, time.Minute), ErrExpired)
+	assert.ErrorIs(t, Verify("secret", http.Header{}, body, time.Minute), ErrNoSignature)
+}
+
+func TestWants(t *testing.T) {
+	assert.True(t, Subscription{}.Wants(events.ProductDeleted))
+	assert.False(t, Subscription{Disabled: true}.Wants(events.ProductDeleted))
+	sub := Subscription{Events: []events.Type{events.ProductCreated, events.UserCreated}}
+	assert.True(t, sub.Wants(events.UserCreated))
+	assert.False(t, sub.Wants(events.ProductUpdated))
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	var delays []time.Duration
+	for n := 1; n <= 5; n++ {
+		delays = append(delays, d.backoff(n))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+}